@@ -75,6 +75,8 @@ type Static struct {
 	QuotaMessageSize                int64 `sconf:"optional" sconf-doc:"Default maximum total message size in bytes for each individual account, only applicable if greater than zero. Can be overridden per account. Attempting to add new messages to an account beyond its maximum total size will result in an error. Useful to prevent a single account from filling storage. The quota only applies to the email message files, not to any file system overhead and also not the message index database file (account for approximately 15% overhead)."`
 	NATS                            *NATS `sconf:"optional" sconf-doc:"NATS configuration for storing email copies in object store. If configured, a copy of each incoming email will be stored in the specified NATS object store bucket."`
 
+	MessageStore string `sconf:"optional" sconf-doc:"Name of a backend for storing copies of messages outside the data directory, registered by programs embedding mox with store.RegisterMessageStore, e.g. for an S3-compatible object store. Messages are stored in the background after delivery, and removed when erased or when their account is removed. Cannot be combined with NATS, which is the built-in backend."`
+
 	// All IPs that were explicitly listened on for external SMTP. Only set when there
 	// are no unspecified external SMTP listeners and there is at most one for IPv4 and
 	// at most one for IPv6. Used for setting the local address when making outgoing
@@ -662,13 +664,121 @@ func (wi WebInternal) equal(o WebInternal) bool {
 
 // NATS holds the configuration for connecting to NATS and storing messages in object store.
 type NATS struct {
-	URL           string `sconf-doc:"NATS server URL, e.g. nats://localhost:4222"`
-	Username      string `sconf:"optional" sconf-doc:"Username for NATS authentication"`
-	Password      string `sconf:"optional" sconf-doc:"Password for NATS authentication"`
-	Token         string `sconf:"optional" sconf-doc:"Token for NATS authentication"`
-	CredentialsFile string `sconf:"optional" sconf-doc:"Path to NATS credentials file"`
-	BucketName    string `sconf-doc:"Object store bucket name for storing email copies"`
-	ConnectTimeout time.Duration `sconf:"optional" sconf-doc:"Connection timeout, default 30s"`
-	RequestTimeout time.Duration `sconf:"optional" sconf-doc:"Request timeout for object store operations, default 30s"`
-	DeleteAfterStore bool `sconf:"optional" sconf-doc:"Delete email from local mailbox after successfully storing in NATS. When enabled, emails are only stored in NATS and not kept locally. Use with caution."`
+	URL              string        `sconf:"optional" sconf-doc:"NATS server URL, e.g. nats://localhost:4222. URL or URLs is required."`
+	URLs             []string      `sconf:"optional" sconf-doc:"NATS server URLs of a cluster, for failing over to another server. Used along with URL, if set."`
+	DontRandomize    bool          `sconf:"optional" sconf-doc:"Connect to the servers of URL and URLs in the configured order, instead of in random order."`
+	ConnectionName   string        `sconf:"optional" sconf-doc:"Name of the connection shown in NATS monitoring. Default mox-email-server/<hostname>, with the hostname of mox."`
+	Username         string        `sconf:"optional" sconf-doc:"Username for NATS authentication"`
+	Password         string        `sconf:"optional" sconf-doc:"Password for NATS authentication"`
+	Token            string        `sconf:"optional" sconf-doc:"Token for NATS authentication"`
+	CredentialsFile  string        `sconf:"optional" sconf-doc:"Path to NATS credentials file"`
+	NKeySeedFile     string        `sconf:"optional" sconf-doc:"Path to file with NKey user seed for NATS authentication, or, with UserJWT or UserJWTFile, for signing the server nonce in decentralized JWT authentication. Only one of NKeySeedFile, UserJWT/UserJWTFile, CredentialsFile, Token and Username/Password can be configured, other than NKeySeedFile with UserJWT/UserJWTFile."`
+	UserJWT          string        `sconf:"optional" sconf-doc:"User JWT for decentralized JWT authentication, for NATS accounts configured with JWTs. Requires NKeySeedFile with the seed of the user. Use a CredentialsFile instead to keep the JWT and seed in one file."`
+	UserJWTFile      string        `sconf:"optional" sconf-doc:"Path to file with user JWT, like UserJWT. The file is read again on each (re)connect, so the JWT can be replaced."`
+	TLSCert          string        `sconf:"optional" sconf-doc:"Path to PEM file with TLS client certificate, for NATS servers that require mutual TLS. Requires TLSKey."`
+	TLSKey           string        `sconf:"optional" sconf-doc:"Path to PEM file with private key of TLSCert."`
+	TLSCACert        string        `sconf:"optional" sconf-doc:"Path to PEM file with CA certificates for verifying the TLS certificate of the NATS server, instead of the system CA certificates. Can be used without TLSCert."`
+	BucketName       string        `sconf-doc:"Object store bucket name for storing email copies"`
+	ConnectTimeout   time.Duration `sconf:"optional" sconf-doc:"Connection timeout, default 30s"`
+	RequestTimeout   time.Duration `sconf:"optional" sconf-doc:"Request timeout for object store operations, default 30s"`
+	DeleteAfterStore bool          `sconf:"optional" sconf-doc:"Delete email from local mailbox after successfully storing in NATS. When enabled, emails are only stored in NATS and not kept locally. Use with caution."`
+
+	MaxConcurrentStores int `sconf:"optional" sconf-doc:"Maximum number of messages being stored in the object store at the same time, shared between synchronous stores, asynchronous stores and retries from the pending queue. Default 8."`
+
+	CapacityCheckInterval time.Duration `sconf:"optional" sconf-doc:"Interval for checking how much of the maximum size of the object store bucket is in use. Default 5m."`
+	CapacityWarnPercent   int           `sconf:"optional" sconf-doc:"Percentage of the maximum bucket size in use at which the bucket is considered nearly full, logging an error and setting the mox_nats_storage_nearly_full metric. Only applies to buckets with a maximum size. Default 90."`
+
+	HealthCheckInterval time.Duration `sconf:"optional" sconf-doc:"Interval for checking that the NATS connection is up and the object store buckets are usable, setting the mox_nats_healthy metric. Default 1m."`
+
+	PingInterval time.Duration `sconf:"optional" sconf-doc:"Interval for sending pings to the NATS server to detect a broken connection. Default 2m, the NATS client library default."`
+	MaxPingsOut  int           `sconf:"optional" sconf-doc:"Number of pings without response after which the connection is considered broken and a reconnect is attempted. Default 2, the NATS client library default."`
+
+	MaxReconnects int           `sconf:"optional" sconf-doc:"Maximum number of attempts to reconnect after the connection to NATS is lost, after which the connection is closed and stores fail, queueing messages for the retry loop, until mox is restarted. Default -1, or 0, for an unlimited number of attempts."`
+	ReconnectWait time.Duration `sconf:"optional" sconf-doc:"Time to wait between attempts to reconnect to the same NATS server. Default 2s. Raise to avoid reconnect storms from many clients."`
+
+	RetryOnFailedConnect bool `sconf:"optional" sconf-doc:"If no NATS server can be reached at startup, keep trying to connect in the background, like when reconnecting, instead of failing initialization right away. Opening the buckets waits for the connection up to RequestTimeout, initialization fails after that."`
+
+	StoreHeaders    bool          `sconf:"optional" sconf-doc:"Also store the From, To, Subject, Date and Message-ID headers of messages stored in NATS in auth.db, for searching locally without fetching messages from NATS."`
+	HeaderRetention time.Duration `sconf:"optional" sconf-doc:"Remove stored headers after this period. Default 0, keeping them forever."`
+	MaxHeaderSize   int           `sconf:"optional" sconf-doc:"Maximum size in bytes of each stored header value, longer values are truncated. Default 1000."`
+
+	ShutdownTimeout time.Duration `sconf:"optional" sconf-doc:"Maximum time to spend at shutdown (e.g. on SIGTERM) flushing the pending queue to NATS and draining the NATS connection. Messages not flushed in time stay in the pending queue for the next start. Should be below the termination grace period of process managers like Kubernetes. Default 10s."`
+	DrainTimeout    time.Duration `sconf:"optional" sconf-doc:"Maximum time to wait for the NATS connection to drain when closing, finishing in-flight publishes and object store operations, after which the connection is closed. Also bounded by ShutdownTimeout for a graceful shutdown. Default 5s."`
+
+	SyncPut      *bool `sconf:"optional" sconf-doc:"Wait for the NATS server to confirm each message put before continuing. If false, puts are batched and confirmations awaited per batch, for higher throughput: StoreMessage returns before the message is durable in NATS, and a crash before the batch is confirmed loses the NATS copy of the messages in the batch. With DeleteAfterStore, messages are only removed locally after their batch is confirmed. Default true."`
+	PutBatchSize int   `sconf:"optional" sconf-doc:"With SyncPut false, maximum number of messages put in a batch. Default 32."`
+
+	AccountBuckets string `sconf:"optional" sconf-doc:"Template for per-account buckets, e.g. mox-{account}, for isolating the messages of accounts, e.g. to give each its own retention and access controls in NATS. Messages of an account are stored in the bucket named by replacing {account} with the account name, created on first use. Characters not allowed in bucket names are written as _ followed by their hexadecimal value. Messages without account are stored in BucketName. Cannot be combined with ShardBuckets, KeyDerivation or MigrateFromBucket."`
+
+	ShardBuckets  []string `sconf:"optional" sconf-doc:"Additional buckets to spread messages over, next to BucketName, for very large deployments. Buckets are created if needed. Each object is stored in the bucket selected by KeyDerivation from its name. Adding a bucket changes the bucket of some existing objects, which are then no longer found until copied to their new bucket."`
+	KeyDerivation string   `sconf:"optional" sconf-doc:"How object names are mapped to buckets. Either single (only BucketName) or consistent-hash (over BucketName and ShardBuckets, adding a bucket moves only about 1/n of the objects to the new bucket). Programs embedding mox can register their own with store.RegisterNATSKeyDerivation. Default single without ShardBuckets, consistent-hash with ShardBuckets."`
+
+	OpenTelemetry bool `sconf:"optional" sconf-doc:"Also record OpenTelemetry spans and metrics for object store operations, alongside the Prometheus metrics. The global OpenTelemetry tracer and meter providers are used: mox does not configure an exporter itself, programs embedding mox must set the providers before NATS is initialized."`
+
+	RetentionDays int `sconf:"optional" sconf-doc:"If set, NATS removes objects this many days after they were stored, through the maximum age of the bucket, independent of the messages in mailboxes, e.g. for compliance. Applied when mox creates a bucket. For existing buckets, see NATSClient.UpdateRetention. Lowering the retention of a bucket immediately removes objects older than the new maximum age."`
+
+	RetentionClasses map[string]string `sconf:"optional" sconf-doc:"Retention per class, for objects stored with a retention class in their metadata (retention-class), e.g. legal-hold: infinite, transient: 168h. Values are Go durations or infinite for never expiring. Objects whose class expired are removed by an hourly sweep. Objects without class, or with a class not listed here, are not removed."`
+
+	OrphanAction string        `sconf:"optional" sconf-doc:"If set, scan daily for objects stored for messages that no longer exist in any account, e.g. due to a removal that didn't reach NATS. Either report, only logging the orphans, or delete, removing them from NATS. Not possible with DeleteAfterStore."`
+	OrphanGrace  time.Duration `sconf:"optional" sconf-doc:"Objects younger than this are not considered orphans, so messages still being delivered are never removed. Default 24h."`
+
+	RetryConcurrency int `sconf:"optional" sconf-doc:"Maximum number of queued messages the retry loop stores at the same time. Each pass starts with one at a time, allows one more for each stored message, and halves on each failure, so a large backlog doesn't overload a NATS cluster that just recovered. Stores are also limited by MaxConcurrentStores. Default 4."`
+
+	QueueDir string `sconf:"optional" sconf-doc:"Directory for the local queue of messages waiting to be stored in NATS, e.g. during an outage. Relative paths are relative to the data directory. Messages that can never be stored, or that failed RetryMaxAttempts attempts, are moved to directories nats-deadletter and nats-failed next to it. Queue files in store/tmp/nats-pending relative to the working directory, used by older versions, are moved here at startup. Default tmp/nats-pending."`
+
+	MaxQueueBytes int64 `sconf:"optional" sconf-doc:"Maximum total size in bytes of the files in the pending queue, so a long NATS outage can't fill the disk. When adding a message would exceed it, the message is not queued, counted in metric mox_nats_queue_full_total: asynchronous stores then keep the message only locally. Stores with DeleteAfterStore are never queued. Default 0, no limit."`
+
+	RetryInterval      time.Duration `sconf:"optional" sconf-doc:"Time between passes of the retry loop over the pending queue. Lower for faster retries in latency-sensitive deployments, higher to throttle retries to a struggling NATS cluster. Default 30s."`
+	RetryErrorInterval time.Duration `sconf:"optional" sconf-doc:"Time until the next pass of the retry loop after a pass that failed, e.g. because the queue directory could not be read. Default 10s."`
+	RetryJitter        int           `sconf:"optional" sconf-doc:"Maximum random reduction, in percent, of the time between passes of the retry loop and of the time until the next retry of queued messages, so mox instances recovering from the same NATS outage don't retry in lockstep. Default 25, maximum 90."`
+
+	RetryBackoff     time.Duration `sconf:"optional" sconf-doc:"Time to wait before retrying a queued message after its first failed attempt. The wait doubles with each further failed attempt, up to RetryBackoffMax, and is shortened by a random amount of up to a quarter to spread out retries. Default 30s."`
+	RetryBackoffMax  time.Duration `sconf:"optional" sconf-doc:"Maximum time to wait between attempts of a queued message. Default 1h."`
+	RetryMaxAttempts int           `sconf:"optional" sconf-doc:"Queued messages that failed this many attempts are moved to directory nats-failed next to QueueDir instead of being retried, for inspection. They are listed by \"mox nats deadletter list\", and can be put back in the queue with \"mox nats deadletter requeue\". Set to a negative value to retry until stored, e.g. to not give up during a long NATS outage. Default 50, about two days with the default RetryBackoff and RetryBackoffMax."`
+
+	Keepalive time.Duration `sconf:"optional" sconf-doc:"If set, when no message was stored during this interval, make a lightweight object store request (bucket status) to keep the path to JetStream warm, avoiding a slow first store after an idle period. The duration of stores right after an idle period is exported as metric mox_nats_store_duration_seconds with after_idle=true, for comparing with and without keepalive. Default 0, disabled."`
+
+	SlowStoreThreshold time.Duration `sconf:"optional" sconf-doc:"Stores taking at least this long are logged with the time spent in each stage (waiting for a store slot, updating the index, the put, storing headers), for finding where the time goes. Default 1s."`
+
+	FlagEvents bool `sconf:"optional" sconf-doc:"Keep an append-only history of flag changes (e.g. seen, flagged, keywords) of messages in auth.db, for auditing. The flags of a message at any time can be reconstructed from its events."`
+
+	PublishIndex         bool          `sconf:"optional" sconf-doc:"Periodically publish the object index (message IDs, object names, sizes and digests of stored objects) to the bucket as objects mox-index (manifest) and mox-index-* (chunks of at most 1MB), so other tools can discover what is archived without auth.db. If the local object index is empty at startup, e.g. because auth.db was lost, it is restored from the published index."`
+	PublishIndexInterval time.Duration `sconf:"optional" sconf-doc:"Interval for publishing the object index, only published when it changed. Default 1h, minimum 1m."`
+
+	ReadIdleTimeout time.Duration `sconf:"optional" sconf-doc:"Abort reading a message from the object store when no data arrives for this long. Unlike RequestTimeout, which limits a whole operation, this allows large messages over slow links as long as data keeps coming. Default 30s."`
+
+	Transforms []string `sconf:"optional" sconf-doc:"Names of transforms applied in order to messages before storing them in NATS, e.g. removing or adding headers. Transforms are registered by programs embedding mox with store.RegisterNATSTransform. Lossless transforms are reversed when reading messages, lossy transforms are not. The transforms applied to a message are recorded in its object metadata (transforms)."`
+
+	Compression string `sconf:"optional" sconf-doc:"Compress messages before storing them in NATS, reducing storage for the typically well-compressible email messages. One of none (the default, also when empty), gzip, or names of algorithms registered by programs embedding mox with store.RegisterNATSCompression, e.g. zstd. Compression streams while storing, messages are not buffered. Applied after Transforms, and recorded in the object metadata (compression), so reads decompress transparently, also after changing this field. The digest of objects is over the compressed data as stored."`
+
+	SoftDeleteRetention time.Duration `sconf:"optional" sconf-doc:"If set, objects removed from NATS, e.g. orphans removed with OrphanAction delete, are only marked as deleted in their object metadata (deleted-at), and can be recovered with NATSClient.UndeleteMessage for this long. Soft-deleted objects are not returned by reads, and keep using their full size in the bucket until an hourly sweep removes them permanently. Default 0, removing objects immediately."`
+
+	MinStoreSize int64 `sconf:"optional" sconf-doc:"Messages smaller than this many bytes, e.g. delivery notifications, are not stored in NATS and stay on disk only, reducing the number of objects and operations. DeleteAfterStore never removes such messages. Default 0, storing all messages."`
+
+	MetadataKeyFile string `sconf:"optional" sconf-doc:"File with a secret key, at least 16 bytes, for signing object metadata. If set, an HMAC-SHA256 signature over the object name, size, digest and metadata is added to each stored object (metadata signature), and verified when reading, so tampering with metadata, or swapping objects, is detected. Objects without valid signature cannot be read. Complements the digest of the message data, which the object store verifies."`
+
+	EncryptionKeyFile          string   `sconf:"optional" sconf-doc:"File with a 256-bit key, as the raw 32 bytes or as 64 hexadecimal characters, e.g. generated with openssl rand -hex 32, for encrypting messages with AES-256-GCM before storing them in NATS. Each object gets a random nonce, and the ID of the key, derived from the key, in its metadata (encryption, encryption-key-id, encryption-nonce). Encrypted objects are decrypted when reading. Applied after Transforms and Compression. Keep the key file when rotating, see EncryptionPreviousKeyFiles."`
+	EncryptionPreviousKeyFiles []string `sconf:"optional" sconf-doc:"Files with previous keys of EncryptionKeyFile, in the same format, only for decrypting objects stored before a key rotation. Objects encrypted with a key that is not configured cannot be read."`
+
+	StoreTimeoutBase time.Duration `sconf:"optional" sconf-doc:"Timeout for storing a message in NATS, before the time for transferring the message at StoreThroughput is added. Default 5s."`
+	StoreThroughput  int64         `sconf:"optional" sconf-doc:"Expected throughput of stores to NATS in bytes per second, for computing the store timeout of a message from its size. Default 1048576 (1MB/s)."`
+	StoreTimeoutMin  time.Duration `sconf:"optional" sconf-doc:"Minimum timeout for storing a message in NATS. Default 5s."`
+	StoreTimeoutMax  time.Duration `sconf:"optional" sconf-doc:"Maximum timeout for storing a message in NATS, also for the largest messages. Default 30m."`
+
+	StoreThreadID bool `sconf:"optional" sconf-doc:"If set, the thread ID of a message is added to the object metadata as thread-id, for external consumers grouping messages into conversations. The thread ID is the ID of the first message of the thread in the account, as computed by mox from the References and In-Reply-To headers, or the base subject. Not set for messages delivered while threading is being upgraded."`
+
+	ObjectStoreFallback string `sconf:"optional" sconf-doc:"What to do when the JetStream object store is not available for a bucket, e.g. with NATS servers older than 2.6.2 or permissions that don't allow the object store subjects. Either fail (default), failing initialization with an explanation, or stream, storing messages as chunks published to a plain JetStream stream named MOXBLOB_ followed by the bucket name, a degraded mode without atomic updates. JetStream must be enabled in both cases, core NATS alone doesn't persist messages. Once a fallback stream exists, it is used as long as this is stream, also when the object store becomes available."`
+
+	SyncMailboxes []string `sconf:"optional" sconf-doc:"Mailboxes, e.g. for legal or archive purposes, whose messages are stored in NATS synchronously: a delivery waits for the store, and fails if the store fails, instead of queueing it for retry. Child mailboxes are included. Messages to other mailboxes are stored asynchronously. With DeleteAfterStore, all stores are synchronous."`
+
+	MaxGoroutines int `sconf:"optional" sconf-doc:"Maximum number of goroutines for NATS background work at the same time, shared between asynchronous stores, retries from the pending queue, removing objects of accounts and maildir imports, so a burst of work can't exhaust process resources. When all are busy, asynchronous stores are added to the pending queue, other work waits. The number in use is exported as metric mox_nats_goroutines_active. Default 64."`
+
+	AsyncWorkers   int `sconf:"optional" sconf-doc:"Number of workers for asynchronous stores. If set, asynchronous stores are added to a queue that the workers take them from, instead of each starting a goroutine. A worker takes a slot of MaxGoroutines while storing. When the queue is full, asynchronous stores are added to the pending queue. Default 0, a goroutine for each asynchronous store."`
+	AsyncQueueSize int `sconf:"optional" sconf-doc:"With AsyncWorkers, maximum number of asynchronous stores waiting for a worker. Each keeps its message file open. Default 256."`
+
+	KeepExpunged bool `sconf:"optional" sconf-doc:"Keep the objects of messages in NATS when the messages are expunged and erased locally, e.g. to use the bucket as archive. By default, objects of erased messages are removed, or marked as deleted with SoftDeleteRetention."`
+
+	Dedup bool `sconf:"optional" sconf-doc:"Store messages with identical content, e.g. from mailing lists or reply-all threads, only once: objects are named after the SHA-256 of the message (sha256-<hex>), and auth.db references the object from each message. The object is removed with the last message referencing it. Objects have no per-message metadata, so this cannot be combined with StoreThreadID, RetentionClasses or SoftDeleteRetention. Cannot be combined with EncryptionKeyFile either, the object names would reveal the hash of messages. The bucket must not be shared with other mox instances, their references are not known."`
+
+	MigrateFromBucket string `sconf:"optional" sconf-doc:"Name of the bucket messages were stored in before BucketName, for moving to a new bucket. While set, existing objects are copied from this bucket to BucketName in the background, new messages are written to both buckets, and objects are read from this bucket, falling back to BucketName. Once all objects are copied, writes and reads only use BucketName, and this field can be removed."`
 }
@@ -53,12 +53,18 @@ any parameters. Followed by the help and usage information for each command.
 	mox import mbox accountname mailboxname mbox
 	mox export maildir [-single] dst-dir account-path [mailbox]
 	mox export mbox [-single] dst-dir account-path [mailbox]
+	mox nats import maildir [-dryrun] [-concurrency n] maildir
+	mox nats queue export file.tgz
+	mox nats queue import file.tgz
+	mox nats deadletter list
+	mox nats deadletter requeue name ...
+	mox nats test
 	mox localserve
 	mox help [command ...]
 	mox backup destdir
 	mox verifydata data-dir
 	mox licenses
-	mox config test
+	mox config test [-nats]
 	mox config dnscheck domain
 	mox config dnsrecords domain
 	mox config describe-domains >domains.conf
@@ -778,6 +784,92 @@ otherwise reconstructing the original could lose a ">".
 	  -single
 	    	export single mailbox, without any children. disabled if mailbox isn't specified.
 
+# mox nats import maildir
+
+Store all messages of a maildir in the NATS object store.
+
+The maildir and its subdirectories are walked, and each message in a "cur" or
+"new" directory is stored in the bucket configured in mox.conf, with the
+mailbox, original path and maildir flags as object metadata. No messages are
+added to accounts: to import into an account, use "mox import maildir", which
+also stores delivered messages in NATS.
+
+Objects are named after the SHA-256 of the message file. Messages already in the
+bucket are skipped, so an interrupted import can be restarted.
+
+	usage: mox nats import maildir [-dryrun] [-concurrency n] maildir
+	  -concurrency int
+	    	number of messages to store at the same time (default 4)
+	  -dryrun
+	    	only count messages, don't store them
+
+# mox nats queue export
+
+Export the queue of messages waiting to be stored in NATS to a file.
+
+Messages that could not be stored in NATS, e.g. during an outage, are kept in
+a local queue and retried. When moving mox to another host before they are
+stored, export the queue to a gzipped tar file, and import it on the new host
+with "mox nats queue import". Each message is exported with its account, thread
+ID, time of queueing and number of attempts. The queue is not changed.
+
+The queue directory is read from mox.conf, see NATS QueueDir. Run with mox
+stopped: a running mox keeps storing queued messages, which would then be stored
+again after the import.
+
+	usage: mox nats queue export file.tgz
+
+# mox nats queue import
+
+Import messages waiting to be stored in NATS, exported with "mox nats queue export".
+
+The messages are added to the local queue, keeping their order, account, thread
+ID, time of queueing and number of attempts. The retry loop of a running mox
+stores them, otherwise they are stored after mox starts. Messages already in the
+queue are skipped, so an interrupted import can be restarted.
+
+The queue directory is read from mox.conf, see NATS QueueDir.
+
+	usage: mox nats queue import file.tgz
+
+# mox nats deadletter list
+
+List messages the NATS retry queue set aside.
+
+Messages that can never be stored, e.g. because NATS rejects them, are moved to
+directory nats-deadletter next to the queue directory. Messages that failed NATS
+RetryMaxAttempts attempts, by default 50, are moved to directory nats-failed. For each message, the file name, directory, message ID, account,
+number of attempts, size, time of queueing and time it was moved are printed.
+Use "mox nats deadletter requeue" to retry them.
+
+The queue directory is read from mox.conf, see NATS QueueDir.
+
+	usage: mox nats deadletter list
+
+# mox nats deadletter requeue
+
+Move messages set aside by the NATS retry queue back to the queue.
+
+Names are as listed by "mox nats deadletter list". The number of attempts of
+the messages is reset, and they are retried right away by the retry loop of a
+running mox, otherwise after mox starts. Messages that can never be stored fail
+again, unless the cause was fixed.
+
+The queue directory is read from mox.conf, see NATS QueueDir.
+
+	usage: mox nats deadletter requeue name ...
+
+# mox nats test
+
+Check that messages can be stored in NATS as configured in mox.conf.
+
+Without starting mox, connect to NATS, verify JetStream is available, open (or
+create) each configured bucket, and store, read back and remove a probe object
+in each bucket. A line with PASS, FAIL or SKIP is printed for each step. Steps
+after a failed step are skipped. The exit status is 1 if a step did not pass.
+
+	usage: mox nats test
+
 # mox localserve
 
 Start a local SMTP/IMAP server that accepts all messages, useful when testing/developing software that sends email.
@@ -911,7 +1003,14 @@ Parses and validates the configuration files.
 If valid, the command exits with status 0. If not valid, all errors encountered
 are printed.
 
-	usage: mox config test
+With -nats, the NATS configuration is also checked against the NATS server:
+connecting, JetStream availability and the buckets, without creating buckets or
+storing messages, and without affecting a running mox. A line with PASS, FAIL
+or SKIP is printed for each step.
+
+	usage: mox config test [-nats]
+	  -nats
+	    	also check connectivity to nats and its buckets
 
 # mox config dnscheck
 
@@ -136,6 +136,12 @@ var commands = []struct {
 	{"import mbox", cmdImportMbox},
 	{"export maildir", cmdExportMaildir},
 	{"export mbox", cmdExportMbox},
+	{"nats import maildir", cmdNATSImportMaildir},
+	{"nats queue export", cmdNATSQueueExport},
+	{"nats queue import", cmdNATSQueueImport},
+	{"nats deadletter list", cmdNATSDeadLetterList},
+	{"nats deadletter requeue", cmdNATSDeadLetterRequeue},
+	{"nats test", cmdNATSTest},
 	{"localserve", cmdLocalserve},
 	{"help", cmdHelp},
 	{"backup", cmdBackup},
@@ -605,11 +611,19 @@ CRAM-MD5.
 }
 
 func cmdConfigTest(c *cmd) {
+	c.params = "[-nats]"
 	c.help = `Parses and validates the configuration files.
 
 If valid, the command exits with status 0. If not valid, all errors encountered
 are printed.
+
+With -nats, the NATS configuration is also checked against the NATS server:
+connecting, JetStream availability and the buckets, without creating buckets or
+storing messages, and without affecting a running mox. A line with PASS, FAIL
+or SKIP is printed for each step.
 `
+	var checkNATS bool
+	c.flag.BoolVar(&checkNATS, "nats", false, "also check connectivity to nats and its buckets")
 	args := c.Parse()
 	if len(args) != 0 {
 		c.Usage()
@@ -617,7 +631,7 @@ are printed.
 
 	mox.FilesImmediate = true
 
-	_, errs := mox.ParseConfig(context.Background(), c.log, mox.ConfigStaticPath, true, true, false)
+	conf, errs := mox.ParseConfig(context.Background(), c.log, mox.ConfigStaticPath, true, true, false)
 	if len(errs) > 1 {
 		log.Printf("multiple errors:")
 		for _, err := range errs {
@@ -629,6 +643,25 @@ are printed.
 		os.Exit(1)
 	}
 	fmt.Println("config OK")
+
+	if checkNATS {
+		cfg := conf.Static.NATS
+		if cfg == nil {
+			log.Fatalf("nats not configured in mox.conf")
+		}
+		timeout := cfg.RequestTimeout
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*timeout)
+		defer cancel()
+		r := store.ValidateNATSConfig(ctx, c.log, cfg)
+		err := r.Write(os.Stdout)
+		xcheckf(err, "writing report")
+		if !r.OK() {
+			os.Exit(1)
+		}
+	}
 }
 
 func cmdConfigDescribeStatic(c *cmd) {
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricNATSStored = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_nats_messages_stored_total",
+			Help: "Number of messages stored in the NATS object store, by deliveries and the retry queue.",
+		},
+	)
+
+	metricNATSStoredBytes = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_nats_stored_bytes_total",
+			Help: "Number of bytes of messages stored in the NATS object store, before transforms.",
+		},
+	)
+
+	metricNATSStoreFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_nats_store_failures_total",
+			Help: "Number of failed puts of messages to the NATS object store, by deliveries and retries of queued messages.",
+		},
+	)
+)
+
+// NATSStoredInc counts a message of size bytes stored in NATS.
+func NATSStoredInc(size int64) {
+	metricNATSStored.Inc()
+	metricNATSStoredBytes.Add(float64(size))
+}
+
+// NATSStoreFailedInc counts a failed put of a message to NATS.
+func NATSStoreFailedInc() {
+	metricNATSStoreFailures.Inc()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/store"
+)
+
+// xnatsClient connects to NATS as configured in mox.conf, for commands that use
+// NATS, possibly next to a running mox. The retry loop is not started, the
+// running mox processes the queue.
+func xnatsClient(c *cmd) *store.NATSClient {
+	mustLoadConfig()
+	if mox.Conf.Static.NATS == nil {
+		log.Fatalf("nats not configured in mox.conf")
+	}
+	nc, err := store.NewNATSClient(c.log, mox.Conf.Static.NATS)
+	xcheckf(err, "connecting to nats")
+	return nc
+}
+
+func cmdNATSImportMaildir(c *cmd) {
+	c.params = "[-dryrun] [-concurrency n] maildir"
+	c.help = `Store all messages of a maildir in the NATS object store.
+
+The maildir and its subdirectories are walked, and each message in a "cur" or
+"new" directory is stored in the bucket configured in mox.conf, with the
+mailbox, original path and maildir flags as object metadata. No messages are
+added to accounts: to import into an account, use "mox import maildir", which
+also stores delivered messages in NATS.
+
+Objects are named after the SHA-256 of the message file. Messages already in the
+bucket are skipped, so an interrupted import can be restarted.
+`
+	var dryrun bool
+	var concurrency int
+	c.flag.BoolVar(&dryrun, "dryrun", false, "only count messages, don't store them")
+	c.flag.IntVar(&concurrency, "concurrency", 4, "number of messages to store at the same time")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	nc := xnatsClient(c)
+	defer nc.Close()
+	result, err := store.ImportMaildirNATS(context.Background(), c.log, nc, args[0], store.NATSImportOptions{Concurrency: concurrency, DryRun: dryrun})
+	xcheckf(err, "importing maildir")
+	fmt.Printf("messages %d, bytes %d, stored %d, skipped %d, failed %d\n", result.Messages, result.Bytes, result.Stored, result.Skipped, result.Failed)
+}
+
+func cmdNATSQueueExport(c *cmd) {
+	c.params = "file.tgz"
+	c.help = `Export the queue of messages waiting to be stored in NATS to a file.
+
+Messages that could not be stored in NATS, e.g. during an outage, are kept in
+a local queue and retried. When moving mox to another host before they are
+stored, export the queue to a gzipped tar file, and import it on the new host
+with "mox nats queue import". Each message is exported with its account, thread
+ID, time of queueing and number of attempts. The queue is not changed.
+
+The queue directory is read from mox.conf, see NATS QueueDir. Run with mox
+stopped: a running mox keeps storing queued messages, which would then be stored
+again after the import.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	store.SetNATSQueueDir(mox.Conf.Static.NATS)
+
+	f, err := os.OpenFile(args[0], os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	xcheckf(err, "creating export file")
+	result, err := store.ExportNATSQueue(c.log, f)
+	if err != nil {
+		os.Remove(args[0])
+	}
+	xcheckf(err, "exporting queue")
+	err = f.Sync()
+	xcheckf(err, "syncing export file")
+	err = f.Close()
+	xcheckf(err, "closing export file")
+	fmt.Printf("messages %d, bytes %d, corrupt %d\n", result.Messages, result.Bytes, result.Failed)
+}
+
+func cmdNATSQueueImport(c *cmd) {
+	c.params = "file.tgz"
+	c.help = `Import messages waiting to be stored in NATS, exported with "mox nats queue export".
+
+The messages are added to the local queue, keeping their order, account, thread
+ID, time of queueing and number of attempts. The retry loop of a running mox
+stores them, otherwise they are stored after mox starts. Messages already in the
+queue are skipped, so an interrupted import can be restarted.
+
+The queue directory is read from mox.conf, see NATS QueueDir.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	store.SetNATSQueueDir(mox.Conf.Static.NATS)
+
+	f, err := os.Open(args[0])
+	xcheckf(err, "opening export file")
+	defer f.Close()
+	result, err := store.ImportNATSQueue(c.log, f)
+	xcheckf(err, "importing queue")
+	fmt.Printf("messages %d, bytes %d, skipped %d, corrupt %d\n", result.Messages, result.Bytes, result.Skipped, result.Failed)
+}
+
+func cmdNATSDeadLetterList(c *cmd) {
+	c.help = `List messages the NATS retry queue set aside.
+
+Messages that can never be stored, e.g. because NATS rejects them, are moved to
+directory nats-deadletter next to the queue directory. Messages that failed NATS
+RetryMaxAttempts attempts, by default 50, are moved to directory nats-failed. For each message, the file name, directory, message ID, account,
+number of attempts, size, time of queueing and time it was moved are printed.
+Use "mox nats deadletter requeue" to retry them.
+
+The queue directory is read from mox.conf, see NATS QueueDir.
+`
+	args := c.Parse()
+	if len(args) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	store.SetNATSQueueDir(mox.Conf.Static.NATS)
+
+	l, err := store.ListNATSDeadLetters()
+	xcheckf(err, "listing dead-lettered messages")
+	for _, dl := range l {
+		dir := "deadletter"
+		if dl.Failed {
+			dir = "failed"
+		}
+		if dl.Err != nil {
+			fmt.Printf("%s %s moved %s: corrupt: %v\n", dl.Name, dir, dl.Moved.Format(time.RFC3339), dl.Err)
+			continue
+		}
+		fmt.Printf("%s %s msgid %d account %q attempts %d size %d queued %s moved %s\n", dl.Name, dir, dl.MessageID, dl.Account, dl.Attempts, dl.Size, dl.Enqueued.Format(time.RFC3339), dl.Moved.Format(time.RFC3339))
+	}
+}
+
+func cmdNATSDeadLetterRequeue(c *cmd) {
+	c.params = "name ..."
+	c.help = `Move messages set aside by the NATS retry queue back to the queue.
+
+Names are as listed by "mox nats deadletter list". The number of attempts of
+the messages is reset, and they are retried right away by the retry loop of a
+running mox, otherwise after mox starts. Messages that can never be stored fail
+again, unless the cause was fixed.
+
+The queue directory is read from mox.conf, see NATS QueueDir.
+`
+	args := c.Parse()
+	if len(args) == 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	store.SetNATSQueueDir(mox.Conf.Static.NATS)
+
+	for _, name := range args {
+		err := store.RequeueNATSDeadLetter(name)
+		xcheckf(err, "requeueing %s", name)
+		fmt.Printf("%s requeued\n", name)
+	}
+}
+
+func cmdNATSTest(c *cmd) {
+	c.help = `Check that messages can be stored in NATS as configured in mox.conf.
+
+Without starting mox, connect to NATS, verify JetStream is available, open (or
+create) each configured bucket, and store, read back and remove a probe object
+in each bucket. A line with PASS, FAIL or SKIP is printed for each step. Steps
+after a failed step are skipped. The exit status is 1 if a step did not pass.
+`
+	args := c.Parse()
+	if len(args) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+	cfg := mox.Conf.Static.NATS
+	if cfg == nil {
+		log.Fatalf("nats not configured in mox.conf")
+	}
+
+	timeout := cfg.RequestTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*timeout)
+	defer cancel()
+	r := store.NATSPreflight(ctx, c.log, cfg)
+	err := r.Write(os.Stdout)
+	xcheckf(err, "writing report")
+	if !r.OK() {
+		os.Exit(1)
+	}
+}
@@ -47,6 +47,10 @@ func shutdown(log mlog.Log) {
 			log.Print("shutting down with pending sockets")
 		}
 	}
+
+	// Write pending messages to NATS, so archival work isn't abandoned.
+	store.CloseNATS(log)
+
 	err := os.Remove(mox.DataDirPath("ctl"))
 	log.Check(err, "removing ctl unix domain socket during shutdown")
 }
@@ -1081,12 +1081,26 @@ func removeAccount(log mlog.Log, accountName string) error {
 		if err := loginAttemptRemoveAccount(tx, accountName); err != nil {
 			return fmt.Errorf("removing historic login attempts for account: %v", err)
 		}
+		if _, err := bstore.QueryTx[NATSFlagEvent](tx).FilterNonzero(NATSFlagEvent{Account: accountName}).Delete(); err != nil {
+			return fmt.Errorf("removing nats flag events for account: %v", err)
+		}
 		return nil
 	})
 	if err != nil {
 		errs = append(errs, fmt.Errorf("remove account from database: %w", err))
 	}
 
+	// Remove the messages of the account from the message store, NATS or a
+	// registered backend.
+	if ms := GetMessageStore(); ms != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		err := messageStoreHandlerFor(ms).deleteAccount(ctx, accountName)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("removing messages of account from message store: %w", err))
+		}
+	}
+
 	// Remove the account directory and its message and other files.
 	if err := os.RemoveAll(tmpdir); err != nil {
 		errs = append(errs, fmt.Errorf("removing account data directory %q that was moved to %q: %v", odir, tmpdir, err))
@@ -1187,6 +1201,7 @@ func OpenAccountDB(log mlog.Log, accountDir, accountName string) (a *Account, re
 	// Process pending MessageErase records. Check that next the message ID assigned by
 	// the database does not already have a file on disk, or increase the sequence so
 	// it doesn't.
+	var natsErased []int64 // Erased messages that were stored in NATS, not placeholders for moved messages.
 	err = db.Write(context.TODO(), func(tx *bstore.Tx) error {
 		if tx.Get(&Settings{ID: 1}) == bstore.ErrAbsent {
 			if err := tx.Insert(&Settings{ID: 1, ShowAddressSecurity: true}); err != nil {
@@ -1238,6 +1253,7 @@ func OpenAccountDB(log mlog.Log, accountDir, accountName string) (a *Account, re
 			if !me.SkipUpdateDiskUsage {
 				du.MessageSize -= m.Size
 				duChanged = true
+				natsErased = append(natsErased, me.ID)
 			}
 
 			m.erase()
@@ -1329,6 +1345,7 @@ func OpenAccountDB(log mlog.Log, accountDir, accountName string) (a *Account, re
 	if err != nil {
 		return nil, fmt.Errorf("calculating counts for mailbox, inserting settings, expunging messages: %v", err)
 	}
+	deleteErasedMessages(accountName, natsErased)
 
 	up := Upgrade{ID: 1}
 	err = db.Write(context.TODO(), func(tx *bstore.Tx) error {
@@ -2238,6 +2255,12 @@ type AddOpts struct {
 // committed, the caller must clean up the delivered message file identified by
 // m.ID.
 //
+// With NATS DeleteAfterStore, the message is stored in NATS before this call
+// returns, and is marked expunged with its delivered file removed. The caller
+// still owns msgFile and can remove it once this call returns, whether it
+// succeeded or not. If the transaction isn't committed, the stored copy is removed
+// from NATS in the background.
+//
 // If the message does not fit in the quota, an error with ErrOverQuota is returned
 // and the mailbox and message are unchanged and the transaction can continue. For
 // other errors, the caller must abort the transaction.
@@ -2519,42 +2542,99 @@ func (a *Account) MessageAdd(log mlog.Log, tx *bstore.Tx, mb *Mailbox, m *Messag
 
 	mb.MailboxCounts.Add(m.MailboxCounts())
 
-	// Handle NATS storage
-	if natsClient := GetNATSClient(); natsClient != nil && natsClient.IsConnected() {
-		cfg := natsClient.Config()
-		if cfg.DeleteAfterStore {
-			// Synchronous storage when delete-after-store is enabled
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Store a copy in the message store, NATS or a registered backend. For NATS,
+	// messages below MinStoreSize stay local, and are never removed after storing.
+	if ms := GetMessageStore(); ms != nil {
+		h := messageStoreHandlerFor(ms)
+		size := m.Size - int64(len(m.MsgPrefix))
+		switch mode := h.storeMode(mb.Name, size); mode {
+		case messageStoreForward, messageStoreSync:
+			// Synchronous storage when delete-after-store is enabled, or for mailboxes that
+			// require durability in the message store before delivery completes.
+			ctx, cancel := context.WithTimeout(context.Background(), h.storeDeadline(size))
 			defer cancel()
-			
-			if err := natsClient.StoreMessageWithQueue(ctx, m.ID, msgFile); err != nil {
-				log.Errorx("storing message in NATS object store", err, 
-					slog.Int64("message_id", m.ID))
-				return fmt.Errorf("failed to store message in NATS before deletion: %w", err)
+			ctx = WithNATSThreadID(WithMessageAccount(ctx, a.Name), m.ThreadID)
+
+			// Not queued on failure: the delivery fails and its message ID is used again,
+			// a queued copy would be stored later for the next message with that ID.
+			if err := h.storeConfirmed(ctx, m.ID, msgFile); err != nil {
+				log.Errorx("storing message in message store", err,
+					slog.Int64("message_id", m.ID),
+					slog.String("mailbox", mb.Name))
+				return fmt.Errorf("failed to store message in message store for mailbox %q: %w", mb.Name, err)
+			}
+			a.messageStoreUncommitted(log, ms, m.ID)
+			if mode == messageStoreSync {
+				break
 			}
-			
-			// Successfully stored in NATS, now delete from local storage
+
+			// Successfully stored, now delete from local storage
 			if err := a.deleteMessageFromMailbox(log, tx, mb, m); err != nil {
-				log.Errorx("deleting message after NATS storage", err,
+				log.Errorx("deleting message after storing in message store", err,
 					slog.Int64("message_id", m.ID))
-				return fmt.Errorf("failed to delete message after NATS storage: %w", err)
+				return fmt.Errorf("failed to delete message after storing in message store: %w", err)
 			}
-			
-			log.Info("message forwarded to NATS and deleted locally",
+
+			// The store is confirmed and has read the message, so the message file is no
+			// longer needed. Only our link or copy is removed, msgFile remains with the
+			// caller. If the transaction isn't committed, no message references the file.
+			err := os.Remove(msgPath)
+			log.Check(err, "removing message file after storing in message store", slog.String("path", msgPath))
+
+			log.Info("message forwarded to message store and deleted locally",
 				slog.Int64("message_id", m.ID),
 				slog.String("mailbox", mb.Name))
-		} else {
+		case messageStoreBackground:
 			// Asynchronous storage when keeping local copy
-			natsClient.StoreMessageAsync(context.Background(), m.ID, msgFile)
+			h.storeBackground(WithNATSThreadID(WithMessageAccount(context.Background(), a.Name), m.ThreadID), m.ID, msgFile)
 		}
 	}
 
 	return nil
 }
 
+// messageStoreUncommitted removes the copy of message messageID stored by
+// MessageAdd from ms in the background if the transaction that added the message
+// isn't committed, e.g. due to a later error in MessageAdd or an abort by the
+// caller. The message ID is then used again for the next message, whose lookups
+// would find the stale copy. The check waits for the account write lock and
+// runs in a write transaction, so it starts after the delivery's transaction has
+// finished.
+func (a *Account) messageStoreUncommitted(log mlog.Log, ms MessageStore, messageID int64) {
+	go func() {
+		defer func() {
+			x := recover()
+			if x != nil {
+				log.Error("unhandled panic checking commit of stored message", slog.Any("err", x))
+				debug.PrintStack()
+				metrics.PanicInc(metrics.Store)
+			}
+		}()
+
+		a.RLock()
+		defer a.RUnlock()
+		err := a.DB.Write(context.Background(), func(tx *bstore.Tx) error {
+			return tx.Get(&Message{ID: messageID})
+		})
+		if err == nil {
+			return
+		} else if !errors.Is(err, bstore.ErrAbsent) {
+			// E.g. the account was closed, the copy is left alone.
+			log.Errorx("checking commit of stored message", err, slog.Int64("message_id", messageID))
+			return
+		}
+		log.Info("removing stored copy of message whose delivery was not committed", slog.Int64("message_id", messageID))
+		ctx, cancel := context.WithTimeout(WithMessageAccount(context.Background(), a.Name), messageStoreTimeout)
+		defer cancel()
+		err = ms.DeleteMessage(ctx, messageID)
+		log.Check(err, "removing stored copy of uncommitted message", slog.Int64("message_id", messageID))
+	}()
+}
+
 // deleteMessageFromMailbox removes a message from the mailbox and updates counts.
 // This is used when forwarding messages to NATS with DeleteAfterStore enabled.
-// The message file is NOT deleted here as it may still be needed by NATS storage.
+// The message file is not removed here, MessageAdd does that once the message is
+// marked expunged.
 func (a *Account) deleteMessageFromMailbox(log mlog.Log, tx *bstore.Tx, mb *Mailbox, m *Message) error {
 	// Update mailbox counts by subtracting this message's counts
 	mb.MailboxCounts.Sub(m.MailboxCounts())
@@ -0,0 +1,34 @@
+package store_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+func ExampleNATSClient_OpenMessageForRedelivery() {
+	// Resend a message archived in NATS to a recipient, through the outgoing queue.
+	ctx := context.Background()
+	log := mlog.New("example", nil)
+
+	f, size, err := store.GetNATSClient().OpenMessageForRedelivery(ctx, log, "msg-123-1700000000")
+	if err != nil {
+		log.Fatalx("fetching message from nats", err)
+	}
+	// The queue links or copies the message file.
+	defer store.CloseRemoveTempFile(log, f, "message for redelivery")
+
+	sender := smtp.Path{Localpart: "postmaster", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	recipient := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}}
+	// Without scanning the message, assume it needs 8BITMIME.
+	qm := queue.MakeMsg(sender, recipient, true, false, size, "<archived@mox.example>", nil, nil, time.Now(), "")
+	if err := queue.Add(ctx, log, mox.Conf.Static.Postmaster.Account, f, qm); err != nil {
+		log.Fatalx("queueing message for redelivery", err)
+	}
+}
@@ -25,7 +25,7 @@ type AccountRemove struct {
 
 // AuthDB and AuthDBTypes are exported for ../backup.go.
 var AuthDB *bstore.DB
-var AuthDBTypes = []any{TLSPublicKey{}, LoginAttempt{}, LoginAttemptState{}, AccountRemove{}}
+var AuthDBTypes = []any{TLSPublicKey{}, LoginAttempt{}, LoginAttemptState{}, AccountRemove{}, NATSObjectRef{}, NATSMessageHeader{}, NATSFlagEvent{}, NATSIndexBackfill{}, NATSDedupRef{}}
 
 var loginAttemptCleanerStop chan chan struct{}
 
@@ -93,11 +93,15 @@ func Init(ctx context.Context) error {
 		pkglog.Errorx("initializing NATS client", err)
 		// Don't fail startup if NATS initialization fails, just log the error
 	}
+	if err := initMessageStore(pkglog, mox.Conf.Static.MessageStore, mox.Conf.Static.NATS != nil); err != nil {
+		pkglog.Errorx("initializing message store", err)
+	}
 
 	return nil
 }
 
-// Close closes auth.db and stops the login writer.
+// Close closes auth.db, stops the login writer and the NATS retry loop, and closes
+// the message store.
 func Close() error {
 	if AuthDB == nil {
 		return fmt.Errorf("not open")
@@ -111,13 +115,9 @@ func Close() error {
 	loginAttemptCleanerStop <- stopc
 	<-stopc
 
-	// Close NATS client if it exists
-	if natsClient := GetNATSClient(); natsClient != nil {
-		if err := natsClient.Close(); err != nil {
-			pkglog := mlog.New("store", nil)
-			pkglog.Errorx("closing NATS client", err)
-		}
-	}
+	// Close NATS client if it exists, the next Init creates a new one.
+	closeNATS(mlog.New("store", nil))
+	closeMessageStore(mlog.New("store", nil))
 
 	err := AuthDB.Close()
 	AuthDB = nil
@@ -0,0 +1,314 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+)
+
+// MessageStore is a backend storing copies of messages outside the data
+// directory. NATSClient is the built-in implementation, programs embedding mox can
+// register others, e.g. for an S3-compatible object store, with
+// RegisterMessageStore. Messages are identified by their message ID, with the
+// account from the context, see WithMessageAccount: message IDs are only unique per
+// account. Naming of objects and their metadata is up to the backend.
+type MessageStore interface {
+	// StoreMessage stores a copy of msgFile for message messageID. The file remains
+	// with the caller.
+	StoreMessage(ctx context.Context, messageID int64, msgFile *os.File) error
+
+	// GetMessage returns the stored message, or an error wrapping ErrMessageNotFound.
+	GetMessage(ctx context.Context, messageID int64) (io.ReadCloser, error)
+
+	// DeleteMessage removes the stored message. A message that isn't stored is not an
+	// error.
+	DeleteMessage(ctx context.Context, messageID int64) error
+
+	// ListMessages calls fn for each stored message, of the account of ctx if set. If
+	// fn returns an error, listing stops and the error is returned.
+	ListMessages(ctx context.Context, fn func(StoredMessageInfo) error) error
+}
+
+var _ MessageStore = (*NATSClient)(nil)
+
+type messageAccountKeyType struct{}
+
+// WithMessageAccount returns a context that makes messages stored in the message
+// store with it belong to account. Message IDs are only unique per account, so
+// retrieving, removing and listing messages also take the account from the
+// context. For NATS, the account is recorded in the object metadata and the
+// object index, for finding the objects of an account, e.g. when removing it.
+func WithMessageAccount(ctx context.Context, account string) context.Context {
+	return context.WithValue(ctx, messageAccountKeyType{}, account)
+}
+
+// messageAccount returns the account set on ctx, or the empty string.
+func messageAccount(ctx context.Context) string {
+	account, _ := ctx.Value(messageAccountKeyType{}).(string)
+	return account
+}
+
+// Timeout for a store or removal of a message by a registered backend, in the
+// background.
+const messageStoreTimeout = time.Minute
+
+var messageStoreBackends = map[string]func(log mlog.Log) (MessageStore, error){}
+
+// RegisterMessageStore adds a backend that can be selected with MessageStore in
+// the config. Must be called before the store package is initialized. If the
+// returned store implements io.Closer, it is closed with the store package.
+func RegisterMessageStore(name string, open func(log mlog.Log) (MessageStore, error)) {
+	messageStoreBackends[name] = open
+}
+
+// Goroutine budget for background work of the registered backend, like
+// NATS.MaxGoroutines with its default for NATS. When used up, the work is dropped,
+// so a burst of deliveries can't start unlimited goroutines, and a slow backend
+// can't hold up deliveries or erasing.
+var messageStoreSem = semaphore.NewWeighted(natsDefaultMaxGoroutines)
+
+var metricMessageStoreDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_message_store_dropped_total",
+		Help: "Number of stores and removals of the registered message store that were not done because its goroutine budget was used up.",
+	},
+)
+
+var globalMessageStore struct {
+	sync.RWMutex
+	ms MessageStore // Registered backend, nil if none.
+}
+
+// initMessageStore opens the registered backend name, if set. A backend can't be
+// combined with NATS, it replaces it.
+func initMessageStore(log mlog.Log, name string, nats bool) error {
+	if name == "" {
+		return nil
+	}
+	open, ok := messageStoreBackends[name]
+	if !ok {
+		return fmt.Errorf("unknown message store %q", name)
+	}
+	if nats {
+		return fmt.Errorf("message store %q cannot be combined with nats", name)
+	}
+	ms, err := open(log)
+	if err != nil {
+		return fmt.Errorf("opening message store %q: %w", name, err)
+	}
+	globalMessageStore.Lock()
+	globalMessageStore.ms = ms
+	globalMessageStore.Unlock()
+	log.Info("message store initialized", slog.String("messagestore", name))
+	return nil
+}
+
+// closeMessageStore closes the registered backend, if any.
+func closeMessageStore(log mlog.Log) {
+	globalMessageStore.Lock()
+	ms := globalMessageStore.ms
+	globalMessageStore.ms = nil
+	globalMessageStore.Unlock()
+	if c, ok := ms.(io.Closer); ok {
+		err := c.Close()
+		log.Check(err, "closing message store")
+	}
+}
+
+// GetMessageStore returns the backend for storing copies of messages: the backend
+// registered with MessageStore in the config, or the NATS client if NATS is
+// configured. Nil if neither is configured.
+func GetMessageStore() MessageStore {
+	if ms := registeredMessageStore(); ms != nil {
+		return ms
+	}
+	if nc := GetNATSClient(); nc != nil {
+		return nc
+	}
+	return nil
+}
+
+// registeredMessageStore returns the backend from MessageStore in the config, nil
+// if none.
+func registeredMessageStore() MessageStore {
+	globalMessageStore.RLock()
+	defer globalMessageStore.RUnlock()
+	return globalMessageStore.ms
+}
+
+// messageStoreGo runs fn, for work of messageStoreDefault, in a goroutine
+// within the goroutine budget, see messageStoreSem. Callers may hold the account
+// lock or be in a transaction, so fn is never run synchronously: if the budget is
+// used up, fn is not run, the drop is logged and counted, and false is returned.
+// Panics in fn are recovered and logged.
+func messageStoreGo(log mlog.Log, what string, fn func(), attrs ...slog.Attr) bool {
+	if !messageStoreSem.TryAcquire(1) {
+		metricMessageStoreDropped.Inc()
+		log.Error("goroutine budget for message store used up, not "+what, attrs...)
+		return false
+	}
+	go func() {
+		defer messageStoreSem.Release(1)
+		defer func() {
+			x := recover()
+			if x != nil {
+				log.Error("unhandled panic "+what, slog.Any("err", x))
+				debug.PrintStack()
+				metrics.PanicInc(metrics.Store)
+			}
+		}()
+		fn()
+	}()
+	return true
+}
+
+// How MessageAdd stores a copy of a delivered message.
+type messageStoreMode int
+
+const (
+	messageStoreNone       messageStoreMode = iota // Not stored, the message only stays local.
+	messageStoreBackground                         // Stored in the background, the delivery doesn't wait for it.
+	messageStoreSync                               // Stored before the delivery completes, failing the delivery if the store fails.
+	messageStoreForward                            // Like messageStoreSync, then removed locally.
+)
+
+// messageStoreHandler decides how copies of delivered messages are stored, and
+// how copies of erased messages and removed accounts are removed. NATSClient
+// implements it with its configuration, e.g. MinStoreSize, DeleteAfterStore,
+// SyncMailboxes, and its retry queue and goroutine budget. Other message stores
+// are handled by messageStoreDefault.
+type messageStoreHandler interface {
+	// storeMode returns how a message of size bytes delivered to mailbox is stored.
+	storeMode(mailbox string, size int64) messageStoreMode
+
+	// storeDeadline returns the time a synchronous store of size bytes may take.
+	storeDeadline(size int64) time.Duration
+
+	// storeConfirmed stores the message, returning once the store is confirmed. A
+	// failed store is not retried.
+	storeConfirmed(ctx context.Context, messageID int64, msgFile *os.File) error
+
+	// storeBackground stores the message in the background. The message file is
+	// opened again by name before returning, the caller may close and remove msgFile
+	// once it returns.
+	storeBackground(ctx context.Context, messageID int64, msgFile *os.File)
+
+	// deleteErased removes the copies of erased messages ids of account in the
+	// background.
+	deleteErased(account string, ids []int64)
+
+	// deleteAccount removes the copies of all messages of account.
+	deleteAccount(ctx context.Context, account string) error
+}
+
+// messageStoreHandlerFor returns the handler for ms.
+func messageStoreHandlerFor(ms MessageStore) messageStoreHandler {
+	if h, ok := ms.(messageStoreHandler); ok {
+		return h
+	}
+	return messageStoreDefault{ms}
+}
+
+// messageStoreDefault handles message stores without their own handling, like
+// backends registered by programs embedding mox. Messages are stored in the
+// background, and kept locally. Background work is done within the goroutine
+// budget of messageStoreSem, and dropped when it is used up.
+type messageStoreDefault struct {
+	ms MessageStore
+}
+
+func (h messageStoreDefault) storeMode(mailbox string, size int64) messageStoreMode {
+	return messageStoreBackground
+}
+
+func (h messageStoreDefault) storeDeadline(size int64) time.Duration {
+	return messageStoreTimeout
+}
+
+func (h messageStoreDefault) storeConfirmed(ctx context.Context, messageID int64, msgFile *os.File) error {
+	return h.ms.StoreMessage(ctx, messageID, msgFile)
+}
+
+// storeBackground stores the message unless the goroutine budget is used up.
+// Failures are logged, the message stays available locally.
+func (h messageStoreDefault) storeBackground(ctx context.Context, messageID int64, msgFile *os.File) {
+	log := mlog.New("store", nil)
+	f, err := os.Open(msgFile.Name())
+	if err != nil {
+		log.Errorx("opening message file for message store", err, slog.Int64("message_id", messageID))
+		return
+	}
+	// The store outlives the caller, only keep the account of its context.
+	account := messageAccount(ctx)
+	ok := messageStoreGo(log, "storing message in message store", func() {
+		defer func() {
+			err := f.Close()
+			log.Check(err, "closing message file after storing in message store")
+		}()
+
+		ctx, cancel := context.WithTimeout(WithMessageAccount(context.Background(), account), messageStoreTimeout)
+		defer cancel()
+		err := h.ms.StoreMessage(ctx, messageID, f)
+		log.Check(err, "storing message in message store", slog.String("account", account), slog.Int64("message_id", messageID))
+	}, slog.String("account", account), slog.Int64("message_id", messageID))
+	if !ok {
+		err := f.Close()
+		log.Check(err, "closing message file")
+	}
+}
+
+// deleteErased removes the messages unless the goroutine budget is used up, the
+// copies are then left.
+func (h messageStoreDefault) deleteErased(account string, ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	log := mlog.New("store", nil)
+	messageStoreGo(log, "removing erased messages from message store", func() {
+		for _, id := range ids {
+			ctx, cancel := context.WithTimeout(WithMessageAccount(context.Background(), account), messageStoreTimeout)
+			err := h.ms.DeleteMessage(ctx, id)
+			cancel()
+			log.Check(err, "removing erased message from message store", slog.String("account", account), slog.Int64("message_id", id))
+		}
+	}, slog.String("account", account), slog.Any("ids", ids))
+}
+
+// deleteAccount lists the messages of account and removes them one by one.
+func (h messageStoreDefault) deleteAccount(ctx context.Context, account string) error {
+	ctx = WithMessageAccount(ctx, account)
+	var ids []int64
+	err := h.ms.ListMessages(ctx, func(info StoredMessageInfo) error {
+		ids = append(ids, info.MessageID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing messages of account: %w", err)
+	}
+	for _, id := range ids {
+		if err := h.ms.DeleteMessage(ctx, id); err != nil {
+			return fmt.Errorf("removing message %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// deleteErasedMessages removes the stored copies of erased messages ids of
+// account in the background, from the message store, if any.
+func deleteErasedMessages(account string, ids []int64) {
+	if ms := GetMessageStore(); ms != nil {
+		messageStoreHandlerFor(ms).deleteErased(account, ids)
+	}
+}
@@ -0,0 +1,348 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// fakeMessageStore is an in-memory MessageStore. Deliveries are stored with
+// mode, for testing MessageAdd like with NATS.
+type fakeMessageStore struct {
+	sync.Mutex
+	messages map[string][]byte // By account and message ID.
+	closed   bool
+	mode     messageStoreMode
+	storeErr error // Returned by StoreMessage if set.
+}
+
+func newFakeMessageStore() *fakeMessageStore {
+	return &fakeMessageStore{messages: map[string][]byte{}, mode: messageStoreBackground}
+}
+
+var _ messageStoreHandler = (*fakeMessageStore)(nil)
+
+func (ms *fakeMessageStore) storeMode(mailbox string, size int64) messageStoreMode {
+	ms.Lock()
+	defer ms.Unlock()
+	return ms.mode
+}
+
+func (ms *fakeMessageStore) storeDeadline(size int64) time.Duration {
+	return messageStoreTimeout
+}
+
+func (ms *fakeMessageStore) storeConfirmed(ctx context.Context, messageID int64, msgFile *os.File) error {
+	return ms.StoreMessage(ctx, messageID, msgFile)
+}
+
+func (ms *fakeMessageStore) storeBackground(ctx context.Context, messageID int64, msgFile *os.File) {
+	messageStoreDefault{ms}.storeBackground(ctx, messageID, msgFile)
+}
+
+func (ms *fakeMessageStore) deleteErased(account string, ids []int64) {
+	messageStoreDefault{ms}.deleteErased(account, ids)
+}
+
+func (ms *fakeMessageStore) deleteAccount(ctx context.Context, account string) error {
+	return messageStoreDefault{ms}.deleteAccount(ctx, account)
+}
+
+func (ms *fakeMessageStore) setMode(mode messageStoreMode, storeErr error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.mode = mode
+	ms.storeErr = storeErr
+}
+
+func fakeMessageKey(ctx context.Context, messageID int64) string {
+	return fmt.Sprintf("%s/%d", messageAccount(ctx), messageID)
+}
+
+func (ms *fakeMessageStore) StoreMessage(ctx context.Context, messageID int64, msgFile *os.File) error {
+	buf, err := io.ReadAll(io.NewSectionReader(msgFile, 0, 1<<30))
+	if err != nil {
+		return err
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.storeErr != nil {
+		return ms.storeErr
+	}
+	ms.messages[fakeMessageKey(ctx, messageID)] = buf
+	return nil
+}
+
+func (ms *fakeMessageStore) GetMessage(ctx context.Context, messageID int64) (io.ReadCloser, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	buf, ok := ms.messages[fakeMessageKey(ctx, messageID)]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	return io.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (ms *fakeMessageStore) DeleteMessage(ctx context.Context, messageID int64) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.messages, fakeMessageKey(ctx, messageID))
+	return nil
+}
+
+func (ms *fakeMessageStore) ListMessages(ctx context.Context, fn func(StoredMessageInfo) error) error {
+	ms.Lock()
+	var l []StoredMessageInfo
+	for k, buf := range ms.messages {
+		var info StoredMessageInfo
+		fmt.Sscanf(filepath.Base(k), "%d", &info.MessageID)
+		info.Account = filepath.Dir(k)
+		info.Size = int64(len(buf))
+		if account := messageAccount(ctx); account == "" || info.Account == account {
+			l = append(l, info)
+		}
+	}
+	ms.Unlock()
+	for _, info := range l {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *fakeMessageStore) Close() error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.closed = true
+	return nil
+}
+
+func (ms *fakeMessageStore) keys() []string {
+	ms.Lock()
+	defer ms.Unlock()
+	var l []string
+	for k := range ms.messages {
+		l = append(l, k)
+	}
+	slices.Sort(l)
+	return l
+}
+
+func TestMessageStore(t *testing.T) {
+	log := mlog.New("store", nil)
+	fms := newFakeMessageStore()
+	RegisterMessageStore("fake", func(log mlog.Log) (MessageStore, error) { return fms, nil })
+
+	if err := initMessageStore(log, "absent", false); err == nil {
+		t.Fatalf("unknown message store accepted")
+	}
+	if err := initMessageStore(log, "fake", true); err == nil {
+		t.Fatalf("message store combined with nats accepted")
+	}
+	tcompare(t, GetMessageStore() == nil, true)
+
+	// Without registered backend, NATS is the message store.
+	nc := newTestNATSClient(nil, newFakeObjectStore())
+	orig := globalNATSClient
+	globalNATSClient = nc
+	tcompare(t, GetMessageStore() == MessageStore(nc), true)
+	globalNATSClient = orig
+
+	err := initMessageStore(log, "fake", false)
+	tcheck(t, err, "init message store")
+	defer closeMessageStore(log)
+	tcompare(t, GetMessageStore() == MessageStore(fms), true)
+
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer Switchboard()()
+
+	acc, err := OpenAccount(pkglog, "mjl", true)
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.WaitClosed()
+	}()
+
+	wait := func(n int) {
+		t.Helper()
+		for range 100 {
+			if len(fms.keys()) == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("got %d messages in message store, expected %d", len(fms.keys()), n)
+	}
+
+	// Delivered messages are stored in the background.
+	const s = "Subject: test\r\n\r\ntest\r\n"
+	m := Message{Size: int64(len(s)), Received: time.Now()}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(pkglog, "Inbox", &m, writeTestMessage(t, s))
+	})
+	tcheck(t, err, "deliver")
+	wait(1)
+	r, err := fms.GetMessage(WithMessageAccount(ctxbg, "mjl"), m.ID)
+	tcheck(t, err, "get message")
+	buf, err := io.ReadAll(r)
+	tcheck(t, err, "read message")
+	tcompare(t, string(buf), s)
+
+	// Erased messages are removed.
+	acc.WithWLock(func() {
+		var changes []Change
+		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			mb := Mailbox{ID: m.MailboxID}
+			if err := tx.Get(&mb); err != nil {
+				return err
+			}
+			modseq, err := acc.NextModSeq(tx)
+			if err != nil {
+				return err
+			}
+			if err := tx.Get(&m); err != nil {
+				return err
+			}
+			chrem, chcounts, err := acc.MessageRemove(pkglog, tx, modseq, &mb, RemoveOpts{}, m)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, chrem, chcounts)
+			return tx.Update(&mb)
+		})
+		BroadcastChanges(acc, changes)
+	})
+	tcheck(t, err, "expunge message")
+	wait(0)
+
+	// Removing messages of an account only removes those of the account.
+	for _, account := range []string{"mjl", "mjl", "other"} {
+		err := fms.StoreMessage(WithMessageAccount(ctxbg, account), int64(len(fms.keys())+1), writeTestMessage(t, s))
+		tcheck(t, err, "store message")
+	}
+	err = messageStoreHandlerFor(fms).deleteAccount(ctxbg, "mjl")
+	tcheck(t, err, "delete account messages")
+	tcompare(t, fms.keys(), []string{"other/3"})
+	err = fms.DeleteMessage(WithMessageAccount(ctxbg, "other"), 3)
+	tcheck(t, err, "delete message")
+
+	deliver := func() (*os.File, Message, error) {
+		t.Helper()
+		f := writeTestMessage(t, s)
+		m := Message{Size: int64(len(s)), Received: time.Now()}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(pkglog, "Inbox", &m, f)
+		})
+		return f, m, err
+	}
+
+	// Synchronous stores are done before the delivery completes, and a failed store
+	// fails the delivery.
+	fms.setMode(messageStoreSync, nil)
+	_, m, err = deliver()
+	tcheck(t, err, "deliver with sync store")
+	tcompare(t, fms.keys(), []string{fmt.Sprintf("mjl/%d", m.ID)})
+	fms.setMode(messageStoreSync, errors.New("store failed"))
+	if _, _, err := deliver(); err == nil {
+		t.Fatalf("deliver succeeded with failing store")
+	}
+	tcompare(t, len(fms.keys()), 1)
+
+	// Forwarded messages are removed locally after the store, the file of the
+	// caller remains.
+	fms.setMode(messageStoreForward, nil)
+	f, m, err := deliver()
+	tcheck(t, err, "deliver with forward")
+	tcompare(t, len(fms.keys()), 2)
+	if _, err := os.Stat(acc.MessagePath(m.ID)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("message file still present after store: %v", err)
+	}
+	_, err = os.Stat(f.Name())
+	tcheck(t, err, "stat message file of caller")
+	err = acc.DB.Get(ctxbg, &m)
+	tcheck(t, err, "get message")
+	tcompare(t, m.Expunged, true)
+
+	// When the transaction isn't committed after the store, the stored copy is
+	// removed, the message ID will be used again.
+	acc.WithWLock(func() {
+		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			m := Message{Size: int64(len(s)), Received: time.Now()}
+			mb, _, err := acc.MailboxEnsure(tx, "Inbox", true, SpecialUse{}, &m.ModSeq)
+			tcheck(t, err, "ensure mailbox")
+			m.CreateSeq = m.ModSeq
+			err = acc.MessageAdd(pkglog, tx, &mb, &m, writeTestMessage(t, s), AddOpts{})
+			tcheck(t, err, "add message")
+			tcompare(t, len(fms.keys()), 3)
+			return errors.New("abort")
+		})
+	})
+	if err == nil {
+		t.Fatalf("transaction not aborted")
+	}
+	wait(2)
+	// A committed delivery keeps its stored copy, also after the check.
+	_, _, err = deliver()
+	tcheck(t, err, "deliver after abort")
+	time.Sleep(50 * time.Millisecond)
+	tcompare(t, len(fms.keys()), 3)
+
+	// Without store mode, nothing is stored.
+	fms.setMode(messageStoreNone, nil)
+	_, _, err = deliver()
+	tcheck(t, err, "deliver without store")
+	time.Sleep(50 * time.Millisecond)
+	tcompare(t, len(fms.keys()), 3)
+
+	closeMessageStore(log)
+	tcompare(t, fms.closed, true)
+	tcompare(t, GetMessageStore() == nil, true)
+}
+
+func TestMessageStoreBudget(t *testing.T) {
+	log := mlog.New("store", nil)
+	orig := messageStoreSem
+	messageStoreSem = semaphore.NewWeighted(1)
+	defer func() { messageStoreSem = orig }()
+
+	// The first work takes the only slot and runs in the background.
+	release := make(chan struct{})
+	done := make(chan struct{})
+	ok := messageStoreGo(log, "test", func() {
+		<-release
+		close(done)
+	})
+	tcompare(t, ok, true)
+
+	// With the budget used up, work is dropped, not run synchronously while the
+	// caller may hold locks.
+	dropped := testutil.ToFloat64(metricMessageStoreDropped)
+	var ran bool
+	ok = messageStoreGo(log, "test", func() { ran = true })
+	tcompare(t, ok, false)
+	tcompare(t, ran, false)
+	tcompare(t, testutil.ToFloat64(metricMessageStoreDropped)-dropped, 1.0)
+
+	close(release)
+	<-done
+}
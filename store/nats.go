@@ -2,20 +2,48 @@ package store
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"math/rand"
 	"os"
-	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
 	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+var (
+	metricNATSStoresActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_stores_active",
+			Help: "Number of messages currently being stored in the NATS object store, over all store paths.",
+		},
+	)
+	metricNATSLocalOnly = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_nats_local_only_total",
+			Help: "Number of messages not stored in the NATS object store because they are smaller than MinStoreSize.",
+		},
+	)
 )
 
 // NATSClient manages the connection to NATS and object store operations
@@ -24,8 +52,86 @@ type NATSClient struct {
 	js     jetstream.JetStream
 	os     jetstream.ObjectStore
 	config *config.NATS
-	mu     sync.Mutex
 	log    mlog.Log
+
+	// Reports connectivity instead of conn if set, for tests without NATS server.
+	connected func() bool
+
+	// Limits the number of concurrent Puts. Acquired by StoreMessage, which all store
+	// paths (synchronous, asynchronous, pending queue) go through.
+	storeSem *semaphore.Weighted
+
+	// Limits the number of goroutines of NATS background work, see acquireGoroutine.
+	// The number currently running is in goroutines.
+	goSem      *semaphore.Weighted
+	goroutines atomic.Int64
+
+	// Set when bucket usage reached the configured warning threshold at the last
+	// capacity check.
+	nearlyFull atomic.Bool
+
+	// Set when the last health check failed, for logging changes.
+	unhealthy atomic.Bool
+
+	// Closed by Close, stops background goroutines of the client.
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// Set when MigrateFromBucket is configured.
+	migration *natsMigration
+
+	// Set when SyncPut is false.
+	batcher *natsPutBatcher
+
+	// Set when AsyncWorkers is configured.
+	async *natsAsyncPool
+
+	// Set when a key derivation is configured, for storing across buckets. The
+	// bucket of os is one of them.
+	shards *natsShards
+
+	// Buckets of accounts with AccountBuckets, by bucket name, opened on first use
+	// with openBucket.
+	accountBucketsMu sync.Mutex
+	accountBuckets   map[string]jetstream.ObjectStore
+	openBucket       func(ctx context.Context, bucket string) (jetstream.ObjectStore, error)
+
+	// Time in unix nanoseconds the last put to NATS finished, for detecting idle
+	// periods.
+	lastStore atomic.Int64
+
+	// From NATS.Transforms, applied in order when storing messages.
+	transforms []natsNamedTransform
+
+	// From NATS.MetadataKeyFile, for signing and verifying object metadata.
+	metadataKey []byte
+	// From EncryptionKeyFile and EncryptionPreviousKeyFiles, nil if not configured.
+	encryption *natsEncryptionKeys
+
+	// Set when OpenTelemetry is enabled.
+	otel *natsOTel
+
+	// Expiry per retention class, 0 for classes that never expire.
+	retention map[string]time.Duration
+
+	// Stores started by callers, for Close to wait for. Once storesClosed, new stores
+	// fail, and storesIdle is closed when storesActive reaches 0.
+	storesMu     sync.Mutex
+	storesClosed bool
+	storesActive int
+	storesIdle   chan struct{}
+
+	// With Dedup, serializes adding references to existing objects and removing
+	// objects with their last reference.
+	dedupMu sync.Mutex
+
+	// Earliest next retry of queued messages seen in the last pass of the retry
+	// loop, for making the next pass when it is due.
+	nextRetry natsNextRetry
+
+	// Channels registered with NotifyDurable.
+	durableMu      sync.Mutex
+	durableWaiters map[natsDurableKey][]chan NATSDurable
 }
 
 // Config returns the NATS configuration
@@ -36,55 +142,267 @@ func (nc *NATSClient) Config() *config.NATS {
 	return nc.config
 }
 
+// ErrNATSNotConfigured is returned by operations that need NATS when it isn't
+// configured.
+var ErrNATSNotConfigured = errors.New("nats not configured")
+
+// ErrMessageNotFound is returned when a message or object isn't present in the
+// NATS object store. Unlike transport errors, retrying won't help.
+var ErrMessageNotFound = errors.New("message not found in nats object store")
+
+// natsObjectError maps a not-found error from the object store to
+// ErrMessageNotFound, keeping the original error in the chain. Other errors are
+// returned as is. All operations looking up objects should pass errors through
+// it, so callers don't treat a missing object as a transport failure.
+func natsObjectError(err error) error {
+	if errors.Is(err, jetstream.ErrObjectNotFound) || errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return fmt.Errorf("%w: %w", ErrMessageNotFound, err)
+	}
+	return err
+}
+
 var (
-	globalNATSClient *NATSClient
-	natsOnce         sync.Once
+	// Serializes InitNATS and closeNATS.
+	natsInitMu sync.Mutex
+
+	// Config of globalNATSClient, for detecting config changes.
+	natsActiveConfig *config.NATS
+
+	// Protects globalNATSClient against concurrent replacement by InitNATS. Tests
+	// set it directly.
+	globalNATSClientMu sync.RWMutex
+	globalNATSClient   *NATSClient
+
+	// Creates the client in InitNATS, replaced in tests.
+	natsNewClient = newNATSClient
 )
 
-// InitNATS initializes the global NATS client if NATS is configured
+// InitNATS initializes the global NATS client if NATS is configured. It can be
+// called again, e.g. after a config change: when cfg differs from the config of
+// the current client, the current client is closed and a new one created, and the
+// retry loop is restarted, its queue directory may have changed. With the same
+// config, or when called again without NATS configured and without a current
+// client, nothing happens. Without NATS configured, a current client is closed.
 func InitNATS(log mlog.Log, cfg *config.NATS) error {
+	natsInitMu.Lock()
+	defer natsInitMu.Unlock()
+
 	if cfg == nil {
 		log.Debug("NATS not configured, skipping initialization")
+		if natsActiveConfig != nil {
+			closeNATSLocked(log)
+		}
+		return nil
+	}
+	if natsActiveConfig != nil && GetNATSClient() != nil && reflect.DeepEqual(*natsActiveConfig, *cfg) {
 		return nil
 	}
+	if natsActiveConfig != nil {
+		log.Info("NATS config changed, reconnecting")
+		closeNATSLocked(log)
+	}
 
-	var initErr error
-	natsOnce.Do(func() {
-		globalNATSClient, initErr = newNATSClient(log, cfg)
-	})
+	nc, initErr := natsNewClient(log, cfg)
+	c := *cfg
+	natsActiveConfig = &c
+	setNATSClient(nc)
+	// Also when creating the client failed, so messages queued before a restart are
+	// still reflected in the queue metrics.
+	startNATSPendingLoop(log, cfg)
 
 	return initErr
 }
 
+// NewNATSClient connects to NATS with cfg, for short-lived commands that use NATS
+// next to a running mox, e.g. for importing messages. Unlike InitNATS, the client
+// doesn't become the global client, and the retry loop isn't started: it would
+// take over the queue files of the running mox. Stores through the queue, e.g.
+// StoreMessageWithQueue, queue failed messages in the queue directory of cfg, for
+// the retry loop of mox. The caller must Close the client.
+func NewNATSClient(log mlog.Log, cfg *config.NATS) (*NATSClient, error) {
+	SetNATSQueueDir(cfg)
+	return newNATSClient(log, cfg)
+}
+
+// closeNATS stops the retry loop and closes the global NATS client, if any. A
+// later InitNATS creates a new client.
+func closeNATS(log mlog.Log) {
+	natsInitMu.Lock()
+	defer natsInitMu.Unlock()
+	closeNATSLocked(log)
+}
+
+// closeNATSLocked is closeNATS for callers holding natsInitMu.
+func closeNATSLocked(log mlog.Log) {
+	// Stop the retry loop before closing the client it stores through.
+	stopNATSPendingLoop()
+	nc := GetNATSClient()
+	setNATSClient(nil)
+	natsActiveConfig = nil
+	if err := nc.Close(); err != nil {
+		log.Errorx("closing NATS client", err)
+	}
+}
+
+// setNATSClient makes nc the global NATS client.
+func setNATSClient(nc *NATSClient) {
+	globalNATSClientMu.Lock()
+	defer globalNATSClientMu.Unlock()
+	globalNATSClient = nc
+}
+
 // GetNATSClient returns the global NATS client, or nil if not configured
 func GetNATSClient() *NATSClient {
+	globalNATSClientMu.RLock()
+	defer globalNATSClientMu.RUnlock()
 	return globalNATSClient
 }
 
-// newNATSClient creates a new NATS client with the given configuration
-func newNATSClient(log mlog.Log, cfg *config.NATS) (*NATSClient, error) {
-	client := &NATSClient{
-		config: cfg,
-		log:    log,
+// requestTimeout returns the configured timeout for object store operations.
+func (nc *NATSClient) requestTimeout() time.Duration {
+	if nc.config.RequestTimeout > 0 {
+		return nc.config.RequestTimeout
+	}
+	return 30 * time.Second
+}
+
+// slowStoreThreshold returns the duration from which stores are logged with the
+// time spent per stage.
+func (nc *NATSClient) slowStoreThreshold() time.Duration {
+	if nc.config.SlowStoreThreshold > 0 {
+		return nc.config.SlowStoreThreshold
+	}
+	return time.Second
+}
+
+// StoresMessage returns whether a message of size bytes is stored in NATS.
+// Messages smaller than MinStoreSize stay on disk only: the store functions skip
+// them, and they must be read from disk, not looked up in NATS.
+func (nc *NATSClient) StoresMessage(size int64) bool {
+	return nc != nil && size >= nc.config.MinStoreSize
+}
+
+// StoresSync returns whether messages delivered to mailbox are stored in NATS
+// synchronously, with the delivery waiting for the store and failing if it fails.
+// True for all mailboxes with DeleteAfterStore, otherwise for mailboxes listed in
+// SyncMailboxes and their children.
+func (nc *NATSClient) StoresSync(mailbox string) bool {
+	if nc == nil {
+		return false
+	}
+	if nc.config.DeleteAfterStore {
+		return true
+	}
+	for _, name := range nc.config.SyncMailboxes {
+		if strings.EqualFold(name, "Inbox") {
+			// Mailbox names are normalized, Inbox is always "Inbox".
+			name = "Inbox"
+		}
+		if mailbox == name || strings.HasPrefix(mailbox, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newNATSClientState returns a client with the state derived from cfg, but without
+// a connection to NATS.
+func newNATSClientState(log mlog.Log, cfg *config.NATS) *NATSClient {
+	maxStores := cfg.MaxConcurrentStores
+	if maxStores <= 0 {
+		maxStores = 8
+	}
+	maxGoroutines := cfg.MaxGoroutines
+	if maxGoroutines <= 0 {
+		maxGoroutines = natsDefaultMaxGoroutines
+	}
+	nc := &NATSClient{
+		config:   cfg,
+		log:      log,
+		storeSem: semaphore.NewWeighted(int64(maxStores)),
+		goSem:    semaphore.NewWeighted(int64(maxGoroutines)),
+		closing:  make(chan struct{}),
+	}
+	nc.lastStore.Store(time.Now().UnixNano())
+	nc.openBucket = func(ctx context.Context, bucket string) (jetstream.ObjectStore, error) {
+		return openNATSBucket(ctx, nc.log, nc.config, nc.js, bucket)
+	}
+	if cfg.OpenTelemetry {
+		nc.otel = newNATSOTel(log)
+	}
+	// Validated by newNATSClient.
+	nc.retention, _ = parseNATSRetentionClasses(cfg)
+	nc.transforms, _ = parseNATSTransforms(cfg)
+	nc.metadataKey, _ = readNATSMetadataKey(cfg)
+	nc.encryption, _ = readNATSEncryptionKeys(cfg)
+	if cfg.SyncPut != nil && !*cfg.SyncPut {
+		nc.batcher = newNATSPutBatcher(cfg.PutBatchSize)
 	}
+	if cfg.AsyncWorkers > 0 {
+		nc.async = newNATSAsyncPool(cfg.AsyncWorkers, cfg.AsyncQueueSize)
+	}
+	return nc
+}
+
+// natsServerURL returns the servers of URL and URLs of cfg, comma-separated as
+// nats.Connect accepts them, in configured order. URL and each of URLs can also
+// be a comma-separated list. Empty URLs are skipped.
+func natsServerURL(cfg *config.NATS) string {
+	var l []string
+	for _, s := range append([]string{cfg.URL}, cfg.URLs...) {
+		for _, u := range strings.Split(s, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				l = append(l, u)
+			}
+		}
+	}
+	return strings.Join(l, ",")
+}
+
+// natsConnectionName returns the name of the connection, for telling apart the
+// connections of mox instances in NATS monitoring.
+func natsConnectionName(cfg *config.NATS) string {
+	if cfg.ConnectionName != "" {
+		return cfg.ConnectionName
+	}
+	if h := mox.Conf.Static.HostnameDomain.ASCII; h != "" {
+		return "mox-email-server/" + h
+	}
+	return "mox-email-server"
+}
 
+// natsMaxReconnects returns the maximum number of reconnect attempts for cfg, -1
+// for unlimited.
+func natsMaxReconnects(cfg *config.NATS) int {
+	if cfg.MaxReconnects > 0 {
+		return cfg.MaxReconnects
+	}
+	return -1
+}
+
+// natsReconnectWait returns the time between reconnect attempts for cfg.
+func natsReconnectWait(cfg *config.NATS) time.Duration {
+	if cfg.ReconnectWait > 0 {
+		return cfg.ReconnectWait
+	}
+	return 2 * time.Second
+}
+
+// natsConnectOptions returns the options for connecting to NATS with cfg.
+func natsConnectOptions(log mlog.Log, cfg *config.NATS) ([]nats.Option, error) {
 	// Set default timeouts
 	connectTimeout := cfg.ConnectTimeout
 	if connectTimeout == 0 {
 		connectTimeout = 30 * time.Second
 	}
 
-	requestTimeout := cfg.RequestTimeout
-	if requestTimeout == 0 {
-		requestTimeout = 30 * time.Second
-	}
-
 	// Build connection options
 	opts := []nats.Option{
-		nats.Name("mox-email-server"),
+		nats.Name(natsConnectionName(cfg)),
 		nats.Timeout(connectTimeout),
-		nats.ReconnectWait(2 * time.Second),
-		nats.MaxReconnects(-1), // unlimited reconnects
+		nats.ReconnectWait(natsReconnectWait(cfg)),
+		nats.MaxReconnects(natsMaxReconnects(cfg)),
+		nats.DrainTimeout(natsDrainTimeout(cfg)),
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 			if err != nil {
 				log.Errorx("NATS disconnected", err)
@@ -96,25 +414,242 @@ func newNATSClient(log mlog.Log, cfg *config.NATS) (*NATSClient, error) {
 			log.Info("NATS reconnected", slog.String("url", nc.ConnectedUrl()))
 		}),
 		nats.ClosedHandler(func(nc *nats.Conn) {
-			log.Info("NATS connection closed")
+			if err := nc.LastError(); err != nil {
+				// E.g. after MaxReconnects failed attempts.
+				log.Errorx("NATS connection closed", err)
+			} else {
+				log.Info("NATS connection closed")
+			}
 		}),
 	}
 
-	// Add authentication options
+	if cfg.DontRandomize {
+		opts = append(opts, nats.DontRandomize())
+	}
+
+	// Liveness detection, library defaults when not configured.
+	if cfg.PingInterval > 0 {
+		opts = append(opts, nats.PingInterval(cfg.PingInterval))
+	}
+	if cfg.MaxPingsOut > 0 {
+		opts = append(opts, nats.MaxPingsOutstanding(cfg.MaxPingsOut))
+	}
+
+	tlsOpts, err := natsTLSOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, tlsOpts...)
+
+	authOpt, err := natsAuthOption(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if authOpt != nil {
+		opts = append(opts, authOpt)
+	}
+
+	return opts, nil
+}
+
+// natsAuthOption returns the option for the authentication method of cfg, or nil
+// without authentication. Configuring more than one method is an error.
+func natsAuthOption(cfg *config.NATS) (nats.Option, error) {
+	var methods []string
+	jwtAuth := cfg.UserJWT != "" || cfg.UserJWTFile != ""
+	if jwtAuth {
+		methods = append(methods, "UserJWT/UserJWTFile")
+	} else if cfg.NKeySeedFile != "" {
+		methods = append(methods, "NKeySeedFile")
+	}
 	if cfg.CredentialsFile != "" {
-		opts = append(opts, nats.UserCredentials(cfg.CredentialsFile))
-	} else if cfg.Token != "" {
-		opts = append(opts, nats.Token(cfg.Token))
-	} else if cfg.Username != "" {
-		opts = append(opts, nats.UserInfo(cfg.Username, cfg.Password))
+		methods = append(methods, "CredentialsFile")
+	}
+	if cfg.Token != "" {
+		methods = append(methods, "Token")
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		methods = append(methods, "Username/Password")
+	}
+	if len(methods) > 1 {
+		return nil, fmt.Errorf("conflicting nats authentication methods %s, configure only one", strings.Join(methods, ", "))
+	}
+
+	switch {
+	case jwtAuth:
+		return natsUserJWTOption(cfg)
+	case cfg.NKeySeedFile != "":
+		// The seed is read again for each signature, and not kept in memory.
+		opt, err := nats.NkeyOptionFromSeed(cfg.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading nkey seed: %w", err)
+		}
+		return opt, nil
+	case cfg.CredentialsFile != "":
+		return nats.UserCredentials(cfg.CredentialsFile), nil
+	case cfg.Token != "":
+		return nats.Token(cfg.Token), nil
+	case cfg.Username == "" && cfg.Password != "":
+		return nil, fmt.Errorf("nats password configured without username")
+	case cfg.Username != "":
+		return nats.UserInfo(cfg.Username, cfg.Password), nil
+	}
+	return nil, nil
+}
+
+// natsUserJWTOption returns the option for decentralized JWT authentication, with
+// the user JWT from UserJWT or UserJWTFile, and the nonce signed with the seed
+// from NKeySeedFile. Like for NKeySeedFile, the files are read for each
+// (re)connect, and checked now.
+func natsUserJWTOption(cfg *config.NATS) (nats.Option, error) {
+	if cfg.UserJWT != "" && cfg.UserJWTFile != "" {
+		return nil, fmt.Errorf("nats user jwt configured both inline and in file, configure only one")
+	} else if cfg.NKeySeedFile == "" {
+		return nil, fmt.Errorf("nats user jwt configured without NKeySeedFile for signing the server nonce")
+	}
+
+	userJWT := func() (string, error) {
+		s := cfg.UserJWT
+		if cfg.UserJWTFile != "" {
+			buf, err := os.ReadFile(cfg.UserJWTFile)
+			if err != nil {
+				return "", fmt.Errorf("reading nats user jwt file: %w", err)
+			}
+			s = string(buf)
+		}
+		s = strings.TrimSpace(s)
+		if strings.Count(s, ".") != 2 {
+			return "", fmt.Errorf("nats user jwt is not a jwt")
+		}
+		return s, nil
+	}
+	if _, err := userJWT(); err != nil {
+		return nil, err
+	}
+
+	// Only the signature callback is used, the public key of the user is in the JWT.
+	nkeyOpt, err := nats.NkeyOptionFromSeed(cfg.NKeySeedFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading nkey seed: %w", err)
+	}
+	var o nats.Options
+	if err := nkeyOpt(&o); err != nil {
+		return nil, fmt.Errorf("loading nkey seed: %w", err)
+	}
+	return nats.UserJWT(userJWT, o.SignatureCB), nil
+}
+
+// natsTLSOptions returns the options for TLS with the client certificate and CA
+// certificates of cfg. The files are loaded to check them, so mistakes show at
+// startup instead of as connection failures.
+func natsTLSOptions(cfg *config.NATS) ([]nats.Option, error) {
+	var opts []nats.Option
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("tls client certificate and key must be configured together")
+	}
+	if cfg.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+			return nil, fmt.Errorf("loading tls client certificate %s and key %s: %w", cfg.TLSCert, cfg.TLSKey, err)
+		}
+		opts = append(opts, nats.ClientCert(cfg.TLSCert, cfg.TLSKey))
+	}
+	if cfg.TLSCACert != "" {
+		buf, err := os.ReadFile(cfg.TLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading tls ca certificates: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates in tls ca certificates file %s", cfg.TLSCACert)
+		}
+		opts = append(opts, nats.RootCAs(cfg.TLSCACert))
+	}
+	return opts, nil
+}
+
+// checkNATSConfig checks the settings of cfg that don't need a connection to NATS.
+func checkNATSConfig(cfg *config.NATS) error {
+	if _, err := parseNATSRetentionClasses(cfg); err != nil {
+		return err
+	}
+	if _, err := parseNATSTransforms(cfg); err != nil {
+		return err
+	}
+	if err := checkNATSCompression(cfg); err != nil {
+		return err
+	}
+	if _, err := readNATSMetadataKey(cfg); err != nil {
+		return err
+	}
+	if _, err := readNATSEncryptionKeys(cfg); err != nil {
+		return err
+	}
+	switch cfg.ObjectStoreFallback {
+	case "", "fail", "stream":
+	default:
+		return fmt.Errorf("unknown object store fallback %q, must be fail or stream", cfg.ObjectStoreFallback)
+	}
+	switch cfg.OrphanAction {
+	case "", "report", "delete":
+	default:
+		return fmt.Errorf("unknown orphan action %q, must be report or delete", cfg.OrphanAction)
+	}
+	if cfg.OrphanAction != "" && cfg.DeleteAfterStore {
+		return fmt.Errorf("orphan scan not possible with DeleteAfterStore")
+	}
+	if err := checkNATSAccountBuckets(cfg); err != nil {
+		return err
+	}
+	if err := checkNATSDedup(cfg); err != nil {
+		return err
+	}
+	if cfg.RetryInterval < 0 || cfg.RetryErrorInterval < 0 {
+		return fmt.Errorf("retry interval and retry error interval must be positive")
+	}
+	if cfg.MaxReconnects < -1 || cfg.ReconnectWait < 0 {
+		return fmt.Errorf("max reconnects must be -1 or more, and reconnect wait positive")
+	}
+	if cfg.RetryJitter < 0 || cfg.RetryJitter > 90 {
+		return fmt.Errorf("retry jitter must be between 0 and 90 percent")
+	}
+	if err := checkNATSRetentionDays(cfg); err != nil {
+		return err
+	}
+	if natsServerURL(cfg) == "" {
+		return fmt.Errorf("nats server url required, configure URL or URLs")
+	}
+	return nil
+}
+
+// newNATSClient creates a new NATS client with the given configuration
+func newNATSClient(log mlog.Log, cfg *config.NATS) (*NATSClient, error) {
+	if err := checkNATSConfig(cfg); err != nil {
+		return nil, err
+	}
+	client := newNATSClientState(log, cfg)
+
+	opts, err := natsConnectOptions(log, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RetryOnFailedConnect {
+		// Not in natsConnectOptions, checking the configuration must not wait for a
+		// server to come up.
+		opts = append(opts,
+			nats.RetryOnFailedConnect(true),
+			nats.ConnectHandler(func(nc *nats.Conn) {
+				log.Info("NATS connected after retrying", slog.String("url", nc.ConnectedUrl()))
+			}))
 	}
 
 	// Connect to NATS
-	conn, err := nats.Connect(cfg.URL, opts...)
+	conn, err := nats.Connect(natsServerURL(cfg), opts...)
 	if err != nil {
 		return nil, fmt.Errorf("connecting to NATS: %w", err)
 	}
 	client.conn = conn
+	if !conn.IsConnected() {
+		log.Info("no NATS server reachable, retrying connect in background", slog.String("url", natsServerURL(cfg)))
+	}
 
 	// Create JetStream context
 	js, err := jetstream.New(conn)
@@ -125,61 +660,422 @@ func newNATSClient(log mlog.Log, cfg *config.NATS) (*NATSClient, error) {
 	client.js = js
 
 	// Create or get object store
-	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), client.requestTimeout())
 	defer cancel()
 
-	os, err := js.ObjectStore(ctx, cfg.BucketName)
+	stores := map[string]jetstream.ObjectStore{}
+	for _, bucket := range natsShardBuckets(cfg) {
+		if stores[bucket] != nil {
+			conn.Close()
+			return nil, fmt.Errorf("duplicate bucket %q", bucket)
+		}
+		os, err := openNATSBucket(ctx, log, cfg, js, bucket)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		stores[bucket] = os
+	}
+	client.os = stores[cfg.BucketName]
+	client.shards, err = newNATSShards(cfg, stores)
 	if err != nil {
-		// Try to create the bucket if it doesn't exist
-		if err == jetstream.ErrBucketNotFound {
-			log.Info("creating NATS object store bucket", slog.String("bucket", cfg.BucketName))
-			os, err = js.CreateObjectStore(ctx, jetstream.ObjectStoreConfig{
-				Bucket:      cfg.BucketName,
-				Description: "Email message storage for mox mail server",
-			})
+		conn.Close()
+		return nil, err
+	}
+
+	if cfg.MigrateFromBucket != "" {
+		if stores[cfg.MigrateFromBucket] != nil {
+			conn.Close()
+			return nil, fmt.Errorf("bucket %q to migrate from is also a bucket to store in", cfg.MigrateFromBucket)
+		}
+		var oldos jetstream.ObjectStore
+		if cfg.ObjectStoreFallback == "stream" {
+			// Possibly moving away from a fallback stream, to the object store.
+			oldos, err = openNATSStreamStore(ctx, js, cfg.MigrateFromBucket, false, 0)
+			if err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if oldos == nil {
+			oldos, err = js.ObjectStore(ctx, cfg.MigrateFromBucket)
 		}
 		if err != nil {
 			conn.Close()
-			return nil, fmt.Errorf("creating/accessing object store bucket %q: %w", cfg.BucketName, err)
+			return nil, fmt.Errorf("accessing object store bucket %q to migrate from: %w", cfg.MigrateFromBucket, err)
 		}
+		client.migration = newNATSMigration(cfg, oldos)
+		go client.migrationLoop()
+	}
+
+	if client.batcher != nil {
+		go client.putBatchLoop()
+	}
+	if client.async != nil {
+		client.startAsyncWorkers()
+	}
+	go client.capacityLoop()
+	go client.healthLoop()
+	go client.indexReconcileLoop()
+	if cfg.Keepalive > 0 {
+		go client.keepaliveLoop()
+	}
+	if cfg.OrphanAction != "" {
+		go client.orphanScanLoop()
+	}
+	if cfg.PublishIndex {
+		go client.publishIndexLoop()
 	}
-	client.os = os
 
 	log.Info("NATS client initialized",
-		slog.String("url", cfg.URL),
-		slog.String("bucket", cfg.BucketName))
+		slog.String("url", natsServerURL(cfg)),
+		slog.String("bucket", cfg.BucketName),
+		slog.Int("max_reconnects", natsMaxReconnects(cfg)),
+		slog.Duration("reconnect_wait", natsReconnectWait(cfg)),
+		slog.Duration("retry_interval", client.retryInterval(false)),
+		slog.Duration("retry_error_interval", client.retryInterval(true)))
 
 	return client, nil
 }
 
-// StoreMessage stores a message in the NATS object store
+// openNATSBucket returns the object store for bucket, creating it if it doesn't
+// exist. If the object store API isn't available and ObjectStoreFallback is
+// "stream", a fallback stream is returned instead. An existing fallback stream is
+// used as long as ObjectStoreFallback is "stream", so messages aren't split over
+// both when the object store becomes available.
+func openNATSBucket(ctx context.Context, log mlog.Log, cfg *config.NATS, js jetstream.JetStream, bucket string) (jetstream.ObjectStore, error) {
+	fallback := cfg.ObjectStoreFallback == "stream"
+	if fallback {
+		ss, err := openNATSStreamStore(ctx, js, bucket, false, 0)
+		if err == nil {
+			log.Warn("using nats fallback stream instead of object store, with limitations", slog.String("bucket", bucket))
+			return ss, nil
+		} else if !errors.Is(err, jetstream.ErrStreamNotFound) {
+			return nil, err
+		}
+	}
+
+	os, err := js.ObjectStore(ctx, bucket)
+	if err != nil {
+		// Try to create the bucket if it doesn't exist
+		if err == jetstream.ErrBucketNotFound {
+			log.Info("creating NATS object store bucket", slog.String("bucket", bucket))
+			os, err = js.CreateObjectStore(ctx, jetstream.ObjectStoreConfig{
+				Bucket:      bucket,
+				Description: "Email message storage for mox mail server",
+				TTL:         natsRetentionMaxAge(cfg.RetentionDays),
+			})
+		}
+	}
+	if err == nil {
+		return os, nil
+	}
+
+	if errors.Is(err, jetstream.ErrJetStreamNotEnabled) || errors.Is(err, jetstream.ErrJetStreamNotEnabledForAccount) {
+		// Core NATS doesn't persist messages, there is nothing to fall back to.
+		return nil, fmt.Errorf("creating/accessing object store bucket %q: %w (JetStream must be enabled on the NATS server and for the account)", bucket, err)
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+		// Don't start storing in a fallback stream for a server that is merely slow.
+		return nil, fmt.Errorf("creating/accessing object store bucket %q: %w", bucket, err)
+	} else if !fallback {
+		return nil, fmt.Errorf("creating/accessing object store bucket %q: %w (if the NATS server doesn't support the object store, set ObjectStoreFallback to stream for storing in a plain stream, with limitations)", bucket, err)
+	}
+	log.Errorx("nats object store not available, storing messages in fallback stream, with limitations", err, slog.String("bucket", bucket))
+	return openNATSStreamStore(ctx, js, bucket, true, natsRetentionMaxAge(cfg.RetentionDays))
+}
+
+// acquireStore waits for a slot for a Put, limited by MaxConcurrentStores. The
+// returned function must be called when the Put is done.
+func (nc *NATSClient) acquireStore(ctx context.Context) (func(), error) {
+	if err := nc.storeSem.Acquire(ctx, 1); err != nil {
+		return nil, fmt.Errorf("waiting for store slot: %w", err)
+	}
+	metricNATSStoresActive.Inc()
+	return func() {
+		metricNATSStoresActive.Dec()
+		nc.storeSem.Release(1)
+	}, nil
+}
+
+// StoreMessage stores a message in the NATS object store. With SyncPut disabled,
+// the message is added to the next batch of puts and StoreMessage returns without
+// waiting for the store to be confirmed. If the batch put fails, the message is
+// added to the pending queue. msgFile is never removed: with DeleteAfterStore,
+// MessageAdd removes its own message file once StoreMessageSync confirmed the
+// store, the caller's file stays with the caller.
 func (nc *NATSClient) StoreMessage(ctx context.Context, messageID int64, msgFile *os.File) error {
+	return nc.StoreMessageWithMeta(ctx, messageID, nil, msgFile)
+}
+
+// StoreMessageWithMeta is like StoreMessage, additionally storing headers, e.g.
+// From, Subject and Message-ID, in the object metadata, see
+// natsObjectHeaderMeta for the sanitizing of keys and values.
+func (nc *NATSClient) StoreMessageWithMeta(ctx context.Context, messageID int64, headers map[string]string, msgFile *os.File) error {
 	if nc == nil {
 		return nil // NATS not configured
 	}
+	if len(headers) > 0 {
+		ctx = withNATSHeaderMeta(ctx, natsObjectHeaderMeta(headers))
+	}
+	done, err := nc.beginStore()
+	if err != nil {
+		return err
+	}
+	defer done()
 
-	nc.mu.Lock()
-	defer nc.mu.Unlock()
+	fi, err := msgFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat message file: %w", err)
+	}
+	if !nc.StoresMessage(fi.Size()) {
+		nc.skipLocalOnly(messageID, fi.Size())
+		return nil
+	}
+	if nc.batcher != nil {
+		return nc.storeMessageBatch(ctx, messageID, msgFile, fi.Size(), false)
+	}
+	return nc.storeMessage(ctx, messageID, msgFile, fi.Size())
+}
 
-	// Generate object name using message ID and timestamp
-	objectName := fmt.Sprintf("msg-%d-%d", messageID, time.Now().Unix())
+// StoreMessageSync stores a message in the NATS object store, and waits for the
+// store to be confirmed, also with SyncPut disabled. A failed store is not queued,
+// the caller handles the failure, e.g. by failing the delivery.
+func (nc *NATSClient) StoreMessageSync(ctx context.Context, messageID int64, msgFile *os.File) error {
+	if nc == nil {
+		return nil // NATS not configured
+	}
+	done, err := nc.beginStore()
+	if err != nil {
+		return err
+	}
+	defer done()
 
-	// Seek to beginning of file
-	if _, err := msgFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("seeking to start of message file: %w", err)
+	fi, err := msgFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat message file: %w", err)
+	}
+	if !nc.StoresMessage(fi.Size()) {
+		nc.skipLocalOnly(messageID, fi.Size())
+		return nil
+	}
+	return nc.storeMessage(ctx, messageID, msgFile, fi.Size())
+}
+
+// storeMessage stores the size bytes of r as message in the object store, waiting
+// until the store is confirmed.
+func (nc *NATSClient) storeMessage(ctx context.Context, messageID int64, r io.ReaderAt, size int64) error {
+	if nc.batcher != nil {
+		return nc.storeMessageBatch(ctx, messageID, r, size, true)
 	}
 
+	start := time.Now()
+	release, err := nc.acquireStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return nc.putMessage(ctx, messageID, r, size, start)
+}
+
+// objectName returns a new name for an object or queue file of message
+// messageID: "msg-<id>-<unixnano>-<random>". Stores of the same message, e.g. a
+// retry racing an asynchronous store, get different names and don't overwrite
+// each other. See natsMessageIDFromObject for parsing.
+func objectName(messageID int64) string {
+	return fmt.Sprintf("msg-%d-%d-%08x", messageID, time.Now().UnixNano(), rand.Uint32())
+}
+
+// natsMessageIDFromObject returns the message ID an object or queue file was
+// stored for, from names made by objectName, or of the older "msg-<id>-<time>"
+// forms.
+func natsMessageIDFromObject(name string) (int64, bool) {
+	s, ok := strings.CutPrefix(name, "msg-")
+	if !ok {
+		return 0, false
+	}
+	ids, _, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(ids, 10, 64)
+	return id, err == nil && id > 0
+}
+
+// putMessage does the Put of a message. The store started at start, the time
+// until the call is logged as waiting for slow stores. Puts run concurrently, up
+// to MaxConcurrentStores, see acquireStore: the object store is safe for
+// concurrent use, and the state of the client used here is either set once at
+// initialization, atomic, or has its own lock.
+func (nc *NATSClient) putMessage(ctx context.Context, messageID int64, r io.ReaderAt, size int64, start time.Time) (rerr error) {
+	objectName := objectName(messageID)
+	if nc.config.Dedup {
+		if AuthDB == nil {
+			return fmt.Errorf("dedup needs auth.db for references to objects")
+		}
+		var err error
+		objectName, err = natsDedupObjectName(r, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	stages := newNATSStages(start)
+	stages.done("wait")
+	defer stages.logSlow(nc.log.WithContext(ctx), nc.slowStoreThreshold(),
+		slog.String("object_name", objectName),
+		slog.Int64("message_id", messageID),
+		slog.Int64("size", size))
+
+	ctx, endSpan := nc.startSpan(ctx, "store",
+		attribute.Int64("mox.message_id", messageID),
+		attribute.String("nats.object_name", objectName),
+		attribute.Int64("nats.size", size))
+	defer func() { endSpan(rerr) }()
+	defer func() {
+		if rerr != nil {
+			metrics.NATSStoreFailedInc()
+		} else {
+			metrics.NATSStoredInc(size)
+		}
+	}()
+
 	// Create object metadata
 	meta := jetstream.ObjectMeta{
 		Name:        objectName,
 		Description: fmt.Sprintf("Email message ID %d", messageID),
 	}
+	if nc.config.Dedup {
+		// Shared by messages, which are only in the dedup references.
+		meta.Description = "Email message content, shared by messages with identical content"
+	}
+	if class := natsRetentionClass(ctx); class != "" {
+		meta.Metadata = map[string]string{natsRetentionClassKey: class}
+	}
+	if account := messageAccount(ctx); account != "" && !nc.config.Dedup {
+		if meta.Metadata == nil {
+			meta.Metadata = map[string]string{}
+		}
+		meta.Metadata[natsAccountKey] = account
+	}
+	if threadID := nc.natsThreadIDMeta(ctx); threadID != "" {
+		if meta.Metadata == nil {
+			meta.Metadata = map[string]string{}
+		}
+		meta.Metadata[natsThreadIDKey] = threadID
+	}
+	if headers := natsHeaderMeta(ctx); len(headers) > 0 && !nc.config.Dedup {
+		if meta.Metadata == nil {
+			meta.Metadata = map[string]string{}
+		}
+		maps.Copy(meta.Metadata, headers)
+	}
+
+	var data io.Reader = io.NewSectionReader(r, 0, size)
+	if len(nc.transforms) > 0 {
+		tr, names, err := nc.transformStore(io.NopCloser(data))
+		if err != nil {
+			return fmt.Errorf("transforming message for NATS: %w", err)
+		}
+		defer tr.Close()
+		data = tr
+		if meta.Metadata == nil {
+			meta.Metadata = map[string]string{}
+		}
+		// Transforms run while streaming, time is counted in the put stage.
+		meta.Metadata[natsTransformsKey] = names
+	}
+	if algorithm := natsCompressionName(nc.config); algorithm != "" {
+		cr := natsCompress(data, algorithm)
+		defer cr.Close()
+		data = cr
+		if meta.Metadata == nil {
+			meta.Metadata = map[string]string{}
+		}
+		meta.Metadata[natsCompressionKey] = algorithm
+	}
+	if nc.encryption != nil && nc.encryption.id != "" {
+		if meta.Metadata == nil {
+			meta.Metadata = map[string]string{}
+		}
+		var err error
+		data, err = nc.encryption.encrypt(data, meta.Metadata)
+		if err != nil {
+			return fmt.Errorf("encrypting message for NATS: %w", err)
+		}
+	}
+
+	if nc.config.Dedup {
+		os, err := nc.objectBucket(ctx, objectName)
+		if err != nil {
+			return err
+		}
+		info, err := nc.natsDedupExisting(ctx, os, objectName, messageID)
+		stages.done("dedup")
+		if err != nil {
+			return err
+		} else if info != nil {
+			metricNATSDedupHits.Inc()
+			nc.natsStoreHeaders(context.WithoutCancel(ctx), messageID, objectName, r)
+			nc.confirmDurable(messageAccount(ctx), messageID, info)
+			nc.log.Debug("message content already stored in NATS, added reference",
+				slog.String("object_name", objectName),
+				slog.Int64("message_id", messageID))
+			return nil
+		}
+	}
 
 	// Store the message in object store
-	info, err := nc.os.Put(ctx, meta, msgFile)
+	ref := nc.natsIndexPending(ctx, messageID, objectName)
+	stages.done("index_pending")
+	t0 := time.Now()
+	os, err := nc.objectBucket(ctx, objectName)
+	if err != nil {
+		nc.natsIndexFailed(context.WithoutCancel(ctx), ref)
+		return err
+	}
+	// Digest of what is sent, after transforms, compression and encryption, to
+	// verify what NATS stored.
+	dr := newNATSDigestReader(data)
+	pctx, pcancel := context.WithTimeout(ctx, nc.storeTimeout(size))
+	info, err := os.Put(pctx, meta, dr)
+	pcancel()
+	nc.observeStore(t0, time.Since(t0))
+	stages.done("put")
 	if err != nil {
+		nc.natsIndexFailed(context.WithoutCancel(ctx), ref)
 		return fmt.Errorf("storing message in NATS object store: %w", err)
 	}
+	if err := dr.verify(info); err != nil {
+		// Don't leave a corrupt object behind, the message is stored again on retry.
+		derr := os.Delete(context.WithoutCancel(ctx), objectName)
+		nc.log.Check(derr, "removing object with mismatching digest", slog.String("object_name", objectName))
+		nc.natsIndexFailed(context.WithoutCancel(ctx), ref)
+		return err
+	}
+	meta, err = nc.signObject(ctx, os, info)
+	stages.done("sign")
+	if err != nil {
+		// Unsigned objects can't be read, don't leave one behind.
+		derr := os.Delete(context.WithoutCancel(ctx), objectName)
+		nc.log.Check(derr, "removing unsigned object after failed signing", slog.String("object_name", objectName))
+		nc.natsIndexFailed(context.WithoutCancel(ctx), ref)
+		return err
+	}
+	metricNATSBucketStores.WithLabelValues(info.Bucket).Inc()
+	nc.natsIndexStored(context.WithoutCancel(ctx), ref, messageID, info)
+	stages.done("index_stored")
+	if nc.config.Dedup {
+		if err := nc.natsDedupStored(context.WithoutCancel(ctx), os, objectName, messageID); err != nil {
+			return err
+		}
+	}
+	nc.migrateDualWrite(ctx, meta, info, r, size)
+	stages.done("dual_write")
+	nc.natsStoreHeaders(context.WithoutCancel(ctx), messageID, objectName, r)
+	stages.done("headers")
+	nc.confirmDurable(messageAccount(ctx), messageID, info)
+	stages.done("confirm")
 
 	nc.log.Debug("message stored in NATS",
 		slog.String("object_name", objectName),
@@ -190,133 +1086,261 @@ func (nc *NATSClient) StoreMessage(ctx context.Context, messageID int64, msgFile
 	return nil
 }
 
-// StoreMessageAsync stores a message in the NATS object store asynchronously
-// by copying the file data first to avoid "file already closed" errors
+// skipLocalOnly records that a message is not stored in NATS because it is
+// smaller than MinStoreSize.
+func (nc *NATSClient) skipLocalOnly(messageID, size int64) {
+	metricNATSLocalOnly.Inc()
+	nc.log.Debug("message below minimum store size, keeping on disk only",
+		slog.Int64("message_id", messageID),
+		slog.Int64("size", size))
+}
+
+// StoreMessageAsync stores a message in the NATS object store asynchronously. The
+// message file is opened again by name before returning, and the message is
+// streamed from that file: the caller may close and remove msgFile as soon as
+// StoreMessageAsync returns, the open file keeps the data available until the
+// store is done. Failed stores are queued for retry.
 func (nc *NATSClient) StoreMessageAsync(ctx context.Context, messageID int64, msgFile *os.File) {
 	if nc == nil {
 		return // NATS not configured
 	}
-	if _, err := msgFile.Seek(0, 0); err != nil {
-		nc.log.Errorx("seeking to start of message file for async NATS storage", err, slog.Int64("message_id", messageID))
+	f, err := os.Open(msgFile.Name())
+	if err != nil {
+		nc.log.Errorx("opening message file for async NATS storage", err, slog.Int64("message_id", messageID))
 		return
 	}
-	data, err := os.ReadFile(msgFile.Name())
+	fclose := func() {
+		err := f.Close()
+		nc.log.Check(err, "closing message file after async NATS storage", slog.Int64("message_id", messageID))
+	}
+	fi, err := f.Stat()
 	if err != nil {
-		nc.log.Errorx("reading message file for async NATS storage", err, slog.Int64("message_id", messageID))
+		nc.log.Errorx("stat message file for async NATS storage", err, slog.Int64("message_id", messageID))
+		fclose()
 		return
 	}
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-		// Use StoreMessageWithQueue for retry logic
-		f, err := os.CreateTemp("", "nats-tmp-async-*.eml")
-		if err != nil {
-			nc.log.Errorx("cannot create temp file for async NATS storage", err)
-			return
-		}
-		_, err = f.Write(data)
-		if err == nil {
-			f.Seek(0, 0)
-			nc.StoreMessageWithQueue(ctx, messageID, f)
+	size := fi.Size()
+	if !nc.StoresMessage(size) {
+		nc.skipLocalOnly(messageID, size)
+		fclose()
+		return
+	}
+	// The store outlives the caller, only keep the retention class, account and
+	// thread ID of its context.
+	class := natsRetentionClass(ctx)
+	account := messageAccount(ctx)
+	threadID := natsThreadID(ctx)
+	done, err := nc.beginStore()
+	if err != nil {
+		// Closing, the local message is kept, store it after the next start.
+		defer fclose()
+		err := queueNATSRetry(ctx, messageID, f, size)
+		nc.log.Check(err, "queueing message for NATS storage during shutdown", slog.Int64("message_id", messageID))
+		return
+	}
+	j := &natsAsyncStore{messageID: messageID, class: class, account: account, threadID: threadID, f: f, size: size, done: done, close: fclose}
+	if nc.async != nil {
+		if !nc.async.trySubmit(j) {
+			// Queue full, or closing. The retry loop stores the message soon.
+			metricNATSAsyncQueueFull.Inc()
+			nc.log.Debug("async NATS store queue full, queueing", slog.Int64("message_id", messageID))
+			nc.queueAsyncStore(ctx, j)
 		}
-		f.Close()
-		os.Remove(f.Name())
+		return
+	}
+	release, ok := nc.tryAcquireGoroutine()
+	if !ok {
+		// Too much NATS work in progress, don't add to it, the retry loop stores the
+		// message soon.
+		metricNATSGoroutineBudgetQueued.Inc()
+		nc.log.Debug("no goroutine available for async NATS store, queueing", slog.Int64("message_id", messageID))
+		nc.queueAsyncStore(ctx, j)
+		return
+	}
+	go func() {
+		defer release()
+		nc.storeAsync(j)
 	}()
 }
 
-// Close closes the NATS connection
-func (nc *NATSClient) Close() error {
-	if nc == nil || nc.conn == nil {
-		return nil
+// RenameObject gives object oldName the name newName. The object store has no
+// native rename, so the object is copied to newName, the copy is verified against
+// the original, and only then is oldName deleted. On failure before the delete,
+// oldName is left intact and an unverified copy is removed. If deleting oldName
+// fails, both objects exist, and an error is returned.
+func (nc *NATSClient) RenameObject(ctx context.Context, oldName, newName string) error {
+	if nc == nil {
+		return ErrNATSNotConfigured
+	}
+	if oldName == newName {
+		return fmt.Errorf("old and new object name are the same")
+	}
+
+	oldos := nc.bucketFor(oldName)
+	newos := nc.bucketFor(newName)
+	if _, err := newos.GetInfo(ctx, newName); err == nil {
+		return fmt.Errorf("object %q already exists", newName)
+	} else if !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return fmt.Errorf("checking for existing object %q: %w", newName, err)
+	}
+
+	release, err := nc.acquireStore(ctx)
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	nc.mu.Lock()
-	defer nc.mu.Unlock()
+	r, err := oldos.Get(ctx, oldName)
+	if err != nil {
+		return fmt.Errorf("getting object %q: %w", oldName, natsObjectError(err))
+	}
+	defer r.Close()
+	oinfo, err := r.Info()
+	if err != nil {
+		return fmt.Errorf("getting info for object %q: %w", oldName, err)
+	}
+
+	if err := nc.verifyObject(oinfo); err != nil {
+		return err
+	}
+
+	meta := oinfo.ObjectMeta
+	meta.Name = newName
+	meta.Opts = nil
+	ninfo, err := newos.Put(ctx, meta, r)
+	if err == nil && (ninfo.Size != oinfo.Size || ninfo.Digest != oinfo.Digest) {
+		err = fmt.Errorf("copy does not match original (size %d, digest %s, expected size %d, digest %s)", ninfo.Size, ninfo.Digest, oinfo.Size, oinfo.Digest)
+	}
+	if err == nil {
+		// The signature covers the name.
+		_, err = nc.signObject(ctx, newos, ninfo)
+	}
+	if err != nil {
+		if ninfo != nil {
+			derr := newos.Delete(ctx, newName)
+			nc.log.Check(derr, "removing unverified copy of object after failed rename", slog.String("object_name", newName))
+		}
+		return fmt.Errorf("copying object %q to %q: %w", oldName, newName, err)
+	}
 
-	nc.conn.Close()
+	if err := oldos.Delete(ctx, oldName); err != nil {
+		return fmt.Errorf("deleting object %q after copy to %q: %w", oldName, newName, err)
+	}
+
+	nc.log.Debug("object renamed in NATS",
+		slog.String("old_name", oldName),
+		slog.String("new_name", newName),
+		slog.Uint64("size", ninfo.Size))
 	return nil
 }
 
-// IsConnected returns true if the NATS client is connected
-func (nc *NATSClient) IsConnected() bool {
-	if nc == nil || nc.conn == nil {
-		return false
+// stop signals background goroutines of the client to stop. Called once.
+func (nc *NATSClient) stop() {
+	close(nc.closing)
+	if nc.batcher != nil {
+		nc.batcher.close()
+	}
+	if nc.async != nil {
+		nc.async.close()
 	}
-	return nc.conn.IsConnected()
 }
 
-const pendingNATSDir = "store/tmp/nats-pending"
+// Close closes the NATS connection. New stores fail with ErrNATSClosed. Stores in
+// progress, including batched puts and asynchronous stores waiting for a worker,
+// are waited for, at most ShutdownTimeout. The connection is then drained, at most
+// DrainTimeout, so in-flight operations finish, and closed, failing remaining
+// stores. See CloseContext for also flushing the pending queue.
+func (nc *NATSClient) Close() error {
+	if nc == nil {
+		return nil
+	}
+	nc.closeOnce.Do(nc.stop)
 
-func init() {
-	os.MkdirAll(pendingNATSDir, 0o700)
-	go processPendingNATSLoop()
+	ctx, cancel := context.WithTimeout(context.Background(), nc.shutdownTimeout())
+	defer cancel()
+	if nc.batcher != nil {
+		select {
+		case <-nc.batcher.done:
+		case <-ctx.Done():
+		}
+	}
+	if nc.async != nil && !nc.async.wait(ctx) {
+		nc.log.Info("NATS async stores in queue not finished before deadline, closing")
+	}
+	if !nc.closeStores(ctx) {
+		nc.log.Info("NATS stores in progress not finished before deadline, closing")
+	}
+
+	if nc.conn != nil {
+		dctx, dcancel := context.WithTimeout(context.Background(), natsDrainTimeout(nc.config))
+		defer dcancel()
+		drainNATSConn(dctx, nc.log, nc.conn)
+	}
+	return nil
 }
 
-// StoreMessageWithQueue tries to store in NATS, and if it fails, queues locally for retry.
-func (nc *NATSClient) StoreMessageWithQueue(ctx context.Context, messageID int64, msgFile *os.File) error {
+// CloseContext finishes stores in progress, including batched puts and
+// asynchronous stores waiting for a worker, flushes the pending queue to NATS,
+// drains the NATS connection and closes it, giving up when ctx is done. Used for
+// a graceful shutdown, e.g. on SIGTERM in container deployments. Returns the
+// number of queued messages that were stored, and the number left in the queue
+// for the next start.
+func (nc *NATSClient) CloseContext(ctx context.Context) (flushed, abandoned int, rerr error) {
 	if nc == nil {
-		return nil // NATS not configured
+		return 0, 0, nil
 	}
+	nc.closeOnce.Do(nc.stop)
 
-	err := nc.StoreMessage(ctx, messageID, msgFile)
-	if err == nil {
-		return nil
+	if nc.batcher != nil {
+		select {
+		case <-nc.batcher.done:
+		case <-ctx.Done():
+			nc.log.Info("NATS batch puts not finished before deadline")
+		}
+	}
+	// Async stores still waiting for a worker are stored, not left for the queue.
+	if nc.async != nil && !nc.async.wait(ctx) {
+		nc.log.Info("NATS async stores in queue not finished before deadline")
 	}
 
-	nc.log.Errorx("NATS store failed, queueing for retry", err, slog.Int64("message_id", messageID))
-	// Save to local queue
-	if _, errSeek := msgFile.Seek(0, 0); errSeek != nil {
-		return fmt.Errorf("seek for queue: %w", errSeek)
+	// Stores by callers are done before flushing, failed ones are then in the queue.
+	if !nc.closeStores(ctx) {
+		nc.log.Info("NATS stores in progress not finished before deadline")
 	}
-	queueName := filepath.Join(pendingNATSDir, fmt.Sprintf("msg-%d-%d-%d", messageID, time.Now().UnixNano(), rand.Intn(10000)))
-	out, errCreate := os.OpenFile(queueName, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
-	if errCreate != nil {
-		return fmt.Errorf("create queue file: %w", errCreate)
+
+	flushed, rerr = processPendingNATS(ctx, nc)
+	abandoned = countPendingNATS()
+	nc.log.Info("flushed NATS pending queue for shutdown", slog.Int("flushed", flushed), slog.Int("abandoned", abandoned))
+
+	if nc.conn == nil {
+		return flushed, abandoned, rerr
 	}
-	defer out.Close()
-	if _, errCopy := io.Copy(out, msgFile); errCopy != nil {
-		return fmt.Errorf("copy to queue: %w", errCopy)
+	dctx, dcancel := context.WithTimeout(ctx, natsDrainTimeout(nc.config))
+	defer dcancel()
+	drainNATSConn(dctx, nc.log, nc.conn)
+	return flushed, abandoned, rerr
+}
+
+// CloseNATS flushes and closes the global NATS client, for shutting down mox. It
+// waits at most NATS.ShutdownTimeout.
+func CloseNATS(log mlog.Log) {
+	nc := GetNATSClient()
+	if nc == nil {
+		return
 	}
-	return err
+	ctx, cancel := context.WithTimeout(context.Background(), nc.shutdownTimeout())
+	defer cancel()
+	_, _, err := nc.CloseContext(ctx)
+	log.Check(err, "flushing NATS pending queue during shutdown")
 }
 
-// processPendingNATSLoop runs forever, retrying to send queued messages to NATS.
-func processPendingNATSLoop() {
-	for {
-		files, err := os.ReadDir(pendingNATSDir)
-		if err != nil {
-			time.Sleep(10 * time.Second)
-			continue
-		}
-		for _, f := range files {
-			if f.IsDir() {
-				continue
-			}
-			path := filepath.Join(pendingNATSDir, f.Name())
-			// Parse messageID from filename
-			var messageID int64
-			_, err := fmt.Sscanf(f.Name(), "msg-%d-", &messageID)
-			if err != nil {
-				continue // skip malformed
-			}
-			client := GetNATSClient()
-			if client == nil || !client.IsConnected() {
-				break // Wait for NATS
-			}
-			file, err := os.Open(path)
-			if err != nil {
-				continue
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			storeErr := client.StoreMessage(ctx, messageID, file)
-			file.Close()
-			cancel()
-			if storeErr == nil {
-				os.Remove(path)
-			} else {
-				// Log and try later
-			}
-		}
-		time.Sleep(30 * time.Second)
+// IsConnected returns true if the NATS client is connected
+func (nc *NATSClient) IsConnected() bool {
+	if nc == nil || nc.os == nil {
+		return false
+	}
+	if nc.connected != nil {
+		return nc.connected()
 	}
+	return nc.conn != nil && nc.conn.IsConnected()
 }
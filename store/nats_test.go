@@ -1,12 +1,66 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
 )
 
+func TestNATSNoInitSideEffects(t *testing.T) {
+	if natsPendingLoopStarted.Load() {
+		t.Skip("retry loop already started by earlier test run")
+	}
+
+	// Importing the package, or initializing without NATS configured, must not create
+	// the pending directory or start the retry loop.
+	os.RemoveAll(pendingNATSDir)
+	defer os.MkdirAll(pendingNATSDir, 0o700)
+	err := InitNATS(pkglog, nil)
+	tcheck(t, err, "init without nats")
+	if _, err := os.Stat(pendingNATSDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("pending directory exists, stat err %v", err)
+	}
+	tcompare(t, natsPendingLoopStarted.Load(), false)
+	if strings.Contains(allGoroutines(), "processPendingNATSLoop") {
+		t.Fatalf("retry loop running without nats configured")
+	}
+}
+
+// allGoroutines returns the stacks of all goroutines.
+func allGoroutines() string {
+	buf := make([]byte, 1<<20)
+	return string(buf[:runtime.Stack(buf, true)])
+}
+
 func TestNATSClientInit(t *testing.T) {
 	log := mlog.New("nats-test", nil)
 
@@ -21,10 +75,14 @@ func TestNATSClientInit(t *testing.T) {
 		t.Fatal("GetNATSClient should return nil when NATS is not configured")
 	}
 
-	// Test with invalid config (should not fail startup)
+	// Test with invalid config (should not fail startup). The queue directory stays
+	// where the other tests expect it.
+	queueDir, err := filepath.Abs(pendingNATSDir)
+	tcheck(t, err, "absolute queue dir")
 	invalidConfig := &config.NATS{
 		URL:        "nats://invalid-server:4222",
 		BucketName: "test-bucket",
+		QueueDir:   queueDir,
 	}
 
 	err = InitNATS(log, invalidConfig)
@@ -37,17 +95,114 @@ func TestNATSClientInit(t *testing.T) {
 	if client := GetNATSClient(); client != nil && client.IsConnected() {
 		t.Fatal("IsConnected should return false for invalid config")
 	}
+
+	// With NATS configured, the retry loop is started, also when connecting failed.
+	tcompare(t, natsPendingLoopStarted.Load(), true)
+	tcompare(t, pendingNATSDir, queueDir)
 }
 
 func TestNATSStoreMessage(t *testing.T) {
 	// Test StoreMessage with nil client (NATS not configured)
 	client := GetNATSClient()
-	
+
 	// This should not panic and return nil (graceful handling)
 	err := client.StoreMessage(nil, 123, nil)
 	if err != nil {
 		t.Fatalf("StoreMessage with nil client should return nil: %v", err)
 	}
+
+	// Storing the same message twice, e.g. a retry racing an asynchronous store,
+	// keeps both objects.
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	err = nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "first"))
+	tcheck(t, err, "store message")
+	err = nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "second"))
+	tcheck(t, err, "store message again")
+	names := fos.names()
+	tcompare(t, len(names), 2)
+	for _, name := range names {
+		id, ok := natsMessageIDFromObject(name)
+		tcompare(t, ok, true)
+		tcompare(t, id, int64(1))
+	}
+}
+
+func TestNATSStoreMessageAsync(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// The caller can close and remove its file right after StoreMessageAsync
+	// returns, the message is still stored.
+	proceed := make(chan struct{})
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		<-proceed
+		return nil
+	}
+	f := writeTestMessage(t, "test message")
+	nc.StoreMessageAsync(ctxbg, 1, f)
+	err := f.Close()
+	tcheck(t, err, "close message file")
+	err = os.Remove(f.Name())
+	tcheck(t, err, "remove message file")
+	close(proceed)
+
+	tcompare(t, nc.closeStores(ctxbg), true)
+	names := fos.names()
+	tcompare(t, len(names), 1)
+	tcompare(t, string(fos.objects[names[0]].data), "test message")
+}
+
+func TestNATSReinit(t *testing.T) {
+	// Start from no client, and leave none behind.
+	closeNATS(pkglog)
+	defer closeNATS(pkglog)
+	origNew := natsNewClient
+	defer func() { natsNewClient = origNew }()
+	var created int
+	natsNewClient = func(log mlog.Log, cfg *config.NATS) (*NATSClient, error) {
+		created++
+		return newTestNATSClient(cfg, newFakeObjectStore()), nil
+	}
+
+	queueDir, err := filepath.Abs(pendingNATSDir)
+	tcheck(t, err, "absolute queue dir")
+	cfg := config.NATS{URL: "nats://localhost:4222", BucketName: "test-bucket", QueueDir: queueDir}
+	err = InitNATS(pkglog, &cfg)
+	tcheck(t, err, "init nats")
+	first := GetNATSClient()
+	tcompare(t, created, 1)
+
+	// The same config again, e.g. on reload, keeps the client.
+	same := cfg
+	err = InitNATS(pkglog, &same)
+	tcheck(t, err, "init nats with same config")
+	tcompare(t, created, 1)
+	tcompare(t, GetNATSClient() == first, true)
+
+	// A changed config replaces the client, the old one is closed.
+	cfg.RequestTimeout = time.Minute
+	err = InitNATS(pkglog, &cfg)
+	tcheck(t, err, "init nats with changed config")
+	tcompare(t, created, 2)
+	second := GetNATSClient()
+	tcompare(t, second != first, true)
+	tcompare(t, second.Config().RequestTimeout, time.Minute)
+	tcompare(t, natsPendingLoopStarted.Load(), true)
+	err = first.StoreMessage(ctxbg, 1, writeTestMessage(t, "test"))
+	if !errors.Is(err, ErrNATSClosed) {
+		t.Fatalf("got err %v, expected ErrNATSClosed for replaced client", err)
+	}
+
+	// Without NATS configured, the client is closed.
+	err = InitNATS(pkglog, nil)
+	tcheck(t, err, "init without nats")
+	tcompare(t, GetNATSClient() == nil, true)
+	tcompare(t, natsPendingLoopStarted.Load(), false)
+	err = second.StoreMessage(ctxbg, 1, writeTestMessage(t, "test"))
+	if !errors.Is(err, ErrNATSClosed) {
+		t.Fatalf("got err %v, expected ErrNATSClosed for closed client", err)
+	}
 }
 
 func TestNATSConfig(t *testing.T) {
@@ -57,7 +212,7 @@ func TestNATSConfig(t *testing.T) {
 	if cfg != nil {
 		t.Fatal("Config should return nil for nil client")
 	}
-	
+
 	// Test with valid config
 	log := mlog.New("nats-test", nil)
 	testConfig := &config.NATS{
@@ -65,15 +220,876 @@ func TestNATSConfig(t *testing.T) {
 		BucketName:       "test-bucket",
 		DeleteAfterStore: true,
 	}
-	
+
 	// This will fail to connect but should still store config
 	err := InitNATS(log, testConfig)
 	if err != nil {
 		t.Logf("Expected connection error: %v", err)
 	}
-	
+
 	// Even with failed connection, we should be able to test config structure
 	if testConfig.DeleteAfterStore != true {
 		t.Fatal("DeleteAfterStore should be true")
 	}
 }
+
+// fakeObjectStore is an in-memory jetstream.ObjectStore for tests. Methods that
+// are not implemented panic through the nil embedded interface.
+type fakeObjectStore struct {
+	jetstream.ObjectStore
+
+	sync.Mutex
+	bucket  string
+	objects map[string]fakeObject
+
+	// Called at the start of Put, can block or return an error to fail the Put.
+	putHook func(meta jetstream.ObjectMeta) error
+
+	// If set, Put stores data with its first byte modified.
+	putCorrupt bool
+
+	// Called at the start of Delete, can return an error to fail the Delete.
+	deleteHook func(name string) error
+
+	// Reported by Status. If used is 0, the size of the objects is reported.
+	maxBytes int64
+	used     uint64
+
+	// Number of calls to Status.
+	statusCalls int
+
+	// Number of calls to List.
+	listCalls int
+
+	// If set, returned by List.
+	listErr error
+
+	// If set, returned by Status.
+	statusErr error
+
+	// Reported by Status.
+	sealed bool
+
+	// If set, wraps the reader of objects returned by Get.
+	getWrap func(r io.Reader) io.Reader
+}
+
+type fakeObject struct {
+	info jetstream.ObjectInfo
+	data []byte
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{bucket: "test-bucket", objects: map[string]fakeObject{}}
+}
+
+func (s *fakeObjectStore) Put(ctx context.Context, meta jetstream.ObjectMeta, r io.Reader) (*jetstream.ObjectInfo, error) {
+	if s.putHook != nil {
+		if err := s.putHook(meta); err != nil {
+			return nil, err
+		}
+		// The hook may have blocked, e.g. until a store is cancelled.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if s.putCorrupt && len(data) > 0 {
+		data[0]++
+	}
+	sum := sha256.Sum256(data)
+	info := jetstream.ObjectInfo{
+		ObjectMeta: meta,
+		Bucket:     s.bucket,
+		NUID:       fmt.Sprintf("nuid-%s", meta.Name),
+		Size:       uint64(len(data)),
+		ModTime:    time.Now(),
+		Digest:     "SHA-256=" + base64.URLEncoding.EncodeToString(sum[:]),
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.objects[meta.Name] = fakeObject{info, data}
+	return &info, nil
+}
+
+func (s *fakeObjectStore) GetInfo(ctx context.Context, name string, opts ...jetstream.GetObjectInfoOpt) (*jetstream.ObjectInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.objects[name]
+	if !ok {
+		return nil, jetstream.ErrObjectNotFound
+	}
+	info := o.info
+	return &info, nil
+}
+
+func (s *fakeObjectStore) Get(ctx context.Context, name string, opts ...jetstream.GetObjectOpt) (jetstream.ObjectResult, error) {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.objects[name]
+	if !ok {
+		return nil, jetstream.ErrObjectNotFound
+	}
+	info := o.info
+	var r io.Reader = bytes.NewReader(o.data)
+	if s.getWrap != nil {
+		r = s.getWrap(r)
+	}
+	return &fakeObjectResult{io.NopCloser(r), &info}, nil
+}
+
+func (s *fakeObjectStore) Delete(ctx context.Context, name string) error {
+	if s.deleteHook != nil {
+		if err := s.deleteHook(name); err != nil {
+			return err
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return jetstream.ErrObjectNotFound
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *fakeObjectStore) UpdateMeta(ctx context.Context, name string, meta jetstream.ObjectMeta) error {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.objects[name]
+	if !ok {
+		return jetstream.ErrUpdateMetaDeleted
+	}
+	o.info.ObjectMeta = meta
+	s.objects[name] = o
+	return nil
+}
+
+func (s *fakeObjectStore) List(ctx context.Context, opts ...jetstream.ListObjectsOpt) ([]*jetstream.ObjectInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.listCalls++
+	if s.listErr != nil {
+		return nil, s.listErr
+	}
+	var l []*jetstream.ObjectInfo
+	for _, o := range s.objects {
+		info := o.info
+		l = append(l, &info)
+	}
+	if len(l) == 0 {
+		return nil, jetstream.ErrNoObjectsFound
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return l, nil
+}
+
+// Watch only sends the current objects, followed by nil, in an unbuffered
+// channel, like a watcher on a large bucket that is read while listing.
+func (s *fakeObjectStore) Watch(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.ObjectWatcher, error) {
+	l, err := s.List(ctx)
+	if err != nil && !errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil, err
+	}
+	w := &fakeObjectWatcher{updates: make(chan *jetstream.ObjectInfo), stop: make(chan struct{})}
+	go func() {
+		for _, info := range append(l, nil) {
+			select {
+			case w.updates <- info:
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+type fakeObjectWatcher struct {
+	updates chan *jetstream.ObjectInfo
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func (w *fakeObjectWatcher) Updates() <-chan *jetstream.ObjectInfo {
+	return w.updates
+}
+
+func (w *fakeObjectWatcher) Stop() error {
+	w.once.Do(func() { close(w.stop) })
+	return nil
+}
+
+func (s *fakeObjectStore) Status(ctx context.Context) (jetstream.ObjectStoreStatus, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.statusCalls++
+	if s.statusErr != nil {
+		return nil, s.statusErr
+	}
+	used := s.used
+	if used == 0 {
+		for _, o := range s.objects {
+			used += o.info.Size
+		}
+	}
+	si := &jetstream.StreamInfo{
+		Config: jetstream.StreamConfig{Name: "OBJ_" + s.bucket, MaxBytes: s.maxBytes, Sealed: s.sealed},
+		State:  jetstream.StreamState{Bytes: used},
+	}
+	return fakeObjectStoreStatus{bucket: s.bucket, si: si}, nil
+}
+
+type fakeObjectStoreStatus struct {
+	jetstream.ObjectStoreStatus
+	bucket string
+	si     *jetstream.StreamInfo
+}
+
+func (s fakeObjectStoreStatus) Bucket() string                    { return s.bucket }
+func (s fakeObjectStoreStatus) Size() uint64                      { return s.si.State.Bytes }
+func (s fakeObjectStoreStatus) StreamInfo() *jetstream.StreamInfo { return s.si }
+func (s fakeObjectStoreStatus) Sealed() bool                      { return s.si.Config.Sealed }
+
+// names returns the sorted names of all objects.
+func (s *fakeObjectStore) names() []string {
+	s.Lock()
+	defer s.Unlock()
+	var l []string
+	for name := range s.objects {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+type fakeObjectResult struct {
+	io.ReadCloser
+	info *jetstream.ObjectInfo
+}
+
+func (r *fakeObjectResult) Info() (*jetstream.ObjectInfo, error) {
+	return r.info, nil
+}
+
+func (r *fakeObjectResult) Error() error {
+	return nil
+}
+
+// newTestNATSClient returns a client storing into fos, without NATS connection.
+func newTestNATSClient(cfg *config.NATS, fos jetstream.ObjectStore) *NATSClient {
+	if cfg == nil {
+		cfg = &config.NATS{BucketName: "test-bucket"}
+	}
+	nc := newNATSClientState(pkglog, cfg)
+	nc.os = fos
+	nc.connected = func() bool { return true }
+	if nc.batcher != nil {
+		go nc.putBatchLoop()
+	}
+	if nc.async != nil {
+		nc.startAsyncWorkers()
+	}
+	return nc
+}
+
+// writeTestMessage writes data to a new file in t's temp dir, returning the file
+// opened for reading and writing.
+func writeTestMessage(t *testing.T, data string) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "msg-*.eml")
+	tcheck(t, err, "create message file")
+	_, err = f.WriteString(data)
+	tcheck(t, err, "write message file")
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestNATSStoreConcurrencyLimit(t *testing.T) {
+	const limit = 2
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", MaxConcurrentStores: limit}, fos)
+
+	var active, maxActive atomic.Int32
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+
+	// Queue a few messages for the pending loop.
+	os.MkdirAll(pendingNATSDir, 0o700)
+	for i := range 3 {
+		p := filepath.Join(pendingNATSDir, fmt.Sprintf("msg-%d-1-1", 100+i))
+		err := os.WriteFile(p, []byte("queued"), 0o600)
+		tcheck(t, err, "write pending file")
+		defer os.Remove(p)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := nc.StoreMessage(ctxbg, int64(i), writeTestMessage(t, "sync"))
+			tcheck(t, err, "store message")
+		}()
+		go func() {
+			defer wg.Done()
+			err := nc.StoreMessageWithQueue(ctxbg, int64(1000+i), writeTestMessage(t, "queue"))
+			tcheck(t, err, "store message with queue")
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := processPendingNATS(ctxbg, nc)
+		tcheck(t, err, "process pending")
+	}()
+	wg.Wait()
+
+	if n := maxActive.Load(); n > limit {
+		t.Fatalf("saw %d concurrent puts, limit is %d", n, limit)
+	}
+	if n := len(fos.names()); n != 23 {
+		t.Fatalf("got %d objects, expected 23", n)
+	}
+}
+
+func TestNATSStoreConcurrent(t *testing.T) {
+	const n = 4
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", MaxConcurrentStores: n}, fos)
+
+	// Each put waits until all are in progress, which only happens when they aren't
+	// serialized.
+	var started sync.WaitGroup
+	started.Add(n)
+	allStarted := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(allStarted)
+	}()
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		started.Done()
+		select {
+		case <-allStarted:
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("puts not concurrent")
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := WithNATSThreadID(WithMessageAccount(ctxbg, "mjl"), int64(i+1))
+			err := nc.StoreMessage(ctx, int64(i+1), writeTestMessage(t, fmt.Sprintf("message %d", i)))
+			tcheck(t, err, "store message")
+		}()
+	}
+	wg.Wait()
+	tcompare(t, len(fos.names()), n)
+}
+
+func BenchmarkNATSStoreConcurrent(b *testing.B) {
+	fos := newFakeObjectStore()
+	// Simulate the round trip for the server to confirm a put.
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", MaxConcurrentStores: 64}, fos)
+	defer nc.Close()
+	p := filepath.Join(b.TempDir(), "msg.eml")
+	if err := os.WriteFile(p, []byte(strings.Repeat("x", 4096)), 0o600); err != nil {
+		b.Fatalf("write message: %v", err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		b.Fatalf("open message: %v", err)
+	}
+	defer f.Close()
+
+	var id atomic.Int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := nc.StoreMessage(ctxbg, id.Add(1), f); err != nil {
+				b.Errorf("store: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func TestNATSStoreMetrics(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	// The metrics are in the metrics package, read them through the registry.
+	value := func(name string) float64 {
+		t.Helper()
+		mfl, err := prometheus.DefaultGatherer.Gather()
+		tcheck(t, err, "gather metrics")
+		for _, mf := range mfl {
+			if mf.GetName() == name {
+				return mf.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		t.Fatalf("metric %s not found", name)
+		return 0
+	}
+	stored := value("mox_nats_messages_stored_total")
+	storedBytes := value("mox_nats_stored_bytes_total")
+	failures := value("mox_nats_store_failures_total")
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	err := nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	tcompare(t, value("mox_nats_messages_stored_total")-stored, 1.0)
+	tcompare(t, value("mox_nats_stored_bytes_total")-storedBytes, 4.0)
+
+	// Failed stores are counted, also when retried from the queue.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	err = nc.StoreMessageWithQueue(ctxbg, 2, writeTestMessage(t, "queued"))
+	if err == nil {
+		t.Fatalf("store succeeded with failing put")
+	}
+	_, err = processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, value("mox_nats_store_failures_total")-failures, 2.0)
+
+	fos.putHook = nil
+	_, err = processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, value("mox_nats_messages_stored_total")-stored, 2.0)
+	tcompare(t, value("mox_nats_stored_bytes_total")-storedBytes, 10.0)
+}
+
+func TestNATSCapacity(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", CapacityWarnPercent: 80}, fos)
+
+	// No size limit, never nearly full.
+	fos.used = 1000
+	c, err := nc.CheckCapacity(ctxbg)
+	tcheck(t, err, "check capacity")
+	tcompare(t, c, BucketCapacity{Used: 1000})
+	tcompare(t, nc.StorageNearlyFull(), false)
+
+	fos.maxBytes = 10000
+	c, err = nc.CheckCapacity(ctxbg)
+	tcheck(t, err, "check capacity")
+	tcompare(t, c.Free(), uint64(9000))
+	tcompare(t, nc.StorageNearlyFull(), false)
+
+	// Near-full usage trips the signal.
+	fos.used = 8500
+	_, err = nc.CheckCapacity(ctxbg)
+	tcheck(t, err, "check capacity")
+	tcompare(t, nc.StorageNearlyFull(), true)
+
+	// And clears it again once space is freed.
+	fos.used = 7000
+	_, err = nc.CheckCapacity(ctxbg)
+	tcheck(t, err, "check capacity")
+	tcompare(t, nc.StorageNearlyFull(), false)
+
+	var xnc *NATSClient
+	_, err = xnc.CheckCapacity(ctxbg)
+	if !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+}
+
+func TestNATSKeepalive(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", Keepalive: time.Minute}, fos)
+
+	// Just created, not idle yet.
+	now := time.Now()
+	nc.keepalive(ctxbg, now, time.Minute)
+	tcompare(t, fos.statusCalls, 0)
+
+	// No store during the interval.
+	nc.keepalive(ctxbg, now.Add(2*time.Minute), time.Minute)
+	tcompare(t, fos.statusCalls, 1)
+
+	// A store makes the path warm again.
+	f := writeTestMessage(t, "test message")
+	err := nc.StoreMessage(ctxbg, 1, f)
+	tcheck(t, err, "store message")
+	nc.keepalive(ctxbg, time.Now().Add(time.Second), time.Minute)
+	tcompare(t, fos.statusCalls, 1)
+}
+
+func TestNATSMinStoreSize(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", MinStoreSize: 10}, fos)
+
+	tcompare(t, nc.StoresMessage(9), false)
+	tcompare(t, nc.StoresMessage(10), true)
+
+	// Below the threshold, messages are not stored, also not through the queue.
+	err := nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "small"))
+	tcheck(t, err, "store message")
+	err = nc.StoreMessageWithQueue(ctxbg, 2, writeTestMessage(t, "small"))
+	tcheck(t, err, "store message with queue")
+	tcompare(t, len(fos.names()), 0)
+
+	err = nc.StoreMessage(ctxbg, 3, writeTestMessage(t, "large enough"))
+	tcheck(t, err, "store message")
+	tcompare(t, len(fos.names()), 1)
+}
+
+func TestNATSRenameObject(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	_, err := fos.Put(ctxbg, jetstream.ObjectMeta{Name: "a", Description: "test"}, strings.NewReader("hello"))
+	tcheck(t, err, "put")
+
+	err = nc.RenameObject(ctxbg, "a", "b")
+	tcheck(t, err, "rename")
+	tcompare(t, fos.names(), []string{"b"})
+	info, err := fos.GetInfo(ctxbg, "b")
+	tcheck(t, err, "get info")
+	tcompare(t, info.Description, "test")
+
+	// Target exists.
+	_, err = fos.Put(ctxbg, jetstream.ObjectMeta{Name: "c"}, strings.NewReader("other"))
+	tcheck(t, err, "put")
+	err = nc.RenameObject(ctxbg, "b", "c")
+	if err == nil {
+		t.Fatalf("rename to existing object succeeded")
+	}
+	tcompare(t, fos.names(), []string{"b", "c"})
+
+	// Missing source.
+	err = nc.RenameObject(ctxbg, "x", "y")
+	if !errors.Is(err, ErrMessageNotFound) || !errors.Is(err, jetstream.ErrObjectNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound wrapping ErrObjectNotFound", err)
+	}
+
+	// Failing copy leaves original.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("boom") }
+	err = nc.RenameObject(ctxbg, "b", "d")
+	if err == nil {
+		t.Fatalf("rename with failing put succeeded")
+	}
+	tcompare(t, fos.names(), []string{"b", "c"})
+	fos.putHook = nil
+
+	// Copy that doesn't verify is removed, original kept.
+	fos.putCorrupt = true
+	err = nc.RenameObject(ctxbg, "b", "d")
+	if err == nil {
+		t.Fatalf("rename with corrupt copy succeeded")
+	}
+	tcompare(t, fos.names(), []string{"b", "c"})
+	fos.putCorrupt = false
+
+	// Failing delete of original keeps both.
+	fos.deleteHook = func(name string) error { return errors.New("boom") }
+	err = nc.RenameObject(ctxbg, "b", "d")
+	if err == nil {
+		t.Fatalf("rename with failing delete succeeded")
+	}
+	tcompare(t, fos.names(), []string{"b", "c", "d"})
+}
+
+// applyNATSOptions returns the nats.Options resulting from the connect options
+// for cfg.
+func applyNATSOptions(t *testing.T, cfg *config.NATS) nats.Options {
+	t.Helper()
+	opts, err := natsConnectOptions(pkglog, cfg)
+	tcheck(t, err, "connect options")
+	o := nats.GetDefaultOptions()
+	for _, opt := range opts {
+		err := opt(&o)
+		tcheck(t, err, "apply option")
+	}
+	return o
+}
+
+func TestNATSServerURLs(t *testing.T) {
+	tcompare(t, natsServerURL(&config.NATS{URL: "nats://a:4222"}), "nats://a:4222")
+	tcompare(t, natsServerURL(&config.NATS{URL: "nats://a:4222", URLs: []string{"nats://b:4222", " ", "nats://c:4222"}}), "nats://a:4222,nats://b:4222,nats://c:4222")
+	tcompare(t, natsServerURL(&config.NATS{URLs: []string{"nats://b:4222"}}), "nats://b:4222")
+	// Comma-separated lists keep their order, also mixed with URLs.
+	tcompare(t, natsServerURL(&config.NATS{URL: "nats://c:4222, nats://a:4222,", URLs: []string{"nats://d:4222,nats://b:4222"}}), "nats://c:4222,nats://a:4222,nats://d:4222,nats://b:4222")
+	if _, err := newNATSClient(pkglog, &config.NATS{BucketName: "test-bucket"}); err == nil {
+		t.Fatalf("no error without url")
+	}
+
+	tcompare(t, applyNATSOptions(t, &config.NATS{}).NoRandomize, false)
+	tcompare(t, applyNATSOptions(t, &config.NATS{DontRandomize: true}).NoRandomize, true)
+
+	// All servers are passed to the connect call, and tried in order with
+	// DontRandomize. The servers close the connection immediately.
+	var mu sync.Mutex
+	var tried []int
+	var urls []string
+	for i := range 3 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		tcheck(t, err, "listen")
+		defer l.Close()
+		urls = append(urls, "nats://"+l.Addr().String())
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				tried = append(tried, i)
+				mu.Unlock()
+				conn.Close()
+			}
+		}()
+	}
+	cfg := config.NATS{URL: urls[0], URLs: urls[1:], DontRandomize: true, BucketName: "test-bucket", ConnectTimeout: time.Second}
+	if _, err := newNATSClient(pkglog, &cfg); err == nil {
+		t.Fatalf("connect succeeded without nats server")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	tcompare(t, tried, []int{0, 1, 2})
+}
+
+func TestNATSRetryOnFailedConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	tcheck(t, err, "listen")
+	url := "nats://" + l.Addr().String()
+	l.Close()
+
+	// Without RetryOnFailedConnect, initialization fails when connecting.
+	cfg := config.NATS{URL: url, BucketName: "test-bucket", ConnectTimeout: time.Second, RequestTimeout: 100 * time.Millisecond}
+	_, err = newNATSClient(pkglog, &cfg)
+	if err == nil || !strings.Contains(err.Error(), "connecting to NATS") {
+		t.Fatalf("got err %v, expected connect error", err)
+	}
+
+	// With RetryOnFailedConnect, connecting continues in the background, and
+	// initialization only fails when the bucket can't be opened in time.
+	cfg.RetryOnFailedConnect = true
+	_, err = newNATSClient(pkglog, &cfg)
+	if err == nil || strings.Contains(err.Error(), "connecting to NATS") {
+		t.Fatalf("got err %v, expected error opening bucket", err)
+	}
+}
+
+func TestNATSConnectionName(t *testing.T) {
+	orig := mox.Conf.Static.HostnameDomain
+	defer func() { mox.Conf.Static.HostnameDomain = orig }()
+
+	mox.Conf.Static.HostnameDomain = dns.Domain{}
+	tcompare(t, applyNATSOptions(t, &config.NATS{}).Name, "mox-email-server")
+	mox.Conf.Static.HostnameDomain = dns.Domain{ASCII: "mail.mox.example"}
+	tcompare(t, applyNATSOptions(t, &config.NATS{}).Name, "mox-email-server/mail.mox.example")
+	tcompare(t, applyNATSOptions(t, &config.NATS{ConnectionName: "mox-eu-1"}).Name, "mox-eu-1")
+}
+
+func TestNATSPingOptions(t *testing.T) {
+	o := applyNATSOptions(t, &config.NATS{})
+	tcompare(t, o.PingInterval, nats.DefaultPingInterval)
+	tcompare(t, o.MaxPingsOut, nats.DefaultMaxPingOut)
+
+	o = applyNATSOptions(t, &config.NATS{PingInterval: 10 * time.Second, MaxPingsOut: 5})
+	tcompare(t, o.PingInterval, 10*time.Second)
+	tcompare(t, o.MaxPingsOut, 5)
+}
+
+func TestNATSReconnectOptions(t *testing.T) {
+	o := applyNATSOptions(t, &config.NATS{})
+	tcompare(t, o.MaxReconnect, -1)
+	tcompare(t, o.ReconnectWait, 2*time.Second)
+
+	o = applyNATSOptions(t, &config.NATS{MaxReconnects: 10, ReconnectWait: 5 * time.Second})
+	tcompare(t, o.MaxReconnect, 10)
+	tcompare(t, o.ReconnectWait, 5*time.Second)
+	o = applyNATSOptions(t, &config.NATS{MaxReconnects: -1})
+	tcompare(t, o.MaxReconnect, -1)
+
+	for _, cfg := range []config.NATS{{MaxReconnects: -2}, {ReconnectWait: -time.Second}} {
+		cfg.URL = "nats://invalid-server:4222"
+		cfg.BucketName = "test-bucket"
+		if _, err := newNATSClient(pkglog, &cfg); err == nil || !strings.Contains(err.Error(), "reconnect") {
+			t.Fatalf("got err %v, expected error about reconnects for %#v", err, cfg)
+		}
+	}
+}
+
+func TestNATSTLSOptions(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, blockType string, buf []byte) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: buf}), 0o600)
+		tcheck(t, err, "write pem file")
+		return p
+	}
+	privKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)) // Fake key, don't use this for real!
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certBuf, err := x509.CreateCertificate(cryptorand.Reader, template, template, privKey.Public(), privKey)
+	tcheck(t, err, "making certificate")
+	keyBuf, err := x509.MarshalPKCS8PrivateKey(privKey)
+	tcheck(t, err, "marshal private key")
+	certPath := write("cert.pem", "CERTIFICATE", certBuf)
+	keyPath := write("key.pem", "PRIVATE KEY", keyBuf)
+	badPath := write("bad.pem", "CERTIFICATE", []byte("bad"))
+
+	// Without TLS configuration, no TLS options.
+	o := applyNATSOptions(t, &config.NATS{})
+	tcompare(t, o.TLSConfig == nil, true)
+
+	// Client certificate with CA. The files are loaded again when connecting.
+	o = applyNATSOptions(t, &config.NATS{TLSCert: certPath, TLSKey: keyPath, TLSCACert: certPath})
+	tcompare(t, o.Secure, true)
+	tcompare(t, o.TLSCertCB != nil, true)
+	tcompare(t, o.RootCAsCB != nil, true)
+
+	// Only a CA, the server is verified without presenting a client certificate.
+	o = applyNATSOptions(t, &config.NATS{TLSCACert: certPath})
+	tcompare(t, o.Secure, true)
+	tcompare(t, o.TLSCertCB == nil, true)
+	tcompare(t, o.RootCAsCB != nil, true)
+
+	bad := []config.NATS{
+		{TLSCert: certPath},
+		{TLSKey: keyPath},
+		{TLSCert: filepath.Join(dir, "missing.pem"), TLSKey: keyPath},
+		{TLSCert: certPath, TLSKey: certPath},
+		{TLSCACert: filepath.Join(dir, "missing.pem")},
+		{TLSCACert: badPath},
+		{TLSCACert: keyPath},
+	}
+	for _, cfg := range bad {
+		if _, err := natsConnectOptions(pkglog, &cfg); err == nil {
+			t.Fatalf("no error for bad tls config %#v", cfg)
+		}
+	}
+}
+
+func TestNATSAuthOptions(t *testing.T) {
+	dir := t.TempDir()
+	// Fake seed, don't use this for real!
+	seedPath := filepath.Join(dir, "user.nk")
+	err := os.WriteFile(seedPath, []byte("SUAA3AHK5EIM3KRYU2AQSS6AWNH5T6TJTHTDIXZLJALZBFH5PNN2F6E5XY\n"), 0o600)
+	tcheck(t, err, "write seed file")
+	badPath := filepath.Join(dir, "bad.nk")
+	err = os.WriteFile(badPath, []byte("bad\n"), 0o600)
+	tcheck(t, err, "write bad seed file")
+
+	o := applyNATSOptions(t, &config.NATS{NKeySeedFile: seedPath})
+	tcompare(t, o.Nkey, "UBHZQ3XPHRDC34364VTQ73G43JOX56Z3G7MA4FEWSHNBKDGNPL5HS6FL")
+	sig, err := o.SignatureCB([]byte("nonce"))
+	tcheck(t, err, "sign nonce")
+	tcompare(t, len(sig), ed25519.SignatureSize)
+
+	// Decentralized JWT authentication, the seed from NKeySeedFile signs the nonce,
+	// the user is identified by the JWT.
+	const userJWT = "eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.e30.c2ln"
+	o = applyNATSOptions(t, &config.NATS{UserJWT: userJWT, NKeySeedFile: seedPath})
+	tcompare(t, o.Nkey, "")
+	jwt, err := o.UserJWT()
+	tcheck(t, err, "user jwt")
+	tcompare(t, jwt, userJWT)
+	sig, err = o.SignatureCB([]byte("nonce"))
+	tcheck(t, err, "sign nonce")
+	tcompare(t, len(sig), ed25519.SignatureSize)
+	// The JWT file is read again on each connect.
+	jwtPath := filepath.Join(dir, "user.jwt")
+	err = os.WriteFile(jwtPath, []byte(userJWT+"\n"), 0o600)
+	tcheck(t, err, "write jwt file")
+	o = applyNATSOptions(t, &config.NATS{UserJWTFile: jwtPath, NKeySeedFile: seedPath})
+	jwt, err = o.UserJWT()
+	tcheck(t, err, "user jwt from file")
+	tcompare(t, jwt, userJWT)
+	err = os.WriteFile(jwtPath, []byte(userJWT+"x"), 0o600)
+	tcheck(t, err, "replace jwt file")
+	jwt, err = o.UserJWT()
+	tcheck(t, err, "user jwt from replaced file")
+	tcompare(t, jwt, userJWT+"x")
+
+	// The credentials file has both the JWT and seed.
+	credsPath := filepath.Join(dir, "user.creds")
+	creds := "-----BEGIN NATS USER JWT-----\n" + userJWT + "\n------END NATS USER JWT------\n\n-----BEGIN USER NKEY SEED-----\nSUAA3AHK5EIM3KRYU2AQSS6AWNH5T6TJTHTDIXZLJALZBFH5PNN2F6E5XY\n------END USER NKEY SEED------\n"
+	err = os.WriteFile(credsPath, []byte(creds), 0o600)
+	tcheck(t, err, "write credentials file")
+	o = applyNATSOptions(t, &config.NATS{CredentialsFile: credsPath})
+	tcompare(t, o.Nkey, "")
+	jwt, err = o.UserJWT()
+	tcheck(t, err, "user jwt from credentials file")
+	tcompare(t, jwt, userJWT)
+	sig, err = o.SignatureCB([]byte("nonce"))
+	tcheck(t, err, "sign nonce with credentials file")
+	tcompare(t, len(sig), ed25519.SignatureSize)
+	o = applyNATSOptions(t, &config.NATS{Token: "secret"})
+	tcompare(t, o.Token, "secret")
+	tcompare(t, o.SignatureCB == nil, true)
+	o = applyNATSOptions(t, &config.NATS{Username: "mox", Password: "secret"})
+	tcompare(t, o.User, "mox")
+	tcompare(t, o.Password, "secret")
+	tcompare(t, o.SignatureCB == nil, true)
+
+	// Without authentication, no option.
+	opt, err := natsAuthOption(&config.NATS{})
+	tcheck(t, err, "auth option without authentication")
+	tcompare(t, opt == nil, true)
+
+	bad := []config.NATS{
+		{NKeySeedFile: filepath.Join(dir, "missing.nk")},
+		{NKeySeedFile: badPath},
+		{NKeySeedFile: seedPath, CredentialsFile: "/path/to/nats.creds"},
+		{NKeySeedFile: seedPath, Token: "secret"},
+		{CredentialsFile: "/path/to/nats.creds", Username: "mox", Password: "secret"},
+		{Token: "secret", Password: "secret"},
+		{Password: "secret"},
+		{UserJWT: userJWT},
+		{UserJWTFile: jwtPath},
+		{UserJWT: userJWT, UserJWTFile: jwtPath, NKeySeedFile: seedPath},
+		{UserJWT: "bad", NKeySeedFile: seedPath},
+		{UserJWTFile: filepath.Join(dir, "missing.jwt"), NKeySeedFile: seedPath},
+		{UserJWT: userJWT, NKeySeedFile: badPath},
+		// A credentials file has both the JWT and seed, it can't be combined.
+		{UserJWT: userJWT, NKeySeedFile: seedPath, CredentialsFile: "/path/to/nats.creds"},
+		{UserJWT: userJWT, NKeySeedFile: seedPath, Token: "secret"},
+	}
+	for _, cfg := range bad {
+		if _, err := natsConnectOptions(pkglog, &cfg); err == nil {
+			t.Fatalf("no error for bad auth config %#v", cfg)
+		}
+	}
+}
+
+func TestNATSObjectError(t *testing.T) {
+	for _, err := range []error{jetstream.ErrObjectNotFound, jetstream.ErrNoObjectsFound, fmt.Errorf("get: %w", jetstream.ErrObjectNotFound)} {
+		if xerr := natsObjectError(err); !errors.Is(xerr, ErrMessageNotFound) {
+			t.Fatalf("natsObjectError(%v) = %v, expected ErrMessageNotFound", err, xerr)
+		}
+	}
+	for _, err := range []error{nil, context.DeadlineExceeded, jetstream.ErrBadObjectMeta} {
+		if xerr := natsObjectError(err); xerr != err {
+			t.Fatalf("natsObjectError(%v) = %v, expected unchanged", err, xerr)
+		}
+	}
+}
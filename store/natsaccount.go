@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+// Object metadata key holding the account a stored message belongs to.
+const natsAccountKey = "account"
+
+// ErrNATSNoAccount is returned when looking up the stored objects of a message
+// without account in the context, see WithMessageAccount. Message IDs are only unique
+// per account, the objects of other accounts would match.
+var ErrNATSNoAccount = errors.New("no account for nats message lookup")
+
+// Maximum number of concurrent deletes by DeleteAccountObjects.
+const natsAccountDeleteConcurrency = 8
+
+// NATSAccountDeletion is the result of DeleteAccountObjects.
+type NATSAccountDeletion struct {
+	Objects int // Objects found for the account.
+	Deleted int
+	Failed  int
+}
+
+// DeleteAccountObjects removes all objects of account from NATS, along with their
+// index rows and stored headers. Objects are found through the object index, or,
+// if auth.db isn't open, by listing the buckets and checking the account in the
+// object metadata. Objects stored without account are not found. With Dedup, the
+// references of the account are removed, and objects only once no other account
+// references them. Deletes run
+// concurrently. Soft-delete doesn't apply, the account is gone. Failed deletes
+// are counted and returned as a joined error, for retrying the removal later.
+func (nc *NATSClient) DeleteAccountObjects(ctx context.Context, account string) (NATSAccountDeletion, error) {
+	var res NATSAccountDeletion
+	if nc == nil {
+		return res, ErrNATSNotConfigured
+	}
+	if account == "" {
+		return res, fmt.Errorf("empty account name")
+	}
+
+	names, err := nc.accountObjects(ctx, account)
+	if err != nil {
+		return res, err
+	}
+	res.Objects = len(names)
+
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, natsAccountDeleteConcurrency)
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		release, err := nc.acquireGoroutine(ctx)
+		if err != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			var err error
+			defer func() {
+				x := recover()
+				if x != nil {
+					nc.log.Error("unhandled panic deleting nats object of account", slog.Any("err", x))
+					debug.PrintStack()
+					metrics.PanicInc(metrics.Store)
+					err = fmt.Errorf("panic deleting object %q", name)
+				}
+				mu.Lock()
+				if err == nil {
+					res.Deleted++
+				} else {
+					res.Failed++
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+				release()
+				<-sem
+				wg.Done()
+			}()
+
+			var os jetstream.ObjectStore
+			os, err = nc.objectBucket(WithMessageAccount(ctx, account), name)
+			if err == nil {
+				err = os.Delete(ctx, name)
+			}
+			if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+				err = fmt.Errorf("removing object %q: %w", name, err)
+				return
+			}
+			err = natsRemoveIndex(context.WithoutCancel(ctx), name)
+		}()
+	}
+	wg.Wait()
+	if err := nc.releaseAccountDedup(ctx, account, &res); err != nil {
+		errs = append(errs, err)
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	nc.log.Info("removed nats objects of account",
+		slog.String("account", account),
+		slog.Int("objects", res.Objects),
+		slog.Int("deleted", res.Deleted),
+		slog.Int("failed", res.Failed))
+	return res, errors.Join(errs...)
+}
+
+// accountObjects returns the names of the objects of account.
+func (nc *NATSClient) accountObjects(ctx context.Context, account string) ([]string, error) {
+	var names []string
+	if AuthDB != nil {
+		q := bstore.QueryDB[NATSObjectRef](ctx, AuthDB)
+		q.FilterNonzero(NATSObjectRef{Account: account})
+		err := q.ForEach(func(ref NATSObjectRef) error {
+			// Dedup objects can be shared with other accounts, see releaseAccountDedup.
+			if !isNATSDedupObject(ref.ObjectName) {
+				names = append(names, ref.ObjectName)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing nats object index rows of account: %w", err)
+		}
+		return names, nil
+	}
+
+	if nc.config.AccountBuckets != "" {
+		// Opened once, so it is included in the buckets below.
+		if _, err := nc.accountBucket(ctx, account); err != nil {
+			return nil, err
+		}
+	}
+	for _, os := range nc.natsBuckets() {
+		infos, err := os.List(ctx)
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("listing objects: %w", err)
+		}
+		for _, info := range infos {
+			if !info.Deleted && info.Metadata[natsAccountKey] == account {
+				names = append(names, info.Name)
+			}
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mjl-/bstore"
+)
+
+func TestNATSDeleteAccountObjects(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	store := func(account string, id int64) {
+		t.Helper()
+		ctx := ctxbg
+		if account != "" {
+			ctx = WithMessageAccount(ctx, account)
+		}
+		err := nc.StoreMessage(ctx, id, writeTestMessage(t, "test"))
+		tcheck(t, err, "store message")
+	}
+
+	test := func(withIndex bool) {
+		t.Helper()
+		const n = 500
+		for i := range int64(n) {
+			store("mjl", 1+i)
+		}
+		// Object names only have the message ID, use IDs not used by mjl.
+		store("other", 10001)
+		store("", 10002)
+
+		var active, maxActive atomic.Int32
+		fos.deleteHook = func(name string) error {
+			v := active.Add(1)
+			defer active.Add(-1)
+			for {
+				m := maxActive.Load()
+				if v <= m || maxActive.CompareAndSwap(m, v) {
+					break
+				}
+			}
+			return nil
+		}
+		defer func() { fos.deleteHook = nil }()
+
+		res, err := nc.DeleteAccountObjects(ctxbg, "mjl")
+		tcheck(t, err, "delete account objects")
+		tcompare(t, res, NATSAccountDeletion{Objects: n, Deleted: n})
+		tcompare(t, len(fos.names()), 2)
+		for _, name := range fos.names() {
+			info, err := fos.GetInfo(ctxbg, name)
+			tcheck(t, err, "get info")
+			if info.Metadata[natsAccountKey] == "mjl" {
+				t.Fatalf("object %q of removed account still present", name)
+			}
+		}
+		if v := maxActive.Load(); v > natsAccountDeleteConcurrency {
+			t.Fatalf("saw %d concurrent deletes, limit is %d", v, natsAccountDeleteConcurrency)
+		}
+
+		if withIndex {
+			exists, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).FilterNonzero(NATSObjectRef{Account: "mjl"}).Exists()
+			tcheck(t, err, "check index")
+			tcompare(t, exists, false)
+			n, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).Count()
+			tcheck(t, err, "count index")
+			tcompare(t, n, 2)
+		}
+
+		// Failed deletes are counted and reported.
+		store("mjl", 20001)
+		fos.deleteHook = func(name string) error { return errors.New("timeout") }
+		res, err = nc.DeleteAccountObjects(ctxbg, "mjl")
+		if err == nil {
+			t.Fatalf("no error for failed delete")
+		}
+		tcompare(t, res, NATSAccountDeletion{Objects: 1, Failed: 1})
+
+		for _, name := range fos.names() {
+			delete(fos.objects, name)
+		}
+	}
+
+	// Without auth.db, objects are found by their metadata.
+	test(false)
+
+	openTestAuthDB(t)
+	test(true)
+}
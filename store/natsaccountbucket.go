@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// checkNATSAccountBuckets checks that AccountBuckets of cfg, if set, can be used.
+func checkNATSAccountBuckets(cfg *config.NATS) error {
+	if cfg.AccountBuckets == "" {
+		return nil
+	}
+	if !strings.Contains(cfg.AccountBuckets, "{account}") {
+		return fmt.Errorf("account buckets template %q must contain {account}", cfg.AccountBuckets)
+	}
+	if len(cfg.ShardBuckets) > 0 || cfg.KeyDerivation != "" || cfg.MigrateFromBucket != "" {
+		return fmt.Errorf("account buckets cannot be combined with shard buckets, key derivation or migrating from a bucket")
+	}
+	return nil
+}
+
+// natsAccountBucketName returns the bucket for account from template. Characters
+// not allowed in bucket names, and the "_" used for escaping, are written as "_"
+// followed by two hexadecimal digits, so each account has its own bucket.
+func natsAccountBucketName(template, account string) string {
+	var b strings.Builder
+	for _, c := range []byte(account) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return strings.ReplaceAll(template, "{account}", b.String())
+}
+
+// objectBucket returns the object store for object name. With AccountBuckets, and
+// an account in ctx, see WithMessageAccount, it is the bucket of the account, opened
+// and created on first use. Otherwise it is the bucket from bucketFor.
+func (nc *NATSClient) objectBucket(ctx context.Context, name string) (jetstream.ObjectStore, error) {
+	account := messageAccount(ctx)
+	if nc.config.AccountBuckets == "" || account == "" {
+		return nc.bucketFor(name), nil
+	}
+	return nc.accountBucket(ctx, account)
+}
+
+// accountBucket returns the object store of the bucket of account, opening it, and
+// creating it if needed, on first use. Handles are kept for later use.
+func (nc *NATSClient) accountBucket(ctx context.Context, account string) (jetstream.ObjectStore, error) {
+	bucket := natsAccountBucketName(nc.config.AccountBuckets, account)
+
+	nc.accountBucketsMu.Lock()
+	defer nc.accountBucketsMu.Unlock()
+	if os, ok := nc.accountBuckets[bucket]; ok {
+		return os, nil
+	}
+	os, err := nc.openBucket(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("opening bucket %q of account: %w", bucket, err)
+	}
+	if nc.accountBuckets == nil {
+		nc.accountBuckets = map[string]jetstream.ObjectStore{}
+	}
+	nc.accountBuckets[bucket] = os
+	nc.log.Debug("opened nats bucket of account", slog.String("account", account), slog.String("bucket", bucket))
+	return os, nil
+}
+
+// openedAccountBuckets returns the object stores of the account buckets opened so
+// far, ordered by bucket name.
+func (nc *NATSClient) openedAccountBuckets() []jetstream.ObjectStore {
+	nc.accountBucketsMu.Lock()
+	defer nc.accountBucketsMu.Unlock()
+	buckets := make([]string, 0, len(nc.accountBuckets))
+	for b := range nc.accountBuckets {
+		buckets = append(buckets, b)
+	}
+	slices.Sort(buckets)
+	var l []jetstream.ObjectStore
+	for _, b := range buckets {
+		l = append(l, nc.accountBuckets[b])
+	}
+	return l
+}
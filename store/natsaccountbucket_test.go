@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSAccountBuckets(t *testing.T) {
+	tcompare(t, natsAccountBucketName("mox-{account}", "mjl"), "mox-mjl")
+	tcompare(t, natsAccountBucketName("mox-{account}", "a.b_c"), "mox-a_2eb_5fc")
+	tcompare(t, natsAccountBucketName("mox-{account}", "a_2eb"), "mox-a_5f2eb")
+
+	tcheck(t, checkNATSAccountBuckets(&config.NATS{}), "no account buckets")
+	tcheck(t, checkNATSAccountBuckets(&config.NATS{AccountBuckets: "mox-{account}"}), "account buckets")
+	for _, cfg := range []config.NATS{
+		{AccountBuckets: "mox"},
+		{AccountBuckets: "mox-{account}", ShardBuckets: []string{"other"}},
+		{AccountBuckets: "mox-{account}", MigrateFromBucket: "old"},
+	} {
+		if err := checkNATSAccountBuckets(&cfg); err == nil {
+			t.Fatalf("no error for account buckets with config %#v", cfg)
+		}
+	}
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", AccountBuckets: "mox-{account}"}, fos)
+	stores := map[string]*fakeObjectStore{}
+	var openErr error
+	nc.openBucket = func(ctx context.Context, bucket string) (jetstream.ObjectStore, error) {
+		if openErr != nil {
+			return nil, openErr
+		}
+		s := newFakeObjectStore()
+		stores[bucket] = s
+		return s, nil
+	}
+
+	store := func(account string, id int64, data string) error {
+		t.Helper()
+		ctx := ctxbg
+		if account != "" {
+			ctx = WithMessageAccount(ctx, account)
+		}
+		return nc.StoreMessage(ctx, id, writeTestMessage(t, data))
+	}
+	get := func(account string, id int64) string {
+		t.Helper()
+		ctx := ctxbg
+		if account != "" {
+			ctx = WithMessageAccount(ctx, account)
+		}
+		r, err := nc.GetMessage(ctx, id)
+		tcheck(t, err, "get message")
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read message")
+		return string(buf)
+	}
+
+	// Messages of accounts go to their own bucket, opened once, others to
+	// BucketName.
+	tcheck(t, store("mjl", 1, "mjl one"), "store")
+	tcheck(t, store("mjl", 2, "mjl two"), "store")
+	tcheck(t, store("other", 1, "other one"), "store")
+	tcheck(t, store("", 3, "no account"), "store")
+	tcompare(t, len(stores), 2)
+	tcompare(t, len(stores["mox-mjl"].names()), 2)
+	tcompare(t, len(stores["mox-other"].names()), 1)
+	tcompare(t, len(fos.names()), 1)
+	tcompare(t, len(nc.natsBuckets()), 3)
+
+	tcompare(t, get("mjl", 1), "mjl one")
+	tcompare(t, get("other", 1), "other one")
+	// Without account, messages can't be looked up, message IDs are only unique per
+	// account.
+	if _, err := nc.GetMessage(ctxbg, 2); !errors.Is(err, ErrNATSNoAccount) {
+		t.Fatalf("got err %v, expected ErrNATSNoAccount", err)
+	}
+	if _, err := nc.GetMessage(WithMessageAccount(ctxbg, "other"), 2); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound for message of other account", err)
+	}
+
+	err := nc.DeleteMessage(WithMessageAccount(ctxbg, "mjl"), 1)
+	tcheck(t, err, "delete message")
+	tcompare(t, len(stores["mox-mjl"].names()), 1)
+	tcompare(t, len(stores["mox-other"].names()), 1)
+
+	res, err := nc.DeleteAccountObjects(ctxbg, "other")
+	tcheck(t, err, "delete account objects")
+	tcompare(t, res.Deleted, 1)
+	tcompare(t, len(stores["mox-other"].names()), 0)
+
+	// If the bucket of an account can't be opened, the store fails.
+	openErr = errors.New("no access")
+	if err := store("new", 1, "test"); err == nil || !errors.Is(err, openErr) {
+		t.Fatalf("got err %v, expected error opening bucket", err)
+	}
+	tcompare(t, len(stores), 2)
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+var metricNATSAsyncQueueFull = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_nats_async_queue_full_total",
+		Help: "Number of asynchronous stores added to the pending queue because all NATS.AsyncWorkers workers were busy and NATS.AsyncQueueSize stores were waiting.",
+	},
+)
+
+// natsAsyncStore is an asynchronous store, done by a goroutine of its own or by
+// a worker.
+type natsAsyncStore struct {
+	messageID int64
+	class     string // Retention class, account and thread ID from the context.
+	account   string
+	threadID  int64
+	f         *os.File // Opened again by StoreMessageAsync.
+	size      int64
+	done      func() // From beginStore.
+	close     func() // Closes f.
+}
+
+// natsAsyncPool is a queue of asynchronous stores for a fixed number of workers,
+// when AsyncWorkers is configured.
+type natsAsyncPool struct {
+	workers int
+	limit   int
+
+	sync.Mutex
+	cond    *sync.Cond
+	queue   []*natsAsyncStore
+	closed  bool
+	running sync.WaitGroup // Workers that have not yet stopped.
+}
+
+func newNATSAsyncPool(workers, limit int) *natsAsyncPool {
+	if limit <= 0 {
+		limit = 256
+	}
+	p := &natsAsyncPool{workers: workers, limit: limit}
+	p.cond = sync.NewCond(&p.Mutex)
+	return p
+}
+
+// trySubmit adds j to the queue for the workers. It returns false, without
+// waiting, if the queue is full or the pool is closed.
+func (p *natsAsyncPool) trySubmit(j *natsAsyncStore) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed || len(p.queue) >= p.limit {
+		return false
+	}
+	p.queue = append(p.queue, j)
+	p.cond.Signal()
+	return true
+}
+
+// next waits for and returns the next store. It returns false when the pool was
+// closed and everything queued has been returned.
+func (p *natsAsyncPool) next() (*natsAsyncStore, bool) {
+	p.Lock()
+	defer p.Unlock()
+	for len(p.queue) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.queue) == 0 {
+		return nil, false
+	}
+	j := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return j, true
+}
+
+// close makes trySubmit fail, and the workers stop once the queue is empty.
+func (p *natsAsyncPool) close() {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// wait waits for the workers to stop after close, i.e. for the queue to be
+// drained, or for ctx to be done. Returns whether the workers stopped.
+func (p *natsAsyncPool) wait(ctx context.Context) bool {
+	stopped := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startAsyncWorkers starts the AsyncWorkers workers for asynchronous stores.
+func (nc *NATSClient) startAsyncWorkers() {
+	for range nc.async.workers {
+		nc.async.running.Add(1)
+		go nc.asyncWorker()
+	}
+}
+
+// asyncWorker does queued asynchronous stores until the pool is closed and
+// empty. While storing, it holds a slot of the goroutine budget.
+func (nc *NATSClient) asyncWorker() {
+	defer nc.async.running.Done()
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS async store worker", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	for {
+		j, ok := nc.async.next()
+		if !ok {
+			return
+		}
+		release, err := nc.acquireGoroutine(context.Background())
+		if err != nil {
+			// Cannot happen without a deadline on the context.
+			nc.log.Errorx("waiting for goroutine for async NATS store, queueing", err, slog.Int64("message_id", j.messageID))
+			nc.queueAsyncStore(context.Background(), j)
+			continue
+		}
+		nc.storeAsync(j)
+		release()
+	}
+}
+
+// storeAsync does asynchronous store j, queueing it for retry if it fails.
+func (nc *NATSClient) storeAsync(j *natsAsyncStore) {
+	defer j.done()
+	defer j.close()
+	ctx, cancel := context.WithTimeout(context.Background(), nc.storeDeadline(j.size))
+	defer cancel()
+	if j.class != "" {
+		ctx = WithNATSRetentionClass(ctx, j.class)
+	}
+	if j.account != "" {
+		ctx = WithMessageAccount(ctx, j.account)
+	}
+	if j.threadID != 0 {
+		ctx = WithNATSThreadID(ctx, j.threadID)
+	}
+	if err := nc.storeMessage(ctx, j.messageID, j.f, j.size); err != nil {
+		nc.log.Errorx("NATS store failed, queueing for retry", err, slog.Int64("message_id", j.messageID))
+		err := queueNATSRetry(ctx, j.messageID, j.f, j.size)
+		nc.log.Check(err, "queueing message for NATS storage after failed store", slog.Int64("message_id", j.messageID))
+	}
+}
+
+// queueAsyncStore adds asynchronous store j to the pending queue without trying
+// to store it first.
+func (nc *NATSClient) queueAsyncStore(ctx context.Context, j *natsAsyncStore) {
+	defer j.done()
+	defer j.close()
+	err := queueNATSRetry(ctx, j.messageID, j.f, j.size)
+	nc.log.Check(err, "queueing message for NATS storage", slog.Int64("message_id", j.messageID))
+}
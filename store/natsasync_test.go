@@ -0,0 +1,121 @@
+package store
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSAsyncWorkers(t *testing.T) {
+	const workers = 2
+	const queueSize = 5
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", AsyncWorkers: workers, AsyncQueueSize: queueSize, MaxConcurrentStores: 100}, fos)
+
+	var active, maxActive atomic.Int64
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 100)
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		v := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if v <= m || maxActive.CompareAndSwap(m, v) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-unblock
+		return nil
+	}
+
+	// Keep the workers busy, further stores wait in the queue, and once it is full
+	// are added to the pending queue.
+	full := testutil.ToFloat64(metricNATSAsyncQueueFull)
+	for i := range int64(workers) {
+		nc.StoreMessageAsync(ctxbg, 1+i, writeTestMessage(t, "test"))
+	}
+	for range workers {
+		<-started
+	}
+	const n = 20
+	for i := range int64(n - workers) {
+		f := writeTestMessage(t, "test")
+		nc.StoreMessageAsync(ctxbg, 100+i, f)
+		// The message file is opened again, the caller can remove it.
+		f.Close()
+		os.Remove(f.Name())
+	}
+	paths, err := listPendingNATS()
+	tcheck(t, err, "list pending")
+	tcompare(t, len(paths), n-workers-queueSize)
+	tcompare(t, testutil.ToFloat64(metricNATSAsyncQueueFull)-full, float64(n-workers-queueSize))
+	// Workers take a slot of the goroutine budget only while storing.
+	tcompare(t, nc.goroutines.Load(), int64(workers))
+
+	close(unblock)
+	tcompare(t, nc.closeStores(ctxbg), true)
+	tcompare(t, len(fos.names()), workers+queueSize)
+	if v := maxActive.Load(); v != workers {
+		t.Fatalf("saw %d concurrent async stores, expected %d workers", v, workers)
+	}
+	tcompare(t, nc.goroutines.Load(), int64(0))
+
+	// Closing stops the workers.
+	err = nc.Close()
+	tcheck(t, err, "close")
+	nc.async.running.Wait()
+}
+
+func TestNATSAsyncWorkersCloseContext(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", AsyncWorkers: 1, AsyncQueueSize: 10}, fos)
+
+	// Stores are waiting in the queue behind a slow put when closing. They are
+	// stored before the connection is closed, not left in the pending queue.
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 1)
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		select {
+		case started <- struct{}{}:
+			<-unblock
+		default:
+		}
+		return nil
+	}
+	const n = 5
+	for i := range int64(n) {
+		nc.StoreMessageAsync(ctxbg, 1+i, writeTestMessage(t, "test"))
+	}
+	<-started
+	type result struct {
+		flushed, abandoned int
+		err                error
+	}
+	done := make(chan result)
+	go func() {
+		flushed, abandoned, err := nc.CloseContext(ctxbg)
+		done <- result{flushed, abandoned, err}
+	}()
+	close(unblock)
+	res := <-done
+	tcheck(t, res.err, "close")
+	tcompare(t, res, result{})
+	tcompare(t, len(fos.names()), n)
+	tcompare(t, countPendingNATS(), 0)
+
+	// Stores after closing are queued.
+	nc.StoreMessageAsync(ctxbg, 100, writeTestMessage(t, "test"))
+	tcompare(t, countPendingNATS(), 1)
+}
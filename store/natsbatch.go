@@ -0,0 +1,245 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+// natsPut is a message waiting to be put in a batch.
+type natsPut struct {
+	messageID int64
+	account   string            // From the context of the store.
+	threadID  int64             // From the context of the store.
+	headers   map[string]string // From the context of the store, see StoreMessageWithMeta.
+	r         io.ReaderAt
+	size      int64
+	close     func()     // If not nil, called when r is no longer needed.
+	start     time.Time  // When the store started, for timing.
+	done      chan error // If not nil, receives the result of the put.
+}
+
+// context returns ctx with the account, thread ID and header metadata of the
+// store of p.
+func (p *natsPut) context(ctx context.Context) context.Context {
+	if p.account != "" {
+		ctx = WithMessageAccount(ctx, p.account)
+	}
+	if p.threadID != 0 {
+		ctx = WithNATSThreadID(ctx, p.threadID)
+	}
+	if p.headers != nil {
+		ctx = withNATSHeaderMeta(ctx, p.headers)
+	}
+	return ctx
+}
+
+// natsPutBatcher collects messages for putting in batches, when SyncPut is false.
+type natsPutBatcher struct {
+	size int
+
+	sync.Mutex
+	cond   *sync.Cond
+	queue  []*natsPut
+	closed bool
+
+	pending sync.WaitGroup // Messages submitted but not yet put.
+	done    chan struct{}  // Closed when the batch loop has finished.
+}
+
+func newNATSPutBatcher(size int) *natsPutBatcher {
+	if size <= 0 {
+		size = 32
+	}
+	b := &natsPutBatcher{size: size, done: make(chan struct{})}
+	b.cond = sync.NewCond(&b.Mutex)
+	return b
+}
+
+// submit adds p to the queue, waiting while the queue holds two batches. It
+// returns false if the batcher is closed.
+func (b *natsPutBatcher) submit(p *natsPut) bool {
+	b.Lock()
+	defer b.Unlock()
+	for len(b.queue) >= 2*b.size && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	b.pending.Add(1)
+	b.queue = append(b.queue, p)
+	b.cond.Broadcast()
+	return true
+}
+
+// next waits for and returns the next batch. It returns false when the batcher
+// was closed and everything queued has been returned.
+func (b *natsPutBatcher) next() ([]*natsPut, bool) {
+	b.Lock()
+	defer b.Unlock()
+	for len(b.queue) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.queue) == 0 {
+		return nil, false
+	}
+	n := min(b.size, len(b.queue))
+	batch := append([]*natsPut(nil), b.queue[:n]...)
+	b.queue = append(b.queue[:0], b.queue[n:]...)
+	b.cond.Broadcast()
+	return batch, true
+}
+
+// close makes submit fail, and next return false once the queue is empty.
+func (b *natsPutBatcher) close() {
+	b.Lock()
+	defer b.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// storeMessageBatch adds a message to the next batch. If wait is set, it returns
+// the result of the put once its batch is done. Otherwise it returns immediately,
+// and a failed put is added to the pending queue.
+//
+// Messages are streamed from r. Without wait, the caller can close r once
+// storeMessageBatch returns: a file is opened again by name, other readers are
+// read into memory.
+func (nc *NATSClient) storeMessageBatch(ctx context.Context, messageID int64, r io.ReaderAt, size int64, wait bool) error {
+	start := time.Now()
+	p := &natsPut{messageID: messageID, account: messageAccount(ctx), threadID: natsThreadID(ctx), headers: natsHeaderMeta(ctx), r: r, size: size, start: start}
+	if wait {
+		p.done = make(chan error, 1)
+	} else {
+		var err error
+		p.r, p.close, err = nc.detachBatchReader(messageID, r, size)
+		if err != nil {
+			return err
+		}
+	}
+	if !nc.batcher.submit(p) {
+		// Closing, put immediately.
+		err := nc.putBatch(ctx, []*natsPut{p})
+		if !wait {
+			return nil
+		}
+		return err
+	}
+	if !wait {
+		return nil
+	}
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for NATS batch put: %w", ctx.Err())
+	}
+}
+
+// detachBatchReader returns a reader for the message in r that stays valid after
+// the caller closes r, with a function to call when done with it.
+func (nc *NATSClient) detachBatchReader(messageID int64, r io.ReaderAt, size int64) (io.ReaderAt, func(), error) {
+	if f, ok := r.(*os.File); ok {
+		nf, err := os.Open(f.Name())
+		if err == nil {
+			return nf, func() {
+				err := nf.Close()
+				nc.log.Check(err, "closing message file after NATS batch put", slog.Int64("message_id", messageID))
+			}, nil
+		}
+		nc.log.Debugx("opening message file for NATS batch put, reading into memory", err, slog.Int64("message_id", messageID))
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("reading message for NATS batch put: %w", err)
+	}
+	return bytes.NewReader(data), nil, nil
+}
+
+// putBatchLoop puts batches of messages until the batcher is closed and empty.
+func (nc *NATSClient) putBatchLoop() {
+	defer close(nc.batcher.done)
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS batch put", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	for {
+		batch, ok := nc.batcher.next()
+		if !ok {
+			return
+		}
+		nc.putBatch(context.Background(), batch)
+		for range batch {
+			nc.batcher.pending.Done()
+		}
+	}
+}
+
+// putBatch puts the messages of a batch concurrently, limited by
+// MaxConcurrentStores, and waits for all puts to be confirmed. Results are sent
+// to waiting submitters, failed puts of others are added to the pending queue.
+// For a batch of one message the result is also returned. The puts don't take
+// slots of the goroutine budget, they are done for stores that were already
+// started, and are limited by the batch size.
+func (nc *NATSClient) putBatch(ctx context.Context, batch []*natsPut) error {
+	errs := make([]error, len(batch))
+	var wg sync.WaitGroup
+	for i, p := range batch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				x := recover()
+				if x != nil {
+					nc.log.Error("unhandled panic in NATS batch put", slog.Any("err", x))
+					debug.PrintStack()
+					metrics.PanicInc(metrics.Store)
+					errs[i] = fmt.Errorf("panic during put")
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(ctx, nc.storeDeadline(p.size))
+			defer cancel()
+			ctx = p.context(ctx)
+			release, err := nc.acquireStore(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer release()
+			errs[i] = nc.putMessage(ctx, p.messageID, p.r, p.size, p.start)
+		}()
+	}
+	wg.Wait()
+
+	for i, p := range batch {
+		if p.done != nil {
+			p.done <- errs[i]
+		} else if errs[i] != nil {
+			nc.log.Errorx("NATS batch put failed, queueing for retry", errs[i], slog.Int64("message_id", p.messageID))
+			err := queueNATSRetry(p.context(context.Background()), p.messageID, p.r, p.size)
+			nc.log.Check(err, "queueing message for retry after failed batch put", slog.Int64("message_id", p.messageID))
+		}
+		if p.close != nil {
+			p.close()
+		}
+	}
+	if len(batch) == 1 {
+		return errs[0]
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// flushPuts waits until all messages submitted for batch puts have been put.
+func (nc *NATSClient) flushPuts() {
+	if nc.batcher != nil {
+		nc.batcher.pending.Wait()
+	}
+}
+
+func TestNATSAsyncPut(t *testing.T) {
+	cleanPendingNATS()
+	defer cleanPendingNATS()
+
+	syncPut := false
+	fos := newFakeObjectStore()
+	release := make(chan struct{})
+	var puts atomic.Int32
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		<-release
+		puts.Add(1)
+		if strings.HasPrefix(meta.Name, "msg-3-") {
+			return errors.New("put failed")
+		}
+		return nil
+	}
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", SyncPut: &syncPut, PutBatchSize: 2}, fos)
+	defer nc.Close()
+
+	// StoreMessage returns before the put is confirmed. The message is streamed
+	// from the file, which the caller can close and remove right away.
+	for id := int64(1); id <= 3; id++ {
+		f := writeTestMessage(t, fmt.Sprintf("message %d", id))
+		err := nc.StoreMessage(ctxbg, id, f)
+		tcheck(t, err, "store message")
+		err = f.Close()
+		tcheck(t, err, "close message file")
+		err = os.Remove(f.Name())
+		tcheck(t, err, "remove message file")
+	}
+	tcompare(t, puts.Load(), int32(0))
+
+	// StoreMessageWithQueue, used for DeleteAfterStore, waits for the put of its batch.
+	result := make(chan error, 1)
+	go func() {
+		result <- nc.StoreMessageWithQueue(ctxbg, 4, writeTestMessage(t, "message 4"))
+	}()
+	select {
+	case err := <-result:
+		t.Fatalf("StoreMessageWithQueue returned before put was confirmed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	tcheck(t, <-result, "store message with queue")
+	nc.flushPuts()
+	tcompare(t, puts.Load(), int32(4))
+	tcompare(t, len(fos.names()), 3)
+
+	// The failed asynchronous put was queued for retry.
+	tcompare(t, countPendingNATS(), 1)
+	fos.putHook = nil
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 1)
+	tcompare(t, len(fos.names()), 4)
+	for _, name := range fos.names() {
+		id, _ := natsMessageIDFromObject(name)
+		tcompare(t, string(fos.objects[name].data), fmt.Sprintf("message %d", id))
+	}
+
+	// After close, the batch loop is done and new stores fail.
+	nc.Close()
+	<-nc.batcher.done
+	err = nc.StoreMessageWithQueue(ctxbg, 5, writeTestMessage(t, "message 5"))
+	if !errors.Is(err, ErrNATSClosed) {
+		t.Fatalf("got err %v, expected ErrNATSClosed for store after close", err)
+	}
+	tcompare(t, len(fos.names()), 4)
+	tcompare(t, countPendingNATS(), 0)
+}
+
+func BenchmarkNATSStore(b *testing.B) {
+	for _, syncPut := range []bool{true, false} {
+		name := "sync"
+		if !syncPut {
+			name = "async"
+		}
+		b.Run(name, func(b *testing.B) {
+			fos := newFakeObjectStore()
+			// Simulate the round trip for the server to confirm a put.
+			fos.putHook = func(meta jetstream.ObjectMeta) error {
+				time.Sleep(time.Millisecond)
+				return nil
+			}
+			nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", SyncPut: &syncPut}, fos)
+			defer nc.Close()
+			p := filepath.Join(b.TempDir(), "msg.eml")
+			if err := os.WriteFile(p, []byte(strings.Repeat("x", 4096)), 0o600); err != nil {
+				b.Fatalf("write message: %v", err)
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				b.Fatalf("open message: %v", err)
+			}
+			defer f.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := nc.StoreMessage(ctxbg, int64(i), f); err != nil {
+					b.Fatalf("store: %v", err)
+				}
+			}
+			nc.flushPuts()
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"log/slog"
+	"runtime/debug"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+)
+
+var metricNATSStoreCallbacksDropped = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_nats_store_callbacks_dropped_total",
+		Help: "Number of confirmed NATS stores not passed to the registered store callbacks because too many were waiting.",
+	},
+)
+
+// Number of confirmed stores waiting for the store callbacks before further ones
+// are dropped.
+const natsStoreCallbackQueueSize = 1024
+
+type natsStoreCallback struct {
+	id int64
+	fn func(d NATSDurable)
+}
+
+var natsStoreCallbacks = struct {
+	sync.Mutex
+	nextID    int64
+	callbacks []natsStoreCallback
+	queue     chan NATSDurable // Created with the first callback.
+}{}
+
+// RegisterNATSStoreCallback adds fn to the callbacks called for each message that
+// is confirmed stored in NATS, with its account, message ID and size in bytes in
+// the bucket, e.g. for billing or quota accounting. Unlike OnNATSDurable, the
+// callbacks don't run in the store path: confirmations are queued, and the
+// callbacks are called in order, one confirmation at a time, in a separate
+// goroutine. A slow callback delays the others. When too many confirmations are
+// waiting, new ones are dropped, logged and counted in a metric. Panics are
+// recovered and logged, and don't affect the other callbacks. The returned
+// function removes the callback.
+func RegisterNATSStoreCallback(fn func(d NATSDurable)) (unregister func()) {
+	cbs := &natsStoreCallbacks
+	cbs.Lock()
+	defer cbs.Unlock()
+	cbs.nextID++
+	id := cbs.nextID
+	cbs.callbacks = append(cbs.callbacks, natsStoreCallback{id, fn})
+	if cbs.queue == nil {
+		cbs.queue = make(chan NATSDurable, natsStoreCallbackQueueSize)
+		go natsStoreCallbackLoop(cbs.queue)
+	}
+	return func() {
+		cbs.Lock()
+		defer cbs.Unlock()
+		cbs.callbacks = slices.DeleteFunc(cbs.callbacks, func(cb natsStoreCallback) bool { return cb.id == id })
+	}
+}
+
+// queueStoreCallbacks queues d for the registered store callbacks, without
+// blocking.
+func (nc *NATSClient) queueStoreCallbacks(d NATSDurable) {
+	cbs := &natsStoreCallbacks
+	cbs.Lock()
+	defer cbs.Unlock()
+	if len(cbs.callbacks) == 0 {
+		return
+	}
+	select {
+	case cbs.queue <- d:
+	default:
+		metricNATSStoreCallbacksDropped.Inc()
+		nc.log.Error("too many confirmed stores waiting for store callbacks, dropping",
+			slog.String("account", d.Account),
+			slog.Int64("message_id", d.MessageID),
+			slog.Int64("size", d.Size))
+	}
+}
+
+// natsStoreCallbackLoop calls the registered callbacks for each confirmed store.
+func natsStoreCallbackLoop(queue chan NATSDurable) {
+	log := mlog.New("store", nil)
+	for d := range queue {
+		natsStoreCallbacks.Lock()
+		callbacks := slices.Clone(natsStoreCallbacks.callbacks)
+		natsStoreCallbacks.Unlock()
+
+		for _, cb := range callbacks {
+			func() {
+				defer func() {
+					x := recover()
+					if x != nil {
+						log.Error("unhandled panic in nats store callback", slog.Any("err", x), slog.Int64("message_id", d.MessageID))
+						debug.PrintStack()
+						metrics.PanicInc(metrics.Store)
+					}
+				}()
+				cb.fn(d)
+			}()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+func TestNATSStoreCallback(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// A panicking callback doesn't affect the store or the other callbacks.
+	var panics int
+	unregisterPanic := RegisterNATSStoreCallback(func(d NATSDurable) {
+		panics++
+		panic("bad callback")
+	})
+	defer unregisterPanic()
+
+	got := make(chan NATSDurable, 10)
+	unregister := RegisterNATSStoreCallback(func(d NATSDurable) {
+		got <- d
+	})
+	defer unregister()
+
+	wait := func() NATSDurable {
+		t.Helper()
+		select {
+		case d := <-got:
+			return d
+		case <-time.After(time.Second):
+			t.Fatalf("no store callback")
+		}
+		return NATSDurable{}
+	}
+
+	err := nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	err = nc.StoreMessage(ctxbg, 2, writeTestMessage(t, "longer test"))
+	tcheck(t, err, "store message")
+
+	d := wait()
+	tcompare(t, d.Account, "mjl")
+	tcompare(t, d.MessageID, int64(1))
+	tcompare(t, d.Size, int64(4))
+	d = wait()
+	tcompare(t, d.Account, "")
+	tcompare(t, d.MessageID, int64(2))
+	tcompare(t, d.Size, int64(11))
+	// Callbacks run in order, the panicking callback ran before each.
+	tcompare(t, panics, 2)
+	metrics.Panics.Add(-2) // Expected panics, don't fail TestMain.
+
+	// Unregistered callbacks aren't called anymore.
+	unregister()
+	unregisterPanic()
+	err = nc.StoreMessage(ctxbg, 3, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	select {
+	case d := <-got:
+		t.Fatalf("unregistered callback called for message %d", d.MessageID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
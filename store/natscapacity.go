@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+var (
+	metricNATSBucketBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_bucket_bytes",
+			Help: "Number of bytes used by the NATS object store bucket, at the last capacity check.",
+		},
+	)
+	metricNATSBucketMaxBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_bucket_max_bytes",
+			Help: "Maximum size in bytes of the NATS object store bucket, 0 if unlimited.",
+		},
+	)
+	metricNATSStorageNearlyFull = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_storage_nearly_full",
+			Help: "Whether usage of the NATS object store bucket is at or above the configured warning threshold (1) or not (0).",
+		},
+	)
+)
+
+// BucketCapacity is the usage of an object store bucket.
+type BucketCapacity struct {
+	Used uint64
+	Max  uint64 // 0 if the bucket has no size limit.
+}
+
+// Free returns the number of bytes still available, or 0 if the bucket has no limit.
+func (c BucketCapacity) Free() uint64 {
+	if c.Max == 0 || c.Used >= c.Max {
+		return 0
+	}
+	return c.Max - c.Used
+}
+
+// NearlyFull returns whether usage is at or above percent of the maximum size.
+// Buckets without limit are never nearly full.
+func (c BucketCapacity) NearlyFull(percent int) bool {
+	return c.Max > 0 && c.Used*100 >= c.Max*uint64(percent)
+}
+
+// streamInfoer is implemented by the object store status returned by jetstream,
+// giving access to the configured maximum size of the underlying stream.
+type streamInfoer interface {
+	StreamInfo() *jetstream.StreamInfo
+}
+
+// bucketCapacity returns the usage of the bucket of os.
+func bucketCapacity(ctx context.Context, os jetstream.ObjectStore) (BucketCapacity, error) {
+	status, err := os.Status(ctx)
+	if err != nil {
+		return BucketCapacity{}, fmt.Errorf("getting object store status: %w", err)
+	}
+	c := BucketCapacity{Used: status.Size()}
+	if si, ok := status.(streamInfoer); ok && si.StreamInfo() != nil && si.StreamInfo().Config.MaxBytes > 0 {
+		c.Max = uint64(si.StreamInfo().Config.MaxBytes)
+	}
+	return c, nil
+}
+
+// StorageNearlyFull returns whether bucket usage was at or above the configured
+// warning threshold (NATS.CapacityWarnPercent) at the last capacity check. Can be
+// used to throttle deliveries or alert before stores start failing.
+func (nc *NATSClient) StorageNearlyFull() bool {
+	if nc == nil {
+		return false
+	}
+	return nc.nearlyFull.Load()
+}
+
+// CheckCapacity fetches the current bucket usage, and updates the nearly full
+// state and metrics.
+func (nc *NATSClient) CheckCapacity(ctx context.Context) (BucketCapacity, error) {
+	if nc == nil {
+		return BucketCapacity{}, ErrNATSNotConfigured
+	}
+
+	c, err := bucketCapacity(ctx, nc.os)
+	if err != nil {
+		return BucketCapacity{}, err
+	}
+
+	percent := nc.config.CapacityWarnPercent
+	if percent <= 0 {
+		percent = 90
+	}
+	full := c.NearlyFull(percent)
+	if full && !nc.nearlyFull.Load() {
+		nc.log.Error("NATS object store bucket nearly full",
+			slog.Uint64("used", c.Used),
+			slog.Uint64("max", c.Max),
+			slog.Int("warnpercent", percent))
+	} else if !full && nc.nearlyFull.Load() {
+		nc.log.Info("NATS object store bucket no longer nearly full", slog.Uint64("used", c.Used), slog.Uint64("max", c.Max))
+	}
+	nc.nearlyFull.Store(full)
+
+	metricNATSBucketBytes.Set(float64(c.Used))
+	metricNATSBucketMaxBytes.Set(float64(c.Max))
+	if full {
+		metricNATSStorageNearlyFull.Set(1)
+	} else {
+		metricNATSStorageNearlyFull.Set(0)
+	}
+	return c, nil
+}
+
+// capacityLoop periodically checks bucket capacity until the client is closed.
+func (nc *NATSClient) capacityLoop() {
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS capacity check", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	interval := nc.config.CapacityCheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), nc.requestTimeout())
+		_, err := nc.CheckCapacity(ctx)
+		cancel()
+		nc.log.Check(err, "checking NATS object store capacity")
+
+		select {
+		case <-nc.closing:
+			return
+		case <-t.C:
+		}
+	}
+}
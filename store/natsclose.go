@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+)
+
+// ErrNATSClosed is returned for stores started after Close or CloseContext was
+// called.
+var ErrNATSClosed = errors.New("nats client closed")
+
+// beginStore registers a store started by a caller, failing with ErrNATSClosed
+// once the client is closing. The returned function must be called when the store
+// is done. Close waits for registered stores before closing the connection.
+func (nc *NATSClient) beginStore() (func(), error) {
+	nc.storesMu.Lock()
+	defer nc.storesMu.Unlock()
+	if nc.storesClosed {
+		return nil, ErrNATSClosed
+	}
+	nc.storesActive++
+	return func() {
+		nc.storesMu.Lock()
+		defer nc.storesMu.Unlock()
+		nc.storesActive--
+		if nc.storesClosed && nc.storesActive == 0 {
+			close(nc.storesIdle)
+		}
+	}, nil
+}
+
+// closeStores makes new stores fail with ErrNATSClosed, and waits for stores in
+// progress to finish, or ctx to be done. Returns whether all stores finished.
+func (nc *NATSClient) closeStores(ctx context.Context) bool {
+	nc.storesMu.Lock()
+	if !nc.storesClosed {
+		nc.storesClosed = true
+		nc.storesIdle = make(chan struct{})
+		if nc.storesActive == 0 {
+			close(nc.storesIdle)
+		}
+	}
+	idle := nc.storesIdle
+	nc.storesMu.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdownTimeout returns the maximum time to wait for stores and flushing at
+// shutdown.
+func (nc *NATSClient) shutdownTimeout() time.Duration {
+	if nc.config.ShutdownTimeout > 0 {
+		return nc.config.ShutdownTimeout
+	}
+	return 10 * time.Second
+}
+
+// natsDrainTimeout returns the maximum time to wait for the connection of cfg to
+// drain.
+func natsDrainTimeout(cfg *config.NATS) time.Duration {
+	if cfg.DrainTimeout > 0 {
+		return cfg.DrainTimeout
+	}
+	return 5 * time.Second
+}
+
+// natsDrainConn is the part of *nats.Conn for draining, for testing.
+type natsDrainConn interface {
+	Drain() error
+	IsClosed() bool
+	Close()
+}
+
+// drainNATSConn drains conn, letting in-flight publishes and requests finish, and
+// waits for it to be closed. If draining fails, or doesn't finish before ctx is
+// done, the connection is closed. Returns whether the drain finished.
+func drainNATSConn(ctx context.Context, log mlog.Log, conn natsDrainConn) bool {
+	if err := conn.Drain(); err != nil {
+		log.Errorx("draining NATS connection, closing", err)
+		conn.Close()
+		return false
+	}
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for !conn.IsClosed() {
+		select {
+		case <-ctx.Done():
+			log.Info("NATS connection drain not finished before deadline, closing")
+			conn.Close()
+			return false
+		case <-t.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSCloseStores(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", ShutdownTimeout: 5 * time.Second}, fos)
+
+	var active atomic.Int32
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		active.Add(1)
+		defer active.Add(-1)
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var stored, closed atomic.Int32
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				err := nc.StoreMessage(ctxbg, int64(i*1000+j), writeTestMessage(t, "test"))
+				if errors.Is(err, ErrNATSClosed) {
+					closed.Add(1)
+					return
+				} else if err != nil {
+					t.Errorf("store message: %v", err)
+					return
+				}
+				stored.Add(1)
+			}
+		}()
+	}
+
+	// Close while stores are in progress.
+	time.Sleep(5 * time.Millisecond)
+	err := nc.Close()
+	tcheck(t, err, "close")
+	if n := active.Load(); n != 0 {
+		t.Fatalf("%d puts still in progress after close", n)
+	}
+	wg.Wait()
+
+	// Every successful store is in the bucket, every other store failed clearly.
+	tcompare(t, len(fos.names()), int(stored.Load()))
+	if closed.Load() == 0 {
+		t.Fatalf("no store failed with ErrNATSClosed, close too late")
+	}
+	err = nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "test"))
+	if !errors.Is(err, ErrNATSClosed) {
+		t.Fatalf("got err %v, expected ErrNATSClosed", err)
+	}
+
+	// Closing again is fine.
+	err = nc.Close()
+	tcheck(t, err, "close again")
+}
+
+// fakeDrainConn closes itself after drainTime once drained, or never if zero.
+type fakeDrainConn struct {
+	sync.Mutex
+	drainErr  error
+	drainTime time.Duration
+	drained   time.Time
+	closed    bool
+	ops       []string
+}
+
+func (c *fakeDrainConn) Drain() error {
+	c.Lock()
+	defer c.Unlock()
+	c.ops = append(c.ops, "drain")
+	c.drained = time.Now()
+	return c.drainErr
+}
+
+func (c *fakeDrainConn) IsClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	if !c.closed && c.drainTime > 0 && time.Since(c.drained) >= c.drainTime {
+		c.closed = true
+		c.ops = append(c.ops, "drained")
+	}
+	return c.closed
+}
+
+func (c *fakeDrainConn) Close() {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	c.ops = append(c.ops, "close")
+}
+
+func TestNATSDrainConn(t *testing.T) {
+	tcompare(t, natsDrainTimeout(&config.NATS{}), 5*time.Second)
+	tcompare(t, natsDrainTimeout(&config.NATS{DrainTimeout: time.Second}), time.Second)
+	o := applyNATSOptions(t, &config.NATS{DrainTimeout: time.Second})
+	tcompare(t, o.DrainTimeout, time.Second)
+
+	drain := func(conn *fakeDrainConn, timeout time.Duration) bool {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctxbg, timeout)
+		defer cancel()
+		return drainNATSConn(ctx, pkglog, conn)
+	}
+
+	// A drain that finishes in time closes the connection itself.
+	conn := &fakeDrainConn{drainTime: 20 * time.Millisecond}
+	tcompare(t, drain(conn, time.Second), true)
+	tcompare(t, conn.ops, []string{"drain", "drained"})
+
+	// A drain that doesn't finish in time is followed by a close.
+	conn = &fakeDrainConn{}
+	tcompare(t, drain(conn, 50*time.Millisecond), false)
+	tcompare(t, conn.ops, []string{"drain", "close"})
+
+	// Failing to start draining, e.g. for an already closed connection, closes.
+	conn = &fakeDrainConn{drainErr: errors.New("nats: connection closed")}
+	tcompare(t, drain(conn, time.Second), false)
+	tcompare(t, conn.ops, []string{"drain", "close"})
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// Object metadata key holding the compression algorithm of a stored message, see
+// NATS.Compression. Absent for uncompressed objects.
+const natsCompressionKey = "compression"
+
+// NATSCompression is a compression algorithm for messages stored in NATS,
+// selected with NATS.Compression in the config. NewWriter returns a writer
+// compressing to w, whose Close flushes the compressed data but doesn't close w.
+// NewReader returns a reader decompressing r, r is closed by the caller.
+type NATSCompression interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type natsGzip struct{}
+
+func (natsGzip) NewWriter(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+func (natsGzip) NewReader(r io.Reader) (io.ReadCloser, error)  { return gzip.NewReader(r) }
+
+var natsCompressions = map[string]NATSCompression{
+	"gzip": natsGzip{},
+}
+
+// RegisterNATSCompression adds a compression algorithm that can be selected with
+// NATS.Compression in the config, e.g. zstd by programs embedding mox. Must be
+// called before InitNATS. Like transforms, algorithms are looked up by the name in
+// the object metadata when reading, so must stay registered as long as objects
+// compressed with them are read.
+func RegisterNATSCompression(name string, c NATSCompression) {
+	natsCompressions[name] = c
+}
+
+// natsCompressionName returns the algorithm of the Compression of cfg, empty for
+// no compression.
+func natsCompressionName(cfg *config.NATS) string {
+	if cfg.Compression == "none" {
+		return ""
+	}
+	return cfg.Compression
+}
+
+// checkNATSCompression checks that the Compression of cfg is supported.
+func checkNATSCompression(cfg *config.NATS) error {
+	if name := natsCompressionName(cfg); name != "" && natsCompressions[name] == nil {
+		return fmt.Errorf("unknown compression %q, must be none, gzip, or registered with RegisterNATSCompression", cfg.Compression)
+	}
+	return nil
+}
+
+// natsCompress returns r compressed with algorithm, compressing while the result
+// is read. Closing the result stops compressing, r is not closed.
+func natsCompress(r io.Reader, algorithm string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := natsCompressions[algorithm].NewWriter(pw)
+		if err == nil {
+			_, err = io.Copy(w, r)
+			if xerr := w.Close(); err == nil {
+				err = xerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// natsDecompressLoad returns object res, decompressed if its metadata has a
+// compression algorithm. Compression is applied after the transforms when storing,
+// so it is reversed before transformLoad.
+func natsDecompressLoad(res jetstream.ObjectResult) (jetstream.ObjectResult, error) {
+	info, err := res.Info()
+	if err != nil || info.Metadata[natsCompressionKey] == "" {
+		return res, nil
+	}
+	algorithm := info.Metadata[natsCompressionKey]
+	c := natsCompressions[algorithm]
+	if c == nil {
+		res.Close()
+		return nil, fmt.Errorf("object %q stored with unknown compression %q", info.Name, algorithm)
+	}
+	r, err := c.NewReader(res)
+	if err != nil {
+		res.Close()
+		return nil, fmt.Errorf("decompressing object %q: %w", info.Name, err)
+	}
+	return &natsTransformedResult{res, natsDecompressReader{r, res}}, nil
+}
+
+// natsDecompressReader reads decompressed data, closing both the decompressor and
+// the object on close.
+type natsDecompressReader struct {
+	io.ReadCloser
+	res io.Closer
+}
+
+func (r natsDecompressReader) Close() error {
+	err := r.ReadCloser.Close()
+	if xerr := r.res.Close(); err == nil {
+		err = xerr
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/config"
+)
+
+// flateCompression is a compression registered by tests, like programs embedding
+// mox would register e.g. zstd.
+type flateCompression struct{}
+
+func (flateCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.BestSpeed)
+}
+
+func (flateCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func TestNATSCompression(t *testing.T) {
+	RegisterNATSCompression("deflate", flateCompression{})
+
+	tcheck(t, checkNATSCompression(&config.NATS{}), "check without compression")
+	tcheck(t, checkNATSCompression(&config.NATS{Compression: "none"}), "check with compression none")
+	if err := checkNATSCompression(&config.NATS{Compression: "lzw"}); err == nil {
+		t.Fatalf("unknown compression accepted")
+	}
+
+	// With none, messages are stored as is.
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", Compression: "none"}, fos)
+	err := nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "plain"))
+	tcheck(t, err, "store message")
+	plainName := fos.names()[0]
+	fos.Lock()
+	o := fos.objects[plainName]
+	fos.Unlock()
+	tcompare(t, string(o.data), "plain")
+	tcompare(t, o.info.Metadata[natsCompressionKey], "")
+
+	msg := "From: mjl@mox.example\r\nSubject: test\r\n\r\n" + strings.Repeat("compressible body text\r\n", 200)
+
+	get := func(nc *NATSClient, name string) string {
+		t.Helper()
+		r, err := nc.getObject(ctxbg, name)
+		tcheck(t, err, "get")
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read")
+		return string(buf)
+	}
+
+	actx := WithMessageAccount(ctxbg, "mjl")
+	for algorithm := range natsCompressions {
+		fos := newFakeObjectStore()
+		nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", Compression: algorithm}, fos)
+		for i, m := range []string{msg, ""} {
+			id := int64(i + 1)
+			err := nc.StoreMessage(actx, id, writeTestMessage(t, m))
+			tcheck(t, err, "store message")
+			names := fos.names()
+			tcompare(t, len(names), i+1)
+
+			// Round trip through GetMessage.
+			r, err := nc.GetMessage(actx, id)
+			tcheck(t, err, "get message")
+			buf, err := io.ReadAll(r)
+			tcheck(t, err, "read message")
+			r.Close()
+			tcompare(t, string(buf), m)
+		}
+
+		// Stored compressed, with the algorithm in the metadata, and the digest over the
+		// compressed data.
+		info, err := nc.natsMessageObject(actx, "mjl", 1)
+		tcheck(t, err, "latest object")
+		fos.Lock()
+		o := fos.objects[info.Name]
+		fos.Unlock()
+		tcompare(t, o.info.Metadata[natsCompressionKey], algorithm)
+		if len(o.data) >= len(msg) {
+			t.Fatalf("%s: stored %d bytes for message of %d bytes", algorithm, len(o.data), len(msg))
+		}
+		sum := sha256.Sum256(o.data)
+		tcompare(t, o.info.Digest, "SHA-256="+base64.URLEncoding.EncodeToString(sum[:]))
+		tcompare(t, o.info.Size, uint64(len(o.data)))
+
+		// Readable after compression is disabled.
+		tcompare(t, get(nc, info.Name), msg)
+		tcompare(t, get(newTestNATSClient(nil, fos), info.Name), msg)
+	}
+
+	// Compression is applied after transforms, and reversed before them.
+	RegisterNATSTransform("archived", archivedHeader{})
+	fos = newFakeObjectStore()
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", Transforms: []string{"archived"}, Compression: "gzip"}, fos)
+	err = nc.StoreMessage(ctxbg, 1, writeTestMessage(t, msg))
+	tcheck(t, err, "store message")
+	name := fos.names()[0]
+	fos.Lock()
+	o = fos.objects[name]
+	fos.Unlock()
+	gzr, err := gzip.NewReader(bytes.NewReader(o.data))
+	tcheck(t, err, "gzip reader")
+	buf, err := io.ReadAll(gzr)
+	tcheck(t, err, "decompress")
+	tcompare(t, string(buf), archivedLine+msg)
+	tcompare(t, get(nc, name), msg)
+
+	// Objects with an unknown compression can't be read.
+	o.info.Metadata[natsCompressionKey] = "lzw"
+	fos.Lock()
+	fos.objects[name] = o
+	fos.Unlock()
+	if _, err := nc.getObject(ctxbg, name); err == nil {
+		t.Fatalf("get of object with unknown compression succeeded")
+	}
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNATSNotDeadLettered is returned by RequeueNATSDeadLetter for a name that is
+// not in the dead-letter or failed directory.
+var ErrNATSNotDeadLettered = errors.New("message not in nats dead-letter or failed directory")
+
+// NATSDeadLetter is a queued message set aside by the retry loop, see
+// ListNATSDeadLetters.
+type NATSDeadLetter struct {
+	Name      string // File name, for RequeueNATSDeadLetter.
+	Failed    bool   // In the failed directory after RetryMaxAttempts, otherwise in the dead-letter directory after a permanent error.
+	MessageID int64
+	Account   string
+	Enqueued  time.Time
+	Attempts  int
+	Size      int64     // Of message.
+	Moved     time.Time // Modification time of the file.
+	Err       error     // If set, the file is corrupt, other fields except Name, Failed and Moved may be zero.
+}
+
+// ListNATSDeadLetters returns the messages in the dead-letter directory, that
+// can never be stored, and the failed directory, that failed RetryMaxAttempts
+// attempts, sorted by the time they were moved there. The directories are next to
+// the pending directory, see SetNATSQueueDir.
+func ListNATSDeadLetters() ([]NATSDeadLetter, error) {
+	var l []NATSDeadLetter
+	for _, failed := range []bool{false, true} {
+		dir := natsDeadLetterDir(failed)
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", dir, err)
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), "msg-") {
+				continue
+			}
+			dl, err := readNATSDeadLetter(dir, e.Name(), failed)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // Requeued in the meantime.
+			} else if err != nil {
+				return nil, err
+			}
+			l = append(l, dl)
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].Moved.Before(l[j].Moved)
+	})
+	return l, nil
+}
+
+// natsDeadLetterDir returns the failed or dead-letter directory.
+func natsDeadLetterDir(failed bool) string {
+	if failed {
+		return failedNATSDir
+	}
+	return deadLetterNATSDir
+}
+
+// readNATSDeadLetter returns the dead-lettered message name in dir.
+func readNATSDeadLetter(dir, name string, failed bool) (NATSDeadLetter, error) {
+	dl := NATSDeadLetter{Name: name, Failed: failed}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return dl, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return dl, err
+	}
+	dl.Moved = fi.ModTime()
+
+	h, msgr, err := readQueueFile(f, name)
+	if err == nil {
+		err = verifyQueueFile(h, msgr)
+	}
+	if err != nil {
+		dl.Err = err
+		return dl, nil
+	}
+	dl.MessageID = h.MessageID
+	dl.Account = h.Account
+	dl.Enqueued = h.Enqueued
+	dl.Attempts = h.Attempts
+	dl.Size = msgr.Size()
+	return dl, nil
+}
+
+// RequeueNATSDeadLetter moves message name, as returned by ListNATSDeadLetters,
+// from the dead-letter or failed directory back to the pending directory, where
+// the retry loop stores it. Its attempts are reset, so it gets RetryMaxAttempts
+// attempts again, and it is retried right away. Messages moved to the dead-letter
+// directory fail again unless the cause was fixed, e.g. a bucket limit raised.
+func RequeueNATSDeadLetter(name string) error {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, "msg-") {
+		return fmt.Errorf("%w: invalid name %q", ErrNATSNotDeadLettered, name)
+	}
+	var src string
+	for _, failed := range []bool{false, true} {
+		p := filepath.Join(natsDeadLetterDir(failed), name)
+		if _, err := os.Stat(p); err == nil {
+			src = p
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if src == "" {
+		return fmt.Errorf("%w: %s", ErrNATSNotDeadLettered, name)
+	}
+
+	dst := filepath.Join(pendingNATSDir, name)
+	for _, p := range []string{dst, dst + natsClaimSuffix} {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%s already in pending directory", name)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h, msgr, err := readQueueFile(f, name)
+	if err == nil {
+		err = verifyQueueFile(h, msgr)
+	}
+	if err != nil {
+		return err
+	}
+	h.Attempts = 0
+	h.NextRetry = time.Time{}
+	if err := os.MkdirAll(pendingNATSDir, 0o700); err != nil {
+		return fmt.Errorf("creating pending directory: %w", err)
+	}
+	if err := writeQueueFile(dst, h, msgr, msgr.Size()); err != nil {
+		return fmt.Errorf("writing queue file: %w", err)
+	}
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("removing requeued message, remove by hand: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSDeadLetters(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+	defer os.RemoveAll(deadLetterNATSDir)
+	defer os.RemoveAll(failedNATSDir)
+
+	l, err := ListNATSDeadLetters()
+	tcheck(t, err, "list without directories")
+	tcompare(t, len(l), 0)
+
+	enqueued := time.Now().Add(-time.Hour).Round(0)
+	write := func(dir, name string, h queueHeader, msg string, moved time.Time) {
+		t.Helper()
+		os.MkdirAll(dir, 0o700)
+		p := filepath.Join(dir, name)
+		err := writeQueueFile(p, h, strings.NewReader(msg), int64(len(msg)))
+		tcheck(t, err, "write queue file")
+		err = os.Chtimes(p, moved, moved)
+		tcheck(t, err, "set time")
+	}
+	write(failedNATSDir, "msg-1-100-1", queueHeader{MessageID: 1, Account: "mjl", Enqueued: enqueued, Attempts: 5, NextRetry: time.Now().Add(time.Hour)}, "first", enqueued.Add(2*time.Minute))
+	write(deadLetterNATSDir, "msg-2-200-1", queueHeader{MessageID: 2, Account: "other", Enqueued: enqueued, Attempts: 1}, "second", enqueued.Add(time.Minute))
+	err = os.WriteFile(filepath.Join(deadLetterNATSDir, "msg-3-300-1"), nil, 0o600)
+	tcheck(t, err, "write corrupt file")
+	os.Chtimes(filepath.Join(deadLetterNATSDir, "msg-3-300-1"), enqueued.Add(3*time.Minute), enqueued.Add(3*time.Minute))
+
+	// Listed from both directories, in order of moving, corrupt files are reported.
+	l, err = ListNATSDeadLetters()
+	tcheck(t, err, "list")
+	tcompare(t, len(l), 3)
+	tcompare(t, l[0], NATSDeadLetter{Name: "msg-2-200-1", MessageID: 2, Account: "other", Enqueued: l[0].Enqueued, Attempts: 1, Size: 6, Moved: l[0].Moved})
+	tcompare(t, l[1], NATSDeadLetter{Name: "msg-1-100-1", Failed: true, MessageID: 1, Account: "mjl", Enqueued: l[1].Enqueued, Attempts: 5, Size: 5, Moved: l[1].Moved})
+	tcompare(t, l[0].Enqueued.Equal(enqueued), true)
+	tcompare(t, l[1].Moved.Equal(enqueued.Add(2*time.Minute)), true)
+	tcompare(t, l[2].Name, "msg-3-300-1")
+	if l[2].Err == nil {
+		t.Fatalf("no error for corrupt file")
+	}
+
+	// Requeued messages are retried right away, with their attempts reset.
+	err = RequeueNATSDeadLetter("msg-1-100-1")
+	tcheck(t, err, "requeue")
+	f, err := os.Open(filepath.Join(pendingNATSDir, "msg-1-100-1"))
+	tcheck(t, err, "open requeued file")
+	defer f.Close()
+	h, msgr, err := readQueueFile(f, "msg-1-100-1")
+	tcheck(t, err, "read requeued file")
+	err = verifyQueueFile(h, msgr)
+	tcheck(t, err, "verify requeued file")
+	tcompare(t, h.MessageID, int64(1))
+	tcompare(t, h.Account, "mjl")
+	tcompare(t, h.Attempts, 0)
+	tcompare(t, h.NextRetry.IsZero(), true)
+	if _, err := os.Stat(filepath.Join(failedNATSDir, "msg-1-100-1")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("requeued file still in failed directory, stat err %v", err)
+	}
+	l, err = ListNATSDeadLetters()
+	tcheck(t, err, "list after requeue")
+	tcompare(t, len(l), 2)
+
+	if err := RequeueNATSDeadLetter("msg-1-100-1"); !errors.Is(err, ErrNATSNotDeadLettered) {
+		t.Fatalf("got err %v, expected ErrNATSNotDeadLettered", err)
+	}
+	if err := RequeueNATSDeadLetter("../msg-1-100-1"); !errors.Is(err, ErrNATSNotDeadLettered) {
+		t.Fatalf("got err %v, expected ErrNATSNotDeadLettered for invalid name", err)
+	}
+
+	// Not when already queued, or corrupt.
+	err = writeQueueFile(filepath.Join(pendingNATSDir, "msg-2-200-1"), queueHeader{MessageID: 2, Enqueued: enqueued}, strings.NewReader("x"), 1)
+	tcheck(t, err, "write queue file")
+	if err := RequeueNATSDeadLetter("msg-2-200-1"); err == nil {
+		t.Fatalf("requeued message already in pending directory")
+	}
+	if err := RequeueNATSDeadLetter("msg-3-300-1"); err == nil {
+		t.Fatalf("requeued corrupt message")
+	}
+}
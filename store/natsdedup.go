@@ -0,0 +1,211 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+)
+
+var metricNATSDedupHits = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_nats_dedup_hits_total",
+		Help: "Number of messages stored in NATS with Dedup whose content was already stored, only adding a reference to the existing object.",
+	},
+)
+
+// With Dedup, objects are named after their content: this prefix followed by the
+// hexadecimal SHA-256 of the message.
+const natsDedupPrefix = "sha256-"
+
+// NATSDedupRef references the object holding the content of a message, with
+// Dedup. Messages with identical content, e.g. of a mailing list, share a single
+// object, which is removed along with its last reference.
+type NATSDedupRef struct {
+	ID         int64
+	ObjectName string    `bstore:"nonzero,index"`
+	MessageID  int64     `bstore:"nonzero,index"`
+	Account    string    `bstore:"index"` // Empty for messages stored without account.
+	Created    time.Time `bstore:"nonzero,default now"`
+}
+
+// checkNATSDedup checks that Dedup isn't combined with options that need
+// per-message object metadata or object names, or with encryption: the object
+// names would reveal the hash of the plaintext, confirming guessed messages.
+func checkNATSDedup(cfg *config.NATS) error {
+	if !cfg.Dedup {
+		return nil
+	}
+	if cfg.StoreThreadID || len(cfg.RetentionClasses) > 0 || cfg.SoftDeleteRetention > 0 {
+		return fmt.Errorf("dedup cannot be combined with StoreThreadID, RetentionClasses or SoftDeleteRetention")
+	}
+	if cfg.EncryptionKeyFile != "" {
+		return fmt.Errorf("dedup cannot be combined with EncryptionKeyFile, object names would reveal the hash of messages")
+	}
+	return nil
+}
+
+// isNATSDedupObject returns whether name is of an object stored with Dedup.
+func isNATSDedupObject(name string) bool {
+	return strings.HasPrefix(name, natsDedupPrefix)
+}
+
+// natsDedupObjectName returns the name of the object for the size bytes of
+// message r with Dedup, from the SHA-256 of the message as stored locally, before
+// transforms.
+func natsDedupObjectName(r io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return "", fmt.Errorf("reading message for content hash: %w", err)
+	}
+	return natsDedupPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// natsDedupExisting returns the info of object name in os if it exists, after
+// adding a reference to it for message messageID. If the object doesn't exist,
+// nil is returned and the caller stores the object.
+func (nc *NATSClient) natsDedupExisting(ctx context.Context, os jetstream.ObjectStore, name string, messageID int64) (*jetstream.ObjectInfo, error) {
+	nc.dedupMu.Lock()
+	defer nc.dedupMu.Unlock()
+
+	info, err := os.GetInfo(ctx, name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("looking up object %q for dedup: %w", name, err)
+	}
+	if err := natsDedupAdd(ctx, name, messageID); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// natsDedupStored adds the reference of message messageID to object name, just
+// stored in os. If the object is gone again, because the removal of its last
+// reference raced the store, the reference is not added and an error returned,
+// so the message is stored again on retry.
+func (nc *NATSClient) natsDedupStored(ctx context.Context, os jetstream.ObjectStore, name string, messageID int64) error {
+	nc.dedupMu.Lock()
+	defer nc.dedupMu.Unlock()
+
+	if _, err := os.GetInfo(ctx, name); err != nil {
+		return fmt.Errorf("verifying object %q after store for dedup: %w", name, err)
+	}
+	return natsDedupAdd(ctx, name, messageID)
+}
+
+// natsDedupAdd adds the reference of message messageID of the account of ctx to
+// object name, if not present yet.
+func natsDedupAdd(ctx context.Context, name string, messageID int64) error {
+	return AuthDB.Write(ctx, func(tx *bstore.Tx) error {
+		ref := NATSDedupRef{ObjectName: name, MessageID: messageID, Account: messageAccount(ctx)}
+		q := bstore.QueryTx[NATSDedupRef](tx)
+		q.FilterNonzero(ref)
+		q.FilterEqual("Account", ref.Account)
+		if exists, err := q.Exists(); err != nil {
+			return fmt.Errorf("looking up dedup reference: %w", err)
+		} else if exists {
+			return nil
+		}
+		if err := tx.Insert(&ref); err != nil {
+			return fmt.Errorf("adding dedup reference: %w", err)
+		}
+		return nil
+	})
+}
+
+// natsDedupRefs returns the references of message messageID of account, or of any
+// account if account is empty.
+func natsDedupRefs(ctx context.Context, account string, messageID int64) ([]NATSDedupRef, error) {
+	q := bstore.QueryDB[NATSDedupRef](ctx, AuthDB)
+	q.FilterNonzero(NATSDedupRef{MessageID: messageID, Account: account})
+	refs, err := q.List()
+	if err != nil {
+		return nil, fmt.Errorf("looking up dedup references of message: %w", err)
+	}
+	return refs, nil
+}
+
+// dedupRelease removes the references of message messageID of account, or of any
+// account if account is empty, to object name in os, and removes the object when
+// no references remain. Returns whether the object was removed.
+func (nc *NATSClient) dedupRelease(ctx context.Context, os jetstream.ObjectStore, account string, messageID int64, name string) (bool, error) {
+	nc.dedupMu.Lock()
+	defer nc.dedupMu.Unlock()
+
+	var left int
+	err := AuthDB.Write(ctx, func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[NATSDedupRef](tx)
+		q.FilterNonzero(NATSDedupRef{ObjectName: name, MessageID: messageID, Account: account})
+		if _, err := q.Delete(); err != nil {
+			return fmt.Errorf("removing dedup references: %w", err)
+		}
+		// Headers are stored per message.
+		qh := bstore.QueryTx[NATSMessageHeader](tx)
+		qh.FilterNonzero(NATSMessageHeader{ObjectName: name, MessageID: messageID})
+		if _, err := qh.Delete(); err != nil {
+			return fmt.Errorf("removing stored message headers: %w", err)
+		}
+		var err error
+		left, err = bstore.QueryTx[NATSDedupRef](tx).FilterNonzero(NATSDedupRef{ObjectName: name}).Count()
+		if err != nil {
+			return fmt.Errorf("counting dedup references: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	} else if left > 0 {
+		nc.log.Debug("released dedup reference, object still referenced", slog.String("object_name", name), slog.Int64("message_id", messageID), slog.Int("references", left))
+		return false, nil
+	}
+	if err := nc.removeObject(ctx, os, name); err != nil && !errors.Is(err, ErrMessageNotFound) {
+		return false, fmt.Errorf("removing object %q after last dedup reference: %w", name, err)
+	}
+	return true, nil
+}
+
+// releaseAccountDedup removes the dedup references of all messages of account,
+// removing objects no longer referenced, for DeleteAccountObjects. Each reference
+// is counted as an object of the account in res.
+func (nc *NATSClient) releaseAccountDedup(ctx context.Context, account string, res *NATSAccountDeletion) error {
+	if AuthDB == nil {
+		return nil
+	}
+	q := bstore.QueryDB[NATSDedupRef](ctx, AuthDB)
+	q.FilterNonzero(NATSDedupRef{Account: account})
+	refs, err := q.List()
+	if err != nil {
+		return fmt.Errorf("listing dedup references of account: %w", err)
+	}
+	var errs []error
+	for _, ref := range refs {
+		if ctx.Err() != nil {
+			break
+		}
+		res.Objects++
+		os, err := nc.objectBucket(ctx, ref.ObjectName)
+		if err == nil {
+			_, err = nc.dedupRelease(ctx, os, account, ref.MessageID, ref.ObjectName)
+		}
+		if err != nil {
+			res.Failed++
+			errs = append(errs, err)
+		} else {
+			res.Deleted++
+		}
+	}
+	return errors.Join(errs...)
+}
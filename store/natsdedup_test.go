@@ -0,0 +1,107 @@
+package store
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSDedup(t *testing.T) {
+	// Dedup needs auth.db for its references.
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", Dedup: true}, fos)
+	if err := nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "test")); err == nil {
+		t.Fatalf("store with dedup without auth.db succeeded")
+	}
+
+	openTestAuthDB(t)
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", Dedup: true}, fos)
+	ctx := WithMessageAccount(ctxbg, "mjl")
+
+	// Identical content is stored as a single object, the second store only adds a
+	// reference.
+	hits := testutil.ToFloat64(metricNATSDedupHits)
+	const s = "Subject: list message\r\n\r\nsame for everyone\r\n"
+	err := nc.StoreMessage(ctx, 1, writeTestMessage(t, s))
+	tcheck(t, err, "store message")
+	err = nc.StoreMessage(ctx, 2, writeTestMessage(t, s))
+	tcheck(t, err, "store identical message")
+	err = nc.StoreMessage(ctx, 3, writeTestMessage(t, "other"))
+	tcheck(t, err, "store other message")
+	names := fos.names()
+	tcompare(t, len(names), 2)
+	for _, name := range names {
+		if !strings.HasPrefix(name, natsDedupPrefix) {
+			t.Fatalf("object name %q without dedup prefix", name)
+		}
+	}
+	tcompare(t, testutil.ToFloat64(metricNATSDedupHits)-hits, 1.0)
+
+	get := func(id int64) string {
+		t.Helper()
+		r, err := nc.GetMessage(ctx, id)
+		tcheck(t, err, "get message")
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read message")
+		return string(buf)
+	}
+	tcompare(t, get(1), s)
+	tcompare(t, get(2), s)
+	tcompare(t, get(3), "other")
+
+	// The object remains while referenced, and is removed with its last reference.
+	err = nc.DeleteMessage(ctx, 1)
+	tcheck(t, err, "delete message")
+	tcompare(t, len(fos.names()), 2)
+	if _, err := nc.GetMessage(ctx, 1); err == nil {
+		t.Fatalf("got deleted message")
+	}
+	tcompare(t, get(2), s)
+	err = nc.DeleteMessage(ctx, 2)
+	tcheck(t, err, "delete last reference")
+	tcompare(t, len(fos.names()), 1)
+
+	// Storing the content again after removal creates a new object.
+	err = nc.StoreMessage(ctx, 4, writeTestMessage(t, s))
+	tcheck(t, err, "store message again")
+	tcompare(t, len(fos.names()), 2)
+	tcompare(t, get(4), s)
+
+	// Removing an account only removes the objects other accounts don't reference.
+	octx := WithMessageAccount(ctxbg, "other")
+	err = nc.StoreMessage(octx, 1, writeTestMessage(t, s))
+	tcheck(t, err, "store message of other account")
+	err = nc.StoreMessage(octx, 2, writeTestMessage(t, "only other"))
+	tcheck(t, err, "store message of other account")
+	tcompare(t, len(fos.names()), 3)
+	res, err := nc.DeleteAccountObjects(ctxbg, "other")
+	tcheck(t, err, "delete account objects")
+	tcompare(t, res, NATSAccountDeletion{Objects: 2, Deleted: 2})
+	tcompare(t, len(fos.names()), 2)
+	tcompare(t, get(4), s)
+	if _, err := nc.GetMessage(octx, 1); err == nil {
+		t.Fatalf("got message of removed account")
+	}
+	_, err = nc.DeleteAccountObjects(ctxbg, "mjl")
+	tcheck(t, err, "delete account objects")
+	tcompare(t, len(fos.names()), 0)
+
+	// Options needing per-message objects are rejected.
+	for _, cfg := range []config.NATS{
+		{Dedup: true, StoreThreadID: true},
+		{Dedup: true, RetentionClasses: map[string]string{"transient": "168h"}},
+		{Dedup: true, SoftDeleteRetention: time.Hour},
+		{Dedup: true, EncryptionKeyFile: "nats-encryption.key"},
+	} {
+		if err := checkNATSDedup(&cfg); err == nil {
+			t.Fatalf("dedup with %#v accepted", cfg)
+		}
+	}
+	tcheck(t, checkNATSDedup(&config.NATS{Dedup: true}), "check dedup")
+}
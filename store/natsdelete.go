@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+var metricNATSMessageObjectsDeleted = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_nats_message_objects_deleted_total",
+		Help: "Number of objects removed from the NATS object store, or marked as deleted with soft-delete, for removed messages.",
+	},
+)
+
+// DeleteMessage removes all stored objects of message messageID of the account of
+// ctx, see WithMessageAccount, e.g. after the message was expunged. Message IDs are
+// only unique per account, without account an error wrapping ErrNATSNoAccount is
+// returned and nothing is removed. With SoftDeleteRetention, objects are marked
+// as deleted instead, see UndeleteMessage. With Dedup, only the reference of the
+// message to the object with its content is removed, and the object once no
+// message references it. Objects that are already gone are not an error. Removed
+// objects are counted in metric mox_nats_message_objects_deleted_total.
+func (nc *NATSClient) DeleteMessage(ctx context.Context, messageID int64) error {
+	if nc == nil {
+		return nil // NATS not configured
+	}
+
+	infos, err := nc.natsMessageObjects(ctx, messageAccount(ctx), messageID)
+	if err != nil {
+		return err
+	}
+	var deleted int
+	for _, info := range infos {
+		// During a migration, also from the old bucket, it would be copied again
+		// otherwise.
+		os, err := nc.objectBucket(WithMessageAccount(ctx, info.Metadata[natsAccountKey]), info.Name)
+		if err != nil {
+			return err
+		}
+		stores := []jetstream.ObjectStore{os}
+		if isNATSDedupObject(info.Name) {
+			// Shared with messages with identical content, only removed with the last
+			// reference.
+			removed, err := nc.dedupRelease(ctx, os, messageAccount(ctx), messageID, info.Name)
+			if err != nil {
+				return err
+			} else if !removed {
+				continue
+			}
+			stores = nil
+		}
+		if old := nc.migrating(); old != nil {
+			stores = append(stores, old)
+		}
+		for _, os := range stores {
+			if err := nc.removeObject(ctx, os, info.Name); err != nil && !errors.Is(err, ErrMessageNotFound) {
+				return fmt.Errorf("removing object %q of message: %w", info.Name, err)
+			}
+		}
+		deleted++
+		metricNATSMessageObjectsDeleted.Inc()
+	}
+	nc.log.Debug("removed nats objects of message",
+		slog.String("account", messageAccount(ctx)),
+		slog.Int64("message_id", messageID),
+		slog.Int("objects", deleted))
+	return nil
+}
+
+// deleteErased removes the objects of erased messages ids of account in the
+// background, unless KeepExpunged is set. Failures are logged, the objects are
+// left as orphans, see ScanNATSOrphans.
+func (nc *NATSClient) deleteErased(account string, ids []int64) {
+	if nc == nil || nc.config.KeepExpunged || len(ids) == 0 {
+		return
+	}
+	release, err := nc.acquireGoroutine(context.Background())
+	if err != nil {
+		nc.log.Errorx("waiting for goroutine for removing nats objects of erased messages", err, slog.String("account", account))
+		return
+	}
+	go func() {
+		defer release()
+		defer func() {
+			x := recover()
+			if x != nil {
+				nc.log.Error("unhandled panic removing nats objects of erased messages", slog.Any("err", x))
+				debug.PrintStack()
+				metrics.PanicInc(metrics.Store)
+			}
+		}()
+
+		for _, id := range ids {
+			ctx, cancel := context.WithTimeout(WithMessageAccount(context.Background(), account), nc.requestTimeout())
+			err := nc.DeleteMessage(ctx, id)
+			cancel()
+			nc.log.Check(err, "removing nats objects of erased message", slog.String("account", account), slog.Int64("message_id", id))
+		}
+	}()
+}
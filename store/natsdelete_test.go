@@ -0,0 +1,229 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestNATSDeleteMessage(t *testing.T) {
+	var nilClient *NATSClient
+	err := nilClient.DeleteMessage(ctxbg, 1)
+	tcheck(t, err, "delete without nats")
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	add := func(name, account string) {
+		t.Helper()
+		meta := jetstream.ObjectMeta{Name: name, Metadata: map[string]string{natsAccountKey: account}}
+		_, err := fos.Put(ctxbg, meta, writeTestMessage(t, "test"))
+		tcheck(t, err, "put object")
+	}
+	add("msg-1-100", "mjl")
+	add("msg-1-200", "mjl")
+	add("msg-2-100", "mjl")
+	add("msg-1-300", "other")
+
+	// All objects of the message of the account are removed, not those of other
+	// messages or other accounts.
+	deleted := testutil.ToFloat64(metricNATSMessageObjectsDeleted)
+	err = nc.DeleteMessage(WithMessageAccount(ctxbg, "mjl"), 1)
+	tcheck(t, err, "delete message")
+	tcompare(t, fos.names(), []string{"msg-1-300", "msg-2-100"})
+	tcompare(t, testutil.ToFloat64(metricNATSMessageObjectsDeleted)-deleted, 2.0)
+
+	// Without account, nothing is removed: message 2 of every account would match.
+	err = nc.DeleteMessage(ctxbg, 2)
+	if !errors.Is(err, ErrNATSNoAccount) {
+		t.Fatalf("got err %v, expected ErrNATSNoAccount", err)
+	}
+	tcompare(t, fos.names(), []string{"msg-1-300", "msg-2-100"})
+
+	// Already gone is not an error, and not counted.
+	err = nc.DeleteMessage(WithMessageAccount(ctxbg, "mjl"), 1)
+	tcheck(t, err, "delete message again")
+	tcompare(t, testutil.ToFloat64(metricNATSMessageObjectsDeleted)-deleted, 2.0)
+
+	// With soft-delete, objects are only marked as deleted.
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", SoftDeleteRetention: time.Hour}, fos)
+	err = nc.DeleteMessage(WithMessageAccount(ctxbg, "mjl"), 2)
+	tcheck(t, err, "soft-delete message")
+	info, err := fos.GetInfo(ctxbg, "msg-2-100")
+	tcheck(t, err, "get info")
+	_, softDeleted := natsDeletedAt(info)
+	tcompare(t, softDeleted, true)
+}
+
+func TestNATSDeleteExpunged(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer Switchboard()()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+
+	acc, err := OpenAccount(pkglog, "mjl", true)
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.WaitClosed()
+	}()
+
+	f, err := CreateMessageTemp(pkglog, "account-test")
+	tcheck(t, err, "temp file")
+	defer os.Remove(f.Name())
+	defer f.Close()
+	const s = "Subject: test\r\n\r\ntest\r\n"
+	_, err = f.WriteString(s)
+	tcheck(t, err, "write message")
+	m := Message{
+		Size:     int64(len(s)),
+		Received: time.Now(),
+	}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(pkglog, "Inbox", &m, f)
+	})
+	tcheck(t, err, "deliver")
+	// Wait for the asynchronous store.
+	for range 100 {
+		if len(fos.names()) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tcompare(t, len(fos.names()), 1)
+
+	// Expunge, the object is removed once the message is erased.
+	acc.WithWLock(func() {
+		var changes []Change
+		err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+			mb := Mailbox{ID: m.MailboxID}
+			if err := tx.Get(&mb); err != nil {
+				return err
+			}
+			modseq, err := acc.NextModSeq(tx)
+			if err != nil {
+				return err
+			}
+			err = tx.Get(&m)
+			if err != nil {
+				return err
+			}
+			chrem, chcounts, err := acc.MessageRemove(pkglog, tx, modseq, &mb, RemoveOpts{}, m)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, chrem, chcounts)
+			return tx.Update(&mb)
+		})
+		BroadcastChanges(acc, changes)
+	})
+	tcheck(t, err, "expunge message")
+	for range 100 {
+		if len(fos.names()) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tcompare(t, len(fos.names()), 0)
+}
+
+func TestNATSDeleteAfterStore(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer Switchboard()()
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", DeleteAfterStore: true}, fos)
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+
+	acc, err := OpenAccount(pkglog, "mjl", true)
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.WaitClosed()
+	}()
+
+	deliver := func() (*os.File, Message, error) {
+		t.Helper()
+		f := writeTestMessage(t, "Subject: test\r\n\r\ntest\r\n")
+		fi, err := f.Stat()
+		tcheck(t, err, "stat message")
+		m := Message{
+			Size:     fi.Size(),
+			Received: time.Now(),
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(pkglog, "Inbox", &m, f)
+		})
+		return f, m, err
+	}
+
+	// After a successful store, the delivered message file is gone, the file of the
+	// caller remains.
+	f, m, err := deliver()
+	tcheck(t, err, "deliver")
+	tcompare(t, len(fos.names()), 1)
+	if _, err := os.Stat(acc.MessagePath(m.ID)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("message file still present after store: %v", err)
+	}
+	_, err = os.Stat(f.Name())
+	tcheck(t, err, "stat message file of caller")
+	err = acc.DB.Get(ctxbg, &m)
+	tcheck(t, err, "get message")
+	tcompare(t, m.Expunged, true)
+
+	// When the store fails, the delivery fails and the file of the caller remains.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("put failed") }
+	f, _, err = deliver()
+	if err == nil {
+		t.Fatalf("deliver succeeded with failing store")
+	}
+	_, err = os.Stat(f.Name())
+	tcheck(t, err, "stat message file of caller after failed store")
+	tcompare(t, len(fos.names()), 1)
+	// Not queued, the message ID is used again by the next delivery.
+	tcompare(t, countPendingNATS(), 0)
+	fos.putHook = nil
+
+	// With batched puts, the message file is only removed once the put of its batch
+	// is confirmed, and kept when it fails.
+	syncPut := false
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", DeleteAfterStore: true, SyncPut: &syncPut}, fos)
+	globalNATSClient = nc
+	defer nc.Close()
+	fos.putHook = nil
+	_, m, err = deliver()
+	tcheck(t, err, "deliver with batched puts")
+	tcompare(t, len(fos.names()), 2)
+	if _, err := os.Stat(acc.MessagePath(m.ID)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("message file still present after batched store: %v", err)
+	}
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("put failed") }
+	if _, _, err := deliver(); err == nil {
+		t.Fatalf("deliver succeeded with failing batched store")
+	}
+	tcompare(t, len(fos.names()), 2)
+}
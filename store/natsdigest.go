@@ -0,0 +1,61 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricNATSDigestMismatch = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_nats_digest_mismatch_total",
+		Help: "Number of stores to the NATS object store that failed because the digest or size reported by NATS did not match the data sent.",
+	},
+)
+
+// errNATSDigestMismatch is returned for a store for which the object store
+// reported a different digest or size than of the data sent. The store is treated
+// as failed, and retried like other failed stores.
+var errNATSDigestMismatch = errors.New("digest of stored object does not match message")
+
+// natsDigestReader computes the SHA-256 digest and size of the data read through
+// it, for comparing with the object info returned by a Put.
+type natsDigestReader struct {
+	r    io.Reader
+	h    hash.Hash
+	size int64
+}
+
+func newNATSDigestReader(r io.Reader) *natsDigestReader {
+	return &natsDigestReader{r: r, h: sha256.New()}
+}
+
+func (d *natsDigestReader) Read(buf []byte) (int, error) {
+	n, err := d.r.Read(buf)
+	d.h.Write(buf[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+// digest returns the digest of the data read, in the form of
+// jetstream.ObjectInfo.Digest.
+func (d *natsDigestReader) digest() string {
+	return "SHA-256=" + base64.URLEncoding.EncodeToString(d.h.Sum(nil))
+}
+
+// verify returns an error wrapping errNATSDigestMismatch if info doesn't describe
+// the data read.
+func (d *natsDigestReader) verify(info *jetstream.ObjectInfo) error {
+	if exp := d.digest(); info.Digest != exp || info.Size != uint64(d.size) {
+		metricNATSDigestMismatch.Inc()
+		return fmt.Errorf("%w: object %q has size %d, digest %s, sent %d bytes with digest %s", errNATSDigestMismatch, info.Name, info.Size, info.Digest, d.size, exp)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mjl-/bstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNATSDigestVerify(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+	openTestAuthDB(t)
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// An object that doesn't match what was sent fails the store, and is removed.
+	mismatches := testutil.ToFloat64(metricNATSDigestMismatch)
+	fos.putCorrupt = true
+	err := nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "test"))
+	if !errors.Is(err, errNATSDigestMismatch) {
+		t.Fatalf("got err %v, expected errNATSDigestMismatch", err)
+	}
+	tcompare(t, len(fos.names()), 0)
+	tcompare(t, testutil.ToFloat64(metricNATSDigestMismatch)-mismatches, 1.0)
+
+	// It is a temporary failure, the message is queued and stored on retry.
+	err = nc.StoreMessageWithQueue(ctxbg, 2, writeTestMessage(t, "test"))
+	if !errors.Is(err, errNATSDigestMismatch) {
+		t.Fatalf("got err %v, expected errNATSDigestMismatch", err)
+	}
+	tcompare(t, countPendingNATS(), 1)
+	fos.putCorrupt = false
+	stored, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, stored, 1)
+
+	// The index row has the verified digest.
+	sum := sha256.Sum256([]byte("test"))
+	refs, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).FilterNonzero(NATSObjectRef{MessageID: 2, State: NATSObjectStored}).List()
+	tcheck(t, err, "list index rows")
+	tcompare(t, len(refs), 1)
+	tcompare(t, refs[0].Digest, "SHA-256="+base64.URLEncoding.EncodeToString(sum[:]))
+	tcompare(t, testutil.ToFloat64(metricNATSDigestMismatch)-mismatches, 2.0)
+}
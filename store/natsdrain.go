@@ -0,0 +1,75 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricNATSDrainConcurrency = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "mox_nats_drain_concurrency",
+		Help: "Current number of queued messages the NATS retry loop may store at the same time, 0 when not draining.",
+	},
+)
+
+// natsDrainLimiter limits the number of concurrent stores while draining the
+// pending queue, like TCP slow-start: it starts at 1, allows one more for each
+// success up to a maximum, and halves the limit on each failure. This keeps a
+// large backlog from overloading a NATS cluster that just recovered.
+type natsDrainLimiter struct {
+	sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	max      int
+	inflight int
+}
+
+// newNATSDrainLimiter returns a limiter for draining with at most max stores at
+// the same time, NATS.RetryConcurrency.
+func newNATSDrainLimiter(max int) *natsDrainLimiter {
+	if max <= 0 {
+		max = 4
+	}
+	l := &natsDrainLimiter{limit: 1, max: max}
+	l.cond = sync.NewCond(&l.Mutex)
+	metricNATSDrainConcurrency.Set(1)
+	return l
+}
+
+// acquire waits until another store is allowed.
+func (l *natsDrainLimiter) acquire() {
+	l.Lock()
+	defer l.Unlock()
+	for l.inflight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inflight++
+}
+
+// release marks a store as done. A store that failed due to NATS halves the
+// limit, a stored message increases it. Other outcomes, such as dead-lettered
+// messages, leave the limit as is.
+func (l *natsDrainLimiter) release(stored, failed bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.inflight--
+	if failed {
+		l.limit = max(l.limit/2, 1)
+	} else if stored {
+		l.limit = min(l.limit+1, l.max)
+	}
+	metricNATSDrainConcurrency.Set(float64(l.limit))
+	l.cond.Broadcast()
+}
+
+// wait waits until no stores are in flight, and resets the metric.
+func (l *natsDrainLimiter) wait() {
+	l.Lock()
+	defer l.Unlock()
+	for l.inflight > 0 {
+		l.cond.Wait()
+	}
+	metricNATSDrainConcurrency.Set(0)
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+// NATSDurable confirms a message is durably stored in NATS.
+type NATSDurable struct {
+	Account    string // Empty for messages stored without account.
+	MessageID  int64
+	ObjectName string
+	Bucket     string
+	Size       int64
+	Time       time.Time // When the store was confirmed.
+}
+
+// OnNATSDurable, if set, is called for each message that is confirmed stored in
+// NATS, by any store path, also when storing a queued message after a failed
+// store. The callback runs synchronously in the store path, so it should not block
+// for long. Panics are recovered and logged. Must be set before InitNATS.
+var OnNATSDurable func(d NATSDurable)
+
+type natsDurableKey struct {
+	account   string
+	messageID int64
+}
+
+// NotifyDurable returns a channel that receives the confirmation once message
+// messageID of account is durably stored in NATS, e.g. for deferring the final
+// acknowledgement of a delivery until then. Register before storing, to not miss
+// the confirmation. The channel receives at most one value, and never if the
+// message can't be stored, so waits must be bounded. The returned function must be
+// called when no longer waiting, it unregisters the channel.
+func (nc *NATSClient) NotifyDurable(account string, messageID int64) (<-chan NATSDurable, func()) {
+	ch := make(chan NATSDurable, 1)
+	key := natsDurableKey{account, messageID}
+	nc.durableMu.Lock()
+	defer nc.durableMu.Unlock()
+	if nc.durableWaiters == nil {
+		nc.durableWaiters = map[natsDurableKey][]chan NATSDurable{}
+	}
+	nc.durableWaiters[key] = append(nc.durableWaiters[key], ch)
+	return ch, func() {
+		nc.durableMu.Lock()
+		defer nc.durableMu.Unlock()
+		l := nc.durableWaiters[key]
+		for i, c := range l {
+			if c == ch {
+				l = append(l[:i], l[i+1:]...)
+				break
+			}
+		}
+		if len(l) == 0 {
+			delete(nc.durableWaiters, key)
+		} else {
+			nc.durableWaiters[key] = l
+		}
+	}
+}
+
+// confirmDurable sends the confirmation for a stored message to the waiters
+// registered with NotifyDurable, queues it for the store callbacks, and calls
+// OnNATSDurable.
+func (nc *NATSClient) confirmDurable(account string, messageID int64, info *jetstream.ObjectInfo) {
+	d := NATSDurable{
+		Account:    account,
+		MessageID:  messageID,
+		ObjectName: info.Name,
+		Bucket:     info.Bucket,
+		Size:       int64(info.Size),
+		Time:       time.Now(),
+	}
+
+	nc.durableMu.Lock()
+	key := natsDurableKey{account, messageID}
+	for _, ch := range nc.durableWaiters[key] {
+		select {
+		case ch <- d:
+		default:
+			// Already confirmed, e.g. by an earlier store of the same message.
+		}
+	}
+	nc.durableMu.Unlock()
+
+	nc.queueStoreCallbacks(d)
+
+	if OnNATSDurable == nil {
+		return
+	}
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in durable callback", slog.Any("err", x), slog.Int64("message_id", messageID))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+	OnNATSDurable(d)
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestNATSDurable(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+	defer func() { OnNATSDurable = nil }()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	var got []NATSDurable
+	OnNATSDurable = func(d NATSDurable) {
+		got = append(got, d)
+	}
+
+	wait := func(ch <-chan NATSDurable) NATSDurable {
+		t.Helper()
+		select {
+		case d := <-ch:
+			return d
+		case <-time.After(time.Second):
+			t.Fatalf("no durable confirmation")
+		}
+		return NATSDurable{}
+	}
+
+	// Confirmation after a successful store.
+	ch, done := nc.NotifyDurable("mjl", 1)
+	defer done()
+	other, otherDone := nc.NotifyDurable("other", 1)
+	defer otherDone()
+	err := nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	d := wait(ch)
+	tcompare(t, d.Account, "mjl")
+	tcompare(t, d.MessageID, int64(1))
+	tcompare(t, d.ObjectName, fos.names()[0])
+	tcompare(t, d.Bucket, "test-bucket")
+	tcompare(t, d.Size, int64(4))
+	tcompare(t, got, []NATSDurable{d})
+	// Same message ID of another account isn't confirmed.
+	select {
+	case <-other:
+		t.Fatalf("confirmation for message of other account")
+	default:
+	}
+
+	// Confirmation after a failed store, once the queued message is stored.
+	ch, done = nc.NotifyDurable("mjl", 2)
+	defer done()
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	err = nc.StoreMessageWithQueue(WithMessageAccount(ctxbg, "mjl"), 2, writeTestMessage(t, "test"))
+	if err == nil {
+		t.Fatalf("store succeeded with failing put")
+	}
+	select {
+	case <-ch:
+		t.Fatalf("confirmation for failed store")
+	default:
+	}
+	fos.putHook = nil
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 1)
+	d = wait(ch)
+	tcompare(t, d.Account, "mjl")
+	tcompare(t, d.MessageID, int64(2))
+	tcompare(t, len(got), 2)
+
+	// Unregistered channels are removed.
+	done()
+	nc.durableMu.Lock()
+	_, ok := nc.durableWaiters[natsDurableKey{"mjl", 2}]
+	nc.durableMu.Unlock()
+	tcompare(t, ok, false)
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// Object metadata keys of encrypted objects, with EncryptionKeyFile: the
+// algorithm, the ID of the key, and the random base nonce of the object.
+const (
+	natsEncryptionKey      = "encryption"
+	natsEncryptionKeyIDKey = "encryption-key-id"
+	natsEncryptionNonceKey = "encryption-nonce"
+)
+
+const natsEncryptionAlgorithm = "aes-256-gcm"
+
+// Messages are encrypted in chunks, so they can be streamed. Each chunk of
+// plaintext is sealed separately, with a nonce derived from the base nonce and the
+// chunk number. The last chunk is shorter than natsEncryptChunkSize, possibly
+// empty, and sealed with a final marker as additional data, so truncation at a
+// chunk boundary is detected.
+const natsEncryptChunkSize = 64 * 1024
+
+// ErrNATSDecrypt is returned when reading an encrypted object fails, e.g. because
+// it was encrypted with a key that isn't configured, or it was changed.
+var ErrNATSDecrypt = errors.New("decrypting nats object")
+
+// natsEncryptionKeys holds the key for encrypting new objects, and all keys for
+// decrypting objects by key ID.
+type natsEncryptionKeys struct {
+	id   string // Of key for encrypting, empty if not encrypting.
+	keys map[string]cipher.AEAD
+}
+
+// readNATSEncryptionKeys returns the keys of EncryptionKeyFile and
+// EncryptionPreviousKeyFiles, nil if none are configured.
+func readNATSEncryptionKeys(cfg *config.NATS) (*natsEncryptionKeys, error) {
+	if cfg.EncryptionKeyFile == "" && len(cfg.EncryptionPreviousKeyFiles) == 0 {
+		return nil, nil
+	}
+	ek := &natsEncryptionKeys{keys: map[string]cipher.AEAD{}}
+	add := func(path string) (string, error) {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading encryption key file: %w", err)
+		}
+		// Either the raw 32 bytes, or hexadecimal.
+		key := buf
+		if len(buf) != 32 {
+			key, err = hex.DecodeString(string(bytes.TrimSpace(buf)))
+			if err != nil || len(key) != 32 {
+				return "", fmt.Errorf("encryption key in %s must be 32 bytes, raw or as 64 hexadecimal characters", path)
+			}
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return "", fmt.Errorf("aes cipher: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return "", fmt.Errorf("gcm: %w", err)
+		}
+		id := natsEncryptionKeyID(key)
+		ek.keys[id] = aead
+		return id, nil
+	}
+	if cfg.EncryptionKeyFile != "" {
+		id, err := add(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ek.id = id
+	}
+	for _, path := range cfg.EncryptionPreviousKeyFiles {
+		if _, err := add(path); err != nil {
+			return nil, err
+		}
+	}
+	return ek, nil
+}
+
+// natsEncryptionKeyID returns the ID of key stored with objects, identifying the
+// key without revealing it.
+func natsEncryptionKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("mox nats encryption key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// encrypt returns r encrypted with the current key, and sets the encryption
+// metadata in meta.
+func (ek *natsEncryptionKeys) encrypt(r io.Reader, meta map[string]string) (io.Reader, error) {
+	nonce := make([]byte, ek.keys[ek.id].NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	meta[natsEncryptionKey] = natsEncryptionAlgorithm
+	meta[natsEncryptionKeyIDKey] = ek.id
+	meta[natsEncryptionNonceKey] = base64.RawURLEncoding.EncodeToString(nonce)
+	return &natsEncryptReader{src: r, aead: ek.keys[ek.id], nonce: nonce, plain: make([]byte, natsEncryptChunkSize)}, nil
+}
+
+// decryptLoad returns object res, decrypted if its metadata says it is encrypted.
+// Encryption is the last step when storing, so it is reversed first.
+func (ek *natsEncryptionKeys) decryptLoad(res jetstream.ObjectResult) (jetstream.ObjectResult, error) {
+	info, err := res.Info()
+	if err != nil || info.Metadata[natsEncryptionKey] == "" {
+		return res, nil
+	}
+	fail := func(format string, args ...any) (jetstream.ObjectResult, error) {
+		res.Close()
+		return nil, fmt.Errorf("%w: object %q: %s", ErrNATSDecrypt, info.Name, fmt.Sprintf(format, args...))
+	}
+	if alg := info.Metadata[natsEncryptionKey]; alg != natsEncryptionAlgorithm {
+		return fail("unknown encryption %q", alg)
+	}
+	var aead cipher.AEAD
+	if ek != nil {
+		aead = ek.keys[info.Metadata[natsEncryptionKeyIDKey]]
+	}
+	if aead == nil {
+		return fail("encrypted with unknown key id %q", info.Metadata[natsEncryptionKeyIDKey])
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(info.Metadata[natsEncryptionNonceKey])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return fail("invalid nonce")
+	}
+	r := &natsDecryptReader{src: res, aead: aead, nonce: nonce, sealed: make([]byte, natsEncryptChunkSize+aead.Overhead())}
+	return &natsTransformedResult{res, natsDecryptedResult{r, res}}, nil
+}
+
+// natsChunkNonce returns the nonce for chunk n of an object with base nonce.
+func natsChunkNonce(dst, nonce []byte, n uint64) []byte {
+	dst = append(dst[:0], nonce...)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], n)
+	for i, b := range counter {
+		dst[len(dst)-8+i] ^= b
+	}
+	return dst
+}
+
+// natsChunkAD returns the additional data for a chunk, marking the last chunk.
+func natsChunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// natsEncryptReader encrypts src while being read.
+type natsEncryptReader struct {
+	src        io.Reader
+	aead       cipher.AEAD
+	nonce      []byte
+	n          uint64
+	plain      []byte
+	sealed     []byte
+	buf        []byte // Sealed data not yet read.
+	chunkNonce []byte
+	done       bool
+}
+
+func (r *natsEncryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return 0, err
+		}
+		r.chunkNonce = natsChunkNonce(r.chunkNonce, r.nonce, r.n)
+		r.sealed = r.aead.Seal(r.sealed[:0], r.chunkNonce, r.plain[:n], natsChunkAD(final))
+		r.buf = r.sealed
+		r.n++
+		r.done = final
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// natsDecryptReader decrypts src while being read.
+type natsDecryptReader struct {
+	src        io.Reader
+	aead       cipher.AEAD
+	nonce      []byte
+	n          uint64
+	sealed     []byte
+	plain      []byte
+	buf        []byte // Decrypted data not yet read.
+	chunkNonce []byte
+	done       bool
+	err        error
+}
+
+func (r *natsDecryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			var extra [1]byte
+			if n, _ := io.ReadFull(r.src, extra[:]); n > 0 {
+				r.err = fmt.Errorf("%w: data after last chunk", ErrNATSDecrypt)
+				continue
+			}
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.sealed)
+		if err == io.EOF {
+			r.err = fmt.Errorf("%w: truncated", ErrNATSDecrypt)
+			continue
+		}
+		final := err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return 0, err
+		}
+		r.chunkNonce = natsChunkNonce(r.chunkNonce, r.nonce, r.n)
+		r.plain, err = r.aead.Open(r.plain[:0], r.chunkNonce, r.sealed[:n], natsChunkAD(final))
+		if err != nil {
+			r.err = fmt.Errorf("%w: chunk %d: %v", ErrNATSDecrypt, r.n, err)
+			continue
+		}
+		r.buf = r.plain
+		r.n++
+		r.done = final
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// natsDecryptedResult reads decrypted data, closing the object on close.
+type natsDecryptedResult struct {
+	io.Reader
+	io.Closer
+}
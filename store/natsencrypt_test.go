@@ -0,0 +1,150 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSEncryption(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(name, key string) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		err := os.WriteFile(p, []byte(key+"\n"), 0o600)
+		tcheck(t, err, "write key file")
+		return p
+	}
+	keyA := writeKey("a.key", strings.Repeat("0a", 32))
+	keyB := writeKey("b.key", strings.Repeat("0b", 32))
+	bad := writeKey("bad.key", "too short")
+
+	if _, err := readNATSEncryptionKeys(&config.NATS{EncryptionKeyFile: bad}); err == nil {
+		t.Fatalf("short key accepted")
+	}
+	if _, err := newNATSClient(pkglog, &config.NATS{URL: "nats://invalid-server:4222", BucketName: "test-bucket", EncryptionKeyFile: bad}); err == nil || !strings.Contains(err.Error(), "encryption key") {
+		t.Fatalf("got err %v, expected error for malformed encryption key", err)
+	}
+	if _, err := readNATSEncryptionKeys(&config.NATS{EncryptionPreviousKeyFiles: []string{filepath.Join(dir, "absent.key")}}); err == nil {
+		t.Fatalf("missing previous key file accepted")
+	}
+
+	// Raw keys are accepted too, and identified like the same key in hexadecimal.
+	raw := filepath.Join(dir, "raw.key")
+	err := os.WriteFile(raw, bytes.Repeat([]byte{0x0a}, 32), 0o600)
+	tcheck(t, err, "write raw key file")
+	ekRaw, err := readNATSEncryptionKeys(&config.NATS{EncryptionKeyFile: raw})
+	tcheck(t, err, "read raw key")
+	ekHex, err := readNATSEncryptionKeys(&config.NATS{EncryptionKeyFile: keyA})
+	tcheck(t, err, "read hex key")
+	tcompare(t, ekRaw.id, ekHex.id)
+
+	fos := newFakeObjectStore()
+	store := func(nc *NATSClient, id int64, msg string) string {
+		t.Helper()
+		before := fos.names()
+		err := nc.StoreMessage(ctxbg, id, writeTestMessage(t, msg))
+		tcheck(t, err, "store message")
+		for _, name := range fos.names() {
+			if !slices.Contains(before, name) {
+				return name
+			}
+		}
+		t.Fatalf("no new object")
+		return ""
+	}
+	get := func(nc *NATSClient, name string) (string, error) {
+		t.Helper()
+		r, err := nc.getObject(ctxbg, name)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		return string(buf), err
+	}
+	object := func(name string) fakeObject {
+		fos.Lock()
+		defer fos.Unlock()
+		return fos.objects[name]
+	}
+
+	ncA := newTestNATSClient(&config.NATS{BucketName: "test-bucket", EncryptionKeyFile: keyA}, fos)
+
+	// Messages of various sizes, including empty, exactly a chunk and multiple chunks,
+	// are stored encrypted with the key ID and a nonce, and decrypted when read.
+	var objA []string
+	for i, size := range []int{0, 10, natsEncryptChunkSize, 3*natsEncryptChunkSize + 100} {
+		msg := strings.Repeat("x", size)
+		name := store(ncA, int64(i+1), msg)
+		objA = append(objA, name)
+		o := object(name)
+		tcompare(t, o.info.Metadata[natsEncryptionKey], natsEncryptionAlgorithm)
+		tcompare(t, o.info.Metadata[natsEncryptionKeyIDKey], ncA.encryption.id)
+		if o.info.Metadata[natsEncryptionNonceKey] == "" {
+			t.Fatalf("no nonce")
+		}
+		if size > 0 && bytes.Contains(o.data, []byte(msg)) {
+			t.Fatalf("message stored in plaintext")
+		}
+		s, err := get(ncA, name)
+		tcheck(t, err, "get")
+		tcompare(t, s, msg)
+	}
+	// Each object gets its own nonce.
+	if object(objA[0]).info.Metadata[natsEncryptionNonceKey] == object(objA[1]).info.Metadata[natsEncryptionNonceKey] {
+		t.Fatalf("same nonce for objects")
+	}
+
+	// After rotating to key B, with A as previous key, old objects stay readable, and
+	// new objects use key B.
+	ncB := newTestNATSClient(&config.NATS{BucketName: "test-bucket", EncryptionKeyFile: keyB, EncryptionPreviousKeyFiles: []string{keyA}, Compression: "gzip"}, fos)
+	s, err := get(ncB, objA[1])
+	tcheck(t, err, "get with previous key")
+	tcompare(t, s, strings.Repeat("x", 10))
+	nameB := store(ncB, 10, "after rotation")
+	tcompare(t, object(nameB).info.Metadata[natsEncryptionKeyIDKey], ncB.encryption.id)
+	if ncA.encryption.id == ncB.encryption.id {
+		t.Fatalf("same key id for different keys")
+	}
+	s, err = get(ncB, nameB)
+	tcheck(t, err, "get compressed and encrypted")
+	tcompare(t, s, "after rotation")
+
+	// Without the key, or without any keys, objects can't be read.
+	if _, err := get(ncA, nameB); !errors.Is(err, ErrNATSDecrypt) {
+		t.Fatalf("got err %v, expected ErrNATSDecrypt for unknown key", err)
+	}
+	if _, err := get(newTestNATSClient(nil, fos), objA[1]); !errors.Is(err, ErrNATSDecrypt) {
+		t.Fatalf("got err %v, expected ErrNATSDecrypt without keys", err)
+	}
+
+	// Changed and truncated objects fail to decrypt.
+	expectFail := func(name string, change func(data []byte) []byte) {
+		t.Helper()
+		fos.Lock()
+		o := fos.objects[name]
+		orig := o.data
+		o.data = change(bytes.Clone(o.data))
+		fos.objects[name] = o
+		fos.Unlock()
+		if _, err := get(ncA, name); !errors.Is(err, ErrNATSDecrypt) {
+			t.Fatalf("got err %v, expected ErrNATSDecrypt", err)
+		}
+		fos.Lock()
+		o.data = orig
+		fos.objects[name] = o
+		fos.Unlock()
+	}
+	expectFail(objA[1], func(data []byte) []byte { data[0] ^= 1; return data })
+	overhead := ncA.encryption.keys[ncA.encryption.id].Overhead()
+	expectFail(objA[3], func(data []byte) []byte { return data[:natsEncryptChunkSize+overhead] })
+	expectFail(objA[3], func(data []byte) []byte { return append(data, 0) })
+}
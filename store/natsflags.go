@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/mjl-/bstore"
+)
+
+// NATSFlagEvent is a change of the flags of a message. With NATS.FlagEvents, an
+// event is added for each flag change of a message, and never changed or removed,
+// giving a history of flag changes for auditing. The flags at any point can be
+// reconstructed by replaying the events, see ReplayNATSFlagEvents.
+type NATSFlagEvent struct {
+	ID        int64
+	Account   string `bstore:"nonzero,index Account+MessageID"`
+	MessageID int64
+	MailboxID int64
+	UID       UID
+	ModSeq    ModSeq
+	Mask      Flags     // Flags that changed.
+	Flags     Flags     // New values, only those in Mask are relevant.
+	Keywords  []string  // All keywords after the change.
+	Time      time.Time `bstore:"nonzero,default now"`
+}
+
+// ReplayNATSFlagEvents returns the flags and keywords after applying events in
+// order, starting without flags.
+func ReplayNATSFlagEvents(events []NATSFlagEvent) (Flags, []string) {
+	var flags Flags
+	var keywords []string
+	for _, e := range events {
+		flags = flags.Set(e.Mask, e.Flags)
+		keywords = e.Keywords
+	}
+	return flags, keywords
+}
+
+// natsRecordFlagEvents adds flag events for the ChangeFlags in changes of acc,
+// when NATS.FlagEvents is set. Errors are logged, they must not fail the change.
+func natsRecordFlagEvents(acc *Account, changes []Change) {
+	nc := GetNATSClient()
+	if nc == nil || !nc.config.FlagEvents || AuthDB == nil {
+		return
+	}
+
+	var l []ChangeFlags
+	for _, c := range changes {
+		if fc, ok := c.(ChangeFlags); ok {
+			l = append(l, fc)
+		}
+	}
+	if len(l) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nc.requestTimeout())
+	defer cancel()
+	events, err := natsFlagEvents(ctx, acc, l)
+	if err == nil {
+		err = nc.addFlagEvents(ctx, events)
+	}
+	nc.log.Check(err, "recording flag events", slog.String("account", acc.Name), slog.Int("changes", len(l)))
+}
+
+// natsFlagEvents returns the events for changes, looking up the ID of the changed
+// messages.
+func natsFlagEvents(ctx context.Context, acc *Account, changes []ChangeFlags) ([]NATSFlagEvent, error) {
+	now := time.Now()
+	events := make([]NATSFlagEvent, 0, len(changes))
+	err := acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		for _, c := range changes {
+			q := bstore.QueryTx[Message](tx)
+			q.FilterNonzero(Message{MailboxID: c.MailboxID, UID: c.UID})
+			m, err := q.Get()
+			if err != nil {
+				return fmt.Errorf("looking up message for flag change, mailbox %d uid %d: %w", c.MailboxID, c.UID, err)
+			}
+			events = append(events, NATSFlagEvent{
+				Account:   acc.Name,
+				MessageID: m.ID,
+				MailboxID: c.MailboxID,
+				UID:       c.UID,
+				ModSeq:    c.ModSeq,
+				Mask:      c.Mask,
+				Flags:     c.Flags,
+				Keywords:  slices.Clone(c.Keywords),
+				Time:      now,
+			})
+		}
+		return nil
+	})
+	return events, err
+}
+
+// addFlagEvents inserts events.
+func (nc *NATSClient) addFlagEvents(ctx context.Context, events []NATSFlagEvent) error {
+	return AuthDB.Write(ctx, func(tx *bstore.Tx) error {
+		for i := range events {
+			if err := tx.Insert(&events[i]); err != nil {
+				return fmt.Errorf("inserting flag event: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// NATSFlagHistory returns the flag events of message messageID of account, oldest
+// first.
+func (nc *NATSClient) NATSFlagHistory(ctx context.Context, account string, messageID int64) ([]NATSFlagEvent, error) {
+	if nc == nil {
+		return nil, ErrNATSNotConfigured
+	}
+	if AuthDB == nil {
+		return nil, fmt.Errorf("auth database not open")
+	}
+	q := bstore.QueryDB[NATSFlagEvent](ctx, AuthDB)
+	q.FilterNonzero(NATSFlagEvent{Account: account, MessageID: messageID})
+	q.SortAsc("ID")
+	events, err := q.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing flag events: %w", err)
+	}
+	return events, nil
+}
+
+// NATSFlagState returns the flags and keywords of message messageID of account as
+// reconstructed from its flag events.
+func (nc *NATSClient) NATSFlagState(ctx context.Context, account string, messageID int64) (Flags, []string, error) {
+	events, err := nc.NATSFlagHistory(ctx, account, messageID)
+	if err != nil {
+		return Flags{}, nil, err
+	}
+	flags, keywords := ReplayNATSFlagEvents(events)
+	return flags, keywords, nil
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestNATSFlagEvents(t *testing.T) {
+	openTestAuthDB(t)
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// Read, flagged, marked unread, keyword added, unflagged and read again.
+	events := []NATSFlagEvent{
+		{Mask: Flags{Seen: true}, Flags: Flags{Seen: true}},
+		{Mask: Flags{Flagged: true}, Flags: Flags{Seen: true, Flagged: true}},
+		{Mask: Flags{Seen: true}, Flags: Flags{Flagged: true}},
+		{Keywords: []string{"$label1"}},
+		{Mask: Flags{Seen: true, Flagged: true}, Flags: Flags{Seen: true}, Keywords: []string{"$label1"}},
+	}
+	for i := range events {
+		events[i].Account = "mjl"
+		events[i].MessageID = 1
+	}
+	err := nc.addFlagEvents(ctxbg, events[:3])
+	tcheck(t, err, "add flag events")
+
+	// Events of other messages and accounts don't interfere.
+	err = nc.addFlagEvents(ctxbg, []NATSFlagEvent{
+		{Account: "mjl", MessageID: 2, Mask: Flags{Deleted: true}, Flags: Flags{Deleted: true}},
+		{Account: "other", MessageID: 1, Mask: Flags{Answered: true}, Flags: Flags{Answered: true}},
+	})
+	tcheck(t, err, "add flag events")
+
+	flags, keywords, err := nc.NATSFlagState(ctxbg, "mjl", 1)
+	tcheck(t, err, "flag state")
+	tcompare(t, flags, Flags{Flagged: true})
+	tcompare(t, len(keywords), 0)
+
+	err = nc.addFlagEvents(ctxbg, events[3:])
+	tcheck(t, err, "add flag events")
+
+	flags, keywords, err = nc.NATSFlagState(ctxbg, "mjl", 1)
+	tcheck(t, err, "flag state")
+	tcompare(t, flags, Flags{Seen: true})
+	tcompare(t, keywords, []string{"$label1"})
+
+	// History is kept in order, and replaying a prefix gives the state at that time.
+	history, err := nc.NATSFlagHistory(ctxbg, "mjl", 1)
+	tcheck(t, err, "flag history")
+	tcompare(t, len(history), 5)
+	flags, _ = ReplayNATSFlagEvents(history[:2])
+	tcompare(t, flags, Flags{Seen: true, Flagged: true})
+
+	var xnc *NATSClient
+	_, err = xnc.NATSFlagHistory(ctxbg, "mjl", 1)
+	tcompare(t, err, ErrNATSNotConfigured)
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// GetMessage returns the newest stored object of message messageID, for reading
+// messages that were removed locally, e.g. with DeleteAfterStore. See
+// RetrieveMessage, which also returns the object info.
+func (nc *NATSClient) GetMessage(ctx context.Context, messageID int64) (io.ReadCloser, error) {
+	r, _, err := nc.RetrieveMessage(ctx, messageID)
+	return r, err
+}
+
+// RetrieveMessage returns a reader for the newest stored object of message
+// messageID along with its info, with the name, size, time of storing and
+// metadata, e.g. for writing the message file again after losing local storage.
+// Only objects of the account of ctx match, see WithMessageAccount, without account
+// an error wrapping ErrNATSNoAccount is returned. The message is streamed from
+// NATS, with signatures verified and transforms undone as for other reads.
+// Returns an error wrapping ErrMessageNotFound if no object is found, e.g. for
+// messages smaller than MinStoreSize, and ErrNATSNotConfigured if nc is nil. The
+// caller must close the returned reader.
+func (nc *NATSClient) RetrieveMessage(ctx context.Context, messageID int64) (io.ReadCloser, *jetstream.ObjectInfo, error) {
+	if nc == nil {
+		return nil, nil, ErrNATSNotConfigured
+	}
+
+	info, err := nc.natsMessageObject(ctx, messageAccount(ctx), messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := nc.getObject(ctx, info.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting object %q: %w", info.Name, err)
+	}
+	nc.log.Debug("reading message from NATS", slog.Int64("message_id", messageID), slog.String("object_name", info.Name))
+	return r, info, nil
+}
+
+// HasMessage returns whether an object of message messageID of the account of ctx
+// is stored, see WithMessageAccount, without reading it: for checking before storing
+// again, or when verifying backups. As with RetrieveMessage, the object is found
+// through the object index, or by listing the buckets if auth.db isn't open, and
+// ctx must have an account. Not being stored is not an error, failing to look up
+// is. Returns ErrNATSNotConfigured if nc is nil.
+func (nc *NATSClient) HasMessage(ctx context.Context, messageID int64) (bool, error) {
+	if nc == nil {
+		return false, ErrNATSNotConfigured
+	}
+	_, err := nc.natsMessageObject(ctx, messageAccount(ctx), messageID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// natsMessageObject returns the info of the newest readable object of message
+// messageID of account.
+func (nc *NATSClient) natsMessageObject(ctx context.Context, account string, messageID int64) (*jetstream.ObjectInfo, error) {
+	infos, err := nc.natsMessageObjects(ctx, account, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("%w: no object for message %d of account %q", ErrMessageNotFound, messageID, account)
+	}
+	return infos[0], nil
+}
+
+// natsMessageObjects returns the infos of all readable objects of message
+// messageID of account, newest first. The objects are found through the object
+// index, or, if auth.db isn't open, by listing the buckets. An empty account is an
+// error, it would match the objects of all accounts.
+func (nc *NATSClient) natsMessageObjects(ctx context.Context, account string, messageID int64) ([]*jetstream.ObjectInfo, error) {
+	if account == "" {
+		return nil, fmt.Errorf("%w: message %d", ErrNATSNoAccount, messageID)
+	}
+	readable := func(info *jetstream.ObjectInfo) bool {
+		_, deleted := natsDeletedAt(info)
+		return !info.Deleted && !deleted && info.Metadata[natsAccountKey] == account
+	}
+
+	var l []*jetstream.ObjectInfo
+	seen := map[string]bool{}
+	if AuthDB != nil {
+		q := bstore.QueryDB[NATSObjectRef](ctx, AuthDB)
+		q.FilterNonzero(NATSObjectRef{MessageID: messageID, State: NATSObjectStored, Account: account})
+		q.SortDesc("StoredAt")
+		refs, err := q.List()
+		if err != nil {
+			return nil, fmt.Errorf("looking up nats object index rows of message: %w", err)
+		}
+		for _, ref := range refs {
+			// Dedup objects are indexed for the message that first stored them, the
+			// messages referencing them are in the dedup references below.
+			if seen[ref.ObjectName] || isNATSDedupObject(ref.ObjectName) {
+				continue
+			}
+			seen[ref.ObjectName] = true
+			info, err := nc.getObjectInfo(WithMessageAccount(ctx, ref.Account), ref.ObjectName)
+			if errors.Is(err, jetstream.ErrObjectNotFound) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("getting object info of %q: %w", ref.ObjectName, err)
+			}
+			if readable(info) {
+				l = append(l, info)
+			}
+		}
+		// With Dedup, objects are shared, without account in their metadata.
+		drefs, err := natsDedupRefs(ctx, account, messageID)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range drefs {
+			if seen[ref.ObjectName] {
+				continue
+			}
+			seen[ref.ObjectName] = true
+			info, err := nc.getObjectInfo(WithMessageAccount(ctx, ref.Account), ref.ObjectName)
+			if errors.Is(err, jetstream.ErrObjectNotFound) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("getting object info of %q: %w", ref.ObjectName, err)
+			}
+			if _, deleted := natsDeletedAt(info); !info.Deleted && !deleted {
+				l = append(l, info)
+			}
+		}
+		return l, nil
+	}
+
+	if account != "" && nc.config.AccountBuckets != "" {
+		// Opened once, so it is included in the buckets below.
+		if _, err := nc.accountBucket(ctx, account); err != nil {
+			return nil, err
+		}
+	}
+	buckets := nc.natsBuckets()
+	if old := nc.migrating(); old != nil {
+		buckets = append(buckets, old)
+	}
+	for _, os := range buckets {
+		infos, err := os.List(ctx)
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("listing objects: %w", err)
+		}
+		for _, info := range infos {
+			if id, ok := natsMessageIDFromObject(info.Name); ok && id == messageID && !seen[info.Name] && readable(info) {
+				seen[info.Name] = true
+				l = append(l, info)
+			}
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool { return l[i].ModTime.After(l[j].ModTime) })
+	return l, nil
+}
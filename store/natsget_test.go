@@ -0,0 +1,177 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNATSGetMessage(t *testing.T) {
+	var nilClient *NATSClient
+	if _, err := nilClient.GetMessage(ctxbg, 1); !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	get := func(account string, id int64) (string, error) {
+		t.Helper()
+		ctx := ctxbg
+		if account != "" {
+			ctx = WithMessageAccount(ctx, account)
+		}
+		r, err := nc.GetMessage(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read message")
+		return string(buf), nil
+	}
+	expectNotFound := func(account string, id int64) {
+		t.Helper()
+		if _, err := get(account, id); !errors.Is(err, ErrMessageNotFound) {
+			t.Fatalf("got err %v, expected ErrMessageNotFound", err)
+		}
+	}
+
+	expectNoAccount := func(id int64) {
+		t.Helper()
+		if _, err := get("", id); !errors.Is(err, ErrNATSNoAccount) {
+			t.Fatalf("got err %v, expected ErrNATSNoAccount", err)
+		}
+	}
+
+	expectNotFound("mjl", 1)
+
+	err := nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 1, writeTestMessage(t, "first"))
+	tcheck(t, err, "store message")
+	s, err := get("mjl", 1)
+	tcheck(t, err, "get message of account")
+	tcompare(t, s, "first")
+	expectNotFound("other", 1)
+	expectNotFound("mjl", 2)
+	// Message IDs are only unique per account, the account is required.
+	expectNoAccount(1)
+
+	// The newest object of a message is returned, removed objects are skipped. Set
+	// up the objects directly, with modification times far apart.
+	first := fos.objects[fos.names()[0]]
+	fos.objects = map[string]fakeObject{}
+	add := func(name, data string, age time.Duration) {
+		o := first
+		o.info.Name = name
+		o.info.ModTime = time.Now().Add(-age)
+		o.info.Size = uint64(len(data))
+		o.data = []byte(data)
+		fos.objects[name] = o
+	}
+	add("msg-1-100", "first", 2*time.Hour)
+	add("msg-1-200", "second", time.Minute)
+	add("msg-1-50", "oldest", 3*time.Hour)
+	s, err = get("mjl", 1)
+	tcheck(t, err, "get newest message")
+	tcompare(t, s, "second")
+
+	o := fos.objects["msg-1-200"]
+	o.info.Deleted = true
+	fos.objects["msg-1-200"] = o
+	s, err = get("mjl", 1)
+	tcheck(t, err, "get message after removing newest")
+	tcompare(t, s, "first")
+
+	// RetrieveMessage also returns the info of the object read.
+	r, info, err := nc.RetrieveMessage(WithMessageAccount(ctxbg, "mjl"), 1)
+	tcheck(t, err, "retrieve message")
+	buf, err := io.ReadAll(r)
+	tcheck(t, err, "read message")
+	r.Close()
+	tcompare(t, string(buf), "first")
+	tcompare(t, info.Name, "msg-1-100")
+	tcompare(t, info.Size, uint64(len("first")))
+	tcompare(t, info.Metadata[natsAccountKey], "mjl")
+	if _, _, err := nc.RetrieveMessage(WithMessageAccount(ctxbg, "mjl"), 2); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound", err)
+	}
+	if _, _, err := nc.RetrieveMessage(ctxbg, 1); !errors.Is(err, ErrNATSNoAccount) {
+		t.Fatalf("got err %v, expected ErrNATSNoAccount", err)
+	}
+	if _, _, err := nilClient.RetrieveMessage(ctxbg, 1); !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+
+	// With the object index, objects are looked up without listing the bucket.
+	openTestAuthDB(t)
+	fos = newFakeObjectStore()
+	nc = newTestNATSClient(nil, fos)
+	err = nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 3, writeTestMessage(t, "indexed"))
+	tcheck(t, err, "store message")
+	s, err = get("mjl", 3)
+	tcheck(t, err, "get indexed message")
+	tcompare(t, s, "indexed")
+	expectNoAccount(3)
+	expectNotFound("other", 3)
+
+	// Objects gone from the bucket are not found, also when still in the index.
+	for _, n := range fos.names() {
+		delete(fos.objects, n)
+	}
+	expectNotFound("mjl", 3)
+}
+
+func TestNATSHasMessage(t *testing.T) {
+	var nilClient *NATSClient
+	if _, err := nilClient.HasMessage(ctxbg, 1); !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	has := func(account string, id int64, exp bool) {
+		t.Helper()
+		ctx := ctxbg
+		if account != "" {
+			ctx = WithMessageAccount(ctx, account)
+		}
+		ok, err := nc.HasMessage(ctx, id)
+		tcheck(t, err, "has message")
+		tcompare(t, ok, exp)
+	}
+
+	// Without auth.db, by listing the bucket.
+	has("mjl", 1, false)
+	err := nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	has("mjl", 1, true)
+	has("other", 1, false)
+	has("mjl", 2, false)
+
+	// Without account, the message ID could be of any account.
+	if ok, err := nc.HasMessage(ctxbg, 1); !errors.Is(err, ErrNATSNoAccount) || ok {
+		t.Fatalf("got %v, %v, expected ErrNATSNoAccount", ok, err)
+	}
+
+	// Failing to look up is an error, not a missing message.
+	fos.listErr = errors.New("timeout")
+	if ok, err := nc.HasMessage(WithMessageAccount(ctxbg, "mjl"), 1); err == nil || ok {
+		t.Fatalf("got %v, %v, expected error for failing list", ok, err)
+	}
+	fos.listErr = nil
+
+	// With auth.db, through the object index.
+	openTestAuthDB(t)
+	fos = newFakeObjectStore()
+	nc = newTestNATSClient(nil, fos)
+	err = nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	has("mjl", 1, true)
+	has("other", 1, false)
+	has("mjl", 2, false)
+	err = nc.DeleteMessage(WithMessageAccount(ctxbg, "mjl"), 1)
+	tcheck(t, err, "delete message")
+	has("mjl", 1, false)
+	tcompare(t, fos.listCalls, 0)
+}
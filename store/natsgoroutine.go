@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricNATSGoroutinesActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_goroutines_active",
+			Help: "Number of goroutines doing NATS background work: asynchronous stores, pending queue retries, account object removals and maildir imports. Limited by NATS.MaxGoroutines.",
+		},
+	)
+	metricNATSGoroutineBudgetQueued = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_nats_goroutine_budget_queued_total",
+			Help: "Number of asynchronous stores added to the pending queue because all NATS.MaxGoroutines goroutines were busy.",
+		},
+	)
+)
+
+// Default for NATS.MaxGoroutines.
+const natsDefaultMaxGoroutines = 64
+
+// acquireGoroutine waits for a slot in the goroutine budget shared by all NATS
+// background work, for starting a goroutine. The returned function must be called
+// when the goroutine is done.
+func (nc *NATSClient) acquireGoroutine(ctx context.Context) (func(), error) {
+	if err := nc.goSem.Acquire(ctx, 1); err != nil {
+		return nil, fmt.Errorf("waiting for goroutine slot: %w", err)
+	}
+	return nc.startGoroutine(), nil
+}
+
+// tryAcquireGoroutine is like acquireGoroutine, but returns false instead of
+// waiting when the budget is used up.
+func (nc *NATSClient) tryAcquireGoroutine() (func(), bool) {
+	if !nc.goSem.TryAcquire(1) {
+		return nil, false
+	}
+	return nc.startGoroutine(), true
+}
+
+func (nc *NATSClient) startGoroutine() func() {
+	nc.goroutines.Add(1)
+	metricNATSGoroutinesActive.Inc()
+	return func() {
+		metricNATSGoroutinesActive.Dec()
+		nc.goroutines.Add(-1)
+		nc.goSem.Release(1)
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSGoroutineBudget(t *testing.T) {
+	const budget = 3
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", MaxGoroutines: budget, MaxConcurrentStores: 100}, fos)
+
+	var maxActive atomic.Int64
+	observe := func() {
+		for {
+			v := nc.goroutines.Load()
+			m := maxActive.Load()
+			if v <= m || maxActive.CompareAndSwap(m, v) {
+				break
+			}
+		}
+	}
+
+	// Async stores beyond the budget are queued instead of starting a goroutine.
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 100)
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		observe()
+		started <- struct{}{}
+		<-unblock
+		return nil
+	}
+	const n = 20
+	for i := range int64(n) {
+		nc.StoreMessageAsync(ctxbg, 1+i, writeTestMessage(t, "test"))
+	}
+	// Slots are taken before starting the goroutines.
+	<-started
+	tcompare(t, nc.goroutines.Load(), int64(budget))
+	paths, err := listPendingNATS()
+	tcheck(t, err, "list pending")
+	tcompare(t, len(paths), n-budget)
+	close(unblock)
+	nc.closeStores(ctxbg)
+	tcompare(t, len(fos.names()), budget)
+	tcompare(t, nc.goroutines.Load(), int64(0))
+	fos.putHook = nil
+
+	// The retry loop and account object removal are limited by the same budget,
+	// not only by their own concurrency limits.
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", MaxGoroutines: budget, MaxConcurrentStores: 100, RetryConcurrency: 20}, fos)
+	maxActive.Store(0)
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		observe()
+		return nil
+	}
+	fos.deleteHook = func(name string) error {
+		observe()
+		return nil
+	}
+	stored, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, stored, n-budget)
+
+	for i := range int64(100) {
+		err := nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 1000+i, writeTestMessage(t, "test"))
+		tcheck(t, err, "store")
+	}
+	res, err := nc.DeleteAccountObjects(ctxbg, "mjl")
+	tcheck(t, err, "delete account objects")
+	tcompare(t, res.Deleted, 100)
+
+	if v := maxActive.Load(); v > budget {
+		t.Fatalf("saw %d active goroutines, budget is %d", v, budget)
+	} else if v == 0 {
+		t.Fatalf("no active goroutines seen")
+	}
+	tcompare(t, nc.goroutines.Load(), int64(0))
+}
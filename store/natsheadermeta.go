@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits for headers stored in object metadata with StoreMessageWithMeta. The
+// metadata is stored with the object info in a single NATS message, which must
+// stay well below the maximum payload size of the server.
+const (
+	natsHeaderMetaKeyMax   = 64
+	natsHeaderMetaValueMax = 1024
+	natsHeaderMetaTotalMax = 16 * 1024
+)
+
+// Metadata keys set by mox, headers with these keys are not stored: they would
+// change how mox handles the object, e.g. "deleted-at".
+var natsReservedMetaKeys = []string{
+	natsAccountKey,
+	natsCompressionKey,
+	natsDeletedAtKey,
+	natsEncryptionKey,
+	natsEncryptionKeyIDKey,
+	natsEncryptionNonceKey,
+	natsRetentionClassKey,
+	natsSignatureKey,
+	natsThreadIDKey,
+	natsTransformsKey,
+}
+
+type natsHeaderMetaKeyType struct{}
+
+// withNATSHeaderMeta returns a context that makes messages stored in NATS with it
+// get headers, already sanitized, in their object metadata.
+func withNATSHeaderMeta(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, natsHeaderMetaKeyType{}, headers)
+}
+
+// natsHeaderMeta returns the header metadata set on ctx, or nil.
+func natsHeaderMeta(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(natsHeaderMetaKeyType{}).(map[string]string)
+	return headers
+}
+
+// natsObjectHeaderMeta returns headers as object metadata. Keys are lower-cased,
+// e.g. "message-id", and keys that are empty, longer than 64 bytes, have
+// characters other than letters, digits, "-", "_" and ".", or are reserved for
+// mox are skipped. Control characters in values, e.g. of folded headers, are
+// replaced by spaces, invalid UTF-8 removed, and values truncated to 1024 bytes.
+// Headers beyond 16KiB in total, in sorted order of keys, are skipped.
+func natsObjectHeaderMeta(headers map[string]string) map[string]string {
+	validKey := func(k string) bool {
+		if k == "" || len(k) > natsHeaderMetaKeyMax || slices.Contains(natsReservedMetaKeys, k) {
+			return false
+		}
+		for _, c := range k {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				return false
+			}
+		}
+		return true
+	}
+	value := func(v string) string {
+		v = strings.ToValidUTF8(v, "")
+		v = strings.Map(func(c rune) rune {
+			if c < ' ' || c == 0x7f {
+				return ' '
+			}
+			return c
+		}, v)
+		v = strings.TrimSpace(v)
+		if len(v) > natsHeaderMetaValueMax {
+			n := natsHeaderMetaValueMax
+			for n > 0 && !utf8.RuneStart(v[n]) {
+				n--
+			}
+			v = v[:n]
+		}
+		return v
+	}
+
+	m := map[string]string{}
+	var total int
+	for _, k := range slices.Sorted(maps.Keys(headers)) {
+		key := strings.ToLower(strings.TrimSpace(k))
+		if !validKey(key) {
+			continue
+		}
+		v := value(headers[k])
+		if total+len(key)+len(v) > natsHeaderMetaTotalMax {
+			continue
+		}
+		total += len(key) + len(v)
+		m[key] = v
+	}
+	return m
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSHeaderMeta(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	headers := map[string]string{
+		"From":       "mjl@mox.example",
+		"Subject":    "folded\r\n subject",
+		"Message-ID": "<m1@mox.example>",
+		"X-Long":     strings.Repeat("é", natsHeaderMetaValueMax),
+		"Bad Key":    "skipped",
+		"deleted-at": "2000-01-01T00:00:00Z", // Reserved, would mark the object deleted.
+	}
+	exp := map[string]string{
+		natsAccountKey: "mjl",
+		"from":         "mjl@mox.example",
+		"subject":      "folded   subject",
+		"message-id":   "<m1@mox.example>",
+		"x-long":       strings.Repeat("é", natsHeaderMetaValueMax/2),
+	}
+	check := func(fos *fakeObjectStore) {
+		t.Helper()
+		names := fos.names()
+		if len(names) != 1 {
+			t.Fatalf("got %d objects, expected 1", len(names))
+		}
+		info, err := fos.GetInfo(ctxbg, names[0])
+		tcheck(t, err, "get info")
+		tcompare(t, info.Metadata, exp)
+	}
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	ctx := WithMessageAccount(ctxbg, "mjl")
+	err := nc.StoreMessageWithMeta(ctx, 1, headers, writeTestMessage(t, "Subject: test\r\n\r\ntest\r\n"))
+	tcheck(t, err, "store message with meta")
+	check(fos)
+
+	// StoreMessage stores no headers.
+	fos = newFakeObjectStore()
+	nc = newTestNATSClient(nil, fos)
+	err = nc.StoreMessage(ctx, 1, writeTestMessage(t, "Subject: test\r\n\r\ntest\r\n"))
+	tcheck(t, err, "store message")
+	info, err := fos.GetInfo(ctxbg, fos.names()[0])
+	tcheck(t, err, "get info")
+	tcompare(t, info.Metadata, map[string]string{natsAccountKey: "mjl"})
+
+	// Headers are kept through a failed batch put and the retry from the queue.
+	syncPut := false
+	fos = newFakeObjectStore()
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", SyncPut: &syncPut}, fos)
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	err = nc.StoreMessageWithMeta(ctx, 1, headers, writeTestMessage(t, "Subject: test\r\n\r\ntest\r\n"))
+	tcheck(t, err, "store message with meta in batch")
+	nc.flushPuts()
+	defer nc.Close()
+	fos.putHook = nil
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 1)
+	check(fos)
+}
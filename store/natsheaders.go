@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+)
+
+// NATSMessageHeader holds the main headers of a message stored in NATS, for
+// searching locally without fetching messages from the object store. Only
+// maintained when NATS.StoreHeaders is set.
+type NATSMessageHeader struct {
+	ID         int64
+	MessageID  int64 `bstore:"index"`
+	ObjectName string
+	From       string // Addresses, comma-separated.
+	To         string // Addresses, comma-separated.
+	Subject    string
+	Date       time.Time
+	MsgID      string    `bstore:"index"` // Message-ID header, including <>.
+	Created    time.Time `bstore:"nonzero,default now,index"`
+}
+
+// NATSHeaderQuery selects stored headers. Zero fields don't filter.
+type NATSHeaderQuery struct {
+	From    string // Case-insensitive substring.
+	To      string // Case-insensitive substring.
+	Subject string // Case-insensitive substring.
+	MsgID   string // Exact Message-ID header.
+	Since   time.Time
+	Before  time.Time
+	Limit   int
+}
+
+// natsStoreHeaders parses the headers of message msg and stores them for object
+// objectName. Errors are logged, they must not fail the store.
+func (nc *NATSClient) natsStoreHeaders(ctx context.Context, messageID int64, objectName string, msg io.ReaderAt) {
+	if AuthDB == nil || !nc.config.StoreHeaders {
+		return
+	}
+
+	p, err := message.Parse(nc.log.Logger, false, msg)
+	if err != nil || p.Envelope == nil {
+		nc.log.Debugx("parsing message for storing headers, skipping", err, slog.Int64("message_id", messageID))
+		return
+	}
+
+	maxSize := nc.config.MaxHeaderSize
+	if maxSize <= 0 {
+		maxSize = 1000
+	}
+	limit := func(s string) string {
+		if len(s) <= maxSize {
+			return s
+		}
+		n := maxSize
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		return s[:n]
+	}
+	addrs := func(l []message.Address) string {
+		var r []string
+		for _, a := range l {
+			r = append(r, a.User+"@"+a.Host)
+		}
+		return limit(strings.Join(r, ", "))
+	}
+	env := p.Envelope
+	h := NATSMessageHeader{
+		MessageID:  messageID,
+		ObjectName: objectName,
+		From:       addrs(env.From),
+		To:         addrs(env.To),
+		Subject:    limit(env.Subject),
+		Date:       env.Date,
+		MsgID:      limit(env.MessageID),
+	}
+	err = AuthDB.Insert(ctx, &h)
+	nc.log.Check(err, "storing message headers", slog.Int64("message_id", messageID))
+}
+
+// SearchNATSHeaders returns the stored headers matching q, newest first.
+func SearchNATSHeaders(ctx context.Context, q NATSHeaderQuery) ([]NATSMessageHeader, error) {
+	if AuthDB == nil {
+		return nil, fmt.Errorf("auth.db not open")
+	}
+
+	bq := bstore.QueryDB[NATSMessageHeader](ctx, AuthDB)
+	if q.MsgID != "" {
+		bq.FilterNonzero(NATSMessageHeader{MsgID: q.MsgID})
+	}
+	if !q.Since.IsZero() {
+		bq.FilterGreaterEqual("Date", q.Since)
+	}
+	if !q.Before.IsZero() {
+		bq.FilterLess("Date", q.Before)
+	}
+	contains := func(s, sub string) bool {
+		return sub == "" || strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	bq.FilterFn(func(h NATSMessageHeader) bool {
+		return contains(h.From, q.From) && contains(h.To, q.To) && contains(h.Subject, q.Subject)
+	})
+	bq.SortDesc("Date")
+	if q.Limit > 0 {
+		bq.Limit(q.Limit)
+	}
+	return bq.List()
+}
+
+// natsHeadersCleanup removes stored headers older than the configured retention.
+func (nc *NATSClient) natsHeadersCleanup(ctx context.Context) error {
+	if AuthDB == nil || nc.config.HeaderRetention <= 0 {
+		return nil
+	}
+	q := bstore.QueryDB[NATSMessageHeader](ctx, AuthDB)
+	q.FilterLess("Created", time.Now().Add(-nc.config.HeaderRetention))
+	n, err := q.Delete()
+	if err != nil {
+		return fmt.Errorf("removing expired message headers: %w", err)
+	}
+	if n > 0 {
+		nc.log.Debug("removed expired message headers", slog.Int("count", n))
+	}
+	return nil
+}
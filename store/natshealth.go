@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+var metricNATSHealthy = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "mox_nats_healthy",
+		Help: "Whether the NATS connection is up and the object store buckets are usable (1) or not (0), at the last health check.",
+	},
+)
+
+// HealthCheck returns whether the object store is usable: the NATS connection must
+// be up, and the status of each bucket must be retrievable, which needs JetStream
+// and the bucket to be available, and the bucket must not be sealed, which would
+// make stores fail. Unlike IsConnected, a missing or misconfigured bucket makes the
+// check fail. The result is exported as metric mox_nats_healthy, changes are
+// logged.
+func (nc *NATSClient) HealthCheck(ctx context.Context) (rerr error) {
+	if nc == nil {
+		return ErrNATSNotConfigured
+	}
+	defer func() {
+		healthy := rerr == nil
+		if healthy {
+			metricNATSHealthy.Set(1)
+		} else {
+			metricNATSHealthy.Set(0)
+		}
+		if prev := nc.unhealthy.Swap(!healthy); !prev && !healthy {
+			nc.log.Errorx("NATS health check failed", rerr)
+		} else if prev && healthy {
+			nc.log.Info("NATS health check passed again")
+		}
+	}()
+
+	if !nc.IsConnected() {
+		if nc.os == nil {
+			return errors.New("nats object store not available")
+		} else if nc.conn == nil {
+			return errors.New("nats not connected")
+		}
+		return fmt.Errorf("nats not connected, connection status %s", nc.conn.Status())
+	}
+	for _, os := range nc.natsBuckets() {
+		status, err := os.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("getting status of object store bucket: %w", err)
+		}
+		if status.Sealed() {
+			return fmt.Errorf("object store bucket %s is sealed, stores will fail", status.Bucket())
+		}
+	}
+	return nil
+}
+
+// healthLoop periodically runs a health check until the client is closed.
+func (nc *NATSClient) healthLoop() {
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS health check", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	interval := nc.config.HealthCheckInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), nc.requestTimeout())
+		// Logged by HealthCheck on changes.
+		nc.HealthCheck(ctx)
+		cancel()
+
+		select {
+		case <-nc.closing:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNATSHealthCheck(t *testing.T) {
+	var nilClient *NATSClient
+	if err := nilClient.HealthCheck(ctxbg); !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	err := nc.HealthCheck(ctxbg)
+	tcheck(t, err, "health check")
+	tcompare(t, testutil.ToFloat64(metricNATSHealthy), 1.0)
+
+	// A bucket that is gone, e.g. removed or misconfigured, is unhealthy, while the
+	// connection is still up.
+	fos.statusErr = jetstream.ErrBucketNotFound
+	err = nc.HealthCheck(ctxbg)
+	if !errors.Is(err, jetstream.ErrBucketNotFound) {
+		t.Fatalf("got err %v, expected ErrBucketNotFound", err)
+	}
+	tcompare(t, nc.IsConnected(), true)
+	tcompare(t, testutil.ToFloat64(metricNATSHealthy), 0.0)
+
+	// A sealed bucket doesn't accept stores.
+	fos.statusErr = nil
+	fos.sealed = true
+	if err := nc.HealthCheck(ctxbg); err == nil {
+		t.Fatalf("health check passed for sealed bucket")
+	}
+
+	fos.sealed = false
+	err = nc.HealthCheck(ctxbg)
+	tcheck(t, err, "health check after recovery")
+	tcompare(t, testutil.ToFloat64(metricNATSHealthy), 1.0)
+
+	// Without connection, unhealthy.
+	nc.connected = nil
+	tcompare(t, nc.IsConnected(), false)
+	if err := nc.HealthCheck(ctxbg); err == nil {
+		t.Fatalf("health check passed without connection")
+	}
+
+	// Without object store, e.g. when connecting failed, unhealthy.
+	nc.os = nil
+	if err := nc.HealthCheck(ctxbg); err == nil {
+		t.Fatalf("health check passed without object store")
+	}
+}
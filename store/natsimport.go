@@ -0,0 +1,242 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// NATSImportOptions configures ImportMaildirNATS.
+type NATSImportOptions struct {
+	Concurrency int  // Number of messages stored at the same time. Default 4.
+	DryRun      bool // Only walk the maildir and count, don't store.
+}
+
+// NATSImportResult summarizes an import.
+type NATSImportResult struct {
+	Messages int   // Message files found.
+	Stored   int   // Newly stored.
+	Skipped  int   // Already present in the bucket, from an earlier import.
+	Failed   int   // Could not be stored, see the log.
+	Bytes    int64 // Of messages found.
+}
+
+// natsMaildirFlags maps maildir info flags to mox flag names.
+var natsMaildirFlags = map[rune]string{
+	'D': "draft",
+	'F': "flagged",
+	'P': "forwarded",
+	'R': "answered",
+	'S': "seen",
+	'T': "deleted",
+}
+
+// ImportMaildirNATS stores all messages of the maildir tree at dir in the NATS
+// object store, without creating local messages. For importing into an account,
+// use "mox import maildir", messages delivered to an account are stored in NATS
+// as usual.
+//
+// Subdirectories are walked too, each "cur" and "new" directory is treated as a
+// mailbox, e.g. Maildir++ folders like ".Sent". Bare newlines are changed into
+// CRLF like mox does for local imports. Objects are named after the SHA-256 of the
+// message file, and have metadata with the mailbox, original path and flags. The
+// import is resumable: messages already in the bucket are skipped.
+func ImportMaildirNATS(ctx context.Context, log mlog.Log, nc *NATSClient, dir string, opts NATSImportOptions) (NATSImportResult, error) {
+	var result NATSImportResult
+	if nc == nil {
+		return result, ErrNATSNotConfigured
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	var mu sync.Mutex
+	count := func(fn func(r *NATSImportResult)) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn(&result)
+	}
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for range concurrency {
+		// Workers keep their slot in the goroutine budget for the whole import. The walk
+		// below stops when ctx is done, also when no worker started.
+		release, err := nc.acquireGoroutine(ctx)
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			for p := range paths {
+				stored, err := nc.importMaildirMessage(ctx, dir, p)
+				if err != nil {
+					log.Errorx("importing maildir message into nats", err, slog.String("path", p))
+					count(func(r *NATSImportResult) { r.Failed++ })
+				} else if stored {
+					count(func(r *NATSImportResult) { r.Stored++ })
+				} else {
+					count(func(r *NATSImportResult) { r.Skipped++ })
+				}
+			}
+		}()
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		if pdir := filepath.Base(filepath.Dir(p)); pdir != "cur" && pdir != "new" {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		count(func(r *NATSImportResult) {
+			r.Messages++
+			r.Bytes += fi.Size()
+		})
+		if opts.DryRun {
+			return nil
+		}
+		select {
+		case paths <- p:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(paths)
+	wg.Wait()
+	if err != nil {
+		return result, fmt.Errorf("walking maildir: %w", err)
+	}
+	log.Info("imported maildir into nats",
+		slog.String("dir", dir),
+		slog.Bool("dryrun", opts.DryRun),
+		slog.Int("messages", result.Messages),
+		slog.Int("stored", result.Stored),
+		slog.Int("skipped", result.Skipped),
+		slog.Int("failed", result.Failed))
+	return result, nil
+}
+
+// importMaildirMessage stores maildir message file p, found under dir. Returns
+// false without error if the message was already stored.
+func (nc *NATSClient) importMaildirMessage(ctx context.Context, dir, p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, fmt.Errorf("reading message: %w", err)
+	}
+	name := "import-" + hex.EncodeToString(h.Sum(nil))
+	os, err := nc.objectBucket(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.GetInfo(ctx, name); err == nil {
+		return false, nil
+	} else if err = natsObjectError(err); !errors.Is(err, ErrMessageNotFound) {
+		return false, fmt.Errorf("checking for existing object: %w", err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false, err
+	}
+	mailbox := filepath.ToSlash(filepath.Dir(filepath.Dir(rel)))
+	mailbox = strings.TrimPrefix(mailbox, ".")
+	if mailbox == "" || mailbox == "/" {
+		mailbox = "Inbox"
+	}
+	var flags []string
+	if _, info, ok := strings.Cut(filepath.Base(p), ":2,"); ok {
+		for _, c := range info {
+			if flag, ok := natsMaildirFlags[c]; ok {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	meta := jetstream.ObjectMeta{
+		Name:        name,
+		Description: "Email message imported from maildir",
+		Metadata: map[string]string{
+			"mailbox": mailbox,
+			"path":    filepath.ToSlash(rel),
+			"flags":   strings.Join(flags, ","),
+		},
+	}
+
+	release, err := nc.acquireStore(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	// Convert bare newlines to CRLF while streaming.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(crlfCopy(pw, f))
+	}()
+	info, err := os.Put(ctx, meta, pr)
+	pr.Close()
+	if err != nil {
+		return false, fmt.Errorf("storing message: %w", err)
+	}
+	if _, err := nc.signObject(ctx, os, info); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// crlfCopy copies r to w, changing bare "\n" into "\r\n".
+func crlfCopy(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) > 0 && line[len(line)-1] == '\n' && !bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(line[:len(line)-1], "\r\n"...)
+		}
+		if _, werr := bw.Write(line); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return bw.Flush()
+		}
+	}
+}
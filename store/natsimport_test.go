@@ -0,0 +1,61 @@
+package store
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNATSImportMaildir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(p, data string) {
+		t.Helper()
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		err := os.MkdirAll(filepath.Dir(p), 0o700)
+		tcheck(t, err, "mkdir")
+		err = os.WriteFile(p, []byte(data), 0o600)
+		tcheck(t, err, "write message")
+	}
+	write("new/1.mox", "Subject: one\n\nbody\n")
+	write("cur/2.mox:2,SF", "Subject: two\r\n\r\nbody\r\n")
+	write(".Sent/cur/3.mox:2,R", "Subject: three\n\nbody\n")
+	write("dovecot-keywords", "0 $Forwarded\n") // Not a message.
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	result, err := ImportMaildirNATS(ctxbg, pkglog, nc, dir, NATSImportOptions{DryRun: true})
+	tcheck(t, err, "import dry-run")
+	tcompare(t, result.Messages, 3)
+	tcompare(t, result.Stored, 0)
+	tcompare(t, len(fos.names()), 0)
+
+	result, err = ImportMaildirNATS(ctxbg, pkglog, nc, dir, NATSImportOptions{Concurrency: 2})
+	tcheck(t, err, "import")
+	tcompare(t, result, NATSImportResult{Messages: 3, Stored: 3, Bytes: result.Bytes})
+	tcompare(t, len(fos.names()), 3)
+
+	byPath := map[string]string{}
+	for _, name := range fos.names() {
+		r, err := fos.Get(ctxbg, name)
+		tcheck(t, err, "get")
+		info, _ := r.Info()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read")
+		byPath[info.Metadata["path"]] = info.Metadata["mailbox"] + " " + info.Metadata["flags"] + " " + string(buf)
+	}
+	tcompare(t, byPath, map[string]string{
+		"new/1.mox":           "Inbox  Subject: one\r\n\r\nbody\r\n",
+		"cur/2.mox:2,SF":      "Inbox seen,flagged Subject: two\r\n\r\nbody\r\n",
+		".Sent/cur/3.mox:2,R": "Sent answered Subject: three\r\n\r\nbody\r\n",
+	})
+
+	// Resuming skips messages already stored.
+	write("new/4.mox", "Subject: four\n\nbody\n")
+	result, err = ImportMaildirNATS(ctxbg, pkglog, nc, dir, NATSImportOptions{})
+	tcheck(t, err, "import again")
+	tcompare(t, result.Stored, 1)
+	tcompare(t, result.Skipped, 3)
+	tcompare(t, len(fos.names()), 4)
+}
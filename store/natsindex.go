@@ -0,0 +1,307 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+// NATSObjectState is the state of an object in the NATS object index.
+type NATSObjectState string
+
+const (
+	// Row written before the Put. If the row is still pending after a crash, the
+	// object may or may not exist, reconciliation checks the object store.
+	NATSObjectPending NATSObjectState = "pending"
+
+	// Object was confirmed stored.
+	NATSObjectStored NATSObjectState = "stored"
+
+	// Object was soft-deleted, it can be recovered with UndeleteMessage until
+	// SoftDeleteRetention passes.
+	NATSObjectDeleted NATSObjectState = "deleted"
+)
+
+// NATSObjectRef records where a message was stored in the NATS object store, so
+// retrieval and removal don't need to list the bucket.
+//
+// A row is inserted in state pending before the object is stored, and changed to
+// state stored afterwards. This closes the window where a crash between a
+// successful Put and the index write leaves an object nobody knows about.
+type NATSObjectRef struct {
+	ID         int64
+	MessageID  int64  `bstore:"index"`
+	Account    string `bstore:"index"` // Empty for objects stored without account.
+	ObjectName string `bstore:"nonzero,unique"`
+	Bucket     string
+	State      NATSObjectState `bstore:"nonzero,index"`
+	Size       int64
+	Digest     string    // As reported by the object store, e.g. "SHA-256=...".
+	Created    time.Time `bstore:"nonzero,default now"`
+	StoredAt   time.Time // Zero while pending.
+}
+
+// NATSIndexBackfill records that objects stored before the object index existed
+// were added to it, see BackfillNATSIndex. Singleton with ID 1.
+type NATSIndexBackfill struct {
+	ID    int64
+	Done  time.Time
+	Added int
+}
+
+// natsIndexPending inserts a pending index row for an object about to be stored.
+// The index is only maintained when auth.db is open. Failures are logged and
+// not fatal, reconciliation and listing the bucket can still find the object.
+func (nc *NATSClient) natsIndexPending(ctx context.Context, messageID int64, objectName string) *NATSObjectRef {
+	if AuthDB == nil {
+		return nil
+	}
+	ref := NATSObjectRef{
+		MessageID:  messageID,
+		Account:    messageAccount(ctx),
+		ObjectName: objectName,
+		Bucket:     nc.config.BucketName,
+		State:      NATSObjectPending,
+	}
+	if err := AuthDB.Insert(ctx, &ref); err != nil {
+		nc.log.Errorx("adding pending nats object index row", err, slog.Int64("message_id", messageID), slog.String("object_name", objectName))
+		return nil
+	}
+	return &ref
+}
+
+// natsIndexStored marks a pending row as stored with the details from info. If
+// adding the pending row failed, a stored row is added instead, so the object can
+// still be found without listing the bucket.
+func (nc *NATSClient) natsIndexStored(ctx context.Context, ref *NATSObjectRef, messageID int64, info *jetstream.ObjectInfo) {
+	if AuthDB == nil {
+		return
+	}
+	if ref == nil {
+		ref = &NATSObjectRef{
+			MessageID:  messageID,
+			Account:    messageAccount(ctx),
+			ObjectName: info.Name,
+			Bucket:     info.Bucket,
+			State:      NATSObjectStored,
+			Size:       int64(info.Size),
+			Digest:     info.Digest,
+			StoredAt:   time.Now(),
+		}
+		err := AuthDB.Insert(ctx, ref)
+		nc.log.Check(err, "adding nats object index row after store", slog.Int64("message_id", messageID), slog.String("object_name", info.Name))
+		return
+	}
+	ref.State = NATSObjectStored
+	ref.Bucket = info.Bucket
+	ref.Size = int64(info.Size)
+	ref.Digest = info.Digest
+	ref.StoredAt = time.Now()
+	err := AuthDB.Update(ctx, ref)
+	nc.log.Check(err, "marking nats object index row as stored, reconciliation will fix it", slog.Int64("message_id", ref.MessageID), slog.String("object_name", ref.ObjectName))
+}
+
+// natsIndexFailed removes a pending row after a failed Put.
+func (nc *NATSClient) natsIndexFailed(ctx context.Context, ref *NATSObjectRef) {
+	if ref == nil {
+		return
+	}
+	err := AuthDB.Delete(ctx, ref)
+	nc.log.Check(err, "removing pending nats object index row after failed store", slog.Int64("message_id", ref.MessageID), slog.String("object_name", ref.ObjectName))
+}
+
+// natsRemoveIndex removes the index row and stored headers of an
+// object, if auth.db is open.
+func natsRemoveIndex(ctx context.Context, objectName string) error {
+	if AuthDB == nil {
+		return nil
+	}
+	err := AuthDB.Write(ctx, func(tx *bstore.Tx) error {
+		if _, err := bstore.QueryTx[NATSObjectRef](tx).FilterNonzero(NATSObjectRef{ObjectName: objectName}).Delete(); err != nil {
+			return fmt.Errorf("removing nats object index row: %w", err)
+		}
+		if _, err := bstore.QueryTx[NATSMessageHeader](tx).FilterNonzero(NATSMessageHeader{ObjectName: objectName}).Delete(); err != nil {
+			return fmt.Errorf("removing stored message headers: %w", err)
+		}
+		return nil
+	})
+	return err
+}
+
+// ReconcileNATSIndex resolves index rows stuck in state pending, e.g. after a
+// crash during a store. Rows pending for less than grace are skipped, their
+// store may still be in progress. For each other pending row, the object store is
+// checked: if the object exists, the row is marked stored, otherwise the row is
+// removed. Returns the number of rows marked stored and removed.
+func (nc *NATSClient) ReconcileNATSIndex(ctx context.Context, grace time.Duration) (stored, removed int, rerr error) {
+	if nc == nil {
+		return 0, 0, ErrNATSNotConfigured
+	}
+	if AuthDB == nil {
+		return 0, 0, nil
+	}
+
+	q := bstore.QueryDB[NATSObjectRef](ctx, AuthDB)
+	q.FilterNonzero(NATSObjectRef{State: NATSObjectPending})
+	q.FilterLess("Created", time.Now().Add(-grace))
+	refs, err := q.List()
+	if err != nil {
+		return 0, 0, fmt.Errorf("listing pending nats object index rows: %w", err)
+	}
+	for _, ref := range refs {
+		os, err := nc.objectBucket(WithMessageAccount(ctx, ref.Account), ref.ObjectName)
+		if err != nil {
+			return stored, removed, err
+		}
+		info, err := os.GetInfo(ctx, ref.ObjectName)
+		if err = natsObjectError(err); errors.Is(err, ErrMessageNotFound) {
+			if err := AuthDB.Delete(ctx, &ref); err != nil {
+				return stored, removed, fmt.Errorf("removing pending nats object index row: %w", err)
+			}
+			removed++
+			continue
+		} else if err != nil {
+			return stored, removed, fmt.Errorf("checking object %q: %w", ref.ObjectName, err)
+		}
+		ref.State = NATSObjectStored
+		ref.Bucket = info.Bucket
+		ref.Size = int64(info.Size)
+		ref.Digest = info.Digest
+		ref.StoredAt = info.ModTime
+		if err := AuthDB.Update(ctx, &ref); err != nil {
+			return stored, removed, fmt.Errorf("marking nats object index row as stored: %w", err)
+		}
+		stored++
+	}
+	if stored > 0 || removed > 0 {
+		nc.log.Info("reconciled nats object index", slog.Int("stored", stored), slog.Int("removed", removed))
+	}
+	return stored, removed, nil
+}
+
+// BackfillNATSIndex adds rows to the object index for objects of messages in the
+// buckets that have none, e.g. objects stored before the object index existed, or
+// by a mox without auth.db. It is done once: when a backfill has completed
+// before, nothing is done. Returns the number of rows added.
+func (nc *NATSClient) BackfillNATSIndex(ctx context.Context) (int, error) {
+	if nc == nil {
+		return 0, ErrNATSNotConfigured
+	}
+	if AuthDB == nil {
+		return 0, nil
+	}
+	if err := AuthDB.Get(ctx, &NATSIndexBackfill{ID: 1}); err == nil {
+		return 0, nil
+	} else if err != bstore.ErrAbsent {
+		return 0, fmt.Errorf("checking for earlier nats object index backfill: %w", err)
+	}
+
+	var added int
+	for _, os := range nc.natsBuckets() {
+		infos, err := os.List(ctx)
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			continue
+		} else if err != nil {
+			return added, fmt.Errorf("listing objects: %w", err)
+		}
+		err = AuthDB.Write(ctx, func(tx *bstore.Tx) error {
+			for _, info := range infos {
+				messageID, ok := natsMessageIDFromObject(info.Name)
+				if !ok || info.Deleted {
+					continue
+				}
+				exists, err := bstore.QueryTx[NATSObjectRef](tx).FilterNonzero(NATSObjectRef{ObjectName: info.Name}).Exists()
+				if err != nil {
+					return fmt.Errorf("checking index: %w", err)
+				} else if exists {
+					continue
+				}
+				ref := NATSObjectRef{
+					MessageID:  messageID,
+					Account:    info.Metadata[natsAccountKey],
+					ObjectName: info.Name,
+					Bucket:     info.Bucket,
+					State:      NATSObjectStored,
+					Size:       int64(info.Size),
+					Digest:     info.Digest,
+					StoredAt:   info.ModTime,
+				}
+				if _, deleted := natsDeletedAt(info); deleted {
+					ref.State = NATSObjectDeleted
+				}
+				if err := tx.Insert(&ref); err != nil {
+					return fmt.Errorf("adding index row: %w", err)
+				}
+				added++
+			}
+			return nil
+		})
+		if err != nil {
+			return added, err
+		}
+	}
+	if err := AuthDB.Insert(ctx, &NATSIndexBackfill{ID: 1, Done: time.Now(), Added: added}); err != nil {
+		return added, fmt.Errorf("recording nats object index backfill: %w", err)
+	}
+	nc.log.Info("added objects without row to nats object index", slog.Int("added", added))
+	return added, nil
+}
+
+// indexReconcileLoop periodically reconciles the object index and cleans up
+// expired stored headers, objects with expired retention class and soft-deleted
+// objects past their retention, until the client is closed.
+func (nc *NATSClient) indexReconcileLoop() {
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS index reconciliation", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	_, err := nc.BackfillNATSIndex(ctx)
+	cancel()
+	nc.log.Check(err, "adding objects without row to nats object index, retrying at next start")
+
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		// Stores in progress are bounded by the request timeout and the maximum store
+		// timeout, so older rows are stale.
+		_, maxStore := nc.storeTimeoutBounds()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		_, _, err := nc.ReconcileNATSIndex(ctx, 2*nc.requestTimeout()+maxStore)
+		nc.log.Check(err, "reconciling nats object index")
+		err = nc.natsHeadersCleanup(ctx)
+		nc.log.Check(err, "cleaning up stored message headers")
+		cancel()
+		if len(nc.retention) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			_, err := nc.SweepNATSRetention(ctx, time.Now())
+			cancel()
+			nc.log.Check(err, "removing nats objects with expired retention class")
+		}
+		if nc.config.SoftDeleteRetention > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			_, err := nc.SweepNATSSoftDeleted(ctx, time.Now())
+			cancel()
+			nc.log.Check(err, "purging soft-deleted nats objects")
+		}
+
+		select {
+		case <-nc.closing:
+			return
+		case <-t.C:
+		}
+	}
+}
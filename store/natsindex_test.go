@@ -0,0 +1,228 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// openTestAuthDB opens a fresh auth.db as AuthDB for the duration of the test.
+func openTestAuthDB(t *testing.T) {
+	t.Helper()
+	if AuthDB != nil {
+		t.Fatalf("auth.db already open")
+	}
+	db, err := bstore.Open(ctxbg, filepath.Join(t.TempDir(), "auth.db"), nil, AuthDBTypes...)
+	tcheck(t, err, "open auth.db")
+	AuthDB = db
+	t.Cleanup(func() {
+		err := AuthDB.Close()
+		tcheck(t, err, "close auth.db")
+		AuthDB = nil
+	})
+}
+
+func TestNATSIndex(t *testing.T) {
+	openTestAuthDB(t)
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	actx := WithMessageAccount(ctxbg, "mjl")
+
+	err := nc.StoreMessage(actx, 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	refs, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).List()
+	tcheck(t, err, "list refs")
+	tcompare(t, len(refs), 1)
+	tcompare(t, refs[0].State, NATSObjectStored)
+	tcompare(t, refs[0].MessageID, int64(1))
+	tcompare(t, refs[0].Size, int64(4))
+	tcompare(t, fos.names(), []string{refs[0].ObjectName})
+
+	// Failed store doesn't leave a row.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return jetstream.ErrBadObjectMeta }
+	err = nc.StoreMessage(actx, 2, writeTestMessage(t, "test"))
+	if err == nil {
+		t.Fatalf("store succeeded with failing put")
+	}
+	n, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).Count()
+	tcheck(t, err, "count refs")
+	tcompare(t, n, 1)
+	fos.putHook = nil
+
+	// Retrieval and removal look up the object in the index, without listing the
+	// bucket.
+	r, err := nc.GetMessage(actx, 1)
+	tcheck(t, err, "get message")
+	r.Close()
+	err = nc.DeleteMessage(actx, 1)
+	tcheck(t, err, "delete message")
+	tcompare(t, len(fos.names()), 0)
+	tcompare(t, fos.listCalls, 0)
+
+	// With Dedup, messages with the same content map to one object through their
+	// dedup references.
+	fos = newFakeObjectStore()
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", Dedup: true}, fos)
+	for _, id := range []int64{3, 4} {
+		err := nc.StoreMessage(actx, id, writeTestMessage(t, "shared"))
+		tcheck(t, err, "store message with dedup")
+	}
+	tcompare(t, len(fos.names()), 1)
+	err = nc.DeleteMessage(actx, 3)
+	tcheck(t, err, "delete message with dedup")
+	r, err = nc.GetMessage(actx, 4)
+	tcheck(t, err, "get message with dedup")
+	r.Close()
+	if _, err := nc.GetMessage(actx, 3); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound for deleted message", err)
+	}
+	err = nc.DeleteMessage(actx, 4)
+	tcheck(t, err, "delete last message with dedup")
+	tcompare(t, len(fos.names()), 0)
+	tcompare(t, fos.listCalls, 0)
+}
+
+func TestNATSIndexReconcile(t *testing.T) {
+	openTestAuthDB(t)
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// Simulate crashes: one after the Put succeeded but before the row was marked
+	// stored, one before the Put happened.
+	old := time.Now().Add(-time.Hour)
+	crashedAfterPut := NATSObjectRef{MessageID: 1, ObjectName: "msg-1-1", State: NATSObjectPending, Created: old}
+	crashedBeforePut := NATSObjectRef{MessageID: 2, ObjectName: "msg-2-1", State: NATSObjectPending, Created: old}
+	recent := NATSObjectRef{MessageID: 3, ObjectName: "msg-3-1", State: NATSObjectPending}
+	for _, ref := range []*NATSObjectRef{&crashedAfterPut, &crashedBeforePut, &recent} {
+		err := AuthDB.Insert(ctxbg, ref)
+		tcheck(t, err, "insert ref")
+	}
+	_, err := fos.Put(ctxbg, jetstream.ObjectMeta{Name: "msg-1-1"}, strings.NewReader("test"))
+	tcheck(t, err, "put")
+
+	stored, removed, err := nc.ReconcileNATSIndex(ctxbg, time.Minute)
+	tcheck(t, err, "reconcile")
+	tcompare(t, stored, 1)
+	tcompare(t, removed, 1)
+
+	err = AuthDB.Get(ctxbg, &crashedAfterPut)
+	tcheck(t, err, "get ref")
+	tcompare(t, crashedAfterPut.State, NATSObjectStored)
+	tcompare(t, crashedAfterPut.Size, int64(4))
+
+	err = AuthDB.Get(ctxbg, &crashedBeforePut)
+	tcompare(t, err, bstore.ErrAbsent)
+
+	// Recent pending row is left alone, its store may still be in progress.
+	err = AuthDB.Get(ctxbg, &recent)
+	tcheck(t, err, "get ref")
+	tcompare(t, recent.State, NATSObjectPending)
+}
+
+func TestNATSHeaders(t *testing.T) {
+	openTestAuthDB(t)
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", StoreHeaders: true, MaxHeaderSize: 10, HeaderRetention: time.Hour}, fos)
+
+	msg := func(from, subject, date string) string {
+		return fmt.Sprintf("From: %s\r\nTo: <mjl@mox.example>\r\nSubject: %s\r\nDate: %s\r\nMessage-ID: <%s@mox.example>\r\n\r\nbody\r\n", from, subject, date, subject)
+	}
+	err := nc.StoreMessage(ctxbg, 1, writeTestMessage(t, msg("<a@remote.example>", "hello", "Mon, 01 Jan 2024 10:00:00 +0000")))
+	tcheck(t, err, "store message")
+	err = nc.StoreMessage(ctxbg, 2, writeTestMessage(t, msg("<b@other.example>", "a long subject", "Tue, 02 Jan 2024 10:00:00 +0000")))
+	tcheck(t, err, "store message")
+
+	l, err := SearchNATSHeaders(ctxbg, NATSHeaderQuery{})
+	tcheck(t, err, "search")
+	tcompare(t, len(l), 2)
+	tcompare(t, l[0].MessageID, int64(2)) // Newest first.
+	tcompare(t, l[0].Subject, "a long sub")
+	tcompare(t, l[1].From, "a@remote.e")
+
+	l, err = SearchNATSHeaders(ctxbg, NATSHeaderQuery{From: "REMOTE"})
+	tcheck(t, err, "search")
+	tcompare(t, len(l), 1)
+	tcompare(t, l[0].MessageID, int64(1))
+	tcompare(t, l[0].To, "mjl@mox.ex")
+
+	l, err = SearchNATSHeaders(ctxbg, NATSHeaderQuery{Since: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)})
+	tcheck(t, err, "search")
+	tcompare(t, len(l), 1)
+	tcompare(t, l[0].MessageID, int64(2))
+
+	l, err = SearchNATSHeaders(ctxbg, NATSHeaderQuery{MsgID: "<hello@mox"})
+	tcheck(t, err, "search")
+	tcompare(t, len(l), 1)
+
+	// Retention removes old headers.
+	_, err = bstore.QueryDB[NATSMessageHeader](ctxbg, AuthDB).FilterNonzero(NATSMessageHeader{MessageID: 1}).UpdateField("Created", time.Now().Add(-2*time.Hour))
+	tcheck(t, err, "age header")
+	err = nc.natsHeadersCleanup(ctxbg)
+	tcheck(t, err, "cleanup")
+	l, err = SearchNATSHeaders(ctxbg, NATSHeaderQuery{})
+	tcheck(t, err, "search")
+	tcompare(t, len(l), 1)
+	tcompare(t, l[0].MessageID, int64(2))
+
+	// Without StoreHeaders, nothing is stored.
+	nc = newTestNATSClient(nil, fos)
+	err = nc.StoreMessage(ctxbg, 3, writeTestMessage(t, msg("<c@remote.example>", "hi", "Mon, 01 Jan 2024 10:00:00 +0000")))
+	tcheck(t, err, "store message")
+	n, err := bstore.QueryDB[NATSMessageHeader](ctxbg, AuthDB).Count()
+	tcheck(t, err, "count")
+	tcompare(t, n, 1)
+}
+
+func TestNATSIndexBackfill(t *testing.T) {
+	openTestAuthDB(t)
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// Objects stored before the index existed, and one already indexed.
+	put := func(name, account string) {
+		t.Helper()
+		_, err := fos.Put(ctxbg, jetstream.ObjectMeta{Name: name, Metadata: map[string]string{natsAccountKey: account}}, strings.NewReader("test"))
+		tcheck(t, err, "put")
+	}
+	put("msg-1-100", "mjl")
+	put("msg-2-100", "other")
+	put("mox-index", "")
+	err := nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 3, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+
+	// Without rows, the object index doesn't find the objects.
+	_, err = nc.GetMessage(WithMessageAccount(ctxbg, "mjl"), 1)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound", err)
+	}
+
+	added, err := nc.BackfillNATSIndex(ctxbg)
+	tcheck(t, err, "backfill")
+	tcompare(t, added, 2)
+	ref, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).FilterNonzero(NATSObjectRef{ObjectName: "msg-2-100"}).Get()
+	tcheck(t, err, "get ref")
+	tcompare(t, ref.MessageID, int64(2))
+	tcompare(t, ref.Account, "other")
+	tcompare(t, ref.State, NATSObjectStored)
+	tcompare(t, ref.Size, int64(4))
+	r, err := nc.GetMessage(WithMessageAccount(ctxbg, "mjl"), 1)
+	tcheck(t, err, "get backfilled message")
+	r.Close()
+
+	// The backfill is only done once.
+	put("msg-4-100", "mjl")
+	added, err = nc.BackfillNATSIndex(ctxbg)
+	tcheck(t, err, "backfill again")
+	tcompare(t, added, 0)
+	n, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).Count()
+	tcheck(t, err, "count refs")
+	tcompare(t, n, 3)
+}
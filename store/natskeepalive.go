@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+var (
+	metricNATSStoreDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mox_nats_store_duration_seconds",
+			Help:    "Duration of puts to the NATS object store, with after_idle true for the first put after an idle period of at least a minute.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20, 30},
+		},
+		[]string{"after_idle"},
+	)
+	metricNATSKeepaliveDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mox_nats_keepalive_duration_seconds",
+			Help:    "Duration of keepalive requests to the NATS object store.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.100, 0.5, 1, 5, 10, 20},
+		},
+	)
+)
+
+// Time without puts after which the next put is considered the first after an
+// idle period. Keepalive requests don't end an idle period, so the after_idle
+// store durations can be compared with and without keepalive.
+const natsIdleAfter = time.Minute
+
+// observeStore records the duration d of a put that started at start.
+func (nc *NATSClient) observeStore(start time.Time, d time.Duration) {
+	last := time.Unix(0, nc.lastStore.Swap(start.Add(d).UnixNano()))
+	afterIdle := start.Sub(last) >= natsIdleAfter
+	metricNATSStoreDuration.WithLabelValues(strconv.FormatBool(afterIdle)).Observe(d.Seconds())
+	if afterIdle {
+		nc.log.Debug("first store to NATS after idle period",
+			slog.Duration("idle", start.Sub(last)),
+			slog.Duration("duration", d),
+			slog.Duration("keepalive", nc.config.Keepalive))
+	}
+}
+
+// keepalive requests the status of each bucket, when no message was stored
+// during the last interval.
+func (nc *NATSClient) keepalive(ctx context.Context, now time.Time, interval time.Duration) {
+	if now.Sub(time.Unix(0, nc.lastStore.Load())) < interval {
+		return
+	}
+	for _, os := range nc.natsBuckets() {
+		t0 := time.Now()
+		status, err := os.Status(ctx)
+		d := time.Since(t0)
+		if err != nil {
+			nc.log.Errorx("keepalive request to nats", err)
+			continue
+		}
+		metricNATSKeepaliveDuration.Observe(d.Seconds())
+		nc.log.Debug("keepalive request to nats", slog.String("bucket", status.Bucket()), slog.Duration("duration", d))
+	}
+}
+
+// keepaliveLoop makes keepalive requests until the client is closed, when
+// Keepalive is configured.
+func (nc *NATSClient) keepaliveLoop() {
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS keepalive", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	interval := nc.config.Keepalive
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-nc.closing:
+			return
+		case now := <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), nc.requestTimeout())
+			nc.keepalive(ctx, now, interval)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// StoredMessageInfo describes a message object in the NATS object store, as
+// returned by ListMessages.
+type StoredMessageInfo struct {
+	Bucket      string
+	ObjectName  string
+	MessageID   int64
+	Account     string // Empty for objects stored without account.
+	Size        int64  // As stored, after transforms.
+	Stored      time.Time
+	SoftDeleted bool // Marked as deleted with SoftDeleteRetention, see UndeleteMessage.
+}
+
+// ListMessages calls fn for each message object in the buckets messages are
+// stored in, e.g. for auditing or migration. If ctx has an account, see
+// WithMessageAccount, only objects of that account are listed. Objects whose name
+// doesn't have a message ID, e.g. of maildir imports, are skipped. Objects are
+// passed to fn while the bucket is read, without first loading the list of all
+// objects in memory. If fn returns an error, listing stops and the error is
+// returned.
+func (nc *NATSClient) ListMessages(ctx context.Context, fn func(StoredMessageInfo) error) error {
+	if nc == nil {
+		return ErrNATSNotConfigured
+	}
+	account := messageAccount(ctx)
+	if account != "" && nc.config.AccountBuckets != "" {
+		// Opened once, so it is included in the buckets below.
+		if _, err := nc.accountBucket(ctx, account); err != nil {
+			return err
+		}
+	}
+	for _, os := range nc.natsBuckets() {
+		err := natsEachObject(ctx, os, func(info *jetstream.ObjectInfo) error {
+			id, ok := natsMessageIDFromObject(info.Name)
+			if !ok || account != "" && info.Metadata[natsAccountKey] != account {
+				return nil
+			}
+			_, softDeleted := natsDeletedAt(info)
+			return fn(StoredMessageInfo{
+				Bucket:      info.Bucket,
+				ObjectName:  info.Name,
+				MessageID:   id,
+				Account:     info.Metadata[natsAccountKey],
+				Size:        int64(info.Size),
+				Stored:      info.ModTime,
+				SoftDeleted: softDeleted,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// natsEachObject calls fn for each object in os that isn't removed, streaming
+// them from a watcher. Stores that can't be watched, e.g. the fallback stream,
+// are listed instead.
+func natsEachObject(ctx context.Context, os jetstream.ObjectStore, fn func(info *jetstream.ObjectInfo) error) error {
+	w, err := os.Watch(ctx, jetstream.IgnoreDeletes())
+	if errors.Is(err, errNATSStreamUnsupported) {
+		infos, err := os.List(ctx)
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("listing objects: %w", err)
+		}
+		for _, info := range infos {
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("watching objects: %w", err)
+	}
+	defer w.Stop()
+
+	updates := w.Updates()
+	for {
+		select {
+		case info := <-updates:
+			// A nil info marks the end of the existing objects.
+			if info == nil {
+				return nil
+			}
+			if info.Deleted {
+				continue
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
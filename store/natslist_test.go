@@ -0,0 +1,83 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSListMessages(t *testing.T) {
+	var nilClient *NATSClient
+	if err := nilClient.ListMessages(ctxbg, func(StoredMessageInfo) error { return nil }); !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", SoftDeleteRetention: time.Hour}, fos)
+	err := nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 1, writeTestMessage(t, "first"))
+	tcheck(t, err, "store message")
+	err = nc.StoreMessage(WithMessageAccount(ctxbg, "mjl"), 2, writeTestMessage(t, "second"))
+	tcheck(t, err, "store message")
+	err = nc.StoreMessage(WithMessageAccount(ctxbg, "other"), 1, writeTestMessage(t, "other"))
+	tcheck(t, err, "store message")
+	err = nc.DeleteMessage(WithMessageAccount(ctxbg, "mjl"), 2)
+	tcheck(t, err, "soft-delete message")
+	// Objects that aren't messages, and removed objects, are skipped.
+	_, err = fos.Put(ctxbg, jetstream.ObjectMeta{Name: "import-abc"}, writeTestMessage(t, "import"))
+	tcheck(t, err, "put object")
+	o := fos.objects[fos.names()[0]]
+	o.info.Name = "msg-3-100"
+	o.info.Deleted = true
+	fos.objects[o.info.Name] = o
+
+	list := func(account string) (l []StoredMessageInfo) {
+		t.Helper()
+		ctx := ctxbg
+		if account != "" {
+			ctx = WithMessageAccount(ctx, account)
+		}
+		err := nc.ListMessages(ctx, func(info StoredMessageInfo) error {
+			l = append(l, info)
+			return nil
+		})
+		tcheck(t, err, "list messages")
+		return l
+	}
+
+	l := list("")
+	tcompare(t, len(l), 3)
+	for _, info := range l {
+		tcompare(t, info.Bucket, "test-bucket")
+		if info.Stored.IsZero() {
+			t.Fatalf("no time of storing for %q", info.ObjectName)
+		}
+	}
+	l = list("mjl")
+	tcompare(t, len(l), 2)
+	ids := map[int64]StoredMessageInfo{}
+	for _, info := range l {
+		tcompare(t, info.Account, "mjl")
+		ids[info.MessageID] = info
+	}
+	tcompare(t, ids[1].Size, int64(len("first")))
+	tcompare(t, ids[1].SoftDeleted, false)
+	tcompare(t, ids[2].SoftDeleted, true)
+	tcompare(t, len(list("other")), 1)
+	tcompare(t, len(list("nobody")), 0)
+
+	// An error from the callback stops listing.
+	var n int
+	errStop := errors.New("stop")
+	err = nc.ListMessages(ctxbg, func(StoredMessageInfo) error {
+		n++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("got err %v, expected error from callback", err)
+	}
+	tcompare(t, n, 1)
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"context"
+	"os"
+)
+
+var _ messageStoreHandler = (*NATSClient)(nil)
+
+// storeMode stores messages of at least MinStoreSize while connected: forwarded
+// with DeleteAfterStore, synchronously for SyncMailboxes, and in the background,
+// queued for retry on failure, otherwise.
+func (nc *NATSClient) storeMode(mailbox string, size int64) messageStoreMode {
+	if !nc.IsConnected() || !nc.StoresMessage(size) {
+		return messageStoreNone
+	} else if nc.config.DeleteAfterStore {
+		return messageStoreForward
+	} else if nc.StoresSync(mailbox) {
+		return messageStoreSync
+	}
+	return messageStoreBackground
+}
+
+func (nc *NATSClient) storeConfirmed(ctx context.Context, messageID int64, msgFile *os.File) error {
+	return nc.StoreMessageSync(ctx, messageID, msgFile)
+}
+
+func (nc *NATSClient) storeBackground(ctx context.Context, messageID int64, msgFile *os.File) {
+	nc.StoreMessageAsync(ctx, messageID, msgFile)
+}
+
+func (nc *NATSClient) deleteAccount(ctx context.Context, account string) error {
+	_, err := nc.DeleteAccountObjects(ctx, account)
+	return err
+}
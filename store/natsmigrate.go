@@ -0,0 +1,356 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
+)
+
+var (
+	metricNATSMigrationObjects = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_migration_objects",
+			Help: "Number of objects handled in the last pass of the migration to a new NATS bucket, by state: total, copied, skipped (already present) or failed.",
+		},
+		[]string{"state"},
+	)
+	metricNATSMigrationDone = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_migration_done",
+			Help: "Whether the migration to a new NATS bucket is complete and reads were switched to the new bucket (1), or still in progress (0).",
+		},
+	)
+)
+
+// NATSMigrationProgress describes the state of copying objects from the
+// MigrateFromBucket to the BucketName bucket.
+type NATSMigrationProgress struct {
+	FromBucket string
+	ToBucket   string
+
+	// Counts for the current or last pass over the old bucket. Skipped are objects
+	// that were already present in the new bucket, e.g. due to dual-writes.
+	Total   int
+	Copied  int
+	Skipped int
+	Failed  int
+
+	Started  time.Time // Of the current or last pass, zero if none started yet.
+	Finished time.Time // Of the last pass, zero while in progress.
+
+	// Done is set when a pass completed without failures. Reads and writes then only
+	// use the new bucket.
+	Done bool
+}
+
+// natsMigration is the state of a bucket migration of a client.
+type natsMigration struct {
+	os jetstream.ObjectStore // Old bucket.
+
+	sync.Mutex
+	progress NATSMigrationProgress
+}
+
+func newNATSMigration(cfg *config.NATS, old jetstream.ObjectStore) *natsMigration {
+	return &natsMigration{
+		os:       old,
+		progress: NATSMigrationProgress{FromBucket: cfg.MigrateFromBucket, ToBucket: cfg.BucketName},
+	}
+}
+
+// migrating returns the old bucket if a migration is in progress, nil otherwise.
+func (nc *NATSClient) migrating() jetstream.ObjectStore {
+	m := nc.migration
+	if m == nil {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.progress.Done {
+		return nil
+	}
+	return m.os
+}
+
+// MigrationProgress returns the progress of copying objects to a new bucket. The
+// bool is false if no migration is configured.
+func (nc *NATSClient) MigrationProgress() (NATSMigrationProgress, bool) {
+	if nc == nil || nc.migration == nil {
+		return NATSMigrationProgress{}, false
+	}
+	nc.migration.Lock()
+	defer nc.migration.Unlock()
+	return nc.migration.progress, true
+}
+
+// getObject returns the object from the bucket that is authoritative for reads:
+// during a migration the old bucket, falling back to the new bucket for objects
+// whose write to the old bucket failed. Once migration is done, only the new
+// bucket is used.
+func (nc *NATSClient) getObject(ctx context.Context, name string) (rr jetstream.ObjectResult, rerr error) {
+	ctx, endSpan := nc.startSpan(ctx, "get", attribute.String("nats.object_name", name))
+	defer func() { endSpan(rerr) }()
+
+	// Canceled when reading stalls or the result is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	wrap := func(r jetstream.ObjectResult, err error) (jetstream.ObjectResult, error) {
+		if err != nil {
+			cancel()
+			return nil, natsObjectError(err)
+		}
+		if info, err := r.Info(); err == nil {
+			if _, ok := natsDeletedAt(info); ok {
+				r.Close()
+				cancel()
+				return nil, fmt.Errorf("%w: object %q was soft-deleted", ErrMessageNotFound, name)
+			}
+		}
+		if nc.metadataKey != nil {
+			info, err := r.Info()
+			if err == nil {
+				err = nc.verifyObject(info)
+			}
+			if err != nil {
+				r.Close()
+				cancel()
+				return nil, err
+			}
+		}
+		res, err := nc.encryption.decryptLoad(newNATSStallReader(r, nc.readIdleTimeout(), cancel))
+		if err == nil {
+			res, err = natsDecompressLoad(res)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return transformLoad(res)
+	}
+
+	if old := nc.migrating(); old != nil {
+		r, err := old.Get(ctx, name)
+		if err == nil || !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return wrap(r, err)
+		}
+	}
+	os, err := nc.objectBucket(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(os.Get(ctx, name))
+}
+
+// getObjectInfo returns the info of an object from the bucket that is
+// authoritative for reads, like getObject.
+func (nc *NATSClient) getObjectInfo(ctx context.Context, name string) (*jetstream.ObjectInfo, error) {
+	if old := nc.migrating(); old != nil {
+		info, err := old.GetInfo(ctx, name)
+		if err == nil || !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return info, err
+		}
+	}
+	os, err := nc.objectBucket(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.GetInfo(ctx, name)
+}
+
+// migrateDualWrite writes a message just stored in the new bucket to the old
+// bucket too while a migration is in progress, so the old bucket stays complete
+// for readers that haven't switched yet. Failures are logged only: reads fall back
+// to the new bucket.
+func (nc *NATSClient) migrateDualWrite(ctx context.Context, meta jetstream.ObjectMeta, info *jetstream.ObjectInfo, r io.ReaderAt, size int64) {
+	old := nc.migrating()
+	if old == nil {
+		return
+	}
+	var data io.Reader = io.NewSectionReader(r, 0, size)
+	if len(nc.transforms) > 0 {
+		// Transforms may not give the same result again, copy what was stored.
+		res, err := nc.bucketFor(meta.Name).Get(ctx, meta.Name)
+		if err != nil {
+			nc.log.Errorx("reading stored message for writing to old bucket during migration", err, slog.String("object_name", meta.Name))
+			return
+		}
+		defer res.Close()
+		data = res
+	}
+	oinfo, err := old.Put(ctx, meta, data)
+	if err == nil && oinfo.Digest != info.Digest {
+		err = fmt.Errorf("digest %s does not match %s in new bucket", oinfo.Digest, info.Digest)
+	}
+	nc.log.Check(err, "writing message to old bucket during migration", slog.String("object_name", meta.Name), slog.String("bucket", nc.config.MigrateFromBucket))
+}
+
+// MigrateBucket makes a pass over all objects in the old bucket, copying those
+// not yet present in the new bucket. If all objects are present in the new bucket
+// afterwards, the migration is marked done and reads and writes switch to the new
+// bucket only.
+func (nc *NATSClient) MigrateBucket(ctx context.Context) (NATSMigrationProgress, error) {
+	if nc == nil {
+		return NATSMigrationProgress{}, ErrNATSNotConfigured
+	}
+	m := nc.migration
+	if m == nil {
+		return NATSMigrationProgress{}, fmt.Errorf("no bucket migration configured")
+	}
+	old := nc.migrating()
+	if old == nil {
+		p, _ := nc.MigrationProgress()
+		return p, nil
+	}
+
+	update := func(fn func(p *NATSMigrationProgress)) NATSMigrationProgress {
+		m.Lock()
+		defer m.Unlock()
+		fn(&m.progress)
+		p := m.progress
+		metricNATSMigrationObjects.WithLabelValues("total").Set(float64(p.Total))
+		metricNATSMigrationObjects.WithLabelValues("copied").Set(float64(p.Copied))
+		metricNATSMigrationObjects.WithLabelValues("skipped").Set(float64(p.Skipped))
+		metricNATSMigrationObjects.WithLabelValues("failed").Set(float64(p.Failed))
+		if p.Done {
+			metricNATSMigrationDone.Set(1)
+		} else {
+			metricNATSMigrationDone.Set(0)
+		}
+		return p
+	}
+
+	update(func(p *NATSMigrationProgress) {
+		*p = NATSMigrationProgress{FromBucket: p.FromBucket, ToBucket: p.ToBucket, Started: time.Now()}
+	})
+
+	infos, err := old.List(ctx)
+	if err != nil && !errors.Is(err, jetstream.ErrNoObjectsFound) {
+		p := update(func(p *NATSMigrationProgress) { p.Finished = time.Now() })
+		return p, fmt.Errorf("listing objects in old bucket: %w", err)
+	}
+	var live []*jetstream.ObjectInfo
+	for _, info := range infos {
+		if !info.Deleted {
+			live = append(live, info)
+		}
+	}
+	update(func(p *NATSMigrationProgress) { p.Total = len(live) })
+
+	for _, info := range live {
+		if ctx.Err() != nil {
+			p := update(func(p *NATSMigrationProgress) { p.Finished = time.Now() })
+			return p, ctx.Err()
+		}
+		copied, err := nc.migrateObject(ctx, old, info)
+		if err != nil {
+			nc.log.Errorx("copying object to new bucket", err, slog.String("object_name", info.Name))
+		}
+		update(func(p *NATSMigrationProgress) {
+			if err != nil {
+				p.Failed++
+			} else if copied {
+				p.Copied++
+			} else {
+				p.Skipped++
+			}
+		})
+	}
+
+	p := update(func(p *NATSMigrationProgress) {
+		p.Finished = time.Now()
+		p.Done = p.Failed == 0
+	})
+	if p.Done {
+		nc.log.Info("migration to new NATS bucket complete, reads switched to new bucket, MigrateFromBucket can be removed from the config",
+			slog.String("from", p.FromBucket),
+			slog.String("to", p.ToBucket),
+			slog.Int("copied", p.Copied),
+			slog.Int("skipped", p.Skipped))
+	}
+	return p, nil
+}
+
+// migrateObject copies an object from the old to the new bucket, unless already
+// present.
+func (nc *NATSClient) migrateObject(ctx context.Context, old jetstream.ObjectStore, info *jetstream.ObjectInfo) (bool, error) {
+	newos := nc.bucketFor(info.Name)
+	if _, err := newos.GetInfo(ctx, info.Name); err == nil {
+		return false, nil
+	} else if !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return false, fmt.Errorf("checking for object in new bucket: %w", err)
+	}
+
+	release, err := nc.acquireStore(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	r, err := old.Get(ctx, info.Name)
+	if err != nil {
+		return false, fmt.Errorf("getting object from old bucket: %w", natsObjectError(err))
+	}
+	defer r.Close()
+
+	meta := info.ObjectMeta
+	meta.Opts = nil
+	ninfo, err := newos.Put(ctx, meta, r)
+	if err == nil && (ninfo.Size != info.Size || ninfo.Digest != info.Digest) {
+		err = fmt.Errorf("copy does not match original (size %d, digest %s, expected size %d, digest %s)", ninfo.Size, ninfo.Digest, info.Size, info.Digest)
+	}
+	if err != nil {
+		if ninfo != nil {
+			derr := newos.Delete(ctx, info.Name)
+			nc.log.Check(derr, "removing unverified copy of object in new bucket", slog.String("object_name", info.Name))
+		}
+		return false, fmt.Errorf("copying object: %w", err)
+	}
+	return true, nil
+}
+
+// migrationLoop runs passes over the old bucket until the migration is done or
+// the client is closed.
+func (nc *NATSClient) migrationLoop() {
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS bucket migration", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-nc.closing:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		p, err := nc.MigrateBucket(ctx)
+		cancel()
+		nc.log.Check(err, "migrating objects to new NATS bucket")
+		if p.Done {
+			return
+		}
+
+		select {
+		case <-nc.closing:
+			return
+		case <-time.After(5 * time.Minute):
+		}
+	}
+}
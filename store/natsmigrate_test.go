@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSMigration(t *testing.T) {
+	oldos := newFakeObjectStore()
+	oldos.bucket = "old-bucket"
+	newos := newFakeObjectStore()
+	cfg := &config.NATS{BucketName: "test-bucket", MigrateFromBucket: "old-bucket"}
+	nc := newTestNATSClient(cfg, newos)
+	nc.migration = newNATSMigration(cfg, oldos)
+
+	readObject := func(name string) string {
+		t.Helper()
+		r, err := nc.getObject(ctxbg, name)
+		tcheck(t, err, "get object")
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read object")
+		return string(buf)
+	}
+
+	// Objects stored before the migration started, only in the old bucket.
+	_, err := oldos.Put(ctxbg, jetstream.ObjectMeta{Name: "msg-1-1"}, strings.NewReader("one"))
+	tcheck(t, err, "put in old bucket")
+	_, err = oldos.Put(ctxbg, jetstream.ObjectMeta{Name: "msg-2-1"}, strings.NewReader("two"))
+	tcheck(t, err, "put in old bucket")
+
+	p, ok := nc.MigrationProgress()
+	tcompare(t, ok, true)
+	tcompare(t, p.Done, false)
+
+	// During the dual-write window, new messages go to both buckets.
+	err = nc.StoreMessage(ctxbg, 3, writeTestMessage(t, "three"))
+	tcheck(t, err, "store message")
+	tcompare(t, len(oldos.names()), 3)
+	tcompare(t, len(newos.names()), 1)
+	name3 := newos.names()[0]
+	tcompare(t, readObject(name3), "three")
+
+	// Reads come from the old bucket, which has all messages.
+	tcompare(t, readObject("msg-1-1"), "one")
+
+	// A failed write to the old bucket doesn't fail the store, reads fall back to the
+	// new bucket.
+	oldos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("old bucket unavailable") }
+	err = nc.StoreMessage(ctxbg, 4, writeTestMessage(t, "four"))
+	tcheck(t, err, "store message with failing old bucket")
+	oldos.putHook = nil
+	tcompare(t, len(oldos.names()), 3)
+	tcompare(t, len(newos.names()), 2)
+	var name4 string
+	for _, name := range newos.names() {
+		if name != name3 {
+			name4 = name
+		}
+	}
+	tcompare(t, readObject(name4), "four")
+
+	// A failing copy leaves the migration in progress.
+	newos.putHook = func(meta jetstream.ObjectMeta) error {
+		if meta.Name == "msg-2-1" {
+			return errors.New("copy failed")
+		}
+		return nil
+	}
+	p, err = nc.MigrateBucket(ctxbg)
+	tcheck(t, err, "migrate bucket")
+	tcompare(t, p.Total, 3)
+	tcompare(t, p.Copied, 1)
+	tcompare(t, p.Skipped, 1)
+	tcompare(t, p.Failed, 1)
+	tcompare(t, p.Done, false)
+	if nc.migrating() == nil {
+		t.Fatalf("migration done after failed copy")
+	}
+	newos.putHook = nil
+
+	// Next pass copies the remaining object and cuts over.
+	p, err = nc.MigrateBucket(ctxbg)
+	tcheck(t, err, "migrate bucket")
+	tcompare(t, p.Total, 3)
+	tcompare(t, p.Copied, 1)
+	tcompare(t, p.Skipped, 2)
+	tcompare(t, p.Failed, 0)
+	tcompare(t, p.Done, true)
+	tcompare(t, p.FromBucket, "old-bucket")
+	tcompare(t, p.ToBucket, "test-bucket")
+	tcompare(t, len(newos.names()), 4)
+
+	// After cutover, writes only go to the new bucket, and reads come from it.
+	err = nc.StoreMessage(ctxbg, 5, writeTestMessage(t, "five"))
+	tcheck(t, err, "store message after cutover")
+	tcompare(t, len(oldos.names()), 3)
+	tcompare(t, len(newos.names()), 5)
+
+	oldos.Lock()
+	o := oldos.objects["msg-1-1"]
+	o.data = []byte("changed")
+	oldos.objects["msg-1-1"] = o
+	oldos.Unlock()
+	tcompare(t, readObject("msg-1-1"), "one")
+
+	// Further passes are no-ops.
+	p, err = nc.MigrateBucket(ctxbg)
+	tcheck(t, err, "migrate bucket after done")
+	tcompare(t, p.Done, true)
+	tcompare(t, p.Copied, 1)
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+var (
+	metricNATSOrphans = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_orphans",
+			Help: "Number of objects in the NATS object store without local message, found in the last orphan scan.",
+		},
+	)
+	metricNATSOrphansRemoved = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_nats_orphans_removed_total",
+			Help: "Number of objects without local message removed from the NATS object store by orphan scans.",
+		},
+	)
+)
+
+// NATSOrphanScan is the result of an orphan scan.
+type NATSOrphanScan struct {
+	Objects int      // Objects looked at.
+	Skipped int      // Objects not checked: not named after a message, too new, or still pending.
+	Orphans []string // Names of objects without local message.
+	Removed int
+}
+
+// natsAccountsMessageExists returns whether any account has a message with id
+// that is not expunged.
+func natsAccountsMessageExists(ctx context.Context, log mlog.Log) func(id int64) (bool, error) {
+	return func(id int64) (bool, error) {
+		for _, name := range mox.Conf.Accounts() {
+			acc, err := OpenAccount(log, name, false)
+			if err != nil {
+				return false, fmt.Errorf("open account %q: %w", name, err)
+			}
+			exists, err := bstore.QueryDB[Message](ctx, acc.DB).FilterID(id).FilterEqual("Expunged", false).Exists()
+			xerr := acc.Close()
+			log.Check(xerr, "closing account after orphan check")
+			if err != nil {
+				return false, fmt.Errorf("checking for message in account %q: %w", name, err)
+			}
+			if exists {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// ScanNATSOrphans looks for objects in the NATS object store for messages that
+// no longer exist in any account, e.g. because a removal didn't propagate to
+// NATS. Only objects named after a message are checked. Objects younger than
+// grace are skipped, as are objects with a pending index row, so messages still
+// being delivered aren't considered orphans. If remove is set, orphans are
+// removed from the object store.
+//
+// With DeleteAfterStore, messages are intentionally not kept locally, and an
+// error is returned.
+func (nc *NATSClient) ScanNATSOrphans(ctx context.Context, log mlog.Log, grace time.Duration, remove bool) (NATSOrphanScan, error) {
+	if nc == nil {
+		return NATSOrphanScan{}, ErrNATSNotConfigured
+	}
+	if nc.config.DeleteAfterStore {
+		return NATSOrphanScan{}, fmt.Errorf("orphan scan not possible with DeleteAfterStore, messages are not kept locally")
+	}
+	return nc.scanNATSOrphans(ctx, time.Now().Add(-grace), remove, natsAccountsMessageExists(ctx, log))
+}
+
+func (nc *NATSClient) scanNATSOrphans(ctx context.Context, before time.Time, remove bool, exists func(id int64) (bool, error)) (NATSOrphanScan, error) {
+	var scan NATSOrphanScan
+	for _, os := range nc.natsBuckets() {
+		infos, err := os.List(ctx)
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			continue
+		} else if err != nil {
+			return scan, fmt.Errorf("listing objects: %w", err)
+		}
+		for _, info := range infos {
+			if info.Deleted {
+				continue
+			}
+			scan.Objects++
+			id, ok := natsMessageIDFromObject(info.Name)
+			_, softDeleted := natsDeletedAt(info)
+			if !ok || softDeleted || !info.ModTime.Before(before) {
+				scan.Skipped++
+				continue
+			}
+			if pending, err := natsIndexIsPending(ctx, info.Name); err != nil {
+				return scan, err
+			} else if pending {
+				scan.Skipped++
+				continue
+			}
+			if ok, err := exists(id); err != nil {
+				return scan, err
+			} else if ok {
+				continue
+			}
+
+			scan.Orphans = append(scan.Orphans, info.Name)
+			if !remove {
+				nc.log.Info("object in nats without local message", slog.String("object_name", info.Name), slog.Int64("message_id", id))
+				continue
+			}
+			if err := nc.removeObject(ctx, os, info.Name); err != nil {
+				return scan, fmt.Errorf("removing orphaned object: %w", err)
+			}
+			nc.log.Info("removed object in nats without local message", slog.String("object_name", info.Name), slog.Int64("message_id", id))
+			metricNATSOrphansRemoved.Inc()
+			scan.Removed++
+		}
+	}
+	metricNATSOrphans.Set(float64(len(scan.Orphans) - scan.Removed))
+	return scan, nil
+}
+
+// natsIndexIsPending returns whether the index has a pending row for the object.
+func natsIndexIsPending(ctx context.Context, objectName string) (bool, error) {
+	if AuthDB == nil {
+		return false, nil
+	}
+	q := bstore.QueryDB[NATSObjectRef](ctx, AuthDB)
+	q.FilterNonzero(NATSObjectRef{ObjectName: objectName, State: NATSObjectPending})
+	pending, err := q.Exists()
+	if err != nil {
+		return false, fmt.Errorf("checking nats object index: %w", err)
+	}
+	return pending, nil
+}
+
+// orphanScanLoop runs a daily orphan scan until the client is closed, when
+// OrphanAction is configured.
+func (nc *NATSClient) orphanScanLoop() {
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS orphan scan", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	grace := nc.config.OrphanGrace
+	if grace <= 0 {
+		grace = 24 * time.Hour
+	}
+	t := time.NewTicker(24 * time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-nc.closing:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		scan, err := nc.ScanNATSOrphans(ctx, nc.log, grace, nc.config.OrphanAction == "delete")
+		cancel()
+		if err != nil {
+			nc.log.Errorx("scanning for orphaned nats objects", err)
+			continue
+		}
+		nc.log.Info("scanned for orphaned nats objects",
+			slog.Int("objects", scan.Objects),
+			slog.Int("skipped", scan.Skipped),
+			slog.Int("orphans", len(scan.Orphans)),
+			slog.Int("removed", scan.Removed))
+	}
+}
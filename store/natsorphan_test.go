@@ -0,0 +1,67 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSOrphans(t *testing.T) {
+	openTestAuthDB(t)
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	put := func(name string, age time.Duration) {
+		t.Helper()
+		_, err := fos.Put(ctxbg, jetstream.ObjectMeta{Name: name}, strings.NewReader("test"))
+		tcheck(t, err, "put")
+		fos.Lock()
+		o := fos.objects[name]
+		o.info.ModTime = time.Now().Add(-age)
+		fos.objects[name] = o
+		fos.Unlock()
+	}
+	put("msg-1-1", 48*time.Hour)     // Local message exists.
+	put("msg-2-1", 48*time.Hour)     // Orphan.
+	put("msg-3-1", 48*time.Hour)     // No local message yet, but still pending in index.
+	put("msg-4-1", time.Hour)        // No local message yet, but too new.
+	put("import-abcd", 48*time.Hour) // Not stored for a message.
+	nc.natsIndexPending(ctxbg, 3, "msg-3-1")
+
+	exists := func(id int64) (bool, error) { return id == 1, nil }
+	before := time.Now().Add(-24 * time.Hour)
+
+	// Report only.
+	scan, err := nc.scanNATSOrphans(ctxbg, before, false, exists)
+	tcheck(t, err, "scan")
+	tcompare(t, scan, NATSOrphanScan{Objects: 5, Skipped: 3, Orphans: []string{"msg-2-1"}})
+	tcompare(t, len(fos.names()), 5)
+
+	// Delete.
+	scan, err = nc.scanNATSOrphans(ctxbg, before, true, exists)
+	tcheck(t, err, "scan")
+	tcompare(t, scan, NATSOrphanScan{Objects: 5, Skipped: 3, Orphans: []string{"msg-2-1"}, Removed: 1})
+	tcompare(t, fos.names(), []string{"import-abcd", "msg-1-1", "msg-3-1", "msg-4-1"})
+
+	scan, err = nc.scanNATSOrphans(ctxbg, before, true, exists)
+	tcheck(t, err, "scan")
+	tcompare(t, len(scan.Orphans), 0)
+
+	id, ok := natsMessageIDFromObject("msg-123-1700000000")
+	tcompare(t, ok, true)
+	tcompare(t, id, int64(123))
+	_, ok = natsMessageIDFromObject("msg-x-1")
+	tcompare(t, ok, false)
+
+	// Without local messages, everything would look orphaned.
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket", DeleteAfterStore: true}, fos)
+	_, err = nc.ScanNATSOrphans(ctxbg, pkglog, time.Hour, true)
+	if err == nil {
+		t.Fatalf("expected error for orphan scan with DeleteAfterStore")
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+const natsOTelScope = "github.com/mjl-/mox/store"
+
+// natsOTel holds the OpenTelemetry instrumentation of a client, when enabled with
+// NATS.OpenTelemetry.
+type natsOTel struct {
+	tracer     trace.Tracer
+	operations metric.Int64Counter
+	duration   metric.Float64Histogram
+}
+
+// newNATSOTel returns instrumentation using the global tracer and meter
+// providers, as set by the program with otel.SetTracerProvider and
+// otel.SetMeterProvider.
+func newNATSOTel(log mlog.Log) *natsOTel {
+	meter := otel.Meter(natsOTelScope)
+	operations, err := meter.Int64Counter("mox.nats.operations",
+		metric.WithDescription("Number of NATS object store operations, by operation and result."))
+	log.Check(err, "creating opentelemetry counter")
+	duration, err := meter.Float64Histogram("mox.nats.operation.duration",
+		metric.WithDescription("Duration of NATS object store operations, by operation and result."),
+		metric.WithUnit("s"))
+	log.Check(err, "creating opentelemetry histogram")
+	return &natsOTel{
+		tracer:     otel.Tracer(natsOTelScope),
+		operations: operations,
+		duration:   duration,
+	}
+}
+
+// startSpan starts a span for operation op ("store", "get"), as child of any span
+// in ctx, with the "cid" of ctx as attribute. The returned function ends the span
+// and records the metrics, with the result of the operation. Without OpenTelemetry
+// enabled, ctx is returned and the function does nothing.
+func (nc *NATSClient) startSpan(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, func(err error)) {
+	o := nc.otel
+	if o == nil {
+		return ctx, func(error) {}
+	}
+	if cid, ok := ctx.Value(mlog.CidKey).(int64); ok {
+		attrs = append(attrs, attribute.Int64("mox.cid", cid))
+	}
+	ctx, span := o.tracer.Start(ctx, "nats."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	start := time.Now()
+	return ctx, func(err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		mattrs := metric.WithAttributes(attribute.String("operation", op), attribute.String("result", result))
+		if o.operations != nil {
+			o.operations.Add(ctx, 1, mattrs)
+		}
+		if o.duration != nil {
+			o.duration.Record(ctx, time.Since(start).Seconds(), mattrs)
+		}
+	}
+}
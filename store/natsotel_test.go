@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+)
+
+func TestNATSOTel(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", OpenTelemetry: true}, fos)
+
+	ctx := context.WithValue(ctxbg, mlog.CidKey, int64(123))
+	ctx, parent := tp.Tracer("test").Start(ctx, "deliver")
+	err := nc.StoreMessage(ctx, 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	parent.End()
+
+	attrValue := func(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+		for _, kv := range span.Attributes() {
+			if kv.Key == key {
+				return kv.Value
+			}
+		}
+		t.Fatalf("span %s has no attribute %s", span.Name(), key)
+		return attribute.Value{}
+	}
+
+	spans := recorder.Ended()
+	tcompare(t, len(spans), 2)
+	span := spans[0]
+	tcompare(t, span.Name(), "nats.store")
+	tcompare(t, span.SpanContext().TraceID(), parent.SpanContext().TraceID())
+	tcompare(t, span.Parent().SpanID(), parent.SpanContext().SpanID())
+	tcompare(t, attrValue(span, "mox.cid").AsInt64(), int64(123))
+	tcompare(t, attrValue(span, "mox.message_id").AsInt64(), int64(1))
+	tcompare(t, attrValue(span, "nats.object_name").AsString(), fos.names()[0])
+	tcompare(t, span.Status().Code, codes.Unset)
+
+	// Failed operations are recorded as errors.
+	_, err = nc.getObject(ctxbg, "absent")
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound", err)
+	}
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("boom") }
+	err = nc.StoreMessage(ctxbg, 2, writeTestMessage(t, "test"))
+	if err == nil {
+		t.Fatalf("expected store error")
+	}
+	spans = recorder.Ended()
+	tcompare(t, len(spans), 4)
+	tcompare(t, spans[2].Name(), "nats.get")
+	tcompare(t, spans[2].Status().Code, codes.Error)
+	tcompare(t, spans[3].Name(), "nats.store")
+	tcompare(t, spans[3].Status().Code, codes.Error)
+
+	// Without OpenTelemetry enabled, no spans are recorded.
+	nc = newTestNATSClient(&config.NATS{BucketName: "test-bucket"}, newFakeObjectStore())
+	err = nc.StoreMessage(ctxbg, 3, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	tcompare(t, len(recorder.Ended()), 4)
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+)
+
+// NATSPreflightStep is the result of a step of a NATS preflight check.
+type NATSPreflightStep struct {
+	Name     string
+	Detail   string // Additional information, e.g. the bucket.
+	Skipped  bool   // Not run because an earlier step failed.
+	Err      error
+	Duration time.Duration
+}
+
+// NATSPreflightReport is the result of NATSPreflight.
+type NATSPreflightReport struct {
+	Steps []NATSPreflightStep
+}
+
+// OK returns whether all steps passed.
+func (r NATSPreflightReport) OK() bool {
+	for _, s := range r.Steps {
+		if s.Skipped || s.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes a line with PASS, FAIL or SKIP for each step to w, followed by a
+// summary line.
+func (r NATSPreflightReport) Write(w io.Writer) error {
+	var failed int
+	for _, s := range r.Steps {
+		var line string
+		switch {
+		case s.Skipped:
+			line = fmt.Sprintf("SKIP %-10s %s", s.Name, s.Detail)
+		case s.Err != nil:
+			failed++
+			line = fmt.Sprintf("FAIL %-10s %s (%s): %v", s.Name, s.Detail, s.Duration.Round(time.Millisecond), s.Err)
+		default:
+			line = fmt.Sprintf("PASS %-10s %s (%s)", s.Name, s.Detail, s.Duration.Round(time.Millisecond))
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	summary := "all checks passed"
+	if !r.OK() {
+		summary = fmt.Sprintf("%d check(s) failed", failed)
+	}
+	_, err := fmt.Fprintln(w, summary)
+	return err
+}
+
+// step runs fn as step name, unless an earlier step failed.
+func (r *NATSPreflightReport) step(name, detail string, fn func() error) bool {
+	if !r.OK() {
+		r.Steps = append(r.Steps, NATSPreflightStep{Name: name, Detail: detail, Skipped: true})
+		return false
+	}
+	t0 := time.Now()
+	err := fn()
+	r.Steps = append(r.Steps, NATSPreflightStep{Name: name, Detail: detail, Err: err, Duration: time.Since(t0)})
+	return err == nil
+}
+
+// NATSPreflight checks if messages can be stored in NATS with cfg, without
+// starting a client: it connects, verifies JetStream is available, opens (or
+// creates) each bucket, and stores, reads back and removes a probe object in each
+// bucket. Steps after a failed step are skipped.
+func NATSPreflight(ctx context.Context, log mlog.Log, cfg *config.NATS) NATSPreflightReport {
+	var r NATSPreflightReport
+
+	var conn *nats.Conn
+	r.step("connect", natsServerURL(cfg), func() error {
+		opts, err := natsConnectOptions(log, cfg)
+		if err != nil {
+			return err
+		}
+		conn, err = nats.Connect(natsServerURL(cfg), opts...)
+		return err
+	})
+	if conn != nil {
+		defer conn.Close()
+	}
+
+	var js jetstream.JetStream
+	r.step("jetstream", "", func() error {
+		var err error
+		js, err = jetstream.New(conn)
+		if err != nil {
+			return err
+		}
+		// Fails if JetStream isn't enabled for the account.
+		_, err = js.AccountInfo(ctx)
+		return err
+	})
+
+	for _, bucket := range natsShardBuckets(cfg) {
+		var os jetstream.ObjectStore
+		r.step("bucket", bucket, func() error {
+			var err error
+			os, err = openNATSBucket(ctx, log, cfg, js, bucket)
+			return err
+		})
+		r.probe(ctx, log, bucket, os)
+	}
+	return r
+}
+
+// probe adds steps storing, reading back and removing a probe object in os.
+func (r *NATSPreflightReport) probe(ctx context.Context, log mlog.Log, bucket string, os jetstream.ObjectStore) {
+	name := fmt.Sprintf("mox-preflight-%d", time.Now().UnixNano())
+	data := []byte("mox nats preflight probe\r\n")
+
+	stored := r.step("store", bucket, func() error {
+		_, err := os.Put(ctx, jetstream.ObjectMeta{Name: name, Description: "mox preflight probe"}, bytes.NewReader(data))
+		return err
+	})
+	r.step("get", bucket, func() error {
+		res, err := os.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		buf, err := io.ReadAll(res)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, data) {
+			return errors.New("probe object read back differs from stored data")
+		}
+		return nil
+	})
+	// Don't leave a stored probe behind.
+	if stored && !r.OK() {
+		err := os.Delete(ctx, name)
+		log.Check(err, "removing nats preflight probe object", slog.String("object_name", name))
+	}
+	r.step("delete", bucket, func() error {
+		return os.Delete(ctx, name)
+	})
+}
+
+// ValidateNATSConfig checks cfg without side effects, e.g. for checking a
+// configuration before a deploy: it checks the settings, connects, verifies
+// JetStream is available, and looks up each bucket without creating it. A missing
+// bucket passes if the account can create it, it is created when mox starts. No
+// client is started, nothing is stored, and the connection is closed before
+// returning. Steps after a failed step are skipped.
+func ValidateNATSConfig(ctx context.Context, log mlog.Log, cfg *config.NATS) NATSPreflightReport {
+	var r NATSPreflightReport
+
+	r.step("config", "", func() error {
+		return checkNATSConfig(cfg)
+	})
+
+	var conn *nats.Conn
+	r.step("connect", natsServerURL(cfg), func() error {
+		opts, err := natsConnectOptions(log, cfg)
+		if err != nil {
+			return err
+		}
+		conn, err = nats.Connect(natsServerURL(cfg), opts...)
+		return err
+	})
+	if conn != nil {
+		defer conn.Close()
+	}
+
+	var js jetstream.JetStream
+	var account *jetstream.AccountInfo
+	r.step("jetstream", "", func() error {
+		var err error
+		js, err = jetstream.New(conn)
+		if err != nil {
+			return err
+		}
+		// Fails if JetStream isn't enabled for the account.
+		account, err = js.AccountInfo(ctx)
+		return err
+	})
+
+	buckets := natsShardBuckets(cfg)
+	if cfg.MigrateFromBucket != "" {
+		buckets = append(buckets, cfg.MigrateFromBucket)
+	}
+	for _, bucket := range buckets {
+		var detail string
+		if r.step("bucket", bucket, func() error {
+			var err error
+			detail, err = checkNATSBucket(ctx, cfg, js, account, bucket)
+			return err
+		}) && detail != "" {
+			r.Steps[len(r.Steps)-1].Detail += " (" + detail + ")"
+		}
+	}
+	return r
+}
+
+// checkNATSBucket looks up bucket through js without creating it, returning a
+// detail for the report. With stream fallback, an existing fallback stream is
+// fine. A missing bucket is an error if it must exist, as the bucket to migrate
+// from, or if account can't create more streams.
+func checkNATSBucket(ctx context.Context, cfg *config.NATS, js jetstream.JetStream, account *jetstream.AccountInfo, bucket string) (string, error) {
+	if cfg.ObjectStoreFallback == "stream" {
+		if _, err := js.Stream(ctx, natsStreamName(bucket)); err == nil {
+			return "fallback stream", nil
+		} else if !errors.Is(err, jetstream.ErrStreamNotFound) {
+			return "", err
+		}
+	}
+	_, err := js.ObjectStore(ctx, bucket)
+	if err == nil {
+		return "", nil
+	} else if !errors.Is(err, jetstream.ErrBucketNotFound) {
+		return "", err
+	}
+	if bucket == cfg.MigrateFromBucket {
+		return "", fmt.Errorf("bucket to migrate from does not exist")
+	}
+	if account != nil && account.Limits.MaxStreams > 0 && account.Streams >= account.Limits.MaxStreams {
+		return "", fmt.Errorf("bucket does not exist, and account is at its limit of %d streams, so it can't be created", account.Limits.MaxStreams)
+	}
+	return "not found, created when mox starts", nil
+}
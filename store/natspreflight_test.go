@@ -0,0 +1,107 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSPreflightReport(t *testing.T) {
+	// All probe steps pass, and the probe is removed.
+	fos := newFakeObjectStore()
+	var r NATSPreflightReport
+	r.probe(ctxbg, pkglog, "test-bucket", fos)
+	tcompare(t, r.OK(), true)
+	tcompare(t, len(fos.names()), 0)
+
+	var b strings.Builder
+	err := r.Write(&b)
+	tcheck(t, err, "write report")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	tcompare(t, len(lines), 4)
+	for i, name := range []string{"store", "get", "delete"} {
+		if !strings.HasPrefix(lines[i], "PASS "+name) || !strings.Contains(lines[i], "test-bucket") {
+			t.Fatalf("line %q, expected PASS for %s in test-bucket", lines[i], name)
+		}
+	}
+	tcompare(t, lines[3], "all checks passed")
+
+	// A corrupted object fails the get, skips the delete step, but the probe is
+	// still removed.
+	fos.putCorrupt = true
+	r = NATSPreflightReport{}
+	r.probe(ctxbg, pkglog, "test-bucket", fos)
+	tcompare(t, r.OK(), false)
+	tcompare(t, len(fos.names()), 0)
+	b.Reset()
+	err = r.Write(&b)
+	tcheck(t, err, "write report")
+	lines = strings.Split(strings.TrimSpace(b.String()), "\n")
+	tcompare(t, len(lines), 4)
+	tcompare(t, strings.HasPrefix(lines[0], "PASS store"), true)
+	tcompare(t, strings.HasPrefix(lines[1], "FAIL get"), true)
+	tcompare(t, strings.Contains(lines[1], "differs"), true)
+	tcompare(t, strings.HasPrefix(lines[2], "SKIP delete"), true)
+	tcompare(t, lines[3], "1 check(s) failed")
+
+	// A failed store skips the remaining steps.
+	fos.putCorrupt = false
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("no space") }
+	r = NATSPreflightReport{}
+	r.probe(ctxbg, pkglog, "test-bucket", fos)
+	tcompare(t, len(r.Steps), 3)
+	tcompare(t, r.Steps[0].Err.Error(), "no space")
+	tcompare(t, r.Steps[1].Skipped, true)
+	tcompare(t, r.Steps[2].Skipped, true)
+}
+
+func TestNATSValidateConfig(t *testing.T) {
+	// Invalid settings fail before connecting, the other steps are skipped.
+	r := ValidateNATSConfig(ctxbg, pkglog, &config.NATS{URL: "nats://127.0.0.1:1", BucketName: "test-bucket", RetryJitter: 100})
+	tcompare(t, len(r.Steps), 4)
+	tcompare(t, r.Steps[0].Name, "config")
+	tcompare(t, r.Steps[0].Err != nil, true)
+	for _, s := range r.Steps[1:] {
+		tcompare(t, s.Skipped, true)
+	}
+
+	// Connection failures are reported.
+	r = ValidateNATSConfig(ctxbg, pkglog, &config.NATS{URL: "nats://127.0.0.1:1", BucketName: "test-bucket"})
+	tcompare(t, r.Steps[0].Err, nil)
+	tcompare(t, r.Steps[1].Name, "connect")
+	tcompare(t, r.Steps[1].Err != nil, true)
+	tcompare(t, r.OK(), false)
+
+	// Buckets are looked up, not created.
+	cfg := &config.NATS{BucketName: "test-bucket"}
+	js := &fakeJetStream{}
+	detail, err := checkNATSBucket(ctxbg, cfg, js, nil, "test-bucket")
+	tcheck(t, err, "check existing bucket")
+	tcompare(t, detail, "")
+
+	js.objectStoreErr = jetstream.ErrBucketNotFound
+	detail, err = checkNATSBucket(ctxbg, cfg, js, &jetstream.AccountInfo{}, "test-bucket")
+	tcheck(t, err, "check missing bucket")
+	tcompare(t, strings.Contains(detail, "created"), true)
+	tcompare(t, js.created.Bucket, "")
+
+	full := &jetstream.AccountInfo{Tier: jetstream.Tier{Streams: 10, Limits: jetstream.AccountLimits{MaxStreams: 10}}}
+	if _, err := checkNATSBucket(ctxbg, cfg, js, full, "test-bucket"); err == nil {
+		t.Fatalf("missing bucket passed for account at stream limit")
+	}
+	cfg.MigrateFromBucket = "old-bucket"
+	if _, err := checkNATSBucket(ctxbg, cfg, js, nil, "old-bucket"); err == nil {
+		t.Fatalf("missing bucket to migrate from passed")
+	}
+
+	// With fallback, an existing fallback stream is used.
+	cfg = &config.NATS{BucketName: "test-bucket", ObjectStoreFallback: "stream"}
+	js.stream = newFakeStream()
+	detail, err = checkNATSBucket(ctxbg, cfg, js, nil, "test-bucket")
+	tcheck(t, err, "check fallback stream")
+	tcompare(t, detail, "fallback stream")
+}
@@ -0,0 +1,304 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/metrics"
+)
+
+// Name of the manifest object of the published index, in the bucket of BucketName.
+// The manifest lists the chunk objects holding the entries.
+const natsPublishedIndexName = "mox-index"
+
+// Maximum size of a chunk object of the published index.
+const natsPublishedIndexChunkSize = 1024 * 1024
+
+// NATSPublishedIndex is the manifest of the index published in the bucket.
+type NATSPublishedIndex struct {
+	Version    int
+	Generation int64 // Part of the chunk object names, changes with each publish.
+	Updated    time.Time
+	Entries    int
+	Chunks     []string // Object names, each with JSON lines of NATSPublishedIndexEntry.
+}
+
+// NATSPublishedIndexEntry describes a stored object in the published index.
+type NATSPublishedIndexEntry struct {
+	MessageID  int64
+	Account    string `json:",omitempty"`
+	ObjectName string
+	Bucket     string
+	Size       int64
+	Digest     string
+	StoredAt   time.Time
+}
+
+// natsIndexFingerprint identifies the state of the local index cheaply, for
+// skipping publishing when nothing changed.
+type natsIndexFingerprint struct {
+	count int
+	maxID int64
+}
+
+// PublishNATSIndex writes the stored objects of the local object index to the
+// bucket, in chunk objects named mox-index-<generation>-<n> and manifest object
+// mox-index, so the bucket describes its content without mox's auth.db. Chunks of
+// the previous publish are removed after the manifest is updated.
+func (nc *NATSClient) PublishNATSIndex(ctx context.Context) (NATSPublishedIndex, error) {
+	if nc == nil {
+		return NATSPublishedIndex{}, ErrNATSNotConfigured
+	}
+	return nc.publishNATSIndex(ctx, natsPublishedIndexChunkSize)
+}
+
+func (nc *NATSClient) publishNATSIndex(ctx context.Context, chunkSize int) (NATSPublishedIndex, error) {
+	if AuthDB == nil {
+		return NATSPublishedIndex{}, fmt.Errorf("auth database not open")
+	}
+
+	prev, err := nc.readPublishedIndex(ctx)
+	if err != nil && !errors.Is(err, ErrMessageNotFound) {
+		return NATSPublishedIndex{}, err
+	}
+
+	q := bstore.QueryDB[NATSObjectRef](ctx, AuthDB)
+	q.FilterNonzero(NATSObjectRef{State: NATSObjectStored})
+	q.SortAsc("ID")
+	refs, err := q.List()
+	if err != nil {
+		return NATSPublishedIndex{}, fmt.Errorf("listing nats object index: %w", err)
+	}
+
+	idx := NATSPublishedIndex{
+		Version:    1,
+		Generation: max(time.Now().UnixNano(), prev.Generation+1),
+		Updated:    time.Now(),
+		Entries:    len(refs),
+	}
+	var chunk bytes.Buffer
+	flush := func() error {
+		name := fmt.Sprintf("%s-%d-%d", natsPublishedIndexName, idx.Generation, len(idx.Chunks))
+		meta := jetstream.ObjectMeta{Name: name, Description: "mox object index chunk"}
+		if _, err := nc.os.Put(ctx, meta, bytes.NewReader(chunk.Bytes())); err != nil {
+			return fmt.Errorf("storing index chunk %q: %w", name, err)
+		}
+		idx.Chunks = append(idx.Chunks, name)
+		chunk.Reset()
+		return nil
+	}
+	for _, ref := range refs {
+		e := NATSPublishedIndexEntry{ref.MessageID, ref.Account, ref.ObjectName, ref.Bucket, ref.Size, ref.Digest, ref.StoredAt}
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return NATSPublishedIndex{}, fmt.Errorf("marshal index entry: %w", err)
+		}
+		if chunk.Len() > 0 && chunk.Len()+len(buf)+1 > chunkSize {
+			if err := flush(); err != nil {
+				return NATSPublishedIndex{}, err
+			}
+		}
+		chunk.Write(buf)
+		chunk.WriteByte('\n')
+	}
+	if chunk.Len() > 0 {
+		if err := flush(); err != nil {
+			return NATSPublishedIndex{}, err
+		}
+	}
+
+	buf, err := json.Marshal(idx)
+	if err != nil {
+		return NATSPublishedIndex{}, fmt.Errorf("marshal index manifest: %w", err)
+	}
+	meta := jetstream.ObjectMeta{Name: natsPublishedIndexName, Description: "mox object index manifest"}
+	if _, err := nc.os.Put(ctx, meta, bytes.NewReader(buf)); err != nil {
+		return NATSPublishedIndex{}, fmt.Errorf("storing index manifest: %w", err)
+	}
+
+	// Readers that fetched the previous manifest may still read its chunks, but the
+	// old chunks are not worth keeping around.
+	for _, name := range prev.Chunks {
+		err := nc.os.Delete(ctx, name)
+		if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			nc.log.Errorx("removing previous index chunk", err, slog.String("object_name", name))
+		}
+	}
+	nc.log.Debug("published nats object index", slog.Int("entries", idx.Entries), slog.Int("chunks", len(idx.Chunks)))
+	return idx, nil
+}
+
+// readPublishedIndex returns the manifest of the published index. If none was
+// published, an ErrMessageNotFound error is returned.
+func (nc *NATSClient) readPublishedIndex(ctx context.Context) (NATSPublishedIndex, error) {
+	var idx NATSPublishedIndex
+	buf, err := nc.readObject(ctx, natsPublishedIndexName)
+	if err != nil {
+		return idx, fmt.Errorf("reading index manifest: %w", err)
+	}
+	if err := json.Unmarshal(buf, &idx); err != nil {
+		return idx, fmt.Errorf("parsing index manifest: %w", err)
+	}
+	if idx.Version != 1 {
+		return idx, fmt.Errorf("unknown index manifest version %d", idx.Version)
+	}
+	return idx, nil
+}
+
+// readObject reads object name from the bucket of BucketName.
+func (nc *NATSClient) readObject(ctx context.Context, name string) ([]byte, error) {
+	r, err := nc.os.Get(ctx, name)
+	if err != nil {
+		return nil, natsObjectError(err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// RestoreNATSIndex adds the entries of the index published in the bucket to the
+// local object index, e.g. after auth.db was lost. Entries for objects already in
+// the local index are skipped. Returns the number of rows added.
+func (nc *NATSClient) RestoreNATSIndex(ctx context.Context) (int, error) {
+	if nc == nil {
+		return 0, ErrNATSNotConfigured
+	}
+	if AuthDB == nil {
+		return 0, fmt.Errorf("auth database not open")
+	}
+
+	idx, err := nc.readPublishedIndex(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var added int
+	for _, name := range idx.Chunks {
+		buf, err := nc.readObject(ctx, name)
+		if err != nil {
+			return added, fmt.Errorf("reading index chunk %q: %w", name, err)
+		}
+		var n int
+		err = AuthDB.Write(ctx, func(tx *bstore.Tx) error {
+			scanner := bufio.NewScanner(bytes.NewReader(buf))
+			scanner.Buffer(nil, natsPublishedIndexChunkSize)
+			for scanner.Scan() {
+				var e NATSPublishedIndexEntry
+				if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+					return fmt.Errorf("parsing index entry: %w", err)
+				}
+				exists, err := bstore.QueryTx[NATSObjectRef](tx).FilterNonzero(NATSObjectRef{ObjectName: e.ObjectName}).Exists()
+				if err != nil {
+					return fmt.Errorf("checking local index: %w", err)
+				} else if exists {
+					continue
+				}
+				ref := NATSObjectRef{
+					MessageID:  e.MessageID,
+					Account:    e.Account,
+					ObjectName: e.ObjectName,
+					Bucket:     e.Bucket,
+					State:      NATSObjectStored,
+					Size:       e.Size,
+					Digest:     e.Digest,
+					StoredAt:   e.StoredAt,
+				}
+				if err := tx.Insert(&ref); err != nil {
+					return fmt.Errorf("adding index row: %w", err)
+				}
+				n++
+			}
+			return scanner.Err()
+		})
+		if err != nil {
+			return added, fmt.Errorf("restoring index chunk %q: %w", name, err)
+		}
+		added += n
+	}
+	nc.log.Info("restored nats object index from bucket", slog.Int("entries", idx.Entries), slog.Int("added", added))
+	return added, nil
+}
+
+// localIndexFingerprint returns the fingerprint of the stored rows of the local
+// object index.
+func localIndexFingerprint(ctx context.Context) (natsIndexFingerprint, error) {
+	var fp natsIndexFingerprint
+	q := bstore.QueryDB[NATSObjectRef](ctx, AuthDB)
+	q.FilterNonzero(NATSObjectRef{State: NATSObjectStored})
+	err := q.ForEach(func(ref NATSObjectRef) error {
+		fp.count++
+		fp.maxID = max(fp.maxID, ref.ID)
+		return nil
+	})
+	return fp, err
+}
+
+// publishIndexLoop publishes the local object index to the bucket when it
+// changed, at most once per PublishIndexInterval, until the client is closed. If
+// the local index is empty at startup, it is first restored from the published
+// index.
+func (nc *NATSClient) publishIndexLoop() {
+	defer func() {
+		x := recover()
+		if x != nil {
+			nc.log.Error("unhandled panic in NATS index publishing", slog.Any("err", x))
+			debug.PrintStack()
+			metrics.PanicInc(metrics.Store)
+		}
+	}()
+
+	if AuthDB == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	fp, err := localIndexFingerprint(ctx)
+	if err == nil && fp.count == 0 {
+		_, err = nc.RestoreNATSIndex(ctx)
+		if errors.Is(err, ErrMessageNotFound) {
+			err = nil
+		}
+	}
+	cancel()
+	nc.log.Check(err, "restoring nats object index from bucket")
+
+	// Publish at the first tick, then only after changes.
+	published := natsIndexFingerprint{count: -1}
+
+	interval := nc.config.PublishIndexInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	interval = max(interval, time.Minute)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-nc.closing:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		// An empty local index, e.g. after auth.db was lost and restoring failed, would
+		// overwrite a published index that is still needed, it is never published.
+		fp, err := localIndexFingerprint(ctx)
+		if err == nil && fp.count > 0 && fp != published {
+			_, err = nc.PublishNATSIndex(ctx)
+			if err == nil {
+				published = fp
+			}
+		}
+		cancel()
+		nc.log.Check(err, "publishing nats object index")
+	}
+}
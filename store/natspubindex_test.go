@@ -0,0 +1,91 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/bstore"
+)
+
+func TestNATSPublishIndex(t *testing.T) {
+	openTestAuthDB(t)
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	_, err := nc.RestoreNATSIndex(ctxbg)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("restore without published index: got err %v, expected ErrMessageNotFound", err)
+	}
+
+	for i := range 20 {
+		f := writeTestMessage(t, fmt.Sprintf("message %d", i))
+		err := nc.StoreMessage(ctxbg, int64(i+1), f)
+		tcheck(t, err, "store message")
+	}
+	// Pending rows are not published.
+	nc.natsIndexPending(ctxbg, 100, "msg-100-1")
+
+	// Small chunks, so the index is spread over multiple chunks.
+	idx, err := nc.publishNATSIndex(ctxbg, 500)
+	tcheck(t, err, "publish index")
+	tcompare(t, idx.Entries, 20)
+	if len(idx.Chunks) < 2 {
+		t.Fatalf("got %d chunks, expected multiple", len(idx.Chunks))
+	}
+	for _, name := range idx.Chunks {
+		info, err := fos.GetInfo(ctxbg, name)
+		tcheck(t, err, "get chunk info")
+		if info.Size > 500 {
+			t.Fatalf("chunk %s has size %d, above chunk size", name, info.Size)
+		}
+	}
+
+	// Republishing replaces the chunks.
+	idx2, err := nc.publishNATSIndex(ctxbg, 500)
+	tcheck(t, err, "publish index")
+	var indexObjects int
+	for _, name := range fos.names() {
+		if strings.HasPrefix(name, "mox-index-") {
+			indexObjects++
+		}
+	}
+	tcompare(t, indexObjects, len(idx2.Chunks))
+	if idx2.Generation <= idx.Generation {
+		t.Fatalf("generation %d not after previous %d", idx2.Generation, idx.Generation)
+	}
+
+	// Lose the local index, and restore it from the bucket.
+	orig, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).FilterNonzero(NATSObjectRef{State: NATSObjectStored}).SortAsc("ObjectName").List()
+	tcheck(t, err, "list index")
+	_, err = bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).Delete()
+	tcheck(t, err, "remove index")
+
+	added, err := nc.RestoreNATSIndex(ctxbg)
+	tcheck(t, err, "restore index")
+	tcompare(t, added, 20)
+	restored, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).SortAsc("ObjectName").List()
+	tcheck(t, err, "list index")
+	tcompare(t, len(restored), len(orig))
+	for i := range orig {
+		o, r := orig[i], restored[i]
+		tcompare(t, r.MessageID, o.MessageID)
+		tcompare(t, r.ObjectName, o.ObjectName)
+		tcompare(t, r.Bucket, o.Bucket)
+		tcompare(t, r.State, NATSObjectStored)
+		tcompare(t, r.Size, o.Size)
+		tcompare(t, r.Digest, o.Digest)
+		tcompare(t, r.StoredAt.Equal(o.StoredAt.Round(0)), true)
+	}
+
+	// Restoring again skips existing rows.
+	added, err = nc.RestoreNATSIndex(ctxbg)
+	tcheck(t, err, "restore index")
+	tcompare(t, added, 0)
+
+	fp, err := localIndexFingerprint(ctxbg)
+	tcheck(t, err, "fingerprint")
+	tcompare(t, fp.count, 20)
+}
@@ -0,0 +1,855 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+)
+
+var metricNATSQueueQuarantined = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_nats_queue_quarantined_total",
+		Help: "Number of corrupt files in the NATS pending queue moved to the quarantine directory.",
+	},
+)
+
+// Directories of the retry queue. InitNATS resolves them from the config, see
+// SetNATSQueueDir. Until then, they are relative to the working directory, as in
+// older versions.
+var (
+	pendingNATSDir = natsLegacyQueueDir
+
+	// Messages that can never be stored are moved from the pending directory to the
+	// dead-letter directory.
+	deadLetterNATSDir = "store/tmp/nats-deadletter"
+
+	// Queued messages that failed RetryMaxAttempts attempts are moved from the
+	// pending directory to the failed directory. They are not retried, but can be
+	// moved back.
+	failedNATSDir = "store/tmp/nats-failed"
+
+	// Queue files that are truncated, empty or otherwise corrupt are moved to this
+	// subdirectory of the pending directory, for inspection. They are never retried,
+	// storing them would archive a bad message.
+	quarantineNATSDir = "store/tmp/nats-pending/quarantine"
+)
+
+// Start of this process. Temporary queue files from before were left behind by a
+// crash while writing them.
+var natsQueueStart = time.Now()
+
+// OnNATSDeadLetter, if set, is called for each queued message that is moved to
+// the dead-letter directory, with the message data and the reason the message
+// cannot be stored. It allows handing the message off to another system, e.g.
+// long-term local storage or alerting. The callback runs synchronously in the
+// retry loop, so it should not block for long. Panics are recovered and logged.
+// Must be set before InitNATS.
+var OnNATSDeadLetter func(messageID int64, data []byte, reason error)
+
+// Subdirectories of the pending directory that never hold messages to retry, e.g.
+// messages set aside for inspection. They are not traversed. Other subdirectories
+// are traversed, their queue files are retried like those at the top level.
+var natsPendingSpecialDirs = []string{"failed", "quarantine", "deadletter"}
+
+// Queue files being processed are renamed to their name with this suffix,
+// claiming them, so concurrent passes over the queue never store the same message
+// twice.
+const natsClaimSuffix = ".processing"
+
+// The retry loop is started by InitNATS, so merely importing the package doesn't
+// create directories or start goroutines, and stopped by Close.
+var (
+	natsPendingLoopMu      sync.Mutex
+	natsPendingLoopStarted atomic.Bool
+	natsPendingLoopCancel  context.CancelFunc
+	natsPendingLoopStop    chan chan struct{}
+)
+
+// startNATSPendingLoop sets the queue directories for cfg, creates the pending
+// directory and starts the retry loop, if not already running.
+func startNATSPendingLoop(log mlog.Log, cfg *config.NATS) {
+	natsPendingLoopMu.Lock()
+	defer natsPendingLoopMu.Unlock()
+	if natsPendingLoopStarted.Load() {
+		return
+	}
+	SetNATSQueueDir(cfg)
+	os.MkdirAll(pendingNATSDir, 0o700)
+	moveNATSLegacyQueue(log)
+	natsPendingLoopStarted.Store(true)
+	var ctx context.Context
+	ctx, natsPendingLoopCancel = context.WithCancel(context.Background())
+	natsPendingLoopStop = make(chan chan struct{})
+	go processPendingNATSLoop(ctx, natsPendingLoopStop)
+}
+
+// stopNATSPendingLoop cancels stores of the retry loop in progress, and waits for
+// the loop to finish. The loop can be started again. Does nothing if the loop
+// isn't running.
+func stopNATSPendingLoop() {
+	natsPendingLoopMu.Lock()
+	defer natsPendingLoopMu.Unlock()
+	if !natsPendingLoopStarted.Load() {
+		return
+	}
+	natsPendingLoopCancel()
+	stopc := make(chan struct{})
+	natsPendingLoopStop <- stopc
+	<-stopc
+	natsPendingLoopCancel = nil
+	natsPendingLoopStop = nil
+	natsPendingLoopStarted.Store(false)
+}
+
+// StoreMessageWithQueue tries to store in NATS, and if it fails, queues locally for retry.
+//
+// A nil error for a message that StoresMessage accepts means the store is
+// confirmed by the NATS server, also with SyncPut false, and msgFile has been read
+// completely: the caller can then remove msgFile and any links to it. On error,
+// the message may have been queued from a copy, but the caller must keep its
+// local message. msgFile is never closed or removed by StoreMessageWithQueue.
+func (nc *NATSClient) StoreMessageWithQueue(ctx context.Context, messageID int64, msgFile *os.File) error {
+	if nc == nil {
+		return nil // NATS not configured
+	}
+	done, err := nc.beginStore()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	fi, err := msgFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat message file: %w", err)
+	}
+	if !nc.StoresMessage(fi.Size()) {
+		nc.skipLocalOnly(messageID, fi.Size())
+		return nil
+	}
+	// Always wait for the store to be confirmed, also with asynchronous puts: callers
+	// may remove the local message after we return.
+	err = nc.storeMessage(ctx, messageID, msgFile, fi.Size())
+	if err == nil {
+		return nil
+	}
+
+	nc.log.Errorx("NATS store failed, queueing for retry", err, slog.Int64("message_id", messageID))
+	if errWrite := queueNATSRetry(ctx, messageID, msgFile, fi.Size()); errWrite != nil {
+		return errWrite
+	}
+	return err
+}
+
+// queueNATSRetry adds a message to the pending queue, for storing again later. The
+// account, thread ID and header metadata of ctx are kept in the queue file.
+func queueNATSRetry(ctx context.Context, messageID int64, r io.ReaderAt, size int64) error {
+	h := queueHeader{
+		MessageID: messageID,
+		Account:   messageAccount(ctx),
+		ThreadID:  natsThreadID(ctx),
+		Headers:   natsHeaderMeta(ctx),
+		Enqueued:  time.Now(),
+	}
+	if err := os.MkdirAll(pendingNATSDir, 0o700); err != nil {
+		return fmt.Errorf("creating pending directory: %w", err)
+	}
+	// Reserved with room for the header, corrected to the file size after writing.
+	reserved := size + natsQueueHeaderReserve
+	if err := reserveNATSQueueBytes(reserved); err != nil {
+		return err
+	}
+	queueName := filepath.Join(pendingNATSDir, objectName(messageID))
+	if err := writeQueueFile(queueName, h, r, size); err != nil {
+		addNATSQueueBytes(-reserved)
+		return fmt.Errorf("writing queue file: %w", err)
+	}
+	if fi, err := os.Stat(queueName); err == nil {
+		addNATSQueueBytes(fi.Size() - reserved)
+	}
+	return nil
+}
+
+// Queue files start with a magic line, followed by a line with the JSON-encoded
+// queueHeader, followed by the message. Files without the magic line are from
+// before this format, and hold only the message, with the message ID in the file
+// name.
+const queueMagic = "mox-nats-queue\n"
+
+// queueHeader describes a message in the pending queue.
+type queueHeader struct {
+	Version   int
+	MessageID int64
+	Account   string            `json:",omitempty"`
+	ThreadID  int64             `json:",omitempty"`
+	Headers   map[string]string `json:",omitempty"` // Object metadata, see StoreMessageWithMeta.
+	Enqueued  time.Time
+	Attempts  int       // Failed attempts to store.
+	NextRetry time.Time // Not retried by the retry loop before this time.
+	Size      int64     // Of message.
+	CRC32     uint32    // IEEE, of message.
+}
+
+var errQueueCorrupt = errors.New("queue file corrupt")
+
+// errQueueClaimed is returned for a queue file that is being processed elsewhere.
+var errQueueClaimed = errors.New("queue file being processed by another pass")
+
+// errQueueNotDue is returned for a queue file whose next retry is still to come.
+var errQueueNotDue = errors.New("queue file not yet due for retry")
+
+// ErrNATSNotQueued is returned by RetryPending for a message that is not in the
+// pending queue.
+var ErrNATSNotQueued = errors.New("message not in nats retry queue")
+
+// writeQueueFile writes a queue file at path with the size bytes of src as
+// message. The file is written under a temporary name first, and renamed into
+// place after syncing, so the retry loop never sees a partially written file.
+func writeQueueFile(path string, h queueHeader, src io.ReaderAt, size int64) (rerr error) {
+	hbuf, err := encodeQueueHeader(h, io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if rerr != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+	if _, err := f.Write(hbuf); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(src, 0, size)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// encodeQueueHeader returns the magic and header lines of a queue file for
+// message r, with the version, size and CRC of h set.
+func encodeQueueHeader(h queueHeader, r *io.SectionReader) ([]byte, error) {
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+	h.Version = 1
+	h.Size = r.Size()
+	h.CRC32 = crc.Sum32()
+	hbuf, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("marshal queue header: %w", err)
+	}
+	return []byte(queueMagic + string(hbuf) + "\n"), nil
+}
+
+// readQueueFile parses queue file f, with file name name, returning its header
+// and a reader for the message. The CRC is not verified, see verifyQueueFile.
+func readQueueFile(f *os.File, name string) (queueHeader, *io.SectionReader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return queueHeader{}, nil, err
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(f, 0, fi.Size()))
+	magic, err := br.ReadString('\n')
+	if err != nil || magic != queueMagic {
+		// Old format, only the message, with message ID from the file name.
+		var h queueHeader
+		id, ok := natsMessageIDFromObject(name)
+		if !ok {
+			return queueHeader{}, nil, fmt.Errorf("%w: parsing message id from file name %q", errQueueCorrupt, name)
+		}
+		h.MessageID = id
+		h.Size = fi.Size()
+		return h, io.NewSectionReader(f, 0, fi.Size()), nil
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return queueHeader{}, nil, fmt.Errorf("%w: reading header: %v", errQueueCorrupt, err)
+	}
+	var h queueHeader
+	if err := json.Unmarshal([]byte(line), &h); err != nil {
+		return queueHeader{}, nil, fmt.Errorf("%w: parsing header: %v", errQueueCorrupt, err)
+	}
+	if h.Version != 1 {
+		return queueHeader{}, nil, fmt.Errorf("%w: unknown version %d", errQueueCorrupt, h.Version)
+	}
+	offset := int64(len(magic) + len(line))
+	if fi.Size()-offset != h.Size {
+		return queueHeader{}, nil, fmt.Errorf("%w: message is %d bytes, header says %d", errQueueCorrupt, fi.Size()-offset, h.Size)
+	}
+	return h, io.NewSectionReader(f, offset, h.Size), nil
+}
+
+// verifyQueueFile checks the message in r is not empty and matches the CRC in h.
+// The size has already been checked against h by readQueueFile. Files in the old
+// format have no CRC, only the empty check applies.
+func verifyQueueFile(h queueHeader, r *io.SectionReader) error {
+	if r.Size() == 0 {
+		return fmt.Errorf("%w: empty message", errQueueCorrupt)
+	}
+	if h.Version == 0 {
+		return nil
+	}
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		return err
+	}
+	if sum := crc.Sum32(); sum != h.CRC32 {
+		return fmt.Errorf("%w: crc32 is %08x, header says %08x", errQueueCorrupt, sum, h.CRC32)
+	}
+	return nil
+}
+
+// processPendingNATSLoop retries to send queued messages to NATS that are due, see
+// queueHeader.NextRetry, until a channel is received on stop. Stores in progress
+// are cancelled through ctx, stopNATSPendingLoop cancels it before sending on
+// stop. Before returning, the messages left in the queue, including those of the
+// cancelled stores, are counted for the queue metrics and logged, and the channel
+// received on stop is sent on. The queue isn't processed again, flushing at
+// shutdown is done by CloseContext.
+func processPendingNATSLoop(ctx context.Context, stop chan chan struct{}) {
+	log := mlog.New("store", nil)
+	releaseNATSClaims()
+	for {
+		nc := GetNATSClient()
+		_, err := processPendingNATSDue(ctx, nc, time.Now())
+		observePendingNATS(countPendingNATS(), time.Now())
+		syncNATSQueueBytes()
+		t := time.NewTimer(nc.retryWait(err != nil))
+		select {
+		case c := <-stop:
+			t.Stop()
+			// Messages of cancelled stores are back in the queue.
+			n := countPendingNATS()
+			observePendingNATS(n, time.Now())
+			if n > 0 {
+				log.Info("stopping nats retry loop, messages left in queue", slog.Int("pending", n))
+			}
+			c <- struct{}{}
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// processPendingNATS makes a single pass over the pending directory, storing
+// queued messages through client, also those still waiting for their next retry.
+// Messages are stored concurrently, starting with one at a time and ramping up to
+// RetryConcurrency as stores succeed. It stops early when ctx is done. Returns the
+// number of messages stored.
+func processPendingNATS(ctx context.Context, client *NATSClient) (int, error) {
+	return processPendingNATSDue(ctx, client, time.Time{})
+}
+
+// processPendingNATSDue is like processPendingNATS, but skips messages whose next
+// retry is after now. A zero now processes all messages.
+func processPendingNATSDue(ctx context.Context, client *NATSClient, now time.Time) (int, error) {
+	paths, err := listPendingNATS()
+	if err != nil {
+		return 0, err
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	var maxConc int
+	if client != nil {
+		maxConc = client.config.RetryConcurrency
+	}
+	lim := newNATSDrainLimiter(maxConc)
+	if client != nil {
+		client.nextRetry.reset()
+	}
+	var stored atomic.Int32
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		if strings.HasSuffix(path, natsClaimSuffix) {
+			continue // Already claimed.
+		}
+		if client == nil || !client.IsConnected() {
+			break // Wait for NATS
+		}
+		lim.acquire()
+		release, err := client.acquireGoroutine(ctx)
+		if err != nil {
+			lim.release(false, false)
+			break
+		}
+		go func() {
+			var ok, failed bool
+			defer func() {
+				x := recover()
+				if x != nil {
+					client.log.Error("unhandled panic processing queued nats message", slog.Any("err", x), slog.String("path", path))
+					debug.PrintStack()
+					metrics.PanicInc(metrics.Store)
+				}
+				release()
+				lim.release(ok, failed)
+			}()
+
+			ok, failed, _ = client.processPendingFile(ctx, path, now)
+			if ok {
+				stored.Add(1)
+			}
+		}()
+	}
+	lim.wait()
+	return int(stored.Load()), nil
+}
+
+// releaseNATSClaims renames claimed queue files back to their queue name. Claims
+// only live as long as the process, files still claimed at startup were being
+// processed during a crash.
+func releaseNATSClaims() {
+	paths, _ := listPendingNATS()
+	for _, path := range paths {
+		if orig, ok := strings.CutSuffix(path, natsClaimSuffix); ok {
+			os.Rename(path, orig)
+		}
+	}
+	quarantineNATSTemp()
+}
+
+// quarantineNATSTemp moves temporary queue files left behind by a crash while
+// writing them to the quarantine directory. They may be incomplete, and were never
+// renamed into place, so were not retried. Files written by this process are left
+// alone.
+func quarantineNATSTemp() {
+	log := mlog.New("store", nil)
+	entries, _ := os.ReadDir(pendingNATSDir)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), ".tmp-") {
+			continue
+		}
+		if fi, err := e.Info(); err != nil || !fi.ModTime().Before(natsQueueStart) {
+			continue
+		}
+		path := filepath.Join(pendingNATSDir, e.Name())
+		log.Error("moving temporary queue file from before restart to quarantine directory", slog.String("path", path))
+		if err := moveNATSQuarantine(path); err != nil {
+			log.Errorx("moving temporary queue file to quarantine directory", err, slog.String("path", path))
+		}
+	}
+}
+
+// countPendingNATS returns the number of messages in the pending queue.
+func countPendingNATS() int {
+	paths, _ := listPendingNATS()
+	return len(paths)
+}
+
+// listPendingNATS returns the paths of the queue files in the pending directory
+// and its subdirectories, including claimed files, in lexical order. Files that
+// aren't queue files, e.g. those still being written, and the special
+// subdirectories are skipped. Subdirectories that can't be read are logged and
+// skipped, so they don't block retrying the rest of the queue.
+func listPendingNATS() ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(pendingNATSDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == pendingNATSDir {
+				return err
+			}
+			mlog.New("store", nil).Errorx("reading subdirectory of nats pending queue, skipping", err, slog.String("path", path))
+			return nil
+		}
+		if d.IsDir() {
+			if path != pendingNATSDir && slices.Contains(natsPendingSpecialDirs, d.Name()) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && strings.HasPrefix(d.Name(), "msg-") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// processPendingFile tries to store the queued message at path, removing the file
+// on success, moving it to the quarantine directory if it is corrupt, and to the
+// dead-letter directory if it can never be stored. Returns whether the message was stored, whether storing failed due to an
+// error that may be temporary, and why the message was not stored.
+//
+// The file is claimed first. If another pass claimed it, nothing is done. If its
+// next retry is after now, it is left alone, a zero now ignores the next retry. If
+// the store fails temporarily, the attempt is recorded in the queue file and the
+// claim is released for a later pass, or the file is moved to the failed
+// directory after RetryMaxAttempts attempts.
+func (nc *NATSClient) processPendingFile(ctx context.Context, path string, now time.Time) (stored, failed bool, rerr error) {
+	claimed := path + natsClaimSuffix
+	if err := os.Rename(path, claimed); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, false, errQueueClaimed
+		}
+		nc.log.Errorx("claiming queued message", err, slog.String("path", path))
+		return false, false, fmt.Errorf("claiming queued message: %w", err)
+	}
+
+	file, err := os.Open(claimed)
+	if err != nil {
+		nc.log.Errorx("opening queued message", err, slog.String("path", claimed))
+		nc.releaseClaim(claimed, path)
+		return false, false, fmt.Errorf("opening queued message: %w", err)
+	}
+	defer file.Close()
+
+	h, msgr, err := readQueueFile(file, filepath.Base(path))
+	if err == nil {
+		err = verifyQueueFile(h, msgr)
+	}
+	if err != nil {
+		nc.quarantine(claimed, h.MessageID, err)
+		return false, false, fmt.Errorf("moved to quarantine directory: %w", err)
+	}
+	if !now.IsZero() && h.NextRetry.After(now) {
+		nc.nextRetry.note(h.NextRetry)
+		nc.releaseClaim(claimed, path)
+		return false, false, errQueueNotDue
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, nc.storeDeadline(msgr.Size()))
+	defer cancel()
+	if h.Account != "" {
+		sctx = WithMessageAccount(sctx, h.Account)
+	}
+	if h.ThreadID != 0 {
+		sctx = WithNATSThreadID(sctx, h.ThreadID)
+	}
+	if h.Headers != nil {
+		sctx = withNATSHeaderMeta(sctx, h.Headers)
+	}
+	err = nc.storeMessage(sctx, h.MessageID, msgr, msgr.Size())
+	if err == nil {
+		if fi, err := file.Stat(); err == nil && os.Remove(claimed) == nil {
+			addNATSQueueBytes(-fi.Size())
+		}
+		return true, false, nil
+	} else if isPermanentNATSError(err) {
+		nc.deadLetter(claimed, h.MessageID, msgr, err)
+		return false, false, fmt.Errorf("moved to dead-letter directory: %w", err)
+	}
+	if ctx.Err() != nil {
+		// Cancelled, e.g. during shutdown, not an attempt that failed.
+		nc.releaseClaim(claimed, path)
+		return false, false, err
+	}
+	nc.retryLater(claimed, path, h, msgr, err)
+	return false, true, err
+}
+
+// retryLater records a failed attempt to store the queued message claimed, with
+// header h and message msgr, and releases the claim to path. After
+// RetryMaxAttempts attempts, the file is moved to the failed directory instead.
+func (nc *NATSClient) retryLater(claimed, path string, h queueHeader, msgr *io.SectionReader, reason error) {
+	h.Attempts++
+	maxAttempts := nc.retryMaxAttempts()
+	giveUp := maxAttempts > 0 && h.Attempts >= maxAttempts
+	if !giveUp {
+		h.NextRetry = time.Now().Add(natsRetryJitter(nc.retryDelay(h.Attempts), nc.retryJitter()))
+		nc.nextRetry.note(h.NextRetry)
+	}
+	// Replaces the claimed file, the old contents stay readable through msgr.
+	err := writeQueueFile(claimed, h, msgr, msgr.Size())
+	nc.log.Check(err, "recording attempt in queued message", slog.String("path", path))
+	if !giveUp {
+		nc.releaseClaim(claimed, path)
+		return
+	}
+
+	nc.log.Errorx("queued message failed too many attempts, moving to failed directory", reason,
+		slog.Int64("message_id", h.MessageID),
+		slog.Int("attempts", h.Attempts),
+		slog.String("path", path))
+	if err := os.MkdirAll(failedNATSDir, 0o700); err != nil {
+		nc.log.Errorx("creating failed directory", err)
+		nc.releaseClaim(claimed, path)
+	} else if err := os.Rename(claimed, filepath.Join(failedNATSDir, filepath.Base(path))); err != nil {
+		nc.log.Errorx("moving queued message to failed directory", err, slog.String("path", path))
+		nc.releaseClaim(claimed, path)
+	}
+}
+
+// retryInterval returns the time until the next pass of the retry loop, after a
+// failed pass if failed is set. Defaults are used without client.
+func (nc *NATSClient) retryInterval(failed bool) time.Duration {
+	if failed {
+		if nc != nil && nc.config.RetryErrorInterval > 0 {
+			return nc.config.RetryErrorInterval
+		}
+		return 10 * time.Second
+	}
+	if nc != nil && nc.config.RetryInterval > 0 {
+		return nc.config.RetryInterval
+	}
+	return 30 * time.Second
+}
+
+// retryDelay returns the time to wait before retrying a queued message that failed
+// attempts times: RetryBackoff, doubled for each further attempt, at most
+// RetryBackoffMax.
+func (nc *NATSClient) retryDelay(attempts int) time.Duration {
+	d := nc.config.RetryBackoff
+	if d <= 0 {
+		d = 30 * time.Second
+	}
+	maxDelay := nc.config.RetryBackoffMax
+	if maxDelay <= 0 {
+		maxDelay = time.Hour
+	}
+	for i := 1; i < attempts && d < maxDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxDelay)
+}
+
+// retryWait returns the time until the next pass of the retry loop, after a pass
+// that failed or not. When a queued message is due before the retry interval, the
+// next pass is then, so messages are retried promptly, also with a large queue
+// with many different retry times. The wait is jittered, and at least a second.
+func (nc *NATSClient) retryWait(failed bool) time.Duration {
+	d := nc.retryInterval(failed)
+	if nc == nil {
+		return d
+	}
+	if next := nc.nextRetry.get(); !failed && !next.IsZero() {
+		d = min(d, max(time.Until(next), time.Second))
+	}
+	return natsRetryJitter(d, nc.retryJitter())
+}
+
+// Default for RetryMaxAttempts. With the default backoff, attempts are an hour
+// apart after the first hours, so a message is given up after about two days.
+const natsDefaultRetryMaxAttempts = 50
+
+// retryMaxAttempts returns the number of attempts after which a queued message
+// is moved to the failed directory, or 0 for retrying until stored.
+func (nc *NATSClient) retryMaxAttempts() int {
+	if nc.config.RetryMaxAttempts < 0 {
+		return 0
+	} else if nc.config.RetryMaxAttempts > 0 {
+		return nc.config.RetryMaxAttempts
+	}
+	return natsDefaultRetryMaxAttempts
+}
+
+// retryJitter returns the maximum jitter in percent, see natsRetryJitter.
+func (nc *NATSClient) retryJitter() int {
+	if nc.config.RetryJitter > 0 {
+		return nc.config.RetryJitter
+	}
+	return 25
+}
+
+// natsRetryJitter returns d reduced by a random duration of up to percent of d.
+// Messages queued during an outage all fail at about the same time, and mox
+// instances recovering from it retry at about the same time. With jitter their
+// retries are spread out instead of all hitting NATS at once when it is back.
+// The result is never more than d, so RetryBackoffMax still holds.
+func natsRetryJitter(d time.Duration, percent int) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(d)*int64(percent)/100+1))
+}
+
+// natsNextRetry is the earliest next retry of queued messages seen in a pass of
+// the retry loop, zero if none.
+type natsNextRetry struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (r *natsNextRetry) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.t = time.Time{}
+}
+
+func (r *natsNextRetry) note(t time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	if r.t.IsZero() || t.Before(r.t) {
+		r.t = t
+	}
+}
+
+func (r *natsNextRetry) get() time.Time {
+	r.Lock()
+	defer r.Unlock()
+	return r.t
+}
+
+// RetryPending immediately tries to store the queued messages for messageID,
+// instead of waiting for the retry loop. If ctx has an account, see
+// WithMessageAccount, only queue files of that account are retried, otherwise of any
+// account: message IDs are only unique per account. Messages that can never be
+// stored are moved to the dead-letter directory, messages that fail temporarily
+// stay queued. Returns the number of queue files stored, and an error for each
+// queue file that was not stored. If the message is not in the queue,
+// ErrNATSNotQueued is returned.
+func (nc *NATSClient) RetryPending(ctx context.Context, messageID int64) (int, error) {
+	if nc == nil {
+		return 0, ErrNATSNotConfigured
+	}
+
+	paths, err := listPendingNATS()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("listing queue: %w", err)
+	}
+	prefix := fmt.Sprintf("msg-%d-", messageID)
+	var n, stored int
+	var errs []error
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, natsClaimSuffix) {
+			continue
+		}
+		if account := messageAccount(ctx); account != "" && natsQueueFileAccount(path) != account {
+			continue
+		}
+		n++
+		ok, _, err := nc.processPendingFile(ctx, path, time.Time{})
+		if ok {
+			stored++
+		} else {
+			errs = append(errs, fmt.Errorf("queue file %s: %w", name, err))
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("%w: message %d of account %q", ErrNATSNotQueued, messageID, messageAccount(ctx))
+	}
+	nc.log.Info("retried queued message", slog.Int64("message_id", messageID), slog.Int("files", n), slog.Int("stored", stored))
+	return stored, errors.Join(errs...)
+}
+
+// natsQueueFileAccount returns the account from the header of the queue file at
+// path. Empty for queue files without account, e.g. from before queue files had
+// a header, or if the file can't be read, e.g. because it was just stored.
+func natsQueueFileAccount(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h, _, err := readQueueFile(f, filepath.Base(path))
+	if err != nil {
+		return ""
+	}
+	return h.Account
+}
+
+// releaseClaim renames claimed queue file claimed back to path.
+func (nc *NATSClient) releaseClaim(claimed, path string) {
+	err := os.Rename(claimed, path)
+	nc.log.Check(err, "releasing claim on queued message", slog.String("path", path))
+}
+
+// isPermanentNATSError returns whether err indicates a store that will never
+// succeed, so retrying is pointless.
+func isPermanentNATSError(err error) bool {
+	return errors.Is(err, errQueueCorrupt) ||
+		errors.Is(err, jetstream.ErrBadObjectMeta) ||
+		errors.Is(err, jetstream.ErrInvalidStoreName)
+}
+
+// quarantine moves the corrupt queue file at path to the quarantine directory.
+func (nc *NATSClient) quarantine(path string, messageID int64, reason error) {
+	metricNATSQueueQuarantined.Inc()
+	nc.log.Errorx("queued message corrupt, moving to quarantine directory", reason,
+		slog.Int64("message_id", messageID),
+		slog.String("path", path))
+	err := moveNATSQuarantine(path)
+	nc.log.Check(err, "moving queued message to quarantine directory", slog.String("path", path))
+}
+
+// moveNATSQuarantine moves the file at path to the quarantine directory, without
+// claim suffix.
+func moveNATSQuarantine(path string) error {
+	if err := os.MkdirAll(quarantineNATSDir, 0o700); err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), natsClaimSuffix)
+	return os.Rename(path, filepath.Join(quarantineNATSDir, name))
+}
+
+// deadLetter moves the queued message at path, with message msgr, to the
+// dead-letter directory and calls OnNATSDeadLetter, if set.
+func (nc *NATSClient) deadLetter(path string, messageID int64, msgr *io.SectionReader, reason error) {
+	nc.log.Errorx("cannot store queued message in NATS, moving to dead-letter directory", reason,
+		slog.Int64("message_id", messageID),
+		slog.String("path", path))
+
+	var data []byte
+	if OnNATSDeadLetter != nil {
+		var err error
+		data, err = io.ReadAll(io.NewSectionReader(msgr, 0, msgr.Size()))
+		nc.log.Check(err, "reading dead-lettered message for callback", slog.String("path", path))
+	}
+
+	if err := os.MkdirAll(deadLetterNATSDir, 0o700); err != nil {
+		nc.log.Errorx("creating dead-letter directory", err)
+		return
+	}
+	name := strings.TrimSuffix(filepath.Base(path), natsClaimSuffix)
+	if err := os.Rename(path, filepath.Join(deadLetterNATSDir, name)); err != nil {
+		nc.log.Errorx("moving message to dead-letter directory", err, slog.String("path", path))
+		return
+	}
+
+	if OnNATSDeadLetter != nil {
+		func() {
+			defer func() {
+				x := recover()
+				if x != nil {
+					nc.log.Error("unhandled panic in dead-letter callback", slog.Any("err", x), slog.Int64("message_id", messageID))
+					debug.PrintStack()
+					metrics.PanicInc(metrics.Store)
+				}
+			}()
+			OnNATSDeadLetter(messageID, data, reason)
+		}()
+	}
+}
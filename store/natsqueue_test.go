@@ -0,0 +1,953 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/metrics"
+)
+
+func TestNATSDeadLetter(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer os.RemoveAll(deadLetterNATSDir)
+	defer func() { OnNATSDeadLetter = nil }()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	queue := func(name, data string) {
+		t.Helper()
+		err := os.WriteFile(filepath.Join(pendingNATSDir, name), []byte(data), 0o600)
+		tcheck(t, err, "write pending file")
+	}
+
+	type deadLetter struct {
+		messageID int64
+		data      string
+		reason    error
+	}
+	var got []deadLetter
+	OnNATSDeadLetter = func(messageID int64, data []byte, reason error) {
+		got = append(got, deadLetter{messageID, string(data), reason})
+	}
+
+	// Transient errors keep the message queued.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	queue("msg-1-1-1", "test1")
+	_, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	_, err = os.Stat(filepath.Join(pendingNATSDir, "msg-1-1-1"))
+	tcheck(t, err, "stat pending file")
+	tcompare(t, len(got), 0)
+
+	// Permanent errors move the message to dead-letter and call the hook.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return jetstream.ErrBadObjectMeta }
+	_, err = processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	_, err = os.Stat(filepath.Join(pendingNATSDir, "msg-1-1-1"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("pending file still present, err %v", err)
+	}
+	_, err = os.Stat(filepath.Join(deadLetterNATSDir, "msg-1-1-1"))
+	tcheck(t, err, "stat dead-letter file")
+	tcompare(t, len(got), 1)
+	tcompare(t, got[0].messageID, int64(1))
+	tcompare(t, got[0].data, "test1")
+	if !errors.Is(got[0].reason, jetstream.ErrBadObjectMeta) {
+		t.Fatalf("got reason %v, expected ErrBadObjectMeta", got[0].reason)
+	}
+
+	// A panicking callback is contained.
+	OnNATSDeadLetter = func(messageID int64, data []byte, reason error) {
+		panic("bad callback")
+	}
+	queue("msg-2-1-1", "test2")
+	panics := metrics.Panics.Load()
+	_, err = processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, metrics.Panics.Load(), panics+1)
+	metrics.Panics.Add(-1) // Expected panic, don't fail TestMain.
+	_, err = os.Stat(filepath.Join(deadLetterNATSDir, "msg-2-1-1"))
+	tcheck(t, err, "stat dead-letter file")
+}
+
+func TestNATSCloseContext(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	for _, name := range []string{"msg-1-1-1", "msg-2-1-1", "msg-3-1-1"} {
+		err := os.WriteFile(filepath.Join(pendingNATSDir, name), []byte("test"), 0o600)
+		tcheck(t, err, "write pending file")
+	}
+
+	// The first store succeeds, the second hangs until the deadline.
+	var n atomic.Int32
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		if n.Add(1) > 1 {
+			time.Sleep(200 * time.Millisecond)
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctxbg, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	flushed, abandoned, err := nc.CloseContext(ctx)
+	tcheck(t, err, "close")
+	tcompare(t, flushed, 1)
+	tcompare(t, abandoned, 2)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("close took %s, past its deadline", d)
+	}
+	select {
+	case <-nc.closing:
+	default:
+		t.Fatalf("background goroutines not signaled to stop")
+	}
+}
+
+func TestNATSPendingLoopStop(t *testing.T) {
+	// Stop the loop of earlier tests, it is started again with the test client.
+	stopNATSPendingLoop()
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+
+	// The store hangs until it is cancelled by the stop.
+	started := make(chan struct{}, 1)
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		started <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	name := "msg-1-1-1"
+	err := writeQueueFile(filepath.Join(pendingNATSDir, name), queueHeader{MessageID: 1, Enqueued: time.Now()}, strings.NewReader("test"), 4)
+	tcheck(t, err, "write queue file")
+
+	queueDir, err := filepath.Abs(pendingNATSDir)
+	tcheck(t, err, "absolute queue dir")
+	startNATSPendingLoop(pkglog, &config.NATS{BucketName: "test-bucket", QueueDir: queueDir})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("retry loop did not store queued message")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stopNATSPendingLoop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("retry loop did not stop")
+	}
+	tcompare(t, natsPendingLoopStarted.Load(), false)
+	// The loop returns right after acknowledging the stop.
+	for i := 0; strings.Contains(allGoroutines(), "processPendingNATSLoop"); i++ {
+		if i == 100 {
+			t.Fatalf("retry loop still running after stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The cancelled store leaves the message queued, without counting an attempt.
+	tcompare(t, len(fos.names()), 0)
+	f, err := os.Open(filepath.Join(pendingNATSDir, name))
+	tcheck(t, err, "open queue file")
+	defer f.Close()
+	h, _, err := readQueueFile(f, name)
+	tcheck(t, err, "read queue file")
+	tcompare(t, h.Attempts, 0)
+
+	// Stopping again does nothing.
+	stopNATSPendingLoop()
+}
+
+func TestNATSRetryInterval(t *testing.T) {
+	var nilClient *NATSClient
+	tcompare(t, nilClient.retryInterval(false), 30*time.Second)
+	tcompare(t, nilClient.retryInterval(true), 10*time.Second)
+	fos := newFakeObjectStore()
+	tcompare(t, newTestNATSClient(nil, fos).retryInterval(false), 30*time.Second)
+	tcompare(t, newTestNATSClient(nil, fos).retryInterval(true), 10*time.Second)
+	cfg := &config.NATS{BucketName: "test-bucket", RetryInterval: 20 * time.Millisecond, RetryErrorInterval: time.Minute}
+	nc := newTestNATSClient(cfg, fos)
+	tcompare(t, nc.retryInterval(false), 20*time.Millisecond)
+	tcompare(t, nc.retryInterval(true), time.Minute)
+
+	// Negative intervals are rejected before connecting.
+	_, err := newNATSClient(pkglog, &config.NATS{URL: "nats://invalid-server:4222", BucketName: "test-bucket", RetryInterval: -time.Second})
+	if err == nil || !strings.Contains(err.Error(), "retry interval") {
+		t.Fatalf("got err %v, expected error about retry interval", err)
+	}
+	_, err = newNATSClient(pkglog, &config.NATS{URL: "nats://invalid-server:4222", BucketName: "test-bucket", RetryErrorInterval: -time.Second})
+	if err == nil || !strings.Contains(err.Error(), "retry interval") {
+		t.Fatalf("got err %v, expected error about retry interval", err)
+	}
+
+	// The loop makes its passes at the configured interval, a message queued after
+	// the first pass is stored long before the default 30s.
+	stopNATSPendingLoop()
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+	queueDir, err := filepath.Abs(pendingNATSDir)
+	tcheck(t, err, "absolute queue dir")
+	startNATSPendingLoop(pkglog, &config.NATS{BucketName: "test-bucket", QueueDir: queueDir})
+	defer stopNATSPendingLoop()
+	time.Sleep(50 * time.Millisecond)
+	err = writeQueueFile(filepath.Join(pendingNATSDir, "msg-1-1-1"), queueHeader{MessageID: 1, Enqueued: time.Now()}, strings.NewReader("test"), 4)
+	tcheck(t, err, "write queue file")
+	for i := 0; len(fos.names()) == 0; i++ {
+		if i == 200 {
+			t.Fatalf("queued message not stored by retry loop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// cleanPendingNATS removes all files and subdirectories from the pending
+// directory.
+func cleanPendingNATS() {
+	files, _ := os.ReadDir(pendingNATSDir)
+	for _, f := range files {
+		os.RemoveAll(filepath.Join(pendingNATSDir, f.Name()))
+	}
+}
+
+func TestNATSQueueFile(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer os.RemoveAll(deadLetterNATSDir)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// Failing store queues the message in the framed format.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	err := nc.StoreMessageWithQueue(ctxbg, 1, writeTestMessage(t, "hello"))
+	if err == nil {
+		t.Fatalf("store succeeded with failing put")
+	}
+	files, err := os.ReadDir(pendingNATSDir)
+	tcheck(t, err, "read pending dir")
+	tcompare(t, len(files), 1)
+	path := filepath.Join(pendingNATSDir, files[0].Name())
+	f, err := os.Open(path)
+	tcheck(t, err, "open queue file")
+	h, r, err := readQueueFile(f, files[0].Name())
+	tcheck(t, err, "read queue file")
+	tcompare(t, h.Version, 1)
+	tcompare(t, h.MessageID, int64(1))
+	tcompare(t, h.Size, int64(5))
+	err = verifyQueueFile(h, r)
+	tcheck(t, err, "verify queue file")
+	buf, err := io.ReadAll(r)
+	tcheck(t, err, "read message")
+	tcompare(t, string(buf), "hello")
+	f.Close()
+
+	// Corrupt the message, it must not be stored but quarantined.
+	data, err := os.ReadFile(path)
+	tcheck(t, err, "read queue file")
+	data[len(data)-1] = 'X'
+	err = os.WriteFile(path, data, 0o600)
+	tcheck(t, err, "write queue file")
+	fos.putHook = nil
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 0)
+	tcompare(t, len(fos.names()), 0)
+	_, err = os.Stat(filepath.Join(quarantineNATSDir, files[0].Name()))
+	tcheck(t, err, "stat quarantined file")
+
+	// Old format with only the message is still stored.
+	err = os.WriteFile(filepath.Join(pendingNATSDir, "msg-2-1-1"), []byte("legacy"), 0o600)
+	tcheck(t, err, "write legacy queue file")
+	// Temporary files being written are skipped.
+	err = os.WriteFile(filepath.Join(pendingNATSDir, ".tmp-msg-3-1-1"), []byte("partial"), 0o600)
+	tcheck(t, err, "write temp queue file")
+	n, err = processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 1)
+	objs := fos.names()
+	tcompare(t, len(objs), 1)
+	o, err := fos.GetInfo(ctxbg, objs[0])
+	tcheck(t, err, "get info")
+	tcompare(t, o.Size, uint64(len("legacy")))
+	tcompare(t, countPendingNATS(), 0)
+}
+
+func TestNATSRetryPending(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	for id := range int64(2) {
+		err := nc.StoreMessageWithQueue(ctxbg, 10+id, writeTestMessage(t, "hello"))
+		if err == nil {
+			t.Fatalf("store succeeded with failing put")
+		}
+	}
+	tcompare(t, countPendingNATS(), 2)
+
+	// Temporary failures keep the message queued, and are reported.
+	n, err := nc.RetryPending(ctxbg, 10)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("got err %v, expected timeout", err)
+	}
+	tcompare(t, n, 0)
+	tcompare(t, countPendingNATS(), 2)
+
+	// Only the requested message is stored, its queue file is removed.
+	fos.putHook = nil
+	n, err = nc.RetryPending(ctxbg, 10)
+	tcheck(t, err, "retry pending")
+	tcompare(t, n, 1)
+	tcompare(t, len(fos.names()), 1)
+	tcompare(t, strings.HasPrefix(fos.names()[0], "msg-10-"), true)
+	tcompare(t, countPendingNATS(), 1)
+
+	_, err = nc.RetryPending(ctxbg, 10)
+	if !errors.Is(err, ErrNATSNotQueued) {
+		t.Fatalf("got err %v, expected ErrNATSNotQueued", err)
+	}
+
+	// With an account, only the queue files of that account are retried, message IDs
+	// are per account.
+	cleanPendingNATS()
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	for _, account := range []string{"mjl", "other"} {
+		err := nc.StoreMessageWithQueue(WithMessageAccount(ctxbg, account), 5, writeTestMessage(t, "hello"))
+		if err == nil {
+			t.Fatalf("store succeeded with failing put")
+		}
+	}
+	fos.putHook = nil
+	_, err = nc.RetryPending(WithMessageAccount(ctxbg, "none"), 5)
+	if !errors.Is(err, ErrNATSNotQueued) {
+		t.Fatalf("got err %v, expected ErrNATSNotQueued for other account", err)
+	}
+	n, err = nc.RetryPending(WithMessageAccount(ctxbg, "mjl"), 5)
+	tcheck(t, err, "retry pending of account")
+	tcompare(t, n, 1)
+	tcompare(t, countPendingNATS(), 1)
+	n, err = nc.RetryPending(ctxbg, 5)
+	tcheck(t, err, "retry pending of any account")
+	tcompare(t, n, 1)
+	tcompare(t, countPendingNATS(), 0)
+}
+
+func TestNATSRetryBackoff(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+	defer os.RemoveAll(failedNATSDir)
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", RetryBackoff: time.Minute, RetryBackoffMax: 5 * time.Minute, RetryMaxAttempts: 3}, fos)
+
+	tcompare(t, nc.retryDelay(1), time.Minute)
+	tcompare(t, nc.retryDelay(2), 2*time.Minute)
+	tcompare(t, nc.retryDelay(3), 4*time.Minute)
+	tcompare(t, nc.retryDelay(4), 5*time.Minute)
+	tcompare(t, nc.retryDelay(100), 5*time.Minute)
+	tcompare(t, newTestNATSClient(nil, fos).retryDelay(1), 30*time.Second)
+	tcompare(t, newTestNATSClient(nil, fos).retryDelay(20), time.Hour)
+
+	// Jitter makes retries earlier by up to a quarter, never later.
+	seen := map[time.Duration]bool{}
+	for range 100 {
+		d := natsRetryJitter(time.Minute, 25)
+		if d < 45*time.Second || d > time.Minute {
+			t.Fatalf("jittered delay %v, expected between 45s and 1m", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("no jitter in retry delays")
+	}
+	tcompare(t, natsRetryJitter(0, 25), time.Duration(0))
+	for range 100 {
+		if d := natsRetryJitter(time.Minute, 50); d < 30*time.Second || d > time.Minute {
+			t.Fatalf("jittered delay %v, expected between 30s and 1m", d)
+		}
+	}
+	tcompare(t, nc.retryJitter(), 25)
+	tcompare(t, newTestNATSClient(&config.NATS{BucketName: "test-bucket", RetryJitter: 50}, fos).retryJitter(), 50)
+	_, err := newNATSClient(pkglog, &config.NATS{URL: "nats://invalid-server:4222", BucketName: "test-bucket", RetryJitter: 100})
+	if err == nil || !strings.Contains(err.Error(), "retry jitter") {
+		t.Fatalf("got err %v, expected error about retry jitter", err)
+	}
+
+	// The loop also waits with jitter, and less when a queued message is due earlier,
+	// but at least a second. After a failed pass, the error interval is used.
+	var nilClient *NATSClient
+	tcompare(t, nilClient.retryWait(false), 30*time.Second)
+	wc := newTestNATSClient(nil, fos)
+	inRange := func(d, lo, hi time.Duration) {
+		t.Helper()
+		if d < lo || d > hi {
+			t.Fatalf("wait %v, expected between %v and %v", d, lo, hi)
+		}
+	}
+	inRange(wc.retryWait(false), 22500*time.Millisecond, 30*time.Second)
+	wc.nextRetry.note(time.Now().Add(8 * time.Second))
+	inRange(wc.retryWait(false), 5*time.Second, 8*time.Second)
+	inRange(wc.retryWait(true), 7500*time.Millisecond, 10*time.Second)
+	wc.nextRetry.reset()
+	wc.nextRetry.note(time.Now().Add(-time.Minute))
+	inRange(wc.retryWait(false), 750*time.Millisecond, time.Second)
+
+	header := func() queueHeader {
+		t.Helper()
+		paths, err := listPendingNATS()
+		tcheck(t, err, "list pending")
+		tcompare(t, len(paths), 1)
+		f, err := os.Open(paths[0])
+		tcheck(t, err, "open queue file")
+		defer f.Close()
+		h, r, err := readQueueFile(f, filepath.Base(paths[0]))
+		tcheck(t, err, "read queue file")
+		err = verifyQueueFile(h, r)
+		tcheck(t, err, "verify queue file")
+		return h
+	}
+
+	// A failed attempt is recorded in the queue file, with the time of the next retry.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	err = os.WriteFile(filepath.Join(pendingNATSDir, "msg-1-1-1"), []byte("test"), 0o600)
+	tcheck(t, err, "write queue file")
+	start := time.Now()
+	_, err = processPendingNATSDue(ctxbg, nc, start)
+	tcheck(t, err, "process pending")
+	h := header()
+	tcompare(t, h.MessageID, int64(1))
+	tcompare(t, h.Attempts, 1)
+	if h.NextRetry.Before(start.Add(45*time.Second)) || h.NextRetry.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("next retry %v, expected at most a minute from now", h.NextRetry)
+	}
+
+	// The retry loop leaves messages alone until their next retry.
+	puts := 0
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		puts++
+		return errors.New("timeout")
+	}
+	_, err = processPendingNATSDue(ctxbg, nc, time.Now())
+	tcheck(t, err, "process pending")
+	tcompare(t, puts, 0)
+	tcompare(t, header().Attempts, 1)
+	// The next pass of the loop is when the message is due.
+	tcompare(t, nc.nextRetry.get(), header().NextRetry)
+
+	// Once due, it is attempted again, with a longer wait after failing.
+	_, err = processPendingNATSDue(ctxbg, nc, time.Now().Add(time.Minute+time.Second))
+	tcheck(t, err, "process pending")
+	tcompare(t, puts, 1)
+	h = header()
+	tcompare(t, h.Attempts, 2)
+	if d := time.Until(h.NextRetry); d <= 80*time.Second || d > 2*time.Minute {
+		t.Fatalf("next retry in %v, expected at most 2 minutes", d)
+	}
+
+	// After RetryMaxAttempts attempts, the message is moved to the failed directory.
+	_, err = processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, puts, 2)
+	tcompare(t, countPendingNATS(), 0)
+	f, err := os.Open(filepath.Join(failedNATSDir, "msg-1-1-1"))
+	tcheck(t, err, "open failed file")
+	defer f.Close()
+	h, r, err := readQueueFile(f, "msg-1-1-1")
+	tcheck(t, err, "read failed file")
+	tcompare(t, h.Attempts, 3)
+	buf, err := io.ReadAll(r)
+	tcheck(t, err, "read message")
+	tcompare(t, string(buf), "test")
+
+	// The failed message is listed with the dead-lettered messages, and can be
+	// requeued from there.
+	l, err := ListNATSDeadLetters()
+	tcheck(t, err, "list dead letters")
+	tcompare(t, len(l), 1)
+	tcompare(t, l[0].Name, "msg-1-1-1")
+	tcompare(t, l[0].Failed, true)
+	tcompare(t, l[0].Attempts, 3)
+	err = RequeueNATSDeadLetter("msg-1-1-1")
+	tcheck(t, err, "requeue failed message")
+	tcompare(t, header().Attempts, 0)
+
+	// Messages are given up after 50 attempts by default, never with a negative
+	// RetryMaxAttempts.
+	tcompare(t, newTestNATSClient(nil, fos).retryMaxAttempts(), 50)
+	tcompare(t, nc.retryMaxAttempts(), 3)
+	tcompare(t, newTestNATSClient(&config.NATS{BucketName: "test-bucket", RetryMaxAttempts: -1}, fos).retryMaxAttempts(), 0)
+}
+
+func TestNATSRetryStateRestart(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	cfg := &config.NATS{BucketName: "test-bucket", RetryBackoff: time.Minute}
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(cfg, fos)
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+
+	path := filepath.Join(pendingNATSDir, "msg-1-1-1")
+	header := func() queueHeader {
+		t.Helper()
+		f, err := os.Open(path)
+		tcheck(t, err, "open queue file")
+		defer f.Close()
+		h, r, err := readQueueFile(f, "msg-1-1-1")
+		tcheck(t, err, "read queue file")
+		err = verifyQueueFile(h, r)
+		tcheck(t, err, "verify queue file")
+		return h
+	}
+	err := writeQueueFile(path, queueHeader{MessageID: 1, Enqueued: time.Now()}, strings.NewReader("test"), 4)
+	tcheck(t, err, "write queue file")
+	_, err = processPendingNATSDue(ctxbg, nc, time.Now())
+	tcheck(t, err, "process pending")
+	failed := header()
+	tcompare(t, failed.Attempts, 1)
+
+	// A crash while recording the next attempt leaves a temporary file next to the
+	// claimed file, the rename into place never happened.
+	claimed := path + natsClaimSuffix
+	err = os.Rename(path, claimed)
+	tcheck(t, err, "claim queue file")
+	tmp := filepath.Join(pendingNATSDir, ".tmp-msg-1-1-1"+natsClaimSuffix)
+	err = os.WriteFile(tmp, []byte(queueMagic+"{"), 0o600)
+	tcheck(t, err, "write partial temp file")
+	old := natsQueueStart.Add(-time.Minute)
+	err = os.Chtimes(tmp, old, old)
+	tcheck(t, err, "set file time")
+
+	// After the restart, the queue file is back with the state of before the crash,
+	// and the new client doesn't retry it before it is due.
+	releaseNATSClaims()
+	h := header()
+	tcompare(t, h.Attempts, failed.Attempts)
+	tcompare(t, h.NextRetry.Equal(failed.NextRetry), true)
+	nc = newTestNATSClient(cfg, fos)
+	var puts int
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		puts++
+		return errors.New("timeout")
+	}
+	_, err = processPendingNATSDue(ctxbg, nc, time.Now())
+	tcheck(t, err, "process pending after restart")
+	tcompare(t, puts, 0)
+
+	// Once due, the count continues where it was.
+	_, err = processPendingNATSDue(ctxbg, nc, failed.NextRetry.Add(time.Second))
+	tcheck(t, err, "process pending when due")
+	tcompare(t, puts, 1)
+	tcompare(t, header().Attempts, 2)
+}
+
+func TestNATSPendingSubdirs(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	queue := func(dir string, id int64) string {
+		t.Helper()
+		err := os.MkdirAll(filepath.Join(pendingNATSDir, dir), 0o700)
+		tcheck(t, err, "mkdir")
+		p := filepath.Join(pendingNATSDir, dir, fmt.Sprintf("msg-%d-1-1", id))
+		err = os.WriteFile(p, []byte("queued"), 0o600)
+		tcheck(t, err, "write pending file")
+		return p
+	}
+	queue("", 1)
+	queue("restored", 2)
+	queue("restored/2024", 3)
+	claimed := queue("restored", 4) + natsClaimSuffix
+	err := os.Rename(strings.TrimSuffix(claimed, natsClaimSuffix), claimed)
+	tcheck(t, err, "claim")
+	var special []string
+	for _, dir := range natsPendingSpecialDirs {
+		special = append(special, queue(dir, 5), queue(dir+"/nested", 6))
+	}
+	tcompare(t, countPendingNATS(), 4)
+
+	// Regular subdirectories are traversed, special ones and claimed files are not
+	// touched.
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 3)
+	tcompare(t, len(fos.names()), 3)
+	for _, name := range fos.names() {
+		if !strings.HasPrefix(name, "msg-1-") && !strings.HasPrefix(name, "msg-2-") && !strings.HasPrefix(name, "msg-3-") {
+			t.Fatalf("unexpected object %q", name)
+		}
+	}
+	for _, p := range append(special, claimed) {
+		_, err := os.Stat(p)
+		tcheck(t, err, "stat file that should be untouched")
+	}
+
+	// Claims in subdirectories are released in place.
+	releaseNATSClaims()
+	_, err = os.Stat(strings.TrimSuffix(claimed, natsClaimSuffix))
+	tcheck(t, err, "stat released file")
+	n, err = nc.RetryPending(ctxbg, 4)
+	tcheck(t, err, "retry pending")
+	tcompare(t, n, 1)
+	tcompare(t, countPendingNATS(), 0)
+}
+
+func TestNATSQueueTrend(t *testing.T) {
+	now := time.Now()
+	at := func(sec int) time.Time { return now.Add(time.Duration(sec) * time.Second) }
+
+	tr := nextNATSQueueTrend(NATSQueueTrend{State: NATSQueueEmpty}, 10, at(0))
+	tcompare(t, tr.State, NATSQueueSteady) // First observation, no rate yet.
+
+	tr = nextNATSQueueTrend(tr, 20, at(10))
+	tcompare(t, tr.Rate, 0.5)
+	tcompare(t, tr.State, NATSQueueGrowing)
+	tcompare(t, tr.TimeToEmpty, time.Duration(0))
+
+	// Smoothed rate still positive after a single small drop.
+	tr = nextNATSQueueTrend(tr, 18, at(20))
+	tcompare(t, tr.Rate, 0.15)
+	tcompare(t, tr.State, NATSQueueGrowing)
+
+	tr = nextNATSQueueTrend(tr, 8, at(30))
+	tcompare(t, tr.Rate, -0.425)
+	tcompare(t, tr.State, NATSQueueDraining)
+	if tr.TimeToEmpty < 18*time.Second || tr.TimeToEmpty > 19*time.Second {
+		t.Fatalf("time to empty %v, expected about 18.8s", tr.TimeToEmpty)
+	}
+
+	tr = nextNATSQueueTrend(tr, 0, at(40))
+	tcompare(t, tr.State, NATSQueueEmpty)
+	tcompare(t, tr.Rate, 0.0)
+
+	obs := observePendingNATS(3, at(50))
+	tcompare(t, PendingNATSTrend(), obs)
+}
+
+func TestNATSDrainSlowStart(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	cleanPendingNATS()
+	defer cleanPendingNATS()
+
+	for id := int64(1); id <= 30; id++ {
+		err := queueNATSRetry(ctxbg, id, strings.NewReader("test"), 4)
+		tcheck(t, err, "queue message")
+	}
+
+	fos := newFakeObjectStore()
+	var mu sync.Mutex
+	var limits []int // Drain concurrency when each put started.
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		mu.Lock()
+		defer mu.Unlock()
+		limits = append(limits, int(testutil.ToFloat64(metricNATSDrainConcurrency)))
+		return nil
+	}
+	cfg := &config.NATS{BucketName: "test-bucket", RetryConcurrency: 4, MaxConcurrentStores: 8}
+	nc := newTestNATSClient(cfg, fos)
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 30)
+
+	// Drain starts with a single store, and ramps up to the limit on sustained
+	// success, never above it.
+	tcompare(t, limits[0], 1)
+	tcompare(t, slices.IsSorted(limits), true)
+	tcompare(t, slices.Max(limits), 4)
+	tcompare(t, testutil.ToFloat64(metricNATSDrainConcurrency), 0.0)
+
+	// Failures halve the limit, successes increase it again.
+	lim := newNATSDrainLimiter(8)
+	for range 10 {
+		lim.acquire()
+		lim.release(true, false)
+	}
+	tcompare(t, lim.limit, 8)
+	lim.acquire()
+	lim.release(false, true)
+	tcompare(t, lim.limit, 4)
+	lim.acquire()
+	lim.release(false, true)
+	tcompare(t, lim.limit, 2)
+	lim.acquire()
+	lim.release(false, false)
+	tcompare(t, lim.limit, 2)
+	lim.wait()
+}
+
+// A single pass over the queue stores messages in parallel, as many as the default
+// RetryConcurrency of 4, and each queued file is stored by one of them only.
+func TestNATSDrainWorkers(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	cleanPendingNATS()
+	defer cleanPendingNATS()
+
+	const nmsgs = 40
+	for id := int64(1); id <= nmsgs; id++ {
+		err := queueNATSRetry(ctxbg, id, strings.NewReader(fmt.Sprintf("message %d", id)), 4)
+		tcheck(t, err, "queue message")
+	}
+
+	fos := newFakeObjectStore()
+	var inflight, maxInflight atomic.Int32
+	var mu sync.Mutex
+	stores := map[int64]int{}
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			x := maxInflight.Load()
+			if n <= x || maxInflight.CompareAndSwap(x, n) {
+				break
+			}
+		}
+
+		// Claimed before the upload, by renaming.
+		paths, err := listPendingNATS()
+		if err != nil {
+			return err
+		}
+		claimed := slices.ContainsFunc(paths, func(p string) bool { return strings.HasSuffix(p, natsClaimSuffix) })
+		if !claimed {
+			t.Errorf("no claimed queue file during put")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		id, _ := natsMessageIDFromObject(meta.Name)
+		mu.Lock()
+		stores[id]++
+		mu.Unlock()
+		return nil
+	}
+	nc := newTestNATSClient(nil, fos)
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, nmsgs)
+	tcompare(t, maxInflight.Load(), int32(4))
+	tcompare(t, countPendingNATS(), 0)
+	tcompare(t, len(stores), nmsgs)
+	for id, n := range stores {
+		if n != 1 {
+			t.Fatalf("message %d stored %d times", id, n)
+		}
+	}
+}
+
+// Concurrent stores queue messages while multiple passes drain the queue, with NATS
+// failing intermittently. Each message must be stored exactly once, intact.
+func TestNATSQueueStress(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	os.RemoveAll(deadLetterNATSDir)
+	cleanPendingNATS()
+	defer os.RemoveAll(deadLetterNATSDir)
+	defer cleanPendingNATS()
+
+	const producers, perProducer, drainers = 8, 25, 3
+
+	fos := newFakeObjectStore()
+	var mu sync.Mutex
+	var puts int
+	stores := map[int64]int{} // Successful puts per message ID.
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		mu.Lock()
+		defer mu.Unlock()
+		puts++
+		if puts%3 == 0 {
+			return errors.New("nats unavailable")
+		}
+		id, ok := natsMessageIDFromObject(meta.Name)
+		if !ok {
+			t.Errorf("unexpected object name %q", meta.Name)
+		}
+		stores[id]++
+		return nil
+	}
+	cfg := &config.NATS{BucketName: "test-bucket", RetryConcurrency: 4, MaxConcurrentStores: 8}
+	nc := newTestNATSClient(cfg, fos)
+
+	msgData := func(id int64) string {
+		// Sizes differ, so a partially read file can't pass as complete.
+		return fmt.Sprintf("message %d\r\n%s", id, strings.Repeat("x", int(id%7)*1000))
+	}
+
+	var producing sync.WaitGroup
+	for p := range producers {
+		producing.Add(1)
+		go func() {
+			defer producing.Done()
+			for i := range perProducer {
+				id := int64(p*perProducer + i + 1)
+				f, err := os.CreateTemp(t.TempDir(), "msg-*.eml")
+				if err != nil {
+					t.Errorf("create message file: %v", err)
+					return
+				}
+				_, err = f.WriteString(msgData(id))
+				if err == nil {
+					// A failed store is queued, and the error returned.
+					nc.StoreMessageWithQueue(ctxbg, id, f)
+				}
+				f.Close()
+				if err != nil {
+					t.Errorf("write message file: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var draining sync.WaitGroup
+	for range drainers {
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			for {
+				_, err := processPendingNATS(ctxbg, nc)
+				if err != nil {
+					t.Errorf("process pending: %v", err)
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	producing.Wait()
+	close(done)
+	draining.Wait()
+
+	// Drain what is left.
+	for range 100 {
+		if countPendingNATS() == 0 {
+			break
+		}
+		_, err := processPendingNATS(ctxbg, nc)
+		tcheck(t, err, "process pending")
+	}
+	tcompare(t, countPendingNATS(), 0)
+
+	// Nothing was read while being written, or it would have been dead-lettered.
+	_, err := os.Stat(deadLetterNATSDir)
+	tcompare(t, errors.Is(err, fs.ErrNotExist), true)
+
+	mu.Lock()
+	defer mu.Unlock()
+	tcompare(t, len(stores), producers*perProducer)
+	for id, n := range stores {
+		if n != 1 {
+			t.Fatalf("message %d stored %d times", id, n)
+		}
+	}
+	fos.Lock()
+	defer fos.Unlock()
+	for _, o := range fos.objects {
+		id, _ := natsMessageIDFromObject(o.info.Name)
+		tcompare(t, string(o.data), msgData(id))
+	}
+
+	// Claims left behind by a crash are released at startup.
+	err = os.WriteFile(filepath.Join(pendingNATSDir, "msg-1-1-1"+natsClaimSuffix), []byte("test"), 0o600)
+	tcheck(t, err, "write claimed file")
+	releaseNATSClaims()
+	_, err = os.Stat(filepath.Join(pendingNATSDir, "msg-1-1-1"))
+	tcheck(t, err, "stat released file")
+}
+
+func TestNATSQueueQuarantine(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	// A queue file truncated after a crash mid-write.
+	err := queueNATSRetry(ctxbg, 1, strings.NewReader("Subject: test\r\n\r\ntest\r\n"), 23)
+	tcheck(t, err, "queue message")
+	files, err := os.ReadDir(pendingNATSDir)
+	tcheck(t, err, "read pending dir")
+	tcompare(t, len(files), 1)
+	truncated := files[0].Name()
+	path := filepath.Join(pendingNATSDir, truncated)
+	fi, err := os.Stat(path)
+	tcheck(t, err, "stat queue file")
+	err = os.Truncate(path, fi.Size()-10)
+	tcheck(t, err, "truncate queue file")
+
+	// An empty queue file in the old format.
+	err = os.WriteFile(filepath.Join(pendingNATSDir, "msg-2-1-1"), nil, 0o600)
+	tcheck(t, err, "write empty queue file")
+
+	n, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, n, 0)
+	tcompare(t, len(fos.names()), 0)
+	tcompare(t, countPendingNATS(), 0)
+	for _, name := range []string{truncated, "msg-2-1-1"} {
+		_, err = os.Stat(filepath.Join(quarantineNATSDir, name))
+		tcheck(t, err, "stat quarantined file")
+	}
+	_, err = os.Stat(deadLetterNATSDir)
+	if !os.IsNotExist(err) {
+		t.Fatalf("corrupt file dead-lettered, err %v", err)
+	}
+
+	// Temporary files from before a restart are quarantined, those being written
+	// are left alone.
+	stale := filepath.Join(pendingNATSDir, ".tmp-msg-3-1-1")
+	err = os.WriteFile(stale, []byte("partial"), 0o600)
+	tcheck(t, err, "write temp queue file")
+	old := natsQueueStart.Add(-time.Minute)
+	err = os.Chtimes(stale, old, old)
+	tcheck(t, err, "set file time")
+	current := filepath.Join(pendingNATSDir, ".tmp-msg-4-1-1")
+	err = os.WriteFile(current, []byte("partial"), 0o600)
+	tcheck(t, err, "write temp queue file")
+	releaseNATSClaims()
+	_, err = os.Stat(filepath.Join(quarantineNATSDir, ".tmp-msg-3-1-1"))
+	tcheck(t, err, "stat quarantined temp file")
+	_, err = os.Stat(current)
+	tcheck(t, err, "stat temp file being written")
+}
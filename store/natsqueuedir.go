@@ -0,0 +1,98 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// Pending directory of older versions, relative to the working directory.
+const natsLegacyQueueDir = "store/tmp/nats-pending"
+
+// natsQueueDir returns the pending directory for cfg: NATS.QueueDir, or
+// tmp/nats-pending, in the data directory.
+func natsQueueDir(cfg *config.NATS) string {
+	dir := "tmp/nats-pending"
+	if cfg != nil && cfg.QueueDir != "" {
+		dir = cfg.QueueDir
+	}
+	return mox.DataDirPath(dir)
+}
+
+// SetNATSQueueDir makes the retry queue use the directories for cfg: the pending
+// directory from natsQueueDir, with the quarantine directory in it and the
+// dead-letter and failed directories next to it. InitNATS calls it, commands that
+// work on the queue without InitNATS, e.g. for exporting the queue, must call it
+// after loading the config.
+func SetNATSQueueDir(cfg *config.NATS) {
+	dir := natsQueueDir(cfg)
+	pendingNATSDir = dir
+	quarantineNATSDir = filepath.Join(dir, "quarantine")
+	deadLetterNATSDir = filepath.Join(filepath.Dir(dir), "nats-deadletter")
+	failedNATSDir = filepath.Join(filepath.Dir(dir), "nats-failed")
+	var maxBytes int64
+	if cfg != nil {
+		maxBytes = cfg.MaxQueueBytes
+	}
+	setNATSQueueMaxBytes(maxBytes)
+}
+
+// moveNATSLegacyQueue moves queue files from the pending directory of older
+// versions, relative to the working directory, to the pending directory, so they
+// are still stored. Entries already present in the pending directory are left
+// alone. Errors, e.g. when the directories are on different file systems, are
+// logged, the files must then be moved by hand.
+func moveNATSLegacyQueue(log mlog.Log) {
+	entries, err := os.ReadDir(natsLegacyQueueDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.Errorx("reading pending directory of older version", err, slog.String("path", natsLegacyQueueDir))
+		return
+	}
+	if same, err := natsSameDir(natsLegacyQueueDir, pendingNATSDir); err != nil || same {
+		log.Check(err, "comparing pending directories")
+		return
+	}
+
+	var moved int
+	for _, e := range entries {
+		src := filepath.Join(natsLegacyQueueDir, e.Name())
+		dst := filepath.Join(pendingNATSDir, e.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			log.Error("not moving queue file from pending directory of older version, already present", slog.String("path", src))
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			log.Errorx("moving queue file from pending directory of older version, move by hand", err, slog.String("path", src), slog.String("dst", dst))
+			continue
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Info("moved queue files from pending directory of older version", slog.String("path", natsLegacyQueueDir), slog.String("dst", pendingNATSDir), slog.Int("moved", moved))
+	}
+	if moved == len(entries) {
+		err := os.Remove(natsLegacyQueueDir)
+		log.Check(err, "removing empty pending directory of older version")
+	}
+}
+
+// natsSameDir returns whether directories a and b are the same.
+func natsSameDir(a, b string) (bool, error) {
+	afi, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bfi, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(afi, bfi), nil
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestNATSQueueDir(t *testing.T) {
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+
+	// Relative to the data directory, absolute paths as is.
+	tcompare(t, natsQueueDir(nil), mox.DataDirPath("tmp/nats-pending"))
+	tcompare(t, natsQueueDir(&config.NATS{QueueDir: "queue"}), mox.DataDirPath("queue"))
+	dir := filepath.Join(t.TempDir(), "queue")
+	tcompare(t, natsQueueDir(&config.NATS{QueueDir: dir}), dir)
+
+	orig := []string{pendingNATSDir, quarantineNATSDir, deadLetterNATSDir, failedNATSDir}
+	defer func() {
+		pendingNATSDir, quarantineNATSDir, deadLetterNATSDir, failedNATSDir = orig[0], orig[1], orig[2], orig[3]
+	}()
+	SetNATSQueueDir(&config.NATS{QueueDir: dir})
+	tcompare(t, []string{pendingNATSDir, quarantineNATSDir, deadLetterNATSDir, failedNATSDir}, []string{
+		dir,
+		filepath.Join(dir, "quarantine"),
+		filepath.Join(filepath.Dir(dir), "nats-deadletter"),
+		filepath.Join(filepath.Dir(dir), "nats-failed"),
+	})
+
+	// Queue files of older versions are moved, except when already present.
+	os.MkdirAll(natsLegacyQueueDir, 0o700)
+	defer os.RemoveAll(natsLegacyQueueDir)
+	err := os.MkdirAll(dir, 0o700)
+	tcheck(t, err, "mkdir queue dir")
+	for _, name := range []string{"msg-1-1-1", "msg-2-1-1"} {
+		err := os.WriteFile(filepath.Join(natsLegacyQueueDir, name), []byte("legacy"), 0o600)
+		tcheck(t, err, "write legacy queue file")
+	}
+	err = os.WriteFile(filepath.Join(dir, "msg-2-1-1"), []byte("new"), 0o600)
+	tcheck(t, err, "write queue file")
+	moveNATSLegacyQueue(pkglog)
+	buf, err := os.ReadFile(filepath.Join(dir, "msg-1-1-1"))
+	tcheck(t, err, "read moved queue file")
+	tcompare(t, string(buf), "legacy")
+	buf, err = os.ReadFile(filepath.Join(dir, "msg-2-1-1"))
+	tcheck(t, err, "read queue file")
+	tcompare(t, string(buf), "new")
+	_, err = os.Stat(filepath.Join(natsLegacyQueueDir, "msg-2-1-1"))
+	tcheck(t, err, "stat queue file left in legacy dir")
+
+	// Nothing happens when the pending directory is the old one.
+	legacyDir, err := filepath.Abs(natsLegacyQueueDir)
+	tcheck(t, err, "absolute path")
+	SetNATSQueueDir(&config.NATS{QueueDir: legacyDir})
+	moveNATSLegacyQueue(pkglog)
+	_, err = os.Stat(filepath.Join(natsLegacyQueueDir, "msg-2-1-1"))
+	tcheck(t, err, "stat queue file in legacy dir")
+}
+
+func TestNATSQueueDirInit(t *testing.T) {
+	// Absolute config path, so the data directory stays the same when changing the
+	// working directory below.
+	confPath, err := filepath.Abs(filepath.FromSlash("../testdata/store/mox.conf"))
+	tcheck(t, err, "absolute config path")
+	mox.ConfigStaticPath = confPath
+	defer func() { mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf") }()
+	mox.MustLoadConfig(true, false)
+
+	// Restart the retry loop of earlier tests with the default queue directory.
+	stopNATSPendingLoop()
+	orig := []string{pendingNATSDir, quarantineNATSDir, deadLetterNATSDir, failedNATSDir}
+	defer func() {
+		// Stop the loop before restoring, it reads the directories.
+		stopNATSPendingLoop()
+		pendingNATSDir, quarantineNATSDir, deadLetterNATSDir, failedNATSDir = orig[0], orig[1], orig[2], orig[3]
+	}()
+	defer os.RemoveAll(mox.DataDirPath("tmp"))
+
+	// Also when started from another directory, the queue is in the data directory.
+	wd, err := os.Getwd()
+	tcheck(t, err, "get working directory")
+	err = os.Chdir(t.TempDir())
+	tcheck(t, err, "change working directory")
+	defer os.Chdir(wd)
+
+	err = InitNATS(pkglog, &config.NATS{URL: "nats://127.0.0.1:1", BucketName: "test-bucket"})
+	if err != nil {
+		t.Logf("expected connection error: %v", err)
+	}
+	tcompare(t, pendingNATSDir, mox.DataDirPath("tmp/nats-pending"))
+	tcompare(t, filepath.IsAbs(pendingNATSDir), true)
+	_, err = os.Stat(pendingNATSDir)
+	tcheck(t, err, "stat pending directory")
+}
+
+func TestNATSNewClient(t *testing.T) {
+	// Commands using NATS next to a running mox must not start the retry loop.
+	stopNATSPendingLoop()
+	orig := []string{pendingNATSDir, quarantineNATSDir, deadLetterNATSDir, failedNATSDir}
+	defer func() {
+		pendingNATSDir, quarantineNATSDir, deadLetterNATSDir, failedNATSDir = orig[0], orig[1], orig[2], orig[3]
+	}()
+
+	queueDir := t.TempDir()
+	_, err := NewNATSClient(pkglog, &config.NATS{URL: "nats://127.0.0.1:1", BucketName: "test-bucket", QueueDir: queueDir})
+	if err == nil {
+		t.Fatalf("connect succeeded without nats server")
+	}
+	tcompare(t, natsPendingLoopStarted.Load(), false)
+	tcompare(t, pendingNATSDir, queueDir)
+}
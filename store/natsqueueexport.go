@@ -0,0 +1,228 @@
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// NATSQueueTransfer is the result of ExportNATSQueue or ImportNATSQueue.
+type NATSQueueTransfer struct {
+	Messages int   // Exported or imported.
+	Bytes    int64 // Of the messages.
+	Skipped  int   // Import only, already in the pending queue.
+	Failed   int   // Corrupt queue files or archive entries, not exported or imported.
+}
+
+// ExportNATSQueue writes the messages in the pending NATS queue to w as gzipped
+// tar archive, for importing with ImportNATSQueue on another host. Each queue file
+// is a file in the archive, under its path relative to the pending directory and
+// in the order the retry loop processes them, with its header with message ID,
+// account, thread ID, time of queueing and number of attempts. Queue files from
+// before the header format get a header. The queue itself is not changed.
+// Corrupt queue files are logged and skipped.
+func ExportNATSQueue(log mlog.Log, w io.Writer) (NATSQueueTransfer, error) {
+	var res NATSQueueTransfer
+	paths, err := listPendingNATS()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return res, fmt.Errorf("listing pending queue: %w", err)
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	for _, p := range paths {
+		n, err := exportNATSQueueFile(tw, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // Stored in the meantime.
+		} else if errors.Is(err, errQueueCorrupt) {
+			log.Errorx("not exporting corrupt queue file", err, slog.String("path", p))
+			res.Failed++
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		res.Messages++
+		res.Bytes += n
+	}
+	if err := tw.Close(); err != nil {
+		return res, fmt.Errorf("closing tar: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return res, fmt.Errorf("closing gzip: %w", err)
+	}
+	return res, nil
+}
+
+// exportNATSQueueFile adds the queue file at p to tw, returning the size of its
+// message.
+func exportNATSQueueFile(tw *tar.Writer, p string) (int64, error) {
+	rel, err := filepath.Rel(pendingNATSDir, strings.TrimSuffix(p, natsClaimSuffix))
+	if err != nil {
+		return 0, fmt.Errorf("path of queue file: %w", err)
+	}
+	f, err := os.Open(p)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		// Claimed or unclaimed since listing.
+		if alt, ok := strings.CutSuffix(p, natsClaimSuffix); ok {
+			f, err = os.Open(alt)
+		} else {
+			f, err = os.Open(p + natsClaimSuffix)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	h, msgr, err := readQueueFile(f, filepath.Base(rel))
+	if err == nil {
+		err = verifyQueueFile(h, msgr)
+	}
+	if err != nil {
+		return 0, err
+	}
+	hbuf, err := encodeQueueHeader(h, msgr)
+	if err != nil {
+		return 0, err
+	}
+	hdr := tar.Header{
+		Name:    filepath.ToSlash(rel),
+		Size:    int64(len(hbuf)) + msgr.Size(),
+		Mode:    0o600,
+		ModTime: fi.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return 0, fmt.Errorf("writing tar header: %w", err)
+	}
+	if _, err := tw.Write(hbuf); err != nil {
+		return 0, fmt.Errorf("writing queue header: %w", err)
+	}
+	if _, err := io.Copy(tw, msgr); err != nil {
+		return 0, fmt.Errorf("writing message: %w", err)
+	}
+	return msgr.Size(), nil
+}
+
+// ImportNATSQueue adds the messages of archive r, written by ExportNATSQueue, to
+// the pending NATS queue, from where the retry loop stores them. Queue files keep
+// their name, so they are retried in the same order, and their header, so also
+// their account, thread ID, time of queueing and number of attempts. Messages
+// already in the queue, e.g. from an earlier import, are skipped. Corrupt archive
+// entries are logged and skipped.
+func ImportNATSQueue(log mlog.Log, r io.Reader) (NATSQueueTransfer, error) {
+	var res NATSQueueTransfer
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return res, fmt.Errorf("reading gzip: %w", err)
+	}
+	if err := os.MkdirAll(pendingNATSDir, 0o700); err != nil {
+		return res, fmt.Errorf("creating pending directory: %w", err)
+	}
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return res, fmt.Errorf("reading tar: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		imported, size, err := importNATSQueueFile(hdr.Name, tr)
+		if errors.Is(err, errQueueCorrupt) {
+			log.Errorx("not importing corrupt queue file", err, slog.String("name", hdr.Name))
+			res.Failed++
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		if imported {
+			res.Messages++
+			res.Bytes += size
+		} else {
+			res.Skipped++
+		}
+	}
+	if err := gzr.Close(); err != nil {
+		return res, fmt.Errorf("closing gzip: %w", err)
+	}
+	return res, nil
+}
+
+// importNATSQueueFile adds archive entry name with contents r to the pending
+// queue, if it isn't present yet. Returns whether it was added, and the size of
+// its message.
+func importNATSQueueFile(name string, r io.Reader) (imported bool, size int64, rerr error) {
+	name = path.Clean(name)
+	parts := strings.Split(name, "/")
+	base := parts[len(parts)-1]
+	if !filepath.IsLocal(filepath.FromSlash(name)) || !strings.HasPrefix(base, "msg-") || strings.HasSuffix(base, natsClaimSuffix) || len(parts) > 1 && slices.Contains(natsPendingSpecialDirs, parts[0]) {
+		return false, 0, fmt.Errorf("%w: not a queue file name", errQueueCorrupt)
+	}
+	dst := filepath.Join(pendingNATSDir, filepath.FromSlash(name))
+	for _, p := range []string{dst, dst + natsClaimSuffix} {
+		if _, err := os.Stat(p); err == nil {
+			return false, 0, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return false, 0, err
+		}
+	}
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return false, 0, fmt.Errorf("creating queue subdirectory: %w", err)
+	}
+	tmpPath := filepath.Join(dir, ".tmp-import-"+base)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o600)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if rerr != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+	if _, err := io.Copy(f, r); err != nil {
+		return false, 0, fmt.Errorf("writing queue file: %w", err)
+	}
+	h, msgr, err := readQueueFile(f, base)
+	if err == nil {
+		err = verifyQueueFile(h, msgr)
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return false, 0, err
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return false, 0, err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return false, 0, err
+	}
+	return true, msgr.Size(), nil
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSQueueExportImport(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	// Several queue files, with different accounts, attempts and times of queueing,
+	// one in a subdirectory, one claimed and one in the old format.
+	enqueued := time.Now().Add(-time.Hour).Round(0)
+	write := func(name string, h queueHeader, msg string) {
+		t.Helper()
+		p := filepath.Join(pendingNATSDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0o700)
+		err := writeQueueFile(p, h, strings.NewReader(msg), int64(len(msg)))
+		tcheck(t, err, "write queue file")
+	}
+	write("msg-1-100-1", queueHeader{MessageID: 1, Account: "mjl", ThreadID: 1, Enqueued: enqueued, Attempts: 3}, "first")
+	write("msg-2-200-1", queueHeader{MessageID: 2, Account: "other", Enqueued: enqueued.Add(time.Minute)}, "second")
+	write("host2/msg-3-300-1", queueHeader{MessageID: 3, Account: "mjl", Enqueued: enqueued.Add(2 * time.Minute), Attempts: 1}, "third")
+	write("msg-4-400-1"+natsClaimSuffix, queueHeader{MessageID: 4, Enqueued: enqueued.Add(3 * time.Minute), Attempts: 7}, "fourth")
+	err := os.WriteFile(filepath.Join(pendingNATSDir, "msg-5-500-1"), []byte("legacy"), 0o600)
+	tcheck(t, err, "write legacy queue file")
+	err = os.WriteFile(filepath.Join(pendingNATSDir, "msg-6-600-1"), nil, 0o600)
+	tcheck(t, err, "write corrupt queue file")
+
+	type entry struct {
+		name string
+		h    queueHeader
+		msg  string
+	}
+	queue := func() (l []entry) {
+		t.Helper()
+		paths, err := listPendingNATS()
+		tcheck(t, err, "list pending")
+		for _, p := range paths {
+			name, err := filepath.Rel(pendingNATSDir, strings.TrimSuffix(p, natsClaimSuffix))
+			tcheck(t, err, "relative path")
+			f, err := os.Open(p)
+			tcheck(t, err, "open queue file")
+			h, r, err := readQueueFile(f, filepath.Base(name))
+			if err == nil {
+				err = verifyQueueFile(h, r)
+			}
+			if err != nil {
+				f.Close()
+				continue
+			}
+			buf, err := io.ReadAll(r)
+			tcheck(t, err, "read message")
+			f.Close()
+			// Old format files get a header on export.
+			h.Version, h.CRC32 = 0, 0
+			l = append(l, entry{filepath.ToSlash(name), h, string(buf)})
+		}
+		return l
+	}
+	orig := queue()
+	tcompare(t, len(orig), 5)
+
+	var archive bytes.Buffer
+	res, err := ExportNATSQueue(pkglog, &archive)
+	tcheck(t, err, "export queue")
+	tcompare(t, res, NATSQueueTransfer{Messages: 5, Bytes: int64(len("first second third fourth legacy") - 4), Failed: 1})
+	// Exporting leaves the queue as is.
+	tcompare(t, queue(), orig)
+
+	// Import on a "new host", with an empty queue.
+	cleanPendingNATS()
+	data := archive.Bytes()
+	res, err = ImportNATSQueue(pkglog, bytes.NewReader(data))
+	tcheck(t, err, "import queue")
+	tcompare(t, res, NATSQueueTransfer{Messages: 5, Bytes: int64(len("first second third fourth legacy") - 4)})
+	tcompare(t, queue(), orig)
+
+	// Importing again skips messages already queued.
+	res, err = ImportNATSQueue(pkglog, bytes.NewReader(data))
+	tcheck(t, err, "import queue again")
+	tcompare(t, res, NATSQueueTransfer{Skipped: 5})
+	tcompare(t, len(queue()), 5)
+
+	// Truncated archives fail.
+	_, err = ImportNATSQueue(pkglog, bytes.NewReader(data[:len(data)/2]))
+	if err == nil {
+		t.Fatalf("no error for truncated archive")
+	}
+}
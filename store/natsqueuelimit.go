@@ -0,0 +1,111 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricNATSQueueBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_queue_bytes",
+			Help: "Total size in bytes of the files in the NATS pending queue, as tracked for NATS.MaxQueueBytes.",
+		},
+	)
+	metricNATSQueueFull = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_nats_queue_full_total",
+			Help: "Number of messages not added to the NATS pending queue because it would exceed NATS.MaxQueueBytes.",
+		},
+	)
+)
+
+// ErrQueueFull is returned when a message isn't added to the pending queue
+// because the queue would exceed NATS.MaxQueueBytes. Callers storing
+// synchronously should fail the delivery with a temporary error, so the sender
+// retries later.
+var ErrQueueFull = errors.New("nats pending queue full")
+
+// Bytes reserved for the header of a queue file, on top of the message size, when
+// checking the limit. Headers are typically a few hundred bytes.
+const natsQueueHeaderReserve = 1024
+
+// Size of the pending queue, tracked in memory so adding to the queue doesn't have
+// to walk the directory. Added to when writing queue files, and lowered when they
+// are stored. Other changes, e.g. moves to the dead-letter directory or files
+// removed by hand, are picked up by syncNATSQueueBytes, which the retry loop calls
+// after each pass.
+var natsQueueSize struct {
+	sync.Mutex
+	known    bool // Whether bytes was set from the directory.
+	bytes    int64
+	maxBytes int64 // From NATS.MaxQueueBytes, 0 for no limit.
+}
+
+// setNATSQueueMaxBytes sets the limit for the pending queue, and has the size read
+// from the directory again on next use.
+func setNATSQueueMaxBytes(maxBytes int64) {
+	natsQueueSize.Lock()
+	defer natsQueueSize.Unlock()
+	natsQueueSize.maxBytes = maxBytes
+	natsQueueSize.known = false
+}
+
+// reserveNATSQueueBytes adds n bytes to the size of the pending queue for a file
+// about to be written, or returns an error wrapping ErrQueueFull if that would
+// exceed the limit.
+func reserveNATSQueueBytes(n int64) error {
+	natsQueueSize.Lock()
+	defer natsQueueSize.Unlock()
+	if !natsQueueSize.known {
+		natsQueueSize.bytes = pendingNATSBytes()
+		natsQueueSize.known = true
+	}
+	if limit := natsQueueSize.maxBytes; limit > 0 && natsQueueSize.bytes+n > limit {
+		metricNATSQueueFull.Inc()
+		return fmt.Errorf("%w: %d bytes queued, adding %d would exceed limit of %d", ErrQueueFull, natsQueueSize.bytes, n, limit)
+	}
+	natsQueueSize.bytes += n
+	metricNATSQueueBytes.Set(float64(natsQueueSize.bytes))
+	return nil
+}
+
+// addNATSQueueBytes changes the size of the pending queue by n, e.g. negative
+// after removing a queue file.
+func addNATSQueueBytes(n int64) {
+	natsQueueSize.Lock()
+	defer natsQueueSize.Unlock()
+	if !natsQueueSize.known {
+		return // Read on next use, including this change.
+	}
+	natsQueueSize.bytes = max(0, natsQueueSize.bytes+n)
+	metricNATSQueueBytes.Set(float64(natsQueueSize.bytes))
+}
+
+// syncNATSQueueBytes sets the size of the pending queue from the directory.
+func syncNATSQueueBytes() {
+	n := pendingNATSBytes()
+	natsQueueSize.Lock()
+	defer natsQueueSize.Unlock()
+	natsQueueSize.bytes = n
+	natsQueueSize.known = true
+	metricNATSQueueBytes.Set(float64(n))
+}
+
+// pendingNATSBytes returns the total size of the queue files in the pending
+// directory.
+func pendingNATSBytes() int64 {
+	paths, _ := listPendingNATS()
+	var n int64
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			n += fi.Size()
+		}
+	}
+	return n
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNATSQueueMaxBytes(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	cleanPendingNATS()
+	defer cleanPendingNATS()
+	const limit = 4000
+	setNATSQueueMaxBytes(limit)
+	defer setNATSQueueMaxBytes(0)
+
+	// Messages are queued until the next one would exceed the limit, headers
+	// included.
+	msg := strings.Repeat("x", 200)
+	full := testutil.ToFloat64(metricNATSQueueFull)
+	var queued int
+	for i := range int64(10) {
+		err := queueNATSRetry(ctxbg, 1+i, strings.NewReader(msg), int64(len(msg)))
+		if errors.Is(err, ErrQueueFull) {
+			break
+		}
+		tcheck(t, err, "queue message")
+		queued++
+	}
+	if queued == 0 || queued == 10 {
+		t.Fatalf("queued %d messages of %d bytes with limit %d", queued, len(msg), limit)
+	}
+	tcompare(t, testutil.ToFloat64(metricNATSQueueFull)-full, 1.0)
+	tcompare(t, countPendingNATS(), queued)
+	tcompare(t, pendingNATSBytes() <= limit, true)
+	tcompare(t, testutil.ToFloat64(metricNATSQueueBytes), float64(pendingNATSBytes()))
+
+	// A synchronous store that fails and can't be queued returns ErrQueueFull, so
+	// the caller can fail the delivery.
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("put failed") }
+	err := nc.StoreMessageWithQueue(ctxbg, 100, writeTestMessage(t, msg))
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("got err %v, expected ErrQueueFull", err)
+	}
+	tcompare(t, countPendingNATS(), queued)
+
+	// Once queued messages are stored, there is room again, without reading the
+	// directory.
+	fos.putHook = nil
+	stored, err := processPendingNATS(ctxbg, nc)
+	tcheck(t, err, "process pending")
+	tcompare(t, stored, queued)
+	tcompare(t, testutil.ToFloat64(metricNATSQueueBytes), 0.0)
+	err = queueNATSRetry(ctxbg, 200, strings.NewReader(msg), int64(len(msg)))
+	tcheck(t, err, "queue message after stores")
+
+	// Files removed behind our back are picked up by the sync after a pass of the
+	// retry loop.
+	paths, err := listPendingNATS()
+	tcheck(t, err, "list pending")
+	tcompare(t, len(paths), 1)
+	err = os.Remove(paths[0])
+	tcheck(t, err, "remove queue file")
+	for i := range int64(queued) {
+		err := os.WriteFile(filepath.Join(pendingNATSDir, objectName(300+i)), []byte(msg), 0o600)
+		tcheck(t, err, "write queue file")
+	}
+	syncNATSQueueBytes()
+	tcompare(t, testutil.ToFloat64(metricNATSQueueBytes), float64(queued*len(msg)))
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueueStatus returns the number of messages in the NATS pending queue, when the
+// oldest of them was queued, and the combined size of their queue files, e.g. for
+// a status endpoint to watch for a growing retry backlog. Oldest is zero for an
+// empty queue. Only the directory and file metadata are read, not the queue files.
+// Files removed by the retry loop during the scan are not counted.
+func QueueStatus() (count int, oldest time.Time, totalBytes int64, err error) {
+	paths, err := listPendingNATS()
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, time.Time{}, 0, nil
+	} else if err != nil {
+		return 0, time.Time{}, 0, fmt.Errorf("listing nats pending queue: %w", err)
+	}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Claimed, or its claim released, by the retry loop while scanning.
+			if claimed, ok := strings.CutSuffix(p, natsClaimSuffix); ok {
+				fi, err = os.Stat(claimed)
+			} else {
+				fi, err = os.Stat(p + natsClaimSuffix)
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return 0, time.Time{}, 0, fmt.Errorf("stat of queue file: %w", err)
+		}
+		count++
+		totalBytes += fi.Size()
+		queued, ok := natsQueuedAt(filepath.Base(p))
+		if !ok {
+			queued = fi.ModTime()
+		}
+		if oldest.IsZero() || queued.Before(oldest) {
+			oldest = queued
+		}
+	}
+	return count, oldest, totalBytes, nil
+}
+
+// natsQueuedAt returns when the queue file with name was queued, from the time in
+// names made by objectName, or in seconds in the older "msg-<id>-<time>" form.
+// Queue files are rewritten on failed attempts, so their modification time is
+// only a fallback.
+func natsQueuedAt(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, natsClaimSuffix)
+	s, ok := strings.CutPrefix(name, "msg-")
+	if !ok {
+		return time.Time{}, false
+	}
+	t := strings.Split(s, "-")
+	if len(t) < 2 {
+		return time.Time{}, false
+	}
+	v, err := strconv.ParseInt(t[1], 10, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}, false
+	}
+	if len(t) == 2 {
+		return time.Unix(v, 0), true
+	}
+	return time.Unix(0, v), true
+}
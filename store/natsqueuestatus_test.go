@@ -0,0 +1,66 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSQueueStatus(t *testing.T) {
+	os.MkdirAll(pendingNATSDir, 0o700)
+	cleanPendingNATS()
+	defer cleanPendingNATS()
+
+	count, oldest, size, err := QueueStatus()
+	tcheck(t, err, "queue status")
+	tcompare(t, count, 0)
+	tcompare(t, oldest.IsZero(), true)
+	tcompare(t, size, int64(0))
+
+	start := time.Now()
+	msg := strings.Repeat("x", 100)
+	for i := range int64(3) {
+		err := queueNATSRetry(ctxbg, 1+i, strings.NewReader(msg), int64(len(msg)))
+		tcheck(t, err, "queue message")
+	}
+	paths, err := listPendingNATS()
+	tcheck(t, err, "list pending")
+	first := paths[0]
+
+	// A claimed file is still counted, and the time of queueing is from the name, not
+	// the modification time of the rewritten file.
+	err = os.Rename(first, first+natsClaimSuffix)
+	tcheck(t, err, "claim")
+	future := time.Now().Add(time.Hour)
+	for _, p := range paths[1:] {
+		err := os.Chtimes(p, future, future)
+		tcheck(t, err, "chtimes")
+	}
+	// Legacy names without time fall back to the modification time.
+	legacy := filepath.Join(pendingNATSDir, "msg-10")
+	err = os.WriteFile(legacy, []byte(msg), 0o600)
+	tcheck(t, err, "write legacy queue file")
+	old := start.Add(-time.Hour)
+	err = os.Chtimes(legacy, old, old)
+	tcheck(t, err, "chtimes legacy")
+
+	count, oldest, size, err = QueueStatus()
+	tcheck(t, err, "queue status")
+	tcompare(t, count, 4)
+	tcompare(t, oldest.Equal(old), true)
+	tcompare(t, size, pendingNATSBytes())
+
+	os.Remove(legacy)
+	count, oldest, _, err = QueueStatus()
+	tcheck(t, err, "queue status")
+	tcompare(t, count, 3)
+	if oldest.Before(start.Add(-time.Second)) || oldest.After(time.Now()) {
+		t.Fatalf("oldest %v, expected time of queueing after %v", oldest, start)
+	}
+
+	queued, ok := natsQueuedAt("msg-1-1700000000")
+	tcompare(t, ok, true)
+	tcompare(t, queued.Equal(time.Unix(1700000000, 0)), true)
+}
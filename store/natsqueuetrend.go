@@ -0,0 +1,140 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricNATSPendingDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_pending_queue_depth",
+			Help: "Number of messages in the NATS pending queue, at the last pass of the retry loop.",
+		},
+	)
+	metricNATSPendingRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_pending_queue_rate",
+			Help: "Smoothed rate of change of the NATS pending queue in messages per second, negative when draining.",
+		},
+	)
+	metricNATSPendingDraining = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_pending_queue_draining",
+			Help: "Whether the NATS pending queue is non-empty and shrinking (1) or not (0).",
+		},
+	)
+	metricNATSPendingGrowing = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_pending_queue_growing",
+			Help: "Whether the NATS pending queue is growing (1) or not (0).",
+		},
+	)
+	metricNATSPendingEmptySeconds = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mox_nats_pending_queue_empty_seconds",
+			Help: "Estimated number of seconds until the NATS pending queue is empty at the current drain rate, 0 if not draining.",
+		},
+	)
+)
+
+// NATSQueueState is the trend of the NATS pending queue.
+type NATSQueueState string
+
+const (
+	NATSQueueEmpty    NATSQueueState = "empty"
+	NATSQueueSteady   NATSQueueState = "steady"   // Non-empty, not changing.
+	NATSQueueDraining NATSQueueState = "draining" // Non-empty, shrinking.
+	NATSQueueGrowing  NATSQueueState = "growing"
+)
+
+// NATSQueueTrend describes how the NATS pending queue changes over passes of the
+// retry loop.
+type NATSQueueTrend struct {
+	Depth    int
+	Observed time.Time // Zero if no pass was made yet.
+
+	// Rate of change in messages per second, smoothed over passes. Negative while
+	// draining.
+	Rate float64
+
+	State NATSQueueState
+
+	// Estimated time until the queue is empty at the current drain rate. Only set
+	// while draining.
+	TimeToEmpty time.Duration
+}
+
+// Weight of the latest observation in the smoothed rate.
+const natsQueueRateAlpha = 0.5
+
+var natsQueueTrend = struct {
+	sync.Mutex
+	trend NATSQueueTrend
+}{trend: NATSQueueTrend{State: NATSQueueEmpty}}
+
+// PendingNATSTrend returns the trend of the NATS pending queue as of the last pass
+// of the retry loop.
+func PendingNATSTrend() NATSQueueTrend {
+	natsQueueTrend.Lock()
+	defer natsQueueTrend.Unlock()
+	return natsQueueTrend.trend
+}
+
+// observePendingNATS updates the queue trend with the depth at time now, and
+// updates the metrics.
+func observePendingNATS(depth int, now time.Time) NATSQueueTrend {
+	natsQueueTrend.Lock()
+	defer natsQueueTrend.Unlock()
+
+	t := nextNATSQueueTrend(natsQueueTrend.trend, depth, now)
+	natsQueueTrend.trend = t
+
+	metricNATSPendingDepth.Set(float64(t.Depth))
+	metricNATSPendingRate.Set(t.Rate)
+	metricNATSPendingDraining.Set(boolFloat(t.State == NATSQueueDraining))
+	metricNATSPendingGrowing.Set(boolFloat(t.State == NATSQueueGrowing))
+	metricNATSPendingEmptySeconds.Set(t.TimeToEmpty.Seconds())
+	return t
+}
+
+// nextNATSQueueTrend returns the trend after observing depth at now, following
+// the previous trend.
+func nextNATSQueueTrend(prev NATSQueueTrend, depth int, now time.Time) NATSQueueTrend {
+	t := NATSQueueTrend{Depth: depth, Observed: now}
+	if !prev.Observed.IsZero() {
+		if dt := now.Sub(prev.Observed).Seconds(); dt > 0 {
+			rate := float64(depth-prev.Depth) / dt
+			t.Rate = natsQueueRateAlpha*rate + (1-natsQueueRateAlpha)*prev.Rate
+		} else {
+			t.Rate = prev.Rate
+		}
+	}
+	if depth == 0 {
+		// Nothing left to drain, don't let an old rate linger.
+		t.Rate = 0
+	}
+
+	switch {
+	case depth == 0:
+		t.State = NATSQueueEmpty
+	case t.Rate < 0:
+		t.State = NATSQueueDraining
+		t.TimeToEmpty = time.Duration(float64(depth) / -t.Rate * float64(time.Second))
+	case t.Rate > 0:
+		t.State = NATSQueueGrowing
+	default:
+		t.State = NATSQueueSteady
+	}
+	return t
+}
+
+func boolFloat(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// OpenMessageForRedelivery fetches object objectName from NATS into a new
+// temporary file in the data directory, for re-injecting an archived message into
+// the delivery path, e.g. with queue.Add. The message is streamed to the file, so
+// large messages don't have to fit in memory, and the returned file is seekable
+// and can be read with ReadAt, as the delivery path requires. The file is
+// positioned at the start. The caller must close and remove the file.
+func (nc *NATSClient) OpenMessageForRedelivery(ctx context.Context, log mlog.Log, objectName string) (rf *os.File, size int64, rerr error) {
+	if nc == nil {
+		return nil, 0, ErrNATSNotConfigured
+	}
+
+	r, err := nc.getObject(ctx, objectName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting object %q: %w", objectName, err)
+	}
+	defer r.Close()
+
+	f, err := CreateMessageTemp(log, "nats-redeliver")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer func() {
+		if rerr != nil {
+			CloseRemoveTempFile(log, f, "message for redelivery")
+		}
+	}()
+
+	// The object store verifies the digest when the last data is read.
+	size, err = io.Copy(f, r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading object %q: %w", objectName, err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, 0, fmt.Errorf("seek to start of message file: %w", err)
+	}
+
+	nc.log.Debug("fetched message from NATS for redelivery", slog.String("object_name", objectName), slog.Int64("size", size))
+	return f, size, nil
+}
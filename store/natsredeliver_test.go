@@ -0,0 +1,40 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestNATSRedelivery(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+
+	msg := strings.Repeat("Subject: test\r\n\r\nbody\r\n", 1000)
+	_, err := fos.Put(ctxbg, jetstream.ObjectMeta{Name: "msg-1-1"}, strings.NewReader(msg))
+	tcheck(t, err, "put")
+
+	f, size, err := nc.OpenMessageForRedelivery(ctxbg, pkglog, "msg-1-1")
+	tcheck(t, err, "open message for redelivery")
+	tcompare(t, size, int64(len(msg)))
+	buf, err := io.ReadAll(f)
+	tcheck(t, err, "read message")
+	tcompare(t, string(buf), msg)
+	buf = make([]byte, 7)
+	_, err = f.ReadAt(buf, 0)
+	tcheck(t, err, "readat")
+	tcompare(t, string(buf), "Subject")
+	CloseRemoveTempFile(pkglog, f, "test message")
+	if _, err := os.Stat(f.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temp file not removed: %v", err)
+	}
+
+	_, _, err = nc.OpenMessageForRedelivery(ctxbg, pkglog, "msg-2-1")
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound", err)
+	}
+}
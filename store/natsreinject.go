@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+)
+
+// NATSReinject is a message fetched from NATS with what is needed to inject it
+// again, e.g. on another server, as returned by GetMessageForReinject.
+type NATSReinject struct {
+	Account    string
+	MessageID  int64
+	ObjectName string
+
+	// Message exactly as stored, with its original headers. Positioned at the
+	// start. The caller must close and remove the file.
+	File *os.File
+	Size int64
+
+	// Parsed from the message headers. Nil if the message has no parsable header.
+	Envelope *message.Envelope
+
+	// Whether the fields below with "local" are from the message in the account,
+	// which is not the case once the message was removed locally, e.g. with
+	// DeleteAfterStore, or for accounts that no longer exist.
+	Local bool
+
+	// When the message was received. From the local message, otherwise the time it
+	// was stored in NATS.
+	Received time.Time
+
+	// From the local message, otherwise as reconstructed from the flag history with
+	// FlagEvents, if any.
+	Flags    Flags
+	Keywords []string
+
+	Mailbox   string            // Local.
+	MsgPrefix []byte            // Local, headers added by mox on delivery, not in the stored message.
+	MailFrom  string            // Local, SMTP "MAIL FROM".
+	RcptTo    string            // Local, SMTP "RCPT TO", localpart@domain.
+	ThreadID  int64             // Local, otherwise from the object metadata with StoreThreadID.
+	Metadata  map[string]string // Object metadata.
+}
+
+// GetMessageForReinject fetches the newest stored object of message messageID of
+// account into a temporary file, see OpenMessageForRedelivery, along with its
+// envelope, flags, received time and delivery details, for injecting the message
+// again, e.g. when moving it to another server. Details are taken from the message
+// in the local account while it exists, and otherwise from the object metadata
+// and flag history. The caller must close and remove the returned file.
+func (nc *NATSClient) GetMessageForReinject(ctx context.Context, log mlog.Log, account string, messageID int64) (ri NATSReinject, rerr error) {
+	if nc == nil {
+		return ri, ErrNATSNotConfigured
+	}
+
+	info, err := nc.natsMessageObject(ctx, account, messageID)
+	if err != nil {
+		return ri, err
+	}
+	f, size, err := nc.OpenMessageForRedelivery(ctx, log, info.Name)
+	if err != nil {
+		return ri, err
+	}
+	defer func() {
+		if rerr != nil {
+			CloseRemoveTempFile(log, f, "message for reinject")
+		}
+	}()
+
+	ri = NATSReinject{
+		Account:    account,
+		MessageID:  messageID,
+		ObjectName: info.Name,
+		File:       f,
+		Size:       size,
+		Received:   info.ModTime,
+		Metadata:   info.Metadata,
+	}
+	if p, err := message.Parse(log.Logger, false, f); err != nil {
+		log.Debugx("parsing message for reinject, continuing without envelope", err, slog.String("object_name", info.Name))
+	} else {
+		ri.Envelope = p.Envelope
+	}
+	if id, err := strconv.ParseInt(info.Metadata[natsThreadIDKey], 10, 64); err == nil {
+		ri.ThreadID = id
+	}
+
+	if err := ri.addLocal(ctx, log); err != nil {
+		return ri, err
+	}
+	if !ri.Local && AuthDB != nil && nc.config.FlagEvents {
+		ri.Flags, ri.Keywords, err = nc.NATSFlagState(ctx, account, messageID)
+		if err != nil {
+			return ri, fmt.Errorf("reconstructing flags: %w", err)
+		}
+	}
+	return ri, nil
+}
+
+// addLocal sets the details from the message in the local account, if present.
+func (ri *NATSReinject) addLocal(ctx context.Context, log mlog.Log) error {
+	if ri.Account == "" {
+		return nil
+	}
+	acc, err := OpenAccount(log, ri.Account, false)
+	if errors.Is(err, ErrAccountUnknown) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening account: %w", err)
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account after reinject lookup")
+	}()
+
+	return acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+		m := Message{ID: ri.MessageID}
+		if err := tx.Get(&m); err == bstore.ErrAbsent || err == nil && m.Expunged {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("get local message: %w", err)
+		}
+		mb := Mailbox{ID: m.MailboxID}
+		if err := tx.Get(&mb); err != nil {
+			return fmt.Errorf("get mailbox of local message: %w", err)
+		}
+		ri.Local = true
+		ri.Received = m.Received
+		ri.Flags = m.Flags
+		ri.Keywords = m.Keywords
+		ri.Mailbox = mb.Name
+		ri.MsgPrefix = m.MsgPrefix
+		ri.MailFrom = m.MailFrom
+		if m.RcptToDomain != "" {
+			ri.RcptTo = string(m.RcptToLocalpart) + "@" + m.RcptToDomain
+		}
+		ri.ThreadID = m.ThreadID
+		return nil
+	})
+}
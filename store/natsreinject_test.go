@@ -0,0 +1,123 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestNATSGetMessageForReinject(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer Switchboard()()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", StoreThreadID: true}, fos)
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+
+	acc, err := OpenAccount(pkglog, "mjl", true)
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.WaitClosed()
+	}()
+
+	msg := strings.ReplaceAll(`From: <remote@remote.example>
+To: <mjl@mox.example>
+Subject: reinject test
+Message-ID: <reinject@remote.example>
+Date: Mon, 01 Jan 2024 12:00:00 +0000
+
+test
+`, "\n", "\r\n")
+	prefix := "Received: from remote.example\r\n"
+	received := time.Date(2024, 1, 1, 12, 0, 1, 0, time.UTC)
+
+	f, err := CreateMessageTemp(pkglog, "account-test")
+	tcheck(t, err, "temp file")
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.WriteString(msg)
+	tcheck(t, err, "write message")
+	m := Message{
+		Size:            int64(len(prefix) + len(msg)),
+		MsgPrefix:       []byte(prefix),
+		Received:        received,
+		Flags:           Flags{Seen: true, Flagged: true},
+		Keywords:        []string{"$label1"},
+		MailFrom:        "remote@remote.example",
+		RcptToLocalpart: "mjl",
+		RcptToDomain:    "mox.example",
+	}
+	acc.WithWLock(func() {
+		err = acc.DeliverMailbox(pkglog, "Inbox", &m, f)
+		tcheck(t, err, "deliver")
+	})
+	if !nc.closeStores(ctxbg) {
+		t.Fatalf("stores did not finish")
+	}
+
+	read := func(ri NATSReinject) string {
+		t.Helper()
+		buf, err := io.ReadAll(ri.File)
+		tcheck(t, err, "read message")
+		return string(buf)
+	}
+
+	ri, err := nc.GetMessageForReinject(ctxbg, pkglog, "mjl", m.ID)
+	tcheck(t, err, "get message for reinject")
+	defer CloseRemoveTempFile(pkglog, ri.File, "test")
+	tcompare(t, read(ri), msg)
+	tcompare(t, ri.Size, int64(len(msg)))
+	tcompare(t, ri.Account, "mjl")
+	tcompare(t, ri.MessageID, m.ID)
+	tcompare(t, ri.ObjectName, fos.names()[0])
+	tcompare(t, ri.Local, true)
+	tcompare(t, ri.Received.Equal(received), true)
+	tcompare(t, ri.Flags, Flags{Seen: true, Flagged: true})
+	tcompare(t, ri.Keywords, []string{"$label1"})
+	tcompare(t, ri.Mailbox, "Inbox")
+	tcompare(t, string(ri.MsgPrefix), prefix)
+	tcompare(t, ri.MailFrom, "remote@remote.example")
+	tcompare(t, ri.RcptTo, "mjl@mox.example")
+	tcompare(t, ri.ThreadID, m.ID)
+	tcompare(t, ri.Metadata[natsAccountKey], "mjl")
+	if ri.Envelope == nil {
+		t.Fatalf("missing envelope")
+	}
+	tcompare(t, ri.Envelope.Subject, "reinject test")
+	tcompare(t, ri.Envelope.MessageID, "<reinject@remote.example>")
+	tcompare(t, ri.Envelope.From[0].User+"@"+ri.Envelope.From[0].Host, "remote@remote.example")
+	tcompare(t, ri.Envelope.Date.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)), true)
+
+	// Messages of accounts that are gone only have what was stored in NATS.
+	nc = newTestNATSClient(nil, fos)
+	err = nc.StoreMessage(WithMessageAccount(ctxbg, "gone"), 1000, writeTestMessage(t, msg))
+	tcheck(t, err, "store message")
+	ri, err = nc.GetMessageForReinject(ctxbg, pkglog, "gone", 1000)
+	tcheck(t, err, "get message for reinject")
+	defer CloseRemoveTempFile(pkglog, ri.File, "test")
+	tcompare(t, read(ri), msg)
+	tcompare(t, ri.Local, false)
+	info, err := fos.GetInfo(ctxbg, ri.ObjectName)
+	tcheck(t, err, "get info")
+	tcompare(t, ri.Received, info.ModTime)
+	tcompare(t, ri.Envelope.Subject, "reinject test")
+
+	// Messages of other accounts are not found.
+	_, err = nc.GetMessageForReinject(ctxbg, pkglog, "other", 1000)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound", err)
+	}
+}
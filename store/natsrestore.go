@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxio"
+)
+
+// NATSRestore is the result of RestoreFromNATS.
+type NATSRestore struct {
+	Restored int // Message files written from NATS.
+	Skipped  int // Message files already present and matching.
+	Failed   int
+}
+
+// RestoreFromNATS writes the message files of messages first through last of acc
+// from their newest NATS object, e.g. after losing local storage. A last of 0
+// means all messages from first. Expunged messages are skipped. A message file
+// that is present with the expected size, and, for objects stored without
+// transforms, the digest of the object, is left alone, so restoring again only
+// writes what is missing or damaged. Restored files are verified against the
+// size of the message, and the digest of the object if possible, written to a
+// temporary file and renamed into place. Messages whose object can't be found,
+// e.g. when smaller than MinStoreSize, or that fail otherwise, are counted as
+// failed and returned as a joined error.
+func (nc *NATSClient) RestoreFromNATS(ctx context.Context, log mlog.Log, acc *Account, first, last int64) (NATSRestore, error) {
+	var res NATSRestore
+	if nc == nil {
+		return res, ErrNATSNotConfigured
+	}
+
+	q := bstore.QueryDB[Message](ctx, acc.DB)
+	q.FilterEqual("Expunged", false)
+	q.FilterGreaterEqual("ID", first)
+	if last > 0 {
+		q.FilterLessEqual("ID", last)
+	}
+	q.SortAsc("ID")
+	msgs, err := q.List()
+	if err != nil {
+		return res, fmt.Errorf("listing messages: %w", err)
+	}
+
+	var errs []error
+	for _, m := range msgs {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		var restored bool
+		acc.WithRLock(func() {
+			restored, err = nc.restoreMessage(ctx, log, acc, m)
+		})
+		if err != nil {
+			res.Failed++
+			errs = append(errs, fmt.Errorf("message %d: %w", m.ID, err))
+			log.Errorx("restoring message from nats", err, slog.Int64("message_id", m.ID))
+		} else if restored {
+			res.Restored++
+		} else {
+			res.Skipped++
+		}
+	}
+	log.Info("restored messages from nats",
+		slog.String("account", acc.Name),
+		slog.Int("restored", res.Restored),
+		slog.Int("skipped", res.Skipped),
+		slog.Int("failed", res.Failed))
+	return res, errors.Join(errs...)
+}
+
+// restoreMessage writes the message file of m from NATS, unless it is already
+// present and matches. Returns whether the file was written.
+func (nc *NATSClient) restoreMessage(ctx context.Context, log mlog.Log, acc *Account, m Message) (bool, error) {
+	// Message may have been removed after listing.
+	if err := acc.DB.Get(ctx, &m); err != nil {
+		if errors.Is(err, bstore.ErrAbsent) {
+			return false, nil
+		}
+		return false, fmt.Errorf("get message: %w", err)
+	} else if m.Expunged {
+		return false, nil
+	}
+
+	ctx = WithMessageAccount(ctx, acc.Name)
+	info, err := nc.natsMessageObject(ctx, acc.Name, m.ID)
+	if err != nil {
+		return false, err
+	}
+	size := m.Size - int64(len(m.MsgPrefix))
+	p := acc.MessagePath(m.ID)
+	if ok, err := natsRestoreMatches(p, size, natsRestoreDigest(info)); err != nil {
+		return false, err
+	} else if ok {
+		return false, nil
+	}
+
+	r, info, err := nc.RetrieveMessage(ctx, m.ID)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return false, fmt.Errorf("creating message directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, ".restore-*")
+	if err != nil {
+		return false, fmt.Errorf("creating temporary message file: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			CloseRemoveTempFile(log, f, "restored message")
+		}
+	}()
+	d := newNATSDigestReader(r)
+	if _, err := io.Copy(f, d); err != nil {
+		return false, fmt.Errorf("reading object %q: %w", info.Name, err)
+	}
+	if d.size != size {
+		return false, fmt.Errorf("object %q has %d bytes, message has %d", info.Name, d.size, size)
+	}
+	if digest := natsRestoreDigest(info); digest != "" && d.digest() != digest {
+		return false, fmt.Errorf("%w: object %q has digest %s, expected %s", errNATSDigestMismatch, info.Name, d.digest(), digest)
+	}
+	if err := f.Sync(); err != nil {
+		return false, fmt.Errorf("sync restored message: %w", err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return false, fmt.Errorf("moving restored message into place: %w", err)
+	}
+	err = f.Close()
+	log.Check(err, "closing restored message file")
+	f = nil
+	if err := moxio.SyncDir(log, dir); err != nil {
+		return true, fmt.Errorf("sync message dir: %w", err)
+	}
+	log.Debug("restored message from nats", slog.Int64("message_id", m.ID), slog.String("object_name", info.Name))
+	return true, nil
+}
+
+// natsRestoreDigest returns the digest of info to compare message files with.
+// Digests are over the stored data, so only usable for objects without transforms,
+// compression or encryption.
+func natsRestoreDigest(info *jetstream.ObjectInfo) string {
+	if info.Metadata[natsTransformsKey] != "" || info.Metadata[natsCompressionKey] != "" || info.Metadata[natsEncryptionKey] != "" {
+		return ""
+	}
+	return info.Digest
+}
+
+// natsRestoreMatches returns whether the message file at p is present with size,
+// and, if digest is set, with that digest.
+func natsRestoreMatches(p string, size int64, digest string) (bool, error) {
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("open message file: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat message file: %w", err)
+	}
+	if fi.Size() != size {
+		return false, nil
+	}
+	if digest == "" {
+		return true, nil
+	}
+	d := newNATSDigestReader(f)
+	if _, err := io.Copy(io.Discard, d); err != nil {
+		return false, fmt.Errorf("reading message file: %w", err)
+	}
+	return d.digest() == digest, nil
+}
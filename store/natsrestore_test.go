@@ -0,0 +1,107 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestNATSRestore(t *testing.T) {
+	var nilClient *NATSClient
+	if _, err := nilClient.RestoreFromNATS(ctxbg, pkglog, nil, 1, 0); !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer Switchboard()()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(nil, fos)
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+
+	acc, err := OpenAccount(pkglog, "mjl", true)
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.WaitClosed()
+	}()
+
+	const s = "Subject: test\r\n\r\ntest\r\n"
+	deliver := func() Message {
+		t.Helper()
+		f := writeTestMessage(t, s)
+		m := Message{
+			Size:     int64(len(s)),
+			Received: time.Now(),
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(pkglog, "Inbox", &m, f)
+		})
+		tcheck(t, err, "deliver")
+		return m
+	}
+	m1 := deliver()
+	m2 := deliver()
+	// Wait for the asynchronous stores.
+	for range 100 {
+		if len(fos.names()) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tcompare(t, len(fos.names()), 2)
+
+	restore := func(first, last int64, exp NATSRestore) {
+		t.Helper()
+		res, _ := nc.RestoreFromNATS(ctxbg, pkglog, acc, first, last)
+		tcompare(t, res, exp)
+	}
+
+	// Files that are present and match are left alone.
+	restore(1, 0, NATSRestore{Skipped: 2})
+
+	// Missing and damaged files are written again.
+	err = os.Remove(acc.MessagePath(m1.ID))
+	tcheck(t, err, "remove message file")
+	err = os.WriteFile(acc.MessagePath(m2.ID), []byte("Subject: TEST\r\n\r\ntest\r\n"), 0o660)
+	tcheck(t, err, "damage message file")
+	restore(1, 0, NATSRestore{Restored: 2})
+	for _, m := range []Message{m1, m2} {
+		buf, err := os.ReadFile(acc.MessagePath(m.ID))
+		tcheck(t, err, "read restored message")
+		tcompare(t, string(buf), s)
+	}
+
+	// Restoring is idempotent, and limited to the range.
+	restore(1, 0, NATSRestore{Skipped: 2})
+	err = os.Remove(acc.MessagePath(m2.ID))
+	tcheck(t, err, "remove message file")
+	restore(m1.ID, m1.ID, NATSRestore{Skipped: 1})
+	restore(m2.ID, m2.ID, NATSRestore{Restored: 1})
+
+	// Messages without object fail.
+	for _, n := range fos.names() {
+		delete(fos.objects, n)
+	}
+	err = os.Remove(acc.MessagePath(m1.ID))
+	tcheck(t, err, "remove message file")
+	res, err := nc.RestoreFromNATS(ctxbg, pkglog, acc, 1, 0)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound", err)
+	}
+	tcompare(t, res, NATSRestore{Failed: 2})
+	if _, err := os.Stat(acc.MessagePath(m1.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("message file present after failed restore: %v", err)
+	}
+	err = os.WriteFile(acc.MessagePath(m1.ID), []byte(s), 0o660)
+	tcheck(t, err, "write message file for consistency check")
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+)
+
+var metricNATSRetentionExpired = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "mox_nats_retention_expired_total",
+		Help: "Number of objects removed from the NATS object store because their retention class expired.",
+	},
+)
+
+// Object metadata key holding the retention class of a stored message.
+const natsRetentionClassKey = "retention-class"
+
+type natsRetentionClassKeyType struct{}
+
+// WithNATSRetentionClass returns a context that makes messages stored in NATS
+// with it get retention class class, one of the NATS.RetentionClasses from the
+// config. The class is stored in the object metadata.
+func WithNATSRetentionClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, natsRetentionClassKeyType{}, class)
+}
+
+// natsRetentionClass returns the retention class set on ctx, or the empty string.
+func natsRetentionClass(ctx context.Context) string {
+	class, _ := ctx.Value(natsRetentionClassKeyType{}).(string)
+	return class
+}
+
+// parseNATSRetentionClasses parses the retention classes from cfg. Classes that
+// never expire have duration 0.
+func parseNATSRetentionClasses(cfg *config.NATS) (map[string]time.Duration, error) {
+	m := map[string]time.Duration{}
+	for class, s := range cfg.RetentionClasses {
+		if class == "" {
+			return nil, fmt.Errorf("empty retention class name")
+		}
+		if s == "infinite" {
+			m[class] = 0
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("retention class %q: %w", class, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("retention class %q: duration must be positive, or infinite", class)
+		}
+		m[class] = d
+	}
+	return m, nil
+}
+
+// natsRetentionMaxAge returns the maximum age of buckets for RetentionDays days,
+// 0 for no maximum age.
+func natsRetentionMaxAge(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// checkNATSRetentionDays checks that RetentionDays isn't negative, and doesn't
+// remove objects before their retention class allows.
+func checkNATSRetentionDays(cfg *config.NATS) error {
+	if cfg.RetentionDays < 0 {
+		return fmt.Errorf("retention days must be positive")
+	} else if cfg.RetentionDays == 0 {
+		return nil
+	}
+	classes, err := parseNATSRetentionClasses(cfg)
+	if err != nil {
+		return err
+	}
+	maxAge := natsRetentionMaxAge(cfg.RetentionDays)
+	for class, d := range classes {
+		if d == 0 || d > maxAge {
+			return fmt.Errorf("retention class %q keeps objects longer than RetentionDays allows", class)
+		}
+	}
+	return nil
+}
+
+// UpdateRetention sets the maximum age of the streams of all buckets messages are
+// stored in to days, e.g. after changing RetentionDays, which is only applied to
+// buckets created by mox. Days 0 removes the maximum age. Lowering the retention
+// makes NATS remove objects older than the new maximum age immediately. Buckets
+// opened later, e.g. per account, get the maximum age only when created.
+func (nc *NATSClient) UpdateRetention(ctx context.Context, days int) error {
+	if nc == nil {
+		return ErrNATSNotConfigured
+	} else if days < 0 {
+		return fmt.Errorf("retention days must be positive")
+	}
+
+	maxAge := natsRetentionMaxAge(days)
+	for _, os := range nc.natsBuckets() {
+		var name string
+		if ss, ok := os.(*natsStreamStore); ok {
+			name = natsStreamName(ss.bucket)
+		} else {
+			status, err := os.Status(ctx)
+			if err != nil {
+				return fmt.Errorf("getting bucket status: %w", err)
+			}
+			// Object store buckets are backed by a stream with this name.
+			name = "OBJ_" + status.Bucket()
+		}
+		stream, err := nc.js.Stream(ctx, name)
+		if err != nil {
+			return fmt.Errorf("getting stream %q: %w", name, err)
+		}
+		si, err := stream.Info(ctx)
+		if err != nil {
+			return fmt.Errorf("getting info of stream %q: %w", name, err)
+		}
+		scfg := si.Config
+		if scfg.MaxAge == maxAge {
+			continue
+		}
+		old := scfg.MaxAge
+		scfg.MaxAge = maxAge
+		if _, err := nc.js.UpdateStream(ctx, scfg); err != nil {
+			return fmt.Errorf("updating maximum age of stream %q: %w", name, err)
+		}
+		nc.log.Info("updated retention of nats bucket",
+			slog.String("stream", name),
+			slog.Duration("old_max_age", old),
+			slog.Duration("max_age", maxAge))
+	}
+	return nil
+}
+
+// SweepNATSRetention removes objects whose retention class has expired at now.
+// Objects without retention class, and with a class that never expires, are kept.
+// Objects with a class not in the config are kept and logged. Index rows and
+// stored headers of removed objects are removed too.
+func (nc *NATSClient) SweepNATSRetention(ctx context.Context, now time.Time) (removed int, rerr error) {
+	if nc == nil {
+		return 0, ErrNATSNotConfigured
+	}
+
+	for _, os := range nc.natsBuckets() {
+		infos, err := os.List(ctx)
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			continue
+		} else if err != nil {
+			return removed, fmt.Errorf("listing objects: %w", err)
+		}
+		for _, info := range infos {
+			class := info.Metadata[natsRetentionClassKey]
+			if info.Deleted || class == "" {
+				continue
+			}
+			d, ok := nc.retention[class]
+			if !ok {
+				nc.log.Info("object has unknown retention class, not expiring", slog.String("object_name", info.Name), slog.String("class", class))
+				continue
+			}
+			if d == 0 || now.Before(info.ModTime.Add(d)) {
+				continue
+			}
+
+			if err := os.Delete(ctx, info.Name); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+				return removed, fmt.Errorf("removing expired object %q: %w", info.Name, err)
+			}
+			if err := natsRemoveIndex(ctx, info.Name); err != nil {
+				return removed, err
+			}
+			nc.log.Debug("removed expired object", slog.String("object_name", info.Name), slog.String("class", class))
+			metricNATSRetentionExpired.Inc()
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSRetention(t *testing.T) {
+	openTestAuthDB(t)
+
+	cfg := &config.NATS{
+		BucketName:       "test-bucket",
+		RetentionClasses: map[string]string{"legal-hold": "infinite", "transient": "1h"},
+	}
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(cfg, fos)
+
+	store := func(id int64, class string) string {
+		t.Helper()
+		ctx := ctxbg
+		if class != "" {
+			ctx = WithNATSRetentionClass(ctx, class)
+		}
+		err := nc.StoreMessage(ctx, id, writeTestMessage(t, "test"))
+		tcheck(t, err, "store message")
+		for _, name := range fos.names() {
+			if strings.HasPrefix(name, fmt.Sprintf("msg-%d-", id)) {
+				return name
+			}
+		}
+		t.Fatalf("object for message %d not found", id)
+		return ""
+	}
+	hold := store(1, "legal-hold")
+	transient := store(2, "transient")
+	unknown := store(3, "bogus")
+	none := store(4, "")
+
+	info, err := fos.GetInfo(ctxbg, transient)
+	tcheck(t, err, "get info")
+	tcompare(t, info.Metadata[natsRetentionClassKey], "transient")
+
+	// Nothing expired yet.
+	n, err := nc.SweepNATSRetention(ctxbg, time.Now())
+	tcheck(t, err, "sweep")
+	tcompare(t, n, 0)
+	tcompare(t, len(fos.names()), 4)
+
+	// After the transient period, only the transient object is removed, the others
+	// are kept, including objects with an unknown class.
+	n, err = nc.SweepNATSRetention(ctxbg, time.Now().Add(2*time.Hour))
+	tcheck(t, err, "sweep")
+	tcompare(t, n, 1)
+	tcompare(t, fos.names(), []string{hold, unknown, none})
+
+	// Index row of the removed object is gone.
+	refs, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).List()
+	tcheck(t, err, "list index")
+	tcompare(t, len(refs), 3)
+	for _, ref := range refs {
+		if ref.ObjectName == transient {
+			t.Fatalf("index row for expired object still present")
+		}
+	}
+
+	// Legal holds never expire.
+	n, err = nc.SweepNATSRetention(ctxbg, time.Now().Add(100*365*24*time.Hour))
+	tcheck(t, err, "sweep")
+	tcompare(t, n, 0)
+
+	_, err = parseNATSRetentionClasses(&config.NATS{RetentionClasses: map[string]string{"x": "forever"}})
+	if err == nil {
+		t.Fatalf("expected error for invalid duration")
+	}
+	_, err = parseNATSRetentionClasses(&config.NATS{RetentionClasses: map[string]string{"x": "-1h"}})
+	if err == nil {
+		t.Fatalf("expected error for negative duration")
+	}
+
+	// Retention class is kept when copying an object.
+	_, err = fos.Put(ctxbg, jetstream.ObjectMeta{Name: "x", Metadata: map[string]string{natsRetentionClassKey: "transient"}}, strings.NewReader("x"))
+	tcheck(t, err, "put")
+	err = nc.RenameObject(ctxbg, "x", "y")
+	tcheck(t, err, "rename")
+	info, err = fos.GetInfo(ctxbg, "y")
+	tcheck(t, err, "get info")
+	tcompare(t, info.Metadata[natsRetentionClassKey], "transient")
+}
+
+func TestNATSRetentionDays(t *testing.T) {
+	good := []config.NATS{
+		{},
+		{RetentionDays: 30},
+		{RetentionDays: 30, RetentionClasses: map[string]string{"transient": "24h"}},
+	}
+	for _, cfg := range good {
+		err := checkNATSRetentionDays(&cfg)
+		tcheck(t, err, "check retention days")
+	}
+	bad := []config.NATS{
+		{RetentionDays: -1},
+		{RetentionDays: 30, RetentionClasses: map[string]string{"legal-hold": "infinite"}},
+		{RetentionDays: 1, RetentionClasses: map[string]string{"transient": "48h"}},
+	}
+	for _, cfg := range bad {
+		if err := checkNATSRetentionDays(&cfg); err == nil {
+			t.Fatalf("no error for bad retention config %#v", cfg)
+		}
+	}
+
+	// Buckets and fallback streams created by mox get the maximum age.
+	const month = 30 * 24 * time.Hour
+	cfg := &config.NATS{BucketName: "test-bucket", RetentionDays: 30}
+	js := &fakeJetStream{objectStoreErr: jetstream.ErrBucketNotFound, objectStore: newFakeObjectStore()}
+	_, err := openNATSBucket(ctxbg, pkglog, cfg, js, cfg.BucketName)
+	tcheck(t, err, "open bucket")
+	tcompare(t, js.created.TTL, month)
+
+	cfg.ObjectStoreFallback = "stream"
+	js = &fakeJetStream{objectStoreErr: fmt.Errorf("nats: no responders available for request")}
+	os, err := openNATSBucket(ctxbg, pkglog, cfg, js, cfg.BucketName)
+	tcheck(t, err, "open bucket with fallback")
+	tcompare(t, js.stream.config.MaxAge, month)
+
+	// The retention of existing buckets is updated in their stream.
+	for _, os := range []jetstream.ObjectStore{newFakeObjectStore(), os} {
+		nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket"}, os)
+		js.stream.config = jetstream.StreamConfig{Name: "test", MaxBytes: 1000}
+		nc.js = js
+		err = nc.UpdateRetention(ctxbg, 7)
+		tcheck(t, err, "update retention")
+		tcompare(t, js.stream.config, jetstream.StreamConfig{Name: "test", MaxBytes: 1000, MaxAge: 7 * 24 * time.Hour})
+		err = nc.UpdateRetention(ctxbg, 0)
+		tcheck(t, err, "remove retention")
+		tcompare(t, js.stream.config.MaxAge, time.Duration(0))
+		if err := nc.UpdateRetention(ctxbg, -1); err == nil {
+			t.Fatalf("no error for negative retention")
+		}
+	}
+	var nilClient *NATSClient
+	if err := nilClient.UpdateRetention(ctxbg, 1); !errors.Is(err, ErrNATSNotConfigured) {
+		t.Fatalf("got err %v, expected ErrNATSNotConfigured", err)
+	}
+}
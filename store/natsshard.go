@@ -0,0 +1,207 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/config"
+)
+
+var metricNATSBucketStores = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_nats_bucket_stores_total",
+		Help: "Number of messages stored in the NATS object store, per bucket.",
+	},
+	[]string{"bucket"},
+)
+
+// NATSKeyDerivation maps object names to one of the buckets it was created for.
+// Stores and reads of an object both use the derivation, so it must be
+// deterministic.
+type NATSKeyDerivation interface {
+	Bucket(objectName string) string
+}
+
+// NATSKeyDerivationFunc creates a key derivation for buckets. The first bucket is
+// BucketName, followed by the ShardBuckets.
+type NATSKeyDerivationFunc func(buckets []string) (NATSKeyDerivation, error)
+
+var natsKeyDerivations = map[string]NATSKeyDerivationFunc{
+	"single": func(buckets []string) (NATSKeyDerivation, error) {
+		if len(buckets) != 1 {
+			return nil, fmt.Errorf("key derivation single requires a single bucket, got %d", len(buckets))
+		}
+		return natsSingleBucket(buckets[0]), nil
+	},
+	"consistent-hash": func(buckets []string) (NATSKeyDerivation, error) {
+		return newNATSHashRing(buckets), nil
+	},
+}
+
+// RegisterNATSKeyDerivation adds a key derivation that can be selected with
+// NATS.KeyDerivation in the config. Must be called before InitNATS.
+func RegisterNATSKeyDerivation(name string, fn NATSKeyDerivationFunc) {
+	natsKeyDerivations[name] = fn
+}
+
+type natsSingleBucket string
+
+func (b natsSingleBucket) Bucket(objectName string) string {
+	return string(b)
+}
+
+// Number of points on the hash ring per bucket. More points give a more even
+// distribution.
+const natsHashRingPoints = 160
+
+// natsHashRing is a consistent hash over buckets. Adding a bucket only moves
+// objects to the new bucket, about 1/n of all objects with n buckets.
+type natsHashRing struct {
+	points  []uint64 // Sorted.
+	buckets []string // For each point.
+}
+
+func newNATSHashRing(buckets []string) *natsHashRing {
+	type point struct {
+		hash   uint64
+		bucket string
+	}
+	var l []point
+	for _, b := range buckets {
+		for i := range natsHashRingPoints {
+			l = append(l, point{natsHash(b + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].hash != l[j].hash {
+			return l[i].hash < l[j].hash
+		}
+		return l[i].bucket < l[j].bucket
+	})
+	r := &natsHashRing{}
+	for _, p := range l {
+		r.points = append(r.points, p.hash)
+		r.buckets = append(r.buckets, p.bucket)
+	}
+	return r
+}
+
+func natsHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Bucket returns the bucket of the first point on the ring at or after the hash of
+// objectName.
+func (r *natsHashRing) Bucket(objectName string) string {
+	h := natsHash(objectName)
+	i, _ := slices.BinarySearch(r.points, h)
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.buckets[i]
+}
+
+// natsShards holds the buckets of a client with a key derivation.
+type natsShards struct {
+	keys    NATSKeyDerivation
+	buckets []string // BucketName first.
+	stores  map[string]jetstream.ObjectStore
+}
+
+// natsShardBuckets returns all buckets objects are stored in, BucketName first.
+func natsShardBuckets(cfg *config.NATS) []string {
+	return append([]string{cfg.BucketName}, cfg.ShardBuckets...)
+}
+
+// newNATSShards returns the shards for cfg, or nil if no key derivation is
+// configured. Stores must have an object store for each bucket.
+func newNATSShards(cfg *config.NATS, stores map[string]jetstream.ObjectStore) (*natsShards, error) {
+	name := cfg.KeyDerivation
+	if name == "" {
+		if len(cfg.ShardBuckets) == 0 {
+			return nil, nil
+		}
+		name = "consistent-hash"
+	}
+	fn, ok := natsKeyDerivations[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown key derivation %q", name)
+	}
+	buckets := natsShardBuckets(cfg)
+	keys, err := fn(buckets)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation %q: %w", name, err)
+	}
+	for _, b := range buckets {
+		if stores[b] == nil {
+			return nil, fmt.Errorf("missing object store for bucket %q", b)
+		}
+	}
+	return &natsShards{keys, buckets, stores}, nil
+}
+
+// bucketFor returns the object store an object with name is stored in.
+func (nc *NATSClient) bucketFor(name string) jetstream.ObjectStore {
+	if nc.shards == nil {
+		return nc.os
+	}
+	b := nc.shards.keys.Bucket(name)
+	if os, ok := nc.shards.stores[b]; ok {
+		return os
+	}
+	// Misbehaving key derivation, keep everything in one place.
+	nc.log.Error("key derivation returned unknown bucket, using default bucket", slog.String("bucket", b), slog.String("object_name", name))
+	return nc.os
+}
+
+// natsBuckets returns the object stores of all buckets messages are stored in.
+func (nc *NATSClient) natsBuckets() []jetstream.ObjectStore {
+	if nc.shards == nil {
+		return append([]jetstream.ObjectStore{nc.os}, nc.openedAccountBuckets()...)
+	}
+	var l []jetstream.ObjectStore
+	for _, b := range nc.shards.buckets {
+		l = append(l, nc.shards.stores[b])
+	}
+	return l
+}
+
+// NATSBucketStats are the statistics of one bucket.
+type NATSBucketStats struct {
+	Bucket   string
+	Capacity BucketCapacity
+}
+
+// BucketStats returns the statistics of all buckets messages are stored in,
+// BucketName first.
+func (nc *NATSClient) BucketStats(ctx context.Context) ([]NATSBucketStats, error) {
+	if nc == nil {
+		return nil, ErrNATSNotConfigured
+	}
+	buckets := []string{nc.config.BucketName}
+	stores := map[string]jetstream.ObjectStore{nc.config.BucketName: nc.os}
+	if nc.shards != nil {
+		buckets = nc.shards.buckets
+		stores = nc.shards.stores
+	}
+	var l []NATSBucketStats
+	for _, b := range buckets {
+		c, err := bucketCapacity(ctx, stores[b])
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q: %w", b, err)
+		}
+		l = append(l, NATSBucketStats{b, c})
+	}
+	return l, nil
+}
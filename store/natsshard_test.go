@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSHashRing(t *testing.T) {
+	const n = 30000
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("msg-%d-1791980000", i+1)
+	}
+
+	ring := newNATSHashRing([]string{"b0", "b1", "b2"})
+	counts := map[string]int{}
+	before := map[string]string{}
+	for _, name := range names {
+		b := ring.Bucket(name)
+		counts[b]++
+		before[name] = b
+	}
+	tcompare(t, len(counts), 3)
+	for b, c := range counts {
+		if c < n/3*80/100 || c > n/3*120/100 {
+			t.Fatalf("bucket %s has %d of %d objects, expected about %d", b, c, n, n/3)
+		}
+	}
+
+	// Derivation is deterministic, also for a ring created with buckets in another order.
+	ring2 := newNATSHashRing([]string{"b2", "b0", "b1"})
+	for _, name := range names[:1000] {
+		tcompare(t, ring2.Bucket(name), before[name])
+	}
+
+	// Adding a bucket only moves objects to the new bucket, about 1/4 of them.
+	ring = newNATSHashRing([]string{"b0", "b1", "b2", "b3"})
+	var moved int
+	for _, name := range names {
+		b := ring.Bucket(name)
+		if b == before[name] {
+			continue
+		}
+		if b != "b3" {
+			t.Fatalf("object %s moved from %s to %s, not to new bucket", name, before[name], b)
+		}
+		moved++
+	}
+	if moved < n/4*80/100 || moved > n/4*120/100 {
+		t.Fatalf("%d of %d objects moved after adding bucket, expected about %d", moved, n, n/4)
+	}
+}
+
+func TestNATSShards(t *testing.T) {
+	cfg := &config.NATS{BucketName: "b0", ShardBuckets: []string{"b1", "b2"}}
+	stores := map[string]jetstream.ObjectStore{}
+	fakes := map[string]*fakeObjectStore{}
+	for _, b := range natsShardBuckets(cfg) {
+		fos := newFakeObjectStore()
+		fos.bucket = b
+		fakes[b] = fos
+		stores[b] = fos
+	}
+	nc := newTestNATSClient(cfg, stores["b0"])
+	var err error
+	nc.shards, err = newNATSShards(cfg, stores)
+	tcheck(t, err, "new shards")
+
+	for id := int64(1); id <= 30; id++ {
+		err := nc.StoreMessage(ctxbg, id, writeTestMessage(t, fmt.Sprintf("message %d", id)))
+		tcheck(t, err, "store message")
+	}
+
+	// Each object is in the bucket of its derived key, and reads use the same bucket.
+	var total int
+	for b, fos := range fakes {
+		names := fos.names()
+		if len(names) == 0 {
+			t.Fatalf("no objects in bucket %s", b)
+		}
+		for _, name := range names {
+			tcompare(t, nc.shards.keys.Bucket(name), b)
+			r, err := nc.getObject(ctxbg, name)
+			tcheck(t, err, "get object")
+			_, err = io.ReadAll(r)
+			tcheck(t, err, "read object")
+			r.Close()
+		}
+		total += len(names)
+	}
+	tcompare(t, total, 30)
+
+	stats, err := nc.BucketStats(ctxbg)
+	tcheck(t, err, "bucket stats")
+	tcompare(t, len(stats), 3)
+	for i, b := range natsShardBuckets(cfg) {
+		tcompare(t, stats[i].Bucket, b)
+		var size uint64
+		for _, name := range fakes[b].names() {
+			size += fakes[b].objects[name].info.Size
+		}
+		tcompare(t, stats[i].Capacity.Used, size)
+	}
+
+	_, err = newNATSShards(&config.NATS{BucketName: "b0", KeyDerivation: "bogus"}, stores)
+	if err == nil {
+		t.Fatalf("expected error for unknown key derivation")
+	}
+	_, err = newNATSShards(&config.NATS{BucketName: "b0", ShardBuckets: []string{"b1"}, KeyDerivation: "single"}, stores)
+	if err == nil {
+		t.Fatalf("expected error for single key derivation with multiple buckets")
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// Object metadata key holding the HMAC-SHA256 signature of the object name, size,
+// digest and other metadata, with MetadataKeyFile.
+const natsSignatureKey = "signature"
+
+// Metadata keys not covered by the signature: the signature itself, and keys mox
+// changes after storing.
+var natsUnsignedKeys = []string{natsSignatureKey, natsDeletedAtKey}
+
+// ErrNATSMetadataTampered is returned when reading an object whose metadata
+// signature is missing or doesn't match, with MetadataKeyFile.
+var ErrNATSMetadataTampered = errors.New("nats object metadata signature invalid")
+
+// readNATSMetadataKey returns the key for signing object metadata, nil if not
+// configured.
+func readNATSMetadataKey(cfg *config.NATS) ([]byte, error) {
+	if cfg.MetadataKeyFile == "" {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(cfg.MetadataKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata key file: %w", err)
+	}
+	key := bytes.TrimSpace(buf)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("metadata key in %s must be at least 16 bytes", cfg.MetadataKeyFile)
+	}
+	return key, nil
+}
+
+// natsMetadataSignature returns the signature of object info with key. Each field
+// is length-prefixed, so values can't be shifted between fields.
+func natsMetadataSignature(key []byte, info *jetstream.ObjectInfo) string {
+	mac := hmac.New(sha256.New, key)
+	field := func(s string) {
+		fmt.Fprintf(mac, "%d:%s", len(s), s)
+	}
+	field(info.Name)
+	field(fmt.Sprint(info.Size))
+	field(info.Digest)
+	for _, k := range slices.Sorted(maps.Keys(info.Metadata)) {
+		if !slices.Contains(natsUnsignedKeys, k) {
+			field(k)
+			field(info.Metadata[k])
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signObject adds the metadata signature to object info just stored in os, if
+// MetadataKeyFile is configured. The digest is only known after the put, so the
+// signature is added with a metadata update. Returns the metadata of the object.
+func (nc *NATSClient) signObject(ctx context.Context, os jetstream.ObjectStore, info *jetstream.ObjectInfo) (jetstream.ObjectMeta, error) {
+	meta := info.ObjectMeta
+	meta.Opts = nil
+	if nc.metadataKey == nil {
+		return meta, nil
+	}
+	meta.Metadata = maps.Clone(meta.Metadata)
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]string{}
+	}
+	meta.Metadata[natsSignatureKey] = natsMetadataSignature(nc.metadataKey, info)
+	if err := os.UpdateMeta(ctx, info.Name, meta); err != nil {
+		return meta, fmt.Errorf("adding metadata signature to object %q: %w", info.Name, err)
+	}
+	info.Metadata = meta.Metadata
+	return meta, nil
+}
+
+// verifyObject checks the metadata signature of object info, if MetadataKeyFile
+// is configured. Objects without signature fail too, otherwise removing the
+// signature would hide tampering.
+func (nc *NATSClient) verifyObject(info *jetstream.ObjectInfo) error {
+	if nc.metadataKey == nil {
+		return nil
+	}
+	sig := info.Metadata[natsSignatureKey]
+	if sig == "" {
+		return fmt.Errorf("%w: object %q not signed", ErrNATSMetadataTampered, info.Name)
+	}
+	exp := natsMetadataSignature(nc.metadataKey, info)
+	if !hmac.Equal([]byte(sig), []byte(exp)) {
+		return fmt.Errorf("%w: object %q", ErrNATSMetadataTampered, info.Name)
+	}
+	return nil
+}
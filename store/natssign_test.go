@@ -0,0 +1,109 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSMetadataSignature(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "metadata.key")
+	err := os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o600)
+	tcheck(t, err, "write key file")
+
+	cfg := &config.NATS{BucketName: "test-bucket", MetadataKeyFile: keyFile, SoftDeleteRetention: time.Hour}
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(cfg, fos)
+
+	err = nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	name := fos.names()[0]
+	info, err := fos.GetInfo(ctxbg, name)
+	tcheck(t, err, "get info")
+	if info.Metadata[natsSignatureKey] == "" {
+		t.Fatalf("stored object not signed")
+	}
+
+	read := func() error {
+		t.Helper()
+		r, err := nc.getObject(ctxbg, name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read object")
+		tcompare(t, string(buf), "test")
+		return nil
+	}
+	err = read()
+	tcheck(t, err, "read signed object")
+
+	// Soft-delete changes metadata that isn't signed.
+	err = nc.removeObject(ctxbg, fos, name)
+	tcheck(t, err, "soft-delete")
+	_, err = nc.UndeleteMessage(ctxbg, 1)
+	tcheck(t, err, "undelete")
+	err = read()
+	tcheck(t, err, "read undeleted object")
+
+	// Renaming signs the new name.
+	err = nc.RenameObject(ctxbg, name, "msg-1-renamed")
+	tcheck(t, err, "rename")
+	name = "msg-1-renamed"
+	err = read()
+	tcheck(t, err, "read renamed object")
+
+	tamper := func(fn func(o *fakeObject)) {
+		t.Helper()
+		fos.Lock()
+		defer fos.Unlock()
+		o := fos.objects[name]
+		o.info.Metadata = map[string]string{}
+		for k, v := range fos.objects[name].info.Metadata {
+			o.info.Metadata[k] = v
+		}
+		fn(&o)
+		fos.objects[name] = o
+	}
+	expectTampered := func() {
+		t.Helper()
+		if err := read(); !errors.Is(err, ErrNATSMetadataTampered) {
+			t.Fatalf("got err %v, expected ErrNATSMetadataTampered", err)
+		}
+	}
+
+	orig := fos.objects[name]
+
+	// Changed metadata.
+	tamper(func(o *fakeObject) { o.info.Metadata[natsRetentionClassKey] = "transient" })
+	expectTampered()
+
+	// Changed digest.
+	fos.objects[name] = orig
+	tamper(func(o *fakeObject) { o.info.Digest = "SHA-256=bogus" })
+	expectTampered()
+
+	// Removed signature.
+	fos.objects[name] = orig
+	tamper(func(o *fakeObject) { delete(o.info.Metadata, natsSignatureKey) })
+	expectTampered()
+
+	// Object of another message under this name.
+	fos.objects[name] = orig
+	tamper(func(o *fakeObject) { o.info.Name = "msg-2-renamed" })
+	expectTampered()
+
+	// A key that is too short is rejected.
+	err = os.WriteFile(keyFile, []byte("short"), 0o600)
+	tcheck(t, err, "write key file")
+	_, err = readNATSMetadataKey(cfg)
+	if err == nil {
+		t.Fatalf("short key accepted")
+	}
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+
+	"github.com/mjl-/bstore"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricNATSSoftDeleted = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_nats_soft_deleted_total",
+		Help: "Number of soft-deleted objects in the NATS object store, by action: deleted, undeleted or purged.",
+	},
+	[]string{"action"},
+)
+
+// Object metadata key holding the time an object was soft-deleted, in RFC 3339
+// format. Soft-deleted objects are not returned by reads.
+const natsDeletedAtKey = "deleted-at"
+
+// natsDeletedAt returns when the object was soft-deleted, if it was.
+func natsDeletedAt(info *jetstream.ObjectInfo) (time.Time, bool) {
+	s := info.Metadata[natsDeletedAtKey]
+	if s == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+// removeObject removes object name. With SoftDeleteRetention, the object is only
+// marked as deleted, and can be recovered with UndeleteMessage until the retention
+// passes. Otherwise the object, its index rows and stored headers are removed.
+func (nc *NATSClient) removeObject(ctx context.Context, os jetstream.ObjectStore, name string) error {
+	if nc.config.SoftDeleteRetention > 0 {
+		return nc.softDeleteObject(ctx, os, name)
+	}
+	if err := os.Delete(ctx, name); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return fmt.Errorf("removing object %q: %w", name, err)
+	}
+	return natsRemoveIndex(ctx, name)
+}
+
+// softDeleteObject marks object name as deleted in its metadata, and its index
+// row as deleted.
+func (nc *NATSClient) softDeleteObject(ctx context.Context, os jetstream.ObjectStore, name string) error {
+	info, err := os.GetInfo(ctx, name)
+	if err != nil {
+		return fmt.Errorf("getting info for object %q: %w", name, natsObjectError(err))
+	}
+	if _, ok := natsDeletedAt(info); ok {
+		return nil
+	}
+	meta := info.ObjectMeta
+	meta.Opts = nil
+	meta.Metadata = maps.Clone(meta.Metadata)
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]string{}
+	}
+	meta.Metadata[natsDeletedAtKey] = time.Now().UTC().Format(time.RFC3339)
+	if err := os.UpdateMeta(ctx, name, meta); err != nil {
+		return fmt.Errorf("marking object %q as deleted: %w", name, err)
+	}
+	if err := natsSetIndexState(ctx, name, NATSObjectDeleted); err != nil {
+		return err
+	}
+	metricNATSSoftDeleted.WithLabelValues("deleted").Inc()
+	nc.log.Debug("soft-deleted object", slog.String("object_name", name))
+	return nil
+}
+
+// natsSetIndexState sets the state of the index row of an object, if auth.db is
+// open.
+func natsSetIndexState(ctx context.Context, objectName string, state NATSObjectState) error {
+	if AuthDB == nil {
+		return nil
+	}
+	q := bstore.QueryDB[NATSObjectRef](ctx, AuthDB)
+	q.FilterNonzero(NATSObjectRef{ObjectName: objectName})
+	if _, err := q.UpdateNonzero(NATSObjectRef{State: state}); err != nil {
+		return fmt.Errorf("updating nats object index row: %w", err)
+	}
+	return nil
+}
+
+// UndeleteMessage recovers the soft-deleted objects of message messageID that are
+// still within SoftDeleteRetention, making them readable again. Returns the
+// number of objects recovered, or an ErrMessageNotFound error if there were none.
+func (nc *NATSClient) UndeleteMessage(ctx context.Context, messageID int64) (int, error) {
+	if nc == nil {
+		return 0, ErrNATSNotConfigured
+	}
+	if nc.config.SoftDeleteRetention <= 0 {
+		return 0, fmt.Errorf("soft-delete not enabled, SoftDeleteRetention not set")
+	}
+
+	var n int
+	err := nc.forSoftDeleted(ctx, func(os jetstream.ObjectStore, info *jetstream.ObjectInfo, deletedAt time.Time) error {
+		if id, ok := natsMessageIDFromObject(info.Name); !ok || id != messageID {
+			return nil
+		}
+		if time.Since(deletedAt) >= nc.config.SoftDeleteRetention {
+			return nil // About to be purged.
+		}
+		meta := info.ObjectMeta
+		meta.Opts = nil
+		meta.Metadata = maps.Clone(meta.Metadata)
+		delete(meta.Metadata, natsDeletedAtKey)
+		if err := os.UpdateMeta(ctx, info.Name, meta); err != nil {
+			return fmt.Errorf("undeleting object %q: %w", info.Name, err)
+		}
+		if err := natsSetIndexState(ctx, info.Name, NATSObjectStored); err != nil {
+			return err
+		}
+		metricNATSSoftDeleted.WithLabelValues("undeleted").Inc()
+		nc.log.Info("undeleted object", slog.String("object_name", info.Name), slog.Int64("message_id", messageID))
+		n++
+		return nil
+	})
+	if err == nil && n == 0 {
+		err = fmt.Errorf("%w: no soft-deleted objects for message %d", ErrMessageNotFound, messageID)
+	}
+	return n, err
+}
+
+// SweepNATSSoftDeleted permanently removes objects that were soft-deleted longer
+// than SoftDeleteRetention before now, with their index rows and stored headers.
+func (nc *NATSClient) SweepNATSSoftDeleted(ctx context.Context, now time.Time) (int, error) {
+	if nc == nil {
+		return 0, ErrNATSNotConfigured
+	}
+
+	var purged int
+	err := nc.forSoftDeleted(ctx, func(os jetstream.ObjectStore, info *jetstream.ObjectInfo, deletedAt time.Time) error {
+		if now.Sub(deletedAt) < nc.config.SoftDeleteRetention {
+			return nil
+		}
+		if err := os.Delete(ctx, info.Name); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return fmt.Errorf("purging soft-deleted object %q: %w", info.Name, err)
+		}
+		if err := natsRemoveIndex(ctx, info.Name); err != nil {
+			return err
+		}
+		metricNATSSoftDeleted.WithLabelValues("purged").Inc()
+		nc.log.Debug("purged soft-deleted object", slog.String("object_name", info.Name))
+		purged++
+		return nil
+	})
+	return purged, err
+}
+
+// forSoftDeleted calls fn for each soft-deleted object in the buckets.
+func (nc *NATSClient) forSoftDeleted(ctx context.Context, fn func(os jetstream.ObjectStore, info *jetstream.ObjectInfo, deletedAt time.Time) error) error {
+	for _, os := range nc.natsBuckets() {
+		infos, err := os.List(ctx)
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("listing objects: %w", err)
+		}
+		for _, info := range infos {
+			deletedAt, ok := natsDeletedAt(info)
+			if info.Deleted || !ok {
+				continue
+			}
+			if err := fn(os, info, deletedAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
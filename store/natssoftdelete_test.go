@@ -0,0 +1,92 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSSoftDelete(t *testing.T) {
+	openTestAuthDB(t)
+
+	cfg := &config.NATS{BucketName: "test-bucket", SoftDeleteRetention: 24 * time.Hour}
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(cfg, fos)
+
+	store := func(id int64) string {
+		t.Helper()
+		err := nc.StoreMessage(ctxbg, id, writeTestMessage(t, "test"))
+		tcheck(t, err, "store message")
+		for _, name := range fos.names() {
+			if strings.HasPrefix(name, fmt.Sprintf("msg-%d-", id)) {
+				return name
+			}
+		}
+		t.Fatalf("object for message %d not found", id)
+		return ""
+	}
+	name1 := store(1)
+	name2 := store(2)
+
+	indexState := func(name string) NATSObjectState {
+		t.Helper()
+		ref, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).FilterNonzero(NATSObjectRef{ObjectName: name}).Get()
+		tcheck(t, err, "get index row")
+		return ref.State
+	}
+
+	// Soft-deleted objects stay in the bucket, but can't be read.
+	err := nc.removeObject(ctxbg, fos, name1)
+	tcheck(t, err, "remove object")
+	tcompare(t, fos.names(), []string{name1, name2})
+	tcompare(t, indexState(name1), NATSObjectDeleted)
+	_, err = nc.getObject(ctxbg, name1)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound for soft-deleted object", err)
+	}
+
+	// Undelete makes it readable again.
+	n, err := nc.UndeleteMessage(ctxbg, 1)
+	tcheck(t, err, "undelete")
+	tcompare(t, n, 1)
+	tcompare(t, indexState(name1), NATSObjectStored)
+	r, err := nc.getObject(ctxbg, name1)
+	tcheck(t, err, "get undeleted object")
+	r.Close()
+
+	_, err = nc.UndeleteMessage(ctxbg, 1)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound for message that isn't soft-deleted", err)
+	}
+
+	// Soft-deleted objects are only purged after the retention.
+	err = nc.removeObject(ctxbg, fos, name2)
+	tcheck(t, err, "remove object")
+	n, err = nc.SweepNATSSoftDeleted(ctxbg, time.Now())
+	tcheck(t, err, "sweep")
+	tcompare(t, n, 0)
+	n, err = nc.SweepNATSSoftDeleted(ctxbg, time.Now().Add(25*time.Hour))
+	tcheck(t, err, "sweep")
+	tcompare(t, n, 1)
+	tcompare(t, fos.names(), []string{name1})
+	exists, err := bstore.QueryDB[NATSObjectRef](ctxbg, AuthDB).FilterNonzero(NATSObjectRef{ObjectName: name2}).Exists()
+	tcheck(t, err, "check index")
+	tcompare(t, exists, false)
+
+	_, err = nc.UndeleteMessage(ctxbg, 2)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("got err %v, expected ErrMessageNotFound for purged message", err)
+	}
+
+	// Without retention, objects are removed immediately.
+	nc.config.SoftDeleteRetention = 0
+	err = nc.removeObject(ctxbg, fos, name1)
+	tcheck(t, err, "remove object")
+	tcompare(t, len(fos.names()), 0)
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// natsStages times the stages of a store, for logging a breakdown of slow stores.
+// It doesn't allocate, so timing every store is cheap.
+type natsStages struct {
+	start time.Time
+	last  time.Time
+	n     int
+	names [12]string
+	durs  [12]time.Duration
+}
+
+func newNATSStages(start time.Time) natsStages {
+	return natsStages{start: start, last: start}
+}
+
+// done marks the end of stage name, which started at the end of the previous
+// stage.
+func (s *natsStages) done(name string) {
+	now := time.Now()
+	if s.n < len(s.names) {
+		s.names[s.n] = name
+		s.durs[s.n] = now.Sub(s.last)
+		s.n++
+	}
+	s.last = now
+}
+
+// logSlow logs the stages if the store took at least threshold, with an attribute
+// per stage.
+func (s *natsStages) logSlow(log mlog.Log, threshold time.Duration, attrs ...slog.Attr) {
+	total := s.last.Sub(s.start)
+	if total < threshold {
+		return
+	}
+	attrs = append(attrs, slog.Duration("total", total))
+	for i := range s.n {
+		attrs = append(attrs, slog.Duration("stage_"+s.names[i], s.durs[i]))
+	}
+	log.Info("slow store to NATS", attrs...)
+}
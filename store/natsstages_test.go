@@ -0,0 +1,53 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+)
+
+func TestNATSSlowStoreStages(t *testing.T) {
+	var buf bytes.Buffer
+	log := mlog.New("store", slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", SlowStoreThreshold: 10 * time.Millisecond}, fos)
+	nc.log = log
+
+	// Fast stores are not logged.
+	err := nc.StoreMessage(ctxbg, 1, writeTestMessage(t, "test message"))
+	tcheck(t, err, "store message")
+	tcompare(t, buf.Len(), 0)
+
+	// A slow put is logged with the time per stage, and the put stage accounts for
+	// most of it.
+	fos.putHook = func(meta jetstream.ObjectMeta) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	err = nc.StoreMessage(ctxbg, 2, writeTestMessage(t, "test message"))
+	tcheck(t, err, "store message")
+
+	var record map[string]any
+	err = json.Unmarshal(buf.Bytes(), &record)
+	tcheck(t, err, "parse log record")
+	tcompare(t, record["msg"], "slow store to NATS")
+	tcompare(t, record["message_id"], float64(2))
+	for _, k := range []string{"total", "stage_wait", "stage_index_pending", "stage_put", "stage_index_stored", "stage_dual_write", "stage_headers"} {
+		if _, ok := record[k]; !ok {
+			t.Fatalf("missing attribute %q in log record %v", k, record)
+		}
+	}
+	// Durations are logged as nanoseconds.
+	put := time.Duration(record["stage_put"].(float64))
+	if put < 20*time.Millisecond || put > time.Duration(record["total"].(float64)) {
+		t.Fatalf("put stage %v, expected at least 20ms and at most total %v", put, record["total"])
+	}
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrNATSReadStalled is returned when reading an object from NATS doesn't make
+// progress for longer than the read idle timeout.
+var ErrNATSReadStalled = errors.New("reading from nats object store stalled")
+
+// readIdleTimeout returns the maximum time a read of an object may go without
+// receiving data.
+func (nc *NATSClient) readIdleTimeout() time.Duration {
+	if nc.config.ReadIdleTimeout > 0 {
+		return nc.config.ReadIdleTimeout
+	}
+	return 30 * time.Second
+}
+
+// natsStallReader wraps an object being read, failing reads with
+// ErrNATSReadStalled when no data arrives within the idle timeout. Unlike the
+// deadline of the context, which limits the entire read, this allows large
+// objects to take long as long as data keeps arriving. After a stall, cancel is
+// called to abort the underlying read, and all further reads fail.
+type natsStallReader struct {
+	jetstream.ObjectResult
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	buf []byte // For reads by the goroutine, so p is never written after Read returns.
+	err error
+}
+
+type natsReadResult struct {
+	n   int
+	err error
+}
+
+func newNATSStallReader(r jetstream.ObjectResult, timeout time.Duration, cancel context.CancelFunc) *natsStallReader {
+	return &natsStallReader{ObjectResult: r, timeout: timeout, cancel: cancel}
+}
+
+func (s *natsStallReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if len(s.buf) < len(p) {
+		s.buf = make([]byte, len(p))
+	}
+	buf := s.buf[:len(p)]
+	ch := make(chan natsReadResult, 1)
+	go func() {
+		// The object store returns empty reads while waiting for data, they don't count
+		// as progress.
+		for {
+			n, err := s.ObjectResult.Read(buf)
+			if n > 0 || err != nil {
+				ch <- natsReadResult{n, err}
+				return
+			}
+		}
+	}()
+
+	t := time.NewTimer(s.timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		n := copy(p, buf[:r.n])
+		return n, r.err
+	case <-t.C:
+		s.err = fmt.Errorf("%w: no data for %s", ErrNATSReadStalled, s.timeout)
+		// The goroutine still owns buf, don't reuse it.
+		s.buf = nil
+		s.cancel()
+		return 0, s.err
+	}
+}
+
+func (s *natsStallReader) Close() error {
+	s.cancel()
+	if errors.Is(s.err, ErrNATSReadStalled) {
+		// Close waits for the stalled read to finish, don't block the caller.
+		go s.ObjectResult.Close()
+		return nil
+	}
+	return s.ObjectResult.Close()
+}
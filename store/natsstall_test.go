@@ -0,0 +1,76 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// stallReader returns data in small chunks, sleeping delay before each, and
+// blocks after stallAfter bytes until unblock is closed.
+type stallReader struct {
+	r          io.Reader
+	delay      time.Duration
+	stallAfter int
+	read       int
+	unblock    chan struct{}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if s.stallAfter > 0 && s.read >= s.stallAfter {
+		<-s.unblock
+	}
+	time.Sleep(s.delay)
+	n, err := s.r.Read(p[:min(len(p), 10)])
+	s.read += n
+	return n, err
+}
+
+func TestNATSReadIdleTimeout(t *testing.T) {
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", ReadIdleTimeout: 50 * time.Millisecond}, fos)
+	data := strings.Repeat("0123456789", 10)
+	_, err := fos.Put(ctxbg, jetstream.ObjectMeta{Name: "msg-1-1"}, strings.NewReader(data))
+	tcheck(t, err, "put")
+
+	// A slow read that keeps making progress takes longer than the idle timeout in
+	// total, but succeeds.
+	fos.getWrap = func(r io.Reader) io.Reader { return &stallReader{r: r, delay: 10 * time.Millisecond} }
+	r, err := nc.getObject(ctxbg, "msg-1-1")
+	tcheck(t, err, "get")
+	t0 := time.Now()
+	buf, err := io.ReadAll(r)
+	tcheck(t, err, "read slow object")
+	tcompare(t, string(buf), data)
+	if time.Since(t0) < 50*time.Millisecond {
+		t.Fatalf("read took %v, expected longer than idle timeout", time.Since(t0))
+	}
+	r.Close()
+
+	// A read that stops making progress fails once the idle timeout passes.
+	unblock := make(chan struct{})
+	defer close(unblock)
+	fos.getWrap = func(r io.Reader) io.Reader { return &stallReader{r: r, stallAfter: 30, unblock: unblock} }
+	r, err = nc.getObject(ctxbg, "msg-1-1")
+	tcheck(t, err, "get")
+	t0 = time.Now()
+	buf, err = io.ReadAll(r)
+	if !errors.Is(err, ErrNATSReadStalled) {
+		t.Fatalf("got err %v, expected ErrNATSReadStalled", err)
+	}
+	tcompare(t, len(buf), 30)
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("stalled read took %v, expected idle timeout to fire quickly", d)
+	}
+	// Further reads fail, and closing doesn't block.
+	_, err = r.Read(make([]byte, 1))
+	tcompare(t, errors.Is(err, ErrNATSReadStalled), true)
+	err = r.Close()
+	tcheck(t, err, "close")
+}
@@ -0,0 +1,425 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Size of the chunks published for objects in a fallback stream, as the object
+// store does.
+const natsStreamChunkSize = 128 * 1024
+
+// errNATSStreamUnsupported is returned for object store operations not available
+// in the fallback stream.
+var errNATSStreamUnsupported = errors.New("not supported by nats fallback stream storage")
+
+// natsPublisher publishes messages to a stream, implemented by jetstream.JetStream.
+type natsPublisher interface {
+	Publish(ctx context.Context, subject string, payload []byte, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error)
+}
+
+// natsStreamStore is a jetstream.ObjectStore on a plain JetStream stream, for
+// ObjectStoreFallback "stream", when the object store API isn't available. Data
+// of an object is published as chunks, followed by a message with the object info
+// and the sequence numbers of the chunks, on a subject per object name. Replacing,
+// updating and deleting objects isn't atomic like with the object store, and
+// watching, links and sealing aren't supported.
+type natsStreamStore struct {
+	bucket string
+	prefix string // Subject prefix, "moxblob.<bucket>".
+	pub    natsPublisher
+	stream jetstream.Stream
+}
+
+// natsStreamObject is the message with the object info of an object.
+type natsStreamObject struct {
+	Info   jetstream.ObjectInfo
+	Chunks []uint64 // Stream sequence numbers of the chunks with the data.
+}
+
+// natsStreamName returns the name of the fallback stream for bucket.
+func natsStreamName(bucket string) string {
+	return "MOXBLOB_" + bucket
+}
+
+// openNATSStreamStore returns the fallback store for bucket. If create is set, the
+// stream is created if it doesn't exist, with maxAge, otherwise
+// jetstream.ErrStreamNotFound is returned.
+func openNATSStreamStore(ctx context.Context, js jetstream.JetStream, bucket string, create bool, maxAge time.Duration) (*natsStreamStore, error) {
+	name := natsStreamName(bucket)
+	prefix := "moxblob." + bucket
+	stream, err := js.Stream(ctx, name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) && create {
+		stream, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:        name,
+			Description: "Email message storage for mox mail server, fallback without object store",
+			Subjects:    []string{prefix + ".>"},
+			MaxAge:      maxAge,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accessing fallback stream %q for bucket %q: %w", name, bucket, err)
+	}
+	return newNATSStreamStore(bucket, js, stream), nil
+}
+
+func newNATSStreamStore(bucket string, pub natsPublisher, stream jetstream.Stream) *natsStreamStore {
+	return &natsStreamStore{bucket: bucket, prefix: "moxblob." + bucket, pub: pub, stream: stream}
+}
+
+func (s *natsStreamStore) metaSubject(name string) string {
+	return s.prefix + ".m." + base64.URLEncoding.EncodeToString([]byte(name))
+}
+
+// object returns the object with name, or jetstream.ErrObjectNotFound.
+func (s *natsStreamStore) object(ctx context.Context, name string) (*natsStreamObject, error) {
+	if name == "" {
+		return nil, jetstream.ErrNameRequired
+	}
+	msg, err := s.stream.GetLastMsgForSubject(ctx, s.metaSubject(name))
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return nil, jetstream.ErrObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return parseNATSStreamObject(msg.Data)
+}
+
+func parseNATSStreamObject(buf []byte) (*natsStreamObject, error) {
+	var o natsStreamObject
+	if err := json.Unmarshal(buf, &o); err != nil {
+		return nil, fmt.Errorf("%w: %v", jetstream.ErrBadObjectMeta, err)
+	}
+	return &o, nil
+}
+
+// publishObject publishes the info of o, and removes earlier info messages of the
+// object.
+func (s *natsStreamStore) publishObject(ctx context.Context, o *natsStreamObject) error {
+	buf, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("marshal object info: %w", err)
+	}
+	subject := s.metaSubject(o.Info.Name)
+	if _, err := s.pub.Publish(ctx, subject, buf); err != nil {
+		return fmt.Errorf("publishing object info: %w", err)
+	}
+	if err := s.stream.Purge(ctx, jetstream.WithPurgeSubject(subject), jetstream.WithPurgeKeep(1)); err != nil {
+		return fmt.Errorf("removing previous object info: %w", err)
+	}
+	return nil
+}
+
+// deleteChunks removes the chunk messages, returning the first error.
+func (s *natsStreamStore) deleteChunks(ctx context.Context, chunks []uint64) error {
+	var rerr error
+	for _, seq := range chunks {
+		if err := s.stream.DeleteMsg(ctx, seq); err != nil && !errors.Is(err, jetstream.ErrMsgNotFound) && rerr == nil {
+			rerr = fmt.Errorf("removing chunk: %w", err)
+		}
+	}
+	return rerr
+}
+
+func (s *natsStreamStore) Put(ctx context.Context, meta jetstream.ObjectMeta, r io.Reader) (*jetstream.ObjectInfo, error) {
+	if meta.Name == "" {
+		return nil, jetstream.ErrNameRequired
+	}
+	if meta.Opts != nil && meta.Opts.Link != nil {
+		return nil, fmt.Errorf("links: %w", errNATSStreamUnsupported)
+	}
+	prev, err := s.object(ctx, meta.Name)
+	if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	o := &natsStreamObject{
+		Info: jetstream.ObjectInfo{
+			ObjectMeta: meta,
+			Bucket:     s.bucket,
+			NUID:       hex.EncodeToString(id),
+		},
+	}
+	o.Info.Opts = nil
+	chunkSubject := s.prefix + ".c." + o.Info.NUID
+
+	h := sha256.New()
+	buf := make([]byte, natsStreamChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			ack, perr := s.pub.Publish(ctx, chunkSubject, buf[:n])
+			if perr != nil {
+				s.deleteChunks(context.WithoutCancel(ctx), o.Chunks)
+				return nil, fmt.Errorf("publishing chunk: %w", perr)
+			}
+			o.Chunks = append(o.Chunks, ack.Sequence)
+			h.Write(buf[:n])
+			o.Info.Size += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			s.deleteChunks(context.WithoutCancel(ctx), o.Chunks)
+			return nil, err
+		}
+	}
+	o.Info.Chunks = uint32(len(o.Chunks))
+	o.Info.ModTime = time.Now().UTC()
+	o.Info.Digest = "SHA-256=" + base64.URLEncoding.EncodeToString(h.Sum(nil))
+
+	if err := s.publishObject(ctx, o); err != nil {
+		s.deleteChunks(context.WithoutCancel(ctx), o.Chunks)
+		return nil, err
+	}
+	if prev != nil {
+		// The object was replaced, its previous data isn't referenced anymore.
+		s.deleteChunks(ctx, prev.Chunks)
+	}
+	info := o.Info
+	return &info, nil
+}
+
+func (s *natsStreamStore) PutBytes(ctx context.Context, name string, data []byte) (*jetstream.ObjectInfo, error) {
+	return s.Put(ctx, jetstream.ObjectMeta{Name: name}, bytes.NewReader(data))
+}
+
+func (s *natsStreamStore) PutString(ctx context.Context, name string, data string) (*jetstream.ObjectInfo, error) {
+	return s.Put(ctx, jetstream.ObjectMeta{Name: name}, strings.NewReader(data))
+}
+
+func (s *natsStreamStore) PutFile(ctx context.Context, file string) (*jetstream.ObjectInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return s.Put(ctx, jetstream.ObjectMeta{Name: file}, f)
+}
+
+func (s *natsStreamStore) Get(ctx context.Context, name string, opts ...jetstream.GetObjectOpt) (jetstream.ObjectResult, error) {
+	o, err := s.object(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &natsStreamResult{ctx: ctx, s: s, obj: o, h: sha256.New()}, nil
+}
+
+func (s *natsStreamStore) GetBytes(ctx context.Context, name string, opts ...jetstream.GetObjectOpt) ([]byte, error) {
+	r, err := s.Get(ctx, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *natsStreamStore) GetString(ctx context.Context, name string, opts ...jetstream.GetObjectOpt) (string, error) {
+	buf, err := s.GetBytes(ctx, name, opts...)
+	return string(buf), err
+}
+
+func (s *natsStreamStore) GetFile(ctx context.Context, name, file string, opts ...jetstream.GetObjectOpt) error {
+	r, err := s.Get(ctx, name, opts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(file)
+		return err
+	}
+	return f.Close()
+}
+
+func (s *natsStreamStore) GetInfo(ctx context.Context, name string, opts ...jetstream.GetObjectInfoOpt) (*jetstream.ObjectInfo, error) {
+	o, err := s.object(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &o.Info, nil
+}
+
+func (s *natsStreamStore) UpdateMeta(ctx context.Context, name string, meta jetstream.ObjectMeta) error {
+	o, err := s.object(ctx, name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return jetstream.ErrUpdateMetaDeleted
+	} else if err != nil {
+		return err
+	}
+	if meta.Name != name {
+		return fmt.Errorf("renaming objects: %w", errNATSStreamUnsupported)
+	}
+	o.Info.Description = meta.Description
+	o.Info.Headers = meta.Headers
+	o.Info.Metadata = meta.Metadata
+	return s.publishObject(ctx, o)
+}
+
+func (s *natsStreamStore) Delete(ctx context.Context, name string) error {
+	o, err := s.object(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := s.stream.Purge(ctx, jetstream.WithPurgeSubject(s.metaSubject(name))); err != nil {
+		return fmt.Errorf("removing object info: %w", err)
+	}
+	return s.deleteChunks(ctx, o.Chunks)
+}
+
+func (s *natsStreamStore) AddLink(ctx context.Context, name string, obj *jetstream.ObjectInfo) (*jetstream.ObjectInfo, error) {
+	return nil, fmt.Errorf("links: %w", errNATSStreamUnsupported)
+}
+
+func (s *natsStreamStore) AddBucketLink(ctx context.Context, name string, bucket jetstream.ObjectStore) (*jetstream.ObjectInfo, error) {
+	return nil, fmt.Errorf("links: %w", errNATSStreamUnsupported)
+}
+
+func (s *natsStreamStore) Seal(ctx context.Context) error {
+	return fmt.Errorf("sealing: %w", errNATSStreamUnsupported)
+}
+
+func (s *natsStreamStore) Watch(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.ObjectWatcher, error) {
+	return nil, fmt.Errorf("watching: %w", errNATSStreamUnsupported)
+}
+
+func (s *natsStreamStore) List(ctx context.Context, opts ...jetstream.ListObjectsOpt) ([]*jetstream.ObjectInfo, error) {
+	si, err := s.stream.Info(ctx, jetstream.WithSubjectFilter(s.prefix+".m.>"))
+	if err != nil {
+		return nil, fmt.Errorf("listing object subjects: %w", err)
+	}
+	subjects := make([]string, 0, len(si.State.Subjects))
+	for subject := range si.State.Subjects {
+		if strings.HasPrefix(subject, s.prefix+".m.") {
+			subjects = append(subjects, subject)
+		}
+	}
+	slices.Sort(subjects)
+	var l []*jetstream.ObjectInfo
+	for _, subject := range subjects {
+		msg, err := s.stream.GetLastMsgForSubject(ctx, subject)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			// Deleted since listing.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		o, err := parseNATSStreamObject(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, &o.Info)
+	}
+	if len(l) == 0 {
+		return nil, jetstream.ErrNoObjectsFound
+	}
+	return l, nil
+}
+
+func (s *natsStreamStore) Status(ctx context.Context) (jetstream.ObjectStoreStatus, error) {
+	si, err := s.stream.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return natsStreamStatus{bucket: s.bucket, si: si}, nil
+}
+
+// natsStreamResult reads the chunks of an object, verifying the digest at the end.
+type natsStreamResult struct {
+	ctx  context.Context
+	s    *natsStreamStore
+	obj  *natsStreamObject
+	h    hash.Hash
+	buf  []byte // Remaining data of current chunk.
+	next int    // Index in obj.Chunks of next chunk to read.
+	err  error
+}
+
+func (r *natsStreamResult) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 && r.err == nil {
+		if r.next == len(r.obj.Chunks) {
+			if digest := "SHA-256=" + base64.URLEncoding.EncodeToString(r.h.Sum(nil)); digest != r.obj.Info.Digest {
+				r.err = jetstream.ErrDigestMismatch
+			} else {
+				r.err = io.EOF
+			}
+			break
+		}
+		msg, err := r.s.stream.GetMsg(r.ctx, r.obj.Chunks[r.next])
+		if err != nil {
+			r.err = fmt.Errorf("reading chunk: %w", err)
+		} else if msg.Subject != r.s.prefix+".c."+r.obj.Info.NUID {
+			r.err = fmt.Errorf("chunk of other object at sequence %d", msg.Sequence)
+		} else {
+			r.buf = msg.Data
+			r.h.Write(msg.Data)
+			r.next++
+		}
+	}
+	if len(r.buf) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *natsStreamResult) Close() error {
+	return nil
+}
+
+func (r *natsStreamResult) Info() (*jetstream.ObjectInfo, error) {
+	return &r.obj.Info, nil
+}
+
+func (r *natsStreamResult) Error() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// natsStreamStatus is the status of a fallback stream. It gives access to the
+// stream info for the capacity checks, like the object store status.
+type natsStreamStatus struct {
+	bucket string
+	si     *jetstream.StreamInfo
+}
+
+func (s natsStreamStatus) Bucket() string                 { return s.bucket }
+func (s natsStreamStatus) Description() string            { return s.si.Config.Description }
+func (s natsStreamStatus) TTL() time.Duration             { return s.si.Config.MaxAge }
+func (s natsStreamStatus) Storage() jetstream.StorageType { return s.si.Config.Storage }
+func (s natsStreamStatus) Replicas() int                  { return s.si.Config.Replicas }
+func (s natsStreamStatus) Sealed() bool                   { return s.si.Config.Sealed }
+func (s natsStreamStatus) Size() uint64                   { return s.si.State.Bytes }
+func (s natsStreamStatus) BackingStore() string           { return "JetStream" }
+func (s natsStreamStatus) Metadata() map[string]string    { return s.si.Config.Metadata }
+func (s natsStreamStatus) IsCompressed() bool {
+	return s.si.Config.Compression != jetstream.NoCompression
+}
+func (s natsStreamStatus) StreamInfo() *jetstream.StreamInfo { return s.si }
+
+var _ jetstream.ObjectStore = (*natsStreamStore)(nil)
@@ -0,0 +1,274 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// fakeStream is an in-memory jetstream.Stream with the message operations used by
+// the fallback stream store. It also publishes, for the store and fakeJetStream.
+type fakeStream struct {
+	jetstream.Stream
+
+	sync.Mutex
+	seq    uint64
+	msgs   map[uint64]*jetstream.RawStreamMsg
+	config jetstream.StreamConfig
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{msgs: map[uint64]*jetstream.RawStreamMsg{}}
+}
+
+func (s *fakeStream) Publish(ctx context.Context, subject string, payload []byte, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.seq++
+	s.msgs[s.seq] = &jetstream.RawStreamMsg{Subject: subject, Sequence: s.seq, Data: append([]byte(nil), payload...), Time: time.Now()}
+	return &jetstream.PubAck{Stream: "test", Sequence: s.seq}, nil
+}
+
+func (s *fakeStream) GetMsg(ctx context.Context, seq uint64, opts ...jetstream.GetMsgOpt) (*jetstream.RawStreamMsg, error) {
+	s.Lock()
+	defer s.Unlock()
+	if m, ok := s.msgs[seq]; ok {
+		return m, nil
+	}
+	return nil, jetstream.ErrMsgNotFound
+}
+
+func (s *fakeStream) GetLastMsgForSubject(ctx context.Context, subject string) (*jetstream.RawStreamMsg, error) {
+	s.Lock()
+	defer s.Unlock()
+	var last *jetstream.RawStreamMsg
+	for _, m := range s.msgs {
+		if m.Subject == subject && (last == nil || m.Sequence > last.Sequence) {
+			last = m
+		}
+	}
+	if last == nil {
+		return nil, jetstream.ErrMsgNotFound
+	}
+	return last, nil
+}
+
+func (s *fakeStream) DeleteMsg(ctx context.Context, seq uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.msgs[seq]; !ok {
+		return jetstream.ErrMsgNotFound
+	}
+	delete(s.msgs, seq)
+	return nil
+}
+
+func (s *fakeStream) Purge(ctx context.Context, opts ...jetstream.StreamPurgeOpt) error {
+	var req jetstream.StreamPurgeRequest
+	for _, opt := range opts {
+		if err := opt(&req); err != nil {
+			return err
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	var seqs []uint64
+	for seq, m := range s.msgs {
+		if m.Subject == req.Subject {
+			seqs = append(seqs, seq)
+		}
+	}
+	for _, seq := range seqs {
+		keep := uint64(0)
+		for _, other := range seqs {
+			if other > seq {
+				keep++
+			}
+		}
+		if keep >= req.Keep {
+			delete(s.msgs, seq)
+		}
+	}
+	return nil
+}
+
+// Info returns all subjects, ignoring a subject filter.
+func (s *fakeStream) Info(ctx context.Context, opts ...jetstream.StreamInfoOpt) (*jetstream.StreamInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	si := &jetstream.StreamInfo{Config: s.config, State: jetstream.StreamState{Subjects: map[string]uint64{}}}
+	for _, m := range s.msgs {
+		si.State.Subjects[m.Subject]++
+		si.State.Msgs++
+		si.State.Bytes += uint64(len(m.Data))
+	}
+	return si, nil
+}
+
+// fakeJetStream has an object store API that fails like on servers without object
+// store support, and a fallback stream.
+type fakeJetStream struct {
+	jetstream.JetStream
+
+	objectStoreErr error
+	stream         *fakeStream           // Set when created.
+	objectStore    jetstream.ObjectStore // Returned by CreateObjectStore, if set.
+	created        jetstream.ObjectStoreConfig
+}
+
+func (js *fakeJetStream) ObjectStore(ctx context.Context, bucket string) (jetstream.ObjectStore, error) {
+	return nil, js.objectStoreErr
+}
+
+func (js *fakeJetStream) CreateObjectStore(ctx context.Context, cfg jetstream.ObjectStoreConfig) (jetstream.ObjectStore, error) {
+	js.created = cfg
+	if js.objectStore != nil {
+		return js.objectStore, nil
+	}
+	return nil, js.objectStoreErr
+}
+
+func (js *fakeJetStream) Stream(ctx context.Context, name string) (jetstream.Stream, error) {
+	if js.stream == nil {
+		return nil, jetstream.ErrStreamNotFound
+	}
+	return js.stream, nil
+}
+
+func (js *fakeJetStream) CreateStream(ctx context.Context, cfg jetstream.StreamConfig) (jetstream.Stream, error) {
+	js.stream = newFakeStream()
+	js.stream.config = cfg
+	return js.stream, nil
+}
+
+func (js *fakeJetStream) UpdateStream(ctx context.Context, cfg jetstream.StreamConfig) (jetstream.Stream, error) {
+	js.stream.Lock()
+	defer js.stream.Unlock()
+	js.stream.config = cfg
+	return js.stream, nil
+}
+
+func (js *fakeJetStream) Publish(ctx context.Context, subject string, payload []byte, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	return js.stream.Publish(ctx, subject, payload, opts...)
+}
+
+func TestNATSStreamStore(t *testing.T) {
+	errNoObjectStore := errors.New("nats: no responders available for request")
+
+	// Without fallback, initialization fails with an explanation.
+	js := &fakeJetStream{objectStoreErr: errNoObjectStore}
+	cfg := &config.NATS{BucketName: "test-bucket"}
+	_, err := openNATSBucket(ctxbg, pkglog, cfg, js, cfg.BucketName)
+	if err == nil || !errors.Is(err, errNoObjectStore) || !strings.Contains(err.Error(), "ObjectStoreFallback") {
+		t.Fatalf("got err %v, expected object store error mentioning ObjectStoreFallback", err)
+	}
+
+	// Timeouts and JetStream not being enabled don't fall back.
+	cfg.ObjectStoreFallback = "stream"
+	for _, xerr := range []error{context.DeadlineExceeded, jetstream.ErrJetStreamNotEnabled} {
+		js.objectStoreErr = xerr
+		_, err = openNATSBucket(ctxbg, pkglog, cfg, js, cfg.BucketName)
+		if !errors.Is(err, xerr) {
+			t.Fatalf("got err %v, expected %v", err, xerr)
+		}
+	}
+	if js.stream != nil {
+		t.Fatalf("fallback stream created")
+	}
+
+	js.objectStoreErr = errNoObjectStore
+	os, err := openNATSBucket(ctxbg, pkglog, cfg, js, cfg.BucketName)
+	tcheck(t, err, "open bucket with fallback")
+	if _, ok := os.(*natsStreamStore); !ok {
+		t.Fatalf("got %T, expected fallback stream store", os)
+	}
+
+	// An existing fallback stream is used, also when the object store works.
+	js.objectStoreErr = nil
+	os, err = openNATSBucket(ctxbg, pkglog, cfg, js, cfg.BucketName)
+	tcheck(t, err, "open bucket with existing fallback stream")
+	if _, ok := os.(*natsStreamStore); !ok {
+		t.Fatalf("got %T, expected fallback stream store", os)
+	}
+
+	// Store and retrieve a message.
+	nc := newTestNATSClient(cfg, os)
+	const msg = "Subject: test\r\n\r\ntest\r\n"
+	err = nc.StoreMessage(ctxbg, 1, writeTestMessage(t, msg))
+	tcheck(t, err, "store message")
+	infos, err := os.List(ctxbg)
+	tcheck(t, err, "list")
+	tcompare(t, len(infos), 1)
+	name := infos[0].Name
+
+	read := func(name string) string {
+		t.Helper()
+		r, err := nc.getObject(ctxbg, name)
+		tcheck(t, err, "get object")
+		defer r.Close()
+		buf, err := io.ReadAll(r)
+		tcheck(t, err, "read object")
+		return string(buf)
+	}
+	tcompare(t, read(name), msg)
+
+	// Multiple chunks, replaced by a put with the same name.
+	large := strings.Repeat("x", 2*natsStreamChunkSize+1)
+	info, err := os.Put(ctxbg, jetstream.ObjectMeta{Name: "large"}, strings.NewReader(strings.Repeat("y", natsStreamChunkSize+1)))
+	tcheck(t, err, "put")
+	tcompare(t, info.Chunks, uint32(2))
+	info, err = os.Put(ctxbg, jetstream.ObjectMeta{Name: "large", Metadata: map[string]string{"k": "v"}}, strings.NewReader(large))
+	tcheck(t, err, "put")
+	tcompare(t, info.Chunks, uint32(3))
+	tcompare(t, read("large"), large)
+
+	err = os.UpdateMeta(ctxbg, "large", jetstream.ObjectMeta{Name: "large", Metadata: map[string]string{"k": "v2"}})
+	tcheck(t, err, "update meta")
+	info, err = os.GetInfo(ctxbg, "large")
+	tcheck(t, err, "get info")
+	tcompare(t, info.Metadata["k"], "v2")
+
+	// Only the current data and info messages remain.
+	si, err := js.stream.Info(ctxbg)
+	tcheck(t, err, "stream info")
+	tcompare(t, si.State.Msgs, uint64(1+1+3+1))
+
+	// Deleted objects are gone, along with their chunks.
+	err = os.Delete(ctxbg, "large")
+	tcheck(t, err, "delete")
+	_, err = os.GetInfo(ctxbg, "large")
+	if !errors.Is(err, jetstream.ErrObjectNotFound) {
+		t.Fatalf("got err %v, expected ErrObjectNotFound", err)
+	}
+	si, err = js.stream.Info(ctxbg)
+	tcheck(t, err, "stream info")
+	tcompare(t, si.State.Msgs, uint64(2))
+
+	// Corrupt chunks are detected.
+	js.stream.Lock()
+	for _, m := range js.stream.msgs {
+		if strings.Contains(m.Subject, ".c.") {
+			m.Data = []byte(strings.ToUpper(string(m.Data)))
+		}
+	}
+	js.stream.Unlock()
+	r, err := os.Get(ctxbg, name)
+	tcheck(t, err, "get")
+	_, err = io.ReadAll(r)
+	if !errors.Is(err, jetstream.ErrDigestMismatch) {
+		t.Fatalf("got err %v, expected ErrDigestMismatch", err)
+	}
+
+	_, err = os.Watch(ctxbg)
+	if !errors.Is(err, errNATSStreamUnsupported) {
+		t.Fatalf("got err %v, expected unsupported", err)
+	}
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestNATSSyncMailboxes(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer Switchboard()()
+	os.MkdirAll(pendingNATSDir, 0o700)
+	defer cleanPendingNATS()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", SyncMailboxes: []string{"Archive", "inbox"}}, fos)
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+
+	tcompare(t, nc.StoresSync("Archive"), true)
+	tcompare(t, nc.StoresSync("Archive/2024"), true)
+	tcompare(t, nc.StoresSync("Inbox"), true)
+	tcompare(t, nc.StoresSync("Archived"), false)
+	tcompare(t, nc.StoresSync("Sent"), false)
+
+	acc, err := OpenAccount(pkglog, "mjl", true)
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.WaitClosed()
+	}()
+
+	deliver := func(mailbox string) (Message, error) {
+		t.Helper()
+		f, err := CreateMessageTemp(pkglog, "account-test")
+		tcheck(t, err, "temp file")
+		defer os.Remove(f.Name())
+		defer f.Close()
+		const s = "Subject: test\r\n\r\ntest\r\n"
+		_, err = f.WriteString(s)
+		tcheck(t, err, "write message")
+		m := Message{
+			Size:     int64(len(s)),
+			Received: time.Now(),
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(pkglog, mailbox, &m, f)
+		})
+		return m, err
+	}
+
+	// Message to a sync mailbox is stored before the delivery completes.
+	_, err = deliver("Archive")
+	tcheck(t, err, "deliver to sync mailbox")
+	tcompare(t, len(fos.names()), 1)
+
+	// A failed store fails the delivery to a sync mailbox, without queueing.
+	fos.putHook = func(meta jetstream.ObjectMeta) error { return errors.New("timeout") }
+	_, err = deliver("Archive")
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("got err %v, expected failed delivery with store error", err)
+	}
+	tcompare(t, countPendingNATS(), 0)
+
+	// Other mailboxes store asynchronously: the delivery succeeds, the failed store is
+	// queued for retry.
+	_, err = deliver("Sent")
+	tcheck(t, err, "deliver to async mailbox")
+	if !nc.closeStores(ctxbg) {
+		t.Fatalf("stores did not finish")
+	}
+	tcompare(t, countPendingNATS(), 1)
+	tcompare(t, len(fos.names()), 1)
+}
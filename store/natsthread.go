@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+	"strconv"
+)
+
+// Object metadata key holding the thread ID of a stored message, with
+// StoreThreadID. The thread ID is the ID of the first message of the thread in
+// the account, as computed by mox from the References and In-Reply-To headers,
+// or the base subject.
+const natsThreadIDKey = "thread-id"
+
+type natsThreadIDKeyType struct{}
+
+// WithNATSThreadID returns a context that makes messages stored in NATS with it
+// record threadID in their object metadata, if StoreThreadID is enabled. Zero
+// means no thread ID, e.g. while threading is still being upgraded.
+func WithNATSThreadID(ctx context.Context, threadID int64) context.Context {
+	return context.WithValue(ctx, natsThreadIDKeyType{}, threadID)
+}
+
+// natsThreadID returns the thread ID set on ctx, or 0.
+func natsThreadID(ctx context.Context) int64 {
+	threadID, _ := ctx.Value(natsThreadIDKeyType{}).(int64)
+	return threadID
+}
+
+// natsThreadIDMeta returns the metadata value for the thread ID of ctx, or the
+// empty string if none is set or StoreThreadID is disabled.
+func (nc *NATSClient) natsThreadIDMeta(ctx context.Context) string {
+	threadID := natsThreadID(ctx)
+	if !nc.config.StoreThreadID || threadID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(threadID, 10)
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestNATSThreadID(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = filepath.FromSlash("../testdata/store/mox.conf")
+	mox.MustLoadConfig(true, false)
+	defer Switchboard()()
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", StoreThreadID: true}, fos)
+	orig := globalNATSClient
+	globalNATSClient = nc
+	defer func() { globalNATSClient = orig }()
+
+	acc, err := OpenAccount(pkglog, "mjl", true)
+	tcheck(t, err, "open account")
+	defer func() {
+		err = acc.Close()
+		tcheck(t, err, "closing account")
+		acc.WaitClosed()
+	}()
+
+	deliver := func(s string) Message {
+		t.Helper()
+		f, err := CreateMessageTemp(pkglog, "account-test")
+		tcheck(t, err, "temp file")
+		defer os.Remove(f.Name())
+		defer f.Close()
+		s = strings.ReplaceAll(s, "\n", "\r\n")
+		_, err = f.WriteString(s)
+		tcheck(t, err, "write message")
+		m := Message{
+			Size:     int64(len(s)),
+			Received: time.Now(),
+		}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(pkglog, "Inbox", &m, f)
+			tcheck(t, err, "deliver")
+		})
+		return m
+	}
+
+	m0 := deliver("Message-ID: <m0@localhost>\nSubject: thread\n\ntest\n")
+	m1 := deliver("Message-ID: <m1@localhost>\nReferences: <m0@localhost>\nSubject: thread\n\ntest\n")
+	m2 := deliver("Message-ID: <m2@localhost>\nIn-Reply-To: <m1@localhost>\nSubject: re: thread\n\ntest\n")
+	o0 := deliver("Message-ID: <o0@localhost>\nSubject: other\n\ntest\n")
+	if m1.ThreadID != m0.ID || m2.ThreadID != m0.ID || o0.ThreadID != o0.ID {
+		t.Fatalf("unexpected threading, got thread ids %d %d %d %d", m0.ThreadID, m1.ThreadID, m2.ThreadID, o0.ThreadID)
+	}
+	nc.closeStores(ctxbg)
+
+	// Object metadata holds the thread ID as computed by mox.
+	threadIDs := map[int64]string{}
+	for _, name := range fos.names() {
+		info, err := fos.GetInfo(ctxbg, name)
+		tcheck(t, err, "get info")
+		var id, ts int64
+		_, err = fmt.Sscanf(name, "msg-%d-%d", &id, &ts)
+		tcheck(t, err, "parse object name")
+		threadIDs[id] = info.Metadata[natsThreadIDKey]
+	}
+	for _, m := range []Message{m0, m1, m2, o0} {
+		tcompare(t, threadIDs[m.ID], fmt.Sprint(m.ThreadID))
+	}
+
+	// Without StoreThreadID, no thread ID is stored.
+	fos = newFakeObjectStore()
+	nc = newTestNATSClient(nil, fos)
+	err = nc.StoreMessage(WithNATSThreadID(ctxbg, m0.ThreadID), 1, writeTestMessage(t, "test"))
+	tcheck(t, err, "store message")
+	info, err := fos.GetInfo(ctxbg, fos.names()[0])
+	tcheck(t, err, "get info")
+	if v, ok := info.Metadata[natsThreadIDKey]; ok {
+		t.Fatalf("thread id %q stored without StoreThreadID", v)
+	}
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"time"
+)
+
+// storeTimeout returns the timeout for the Put of a message of size bytes: the
+// base timeout plus the time to transfer size bytes at the expected throughput,
+// clamped to the minimum and maximum. Large messages get time to transfer, small
+// messages fail fast.
+func (nc *NATSClient) storeTimeout(size int64) time.Duration {
+	base := nc.config.StoreTimeoutBase
+	if base <= 0 {
+		base = 5 * time.Second
+	}
+	throughput := nc.config.StoreThroughput
+	if throughput <= 0 {
+		throughput = 1024 * 1024
+	}
+	minTimeout, maxTimeout := nc.storeTimeoutBounds()
+	d := base + time.Duration(float64(size)/float64(throughput)*float64(time.Second))
+	return min(max(d, minTimeout), maxTimeout)
+}
+
+// storeTimeoutBounds returns the minimum and maximum timeout for a Put.
+func (nc *NATSClient) storeTimeoutBounds() (time.Duration, time.Duration) {
+	minTimeout := nc.config.StoreTimeoutMin
+	if minTimeout <= 0 {
+		minTimeout = 5 * time.Second
+	}
+	maxTimeout := nc.config.StoreTimeoutMax
+	if maxTimeout <= 0 {
+		maxTimeout = 30 * time.Minute
+	}
+	return minTimeout, max(minTimeout, maxTimeout)
+}
+
+// storeDeadline returns the time a store of a message of size bytes may take in
+// total, waiting for a store slot and doing the Put.
+func (nc *NATSClient) storeDeadline(size int64) time.Duration {
+	return nc.requestTimeout() + nc.storeTimeout(size)
+}
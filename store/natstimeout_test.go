@@ -0,0 +1,40 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+)
+
+func TestNATSStoreTimeout(t *testing.T) {
+	cfg := &config.NATS{
+		BucketName:       "test-bucket",
+		StoreTimeoutBase: 2 * time.Second,
+		StoreThroughput:  1000,
+		StoreTimeoutMin:  3 * time.Second,
+		StoreTimeoutMax:  time.Minute,
+	}
+	nc := newTestNATSClient(cfg, newFakeObjectStore())
+
+	// Small messages get the minimum.
+	tcompare(t, nc.storeTimeout(0), 3*time.Second)
+	tcompare(t, nc.storeTimeout(500), 3*time.Second)
+
+	// Timeout scales with size.
+	tcompare(t, nc.storeTimeout(2000), 4*time.Second)
+	tcompare(t, nc.storeTimeout(10000), 12*time.Second)
+	if nc.storeTimeout(20000) <= nc.storeTimeout(10000) {
+		t.Fatalf("timeout does not grow with size")
+	}
+
+	// Large messages are clamped to the maximum.
+	tcompare(t, nc.storeTimeout(1000*1000), time.Minute)
+
+	// Defaults: 5s base, 1MB/s.
+	nc = newTestNATSClient(nil, newFakeObjectStore())
+	tcompare(t, nc.storeTimeout(0), 5*time.Second)
+	tcompare(t, nc.storeTimeout(100*1024*1024), 105*time.Second)
+	tcompare(t, nc.storeTimeout(100*1024*1024*1024), 30*time.Minute)
+	tcompare(t, nc.storeDeadline(0), 35*time.Second)
+}
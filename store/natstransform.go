@@ -0,0 +1,125 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/mjl-/mox/config"
+)
+
+// Object metadata key holding the comma-separated names of the transforms applied
+// to a stored message, in order.
+const natsTransformsKey = "transforms"
+
+// NATSTransform changes messages before they are stored in NATS, e.g. removing
+// headers or adding archival headers. Transforms are selected and ordered with
+// NATS.Transforms in the config.
+//
+// Store is called with the message to store, and returns the data to store
+// instead. Load is called with stored data, and returns the message as it was
+// before Store. Both take ownership of r: closing the returned reader must close
+// r. Both must stream, they are used for large messages.
+//
+// A lossless transform can be reversed exactly by Load, e.g. an encoding. A lossy
+// transform discards information, e.g. removing headers, and its Load is never
+// called: reads return the stored message. A transform whose result depends on
+// more than the message, e.g. the current time, is fine, but must still be lossy
+// or reversible by Load.
+type NATSTransform interface {
+	Store(r io.ReadCloser) (io.ReadCloser, error)
+	Load(r io.ReadCloser) (io.ReadCloser, error)
+	Lossless() bool
+}
+
+var natsTransforms = map[string]NATSTransform{}
+
+// RegisterNATSTransform adds a transform that can be selected with
+// NATS.Transforms in the config. Must be called before InitNATS.
+func RegisterNATSTransform(name string, t NATSTransform) {
+	natsTransforms[name] = t
+}
+
+// natsNamedTransform is a transform from the config.
+type natsNamedTransform struct {
+	name string
+	NATSTransform
+}
+
+// parseNATSTransforms returns the transforms selected in cfg, in order.
+func parseNATSTransforms(cfg *config.NATS) ([]natsNamedTransform, error) {
+	var l []natsNamedTransform
+	for _, name := range cfg.Transforms {
+		t, ok := natsTransforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		if strings.Contains(name, ",") {
+			return nil, fmt.Errorf("transform name %q must not contain a comma", name)
+		}
+		l = append(l, natsNamedTransform{name, t})
+	}
+	return l, nil
+}
+
+// transformStore applies the configured transforms to message r, returning the
+// data to store and the value for the transforms metadata.
+func (nc *NATSClient) transformStore(r io.ReadCloser) (io.ReadCloser, string, error) {
+	var names []string
+	for _, t := range nc.transforms {
+		tr, err := t.Store(r)
+		if err != nil {
+			r.Close()
+			return nil, "", fmt.Errorf("transform %q: %w", t.name, err)
+		}
+		r = tr
+		names = append(names, t.name)
+	}
+	return r, strings.Join(names, ","), nil
+}
+
+// natsTransformedResult is an object read through the Load of its transforms.
+type natsTransformedResult struct {
+	jetstream.ObjectResult
+	r io.ReadCloser
+}
+
+func (t *natsTransformedResult) Read(buf []byte) (int, error) {
+	return t.r.Read(buf)
+}
+
+func (t *natsTransformedResult) Close() error {
+	return t.r.Close()
+}
+
+// transformLoad reverses the lossless transforms that were applied to object res,
+// as recorded in its metadata, in reverse order. Transforms are looked up by name,
+// not from the config, so objects stay readable after the config changes.
+func transformLoad(res jetstream.ObjectResult) (jetstream.ObjectResult, error) {
+	info, err := res.Info()
+	if err != nil || info.Metadata[natsTransformsKey] == "" {
+		return res, nil
+	}
+	names := strings.Split(info.Metadata[natsTransformsKey], ",")
+	var r io.ReadCloser = res
+	for _, name := range slices.Backward(names) {
+		t, ok := natsTransforms[name]
+		if !ok {
+			r.Close()
+			return nil, fmt.Errorf("object %q stored with unknown transform %q", info.Name, name)
+		}
+		if !t.Lossless() {
+			continue
+		}
+		tr, err := t.Load(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("reversing transform %q: %w", name, err)
+		}
+		r = tr
+	}
+	return &natsTransformedResult{res, r}, nil
+}
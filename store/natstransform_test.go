@@ -0,0 +1,108 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/config"
+)
+
+// stripHeaders is a lossy transform removing headers with a prefix.
+type stripHeaders string
+
+func (s stripHeaders) Store(r io.ReadCloser) (io.ReadCloser, error) {
+	// Read all for simplicity, real transforms should stream.
+	defer r.Close()
+	var out bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line == "\r\n" || err != nil {
+			out.WriteString(line)
+			break
+		}
+		if !strings.HasPrefix(strings.ToLower(line), strings.ToLower(string(s))) {
+			out.WriteString(line)
+		}
+	}
+	if _, err := io.Copy(&out, br); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&out), nil
+}
+
+func (s stripHeaders) Load(r io.ReadCloser) (io.ReadCloser, error) {
+	panic("load called for lossy transform")
+}
+
+func (s stripHeaders) Lossless() bool { return false }
+
+// archivedHeader is a lossless transform adding a header, removed again on load.
+type archivedHeader struct{}
+
+const archivedLine = "X-Archived: mox\r\n"
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (archivedHeader) Store(r io.ReadCloser) (io.ReadCloser, error) {
+	return multiReadCloser{io.MultiReader(strings.NewReader(archivedLine), r), r}, nil
+}
+
+func (archivedHeader) Load(r io.ReadCloser) (io.ReadCloser, error) {
+	buf := make([]byte, len(archivedLine))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != archivedLine {
+		r.Close()
+		return nil, io.ErrUnexpectedEOF
+	}
+	return r, nil
+}
+
+func (archivedHeader) Lossless() bool { return true }
+
+func TestNATSTransforms(t *testing.T) {
+	RegisterNATSTransform("strip-x-spam", stripHeaders("X-Spam-"))
+	RegisterNATSTransform("archived", archivedHeader{})
+
+	_, err := parseNATSTransforms(&config.NATS{Transforms: []string{"absent"}})
+	tcompare(t, err != nil, true)
+
+	const msg = "From: mjl@mox.example\r\nX-Spam-Score: 5\r\nSubject: test\r\nx-spam-flag: no\r\n\r\nX-Spam-Score: body is kept\r\n"
+	const stripped = "From: mjl@mox.example\r\nSubject: test\r\n\r\nX-Spam-Score: body is kept\r\n"
+
+	fos := newFakeObjectStore()
+	nc := newTestNATSClient(&config.NATS{BucketName: "test-bucket", Transforms: []string{"strip-x-spam", "archived"}}, fos)
+	err = nc.StoreMessage(ctxbg, 1, writeTestMessage(t, msg))
+	tcheck(t, err, "store message")
+
+	// Transforms are applied in order, and recorded in the metadata.
+	names := fos.names()
+	tcompare(t, len(names), 1)
+	fos.Lock()
+	o := fos.objects[names[0]]
+	fos.Unlock()
+	tcompare(t, string(o.data), archivedLine+stripped)
+	tcompare(t, o.info.Metadata[natsTransformsKey], "strip-x-spam,archived")
+
+	// Reading reverses the lossless transform, the removed headers stay removed.
+	r, err := nc.getObject(ctxbg, names[0])
+	tcheck(t, err, "get")
+	buf, err := io.ReadAll(r)
+	tcheck(t, err, "read")
+	r.Close()
+	tcompare(t, string(buf), stripped)
+
+	// Objects stay readable with a different config.
+	nc = newTestNATSClient(nil, fos)
+	r, err = nc.getObject(ctxbg, names[0])
+	tcheck(t, err, "get")
+	buf, err = io.ReadAll(r)
+	tcheck(t, err, "read")
+	r.Close()
+	tcompare(t, string(buf), stripped)
+}
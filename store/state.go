@@ -208,6 +208,15 @@ func eraseMessages(log mlog.Log, acc *Account, ids []int64) {
 		log.Check(err, "close account after erasing expunged messages", slog.String("account", acc.Name))
 	}()
 
+	// Messages that were stored in NATS. Erased messages with SkipUpdateDiskUsage are
+	// placeholders for moved messages, only ever present locally. Their removal from
+	// the message store is started after releasing the account lock, a slow
+	// message store must not hold up the account.
+	var natsIDs []int64
+	defer func() {
+		deleteErasedMessages(acc.Name, natsIDs)
+	}()
+
 	acc.Lock()
 	defer acc.Unlock()
 	err := acc.DB.Write(mox.Context, func(tx *bstore.Tx) error {
@@ -232,6 +241,7 @@ func eraseMessages(log mlog.Log, acc *Account, ids []int64) {
 			if !me.SkipUpdateDiskUsage {
 				du.MessageSize -= m.Size
 				duchanged = true
+				natsIDs = append(natsIDs, id)
 			}
 			m.erase()
 			if err := tx.Update(&m); err != nil {
@@ -256,6 +266,7 @@ func eraseMessages(log mlog.Log, acc *Account, ids []int64) {
 			slog.String("account", acc.Name),
 			slog.Any("ids", ids),
 		)
+		natsIDs = nil
 		return
 	}
 
@@ -529,6 +540,7 @@ func (c *Comm) Broadcast(ch []Change) {
 	if len(ch) == 0 {
 		return
 	}
+	natsRecordFlagEvents(c.acc, ch)
 	done := make(chan struct{}, 1)
 	broadcast <- changeReq{c.acc, c, ch, done}
 	<-done
@@ -559,6 +571,7 @@ func BroadcastChanges(acc *Account, ch []Change) {
 	if len(ch) == 0 {
 		return
 	}
+	natsRecordFlagEvents(acc, ch)
 	done := make(chan struct{}, 1)
 	broadcast <- changeReq{acc, nil, ch, done}
 	<-done